@@ -7,73 +7,243 @@ import (
 	"github.com/oyaguma3/eapaka_test/config"
 	"github.com/oyaguma3/eapaka_test/eap"
 	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+	"github.com/oyaguma3/eapaka_test/session"
 	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/suci"
 	"github.com/oyaguma3/eapaka_test/testcase"
+	"github.com/oyaguma3/eapaka_test/usim"
 )
 
-// BuildPeer constructs the EAP peer and AKA/AKA' methods from config/testcase.
+// BuildPeer constructs the EAP peer and SIM/AKA/AKA' methods from
+// config/testcase. A comp128v1 SIM only registers EAP-SIM.
 func BuildPeer(cfg config.Config, tc testcase.Case, store sqnstore.Store) (*eap.Peer, error) {
-	merged := config.ApplyTestcase(cfg, tc)
-	ki, err := decodeHex("ki", merged.SIM.KI, 16)
+	sub, policies, err := buildSubscriber(cfg, tc, store, nil)
 	if err != nil {
 		return nil, err
 	}
-	opc, err := decodeHex("opc", merged.SIM.OPC, 16)
-	if err != nil {
-		return nil, err
+	return session.NewPeer(sub, policies)
+}
+
+// buildSubscriber maps config/testcase onto the session subscriber and
+// policies. The outer identity is concealed when identity.suci asks for it;
+// ephemeralKey, when set, fixes the ECIES key of every SUCI.
+func buildSubscriber(cfg config.Config, tc testcase.Case, store sqnstore.Store, ephemeralKey []byte) (session.Subscriber, session.Policies, error) {
+	merged := config.ApplyTestcase(cfg, tc)
+	sub := session.Subscriber{
+		IMSI:     merged.SIM.IMSI,
+		Identity: tc.Identity,
+		Realm:    merged.Identity.Realm,
+		SQNStore: store,
 	}
-	amf, err := decodeHex("amf", merged.SIM.AMF, 2)
-	if err != nil {
-		return nil, err
+	policies := session.Policies{
+		MethodMismatch:                    eap.MethodMismatchPolicy(merged.EAP.MethodMismatchPolicy),
+		PermanentIDPolicy:                 merged.EAP.PermanentIDPolicy,
+		PermanentIdentityOverride:         tc.EAP.PermanentIdentityOverride,
+		OuterIdentityUpdateOnPermanentReq: merged.EAP.OuterIdentityUpdateOnPermanentReq,
+		NetNameCheck:                      merged.EAP.AKAPrime.NetNameCheck,
+		IgnoreBidding:                     merged.EAP.BiddingPolicy == "ignore",
 	}
-	sqnInitial, err := sqnstore.ParseSQNHex(merged.SIM.SQNInitialHex)
-	if err != nil {
-		return nil, err
+	for _, name := range merged.EAP.AllowedMethods {
+		if t, ok := eap.ParseMethodName(name); ok {
+			policies.AllowedMethods = append(policies.AllowedMethods, t)
+		}
+	}
+	if t, ok := eap.ParseMethodName(merged.EAP.ExpectedMethod); ok {
+		policies.ExpectedMethod = &t
+	}
+	var err error
+	if policies.ForceResync, err = buildResyncOptions(tc.SQN.ForceResync); err != nil {
+		return sub, policies, err
 	}
-	permanentPolicy := merged.EAP.PermanentIDPolicy
-	outerUpdate := merged.EAP.OuterIdentityUpdateOnPermanentReq
-	permanentOverride := tc.EAP.PermanentIdentityOverride
 
-	akaMethod, err := aka.New(aka.Options{
-		MethodType:                        eap.TypeAKA,
-		IMSI:                              merged.SIM.IMSI,
-		KI:                                ki,
-		OPC:                               opc,
-		AMF:                               amf,
-		Realm:                             merged.Identity.Realm,
-		InitialSQN:                        sqnInitial,
-		SQNStore:                          store,
-		PermanentIDPolicy:                 permanentPolicy,
-		PermanentIdentityOverride:         permanentOverride,
-		OuterIdentityUpdateOnPermanentReq: outerUpdate,
-	})
+	if merged.SIM.Algorithm != "comp128v1" {
+		if sub.Algorithm, err = buildAlgorithm(merged.SIM); err != nil {
+			return sub, policies, err
+		}
+		if sub.AMF, err = decodeHex("amf", merged.SIM.AMF, 2); err != nil {
+			return sub, policies, err
+		}
+		if sub.InitialSQN, err = sqnstore.ParseSQNHex(merged.SIM.SQNInitialHex); err != nil {
+			return sub, policies, err
+		}
+		sqnPolicy := buildSQNPolicy(merged.SIM.SQNPolicy)
+		sub.SQNPolicy = &sqnPolicy
+		sub.NetName = merged.EAP.AKAPrime.NetName
+		sub.KDFs = merged.EAP.AKAPrime.KDFs
+	}
+	if sub.GSMAlgorithm, err = buildGSMAlgorithm(merged.SIM, sub.Algorithm); err != nil {
+		return sub, policies, err
+	}
+	if sub.SUCI, err = buildSUCIParams(merged.Identity.SUCI); err != nil {
+		return sub, policies, err
+	}
+	if sub.SUCI != nil {
+		sub.SUCI.EphemeralKey = ephemeralKey
+	}
+	if merged.Identity.SUCI.OuterIdentity {
+		if sub.SUCI == nil {
+			return sub, policies, fmt.Errorf("app: identity.suci.outer_identity requires identity.suci.scheme")
+		}
+		if sub.Identity, err = suci.Conceal(merged.SIM.IMSI, *sub.SUCI); err != nil {
+			return sub, policies, err
+		}
+	}
+	return sub, policies, nil
+}
+
+// buildSUCIParams converts identity.suci; it returns nil when no scheme is
+// configured.
+func buildSUCIParams(cfg config.SUCIConfig) (*suci.Params, error) {
+	if cfg.Scheme == "" {
+		return nil, nil
+	}
+	scheme, ok := suci.ParseScheme(cfg.Scheme)
+	if !ok {
+		return nil, fmt.Errorf("app: unsupported identity.suci.scheme %q", cfg.Scheme)
+	}
+	params := &suci.Params{
+		MNC:              cfg.MNC,
+		RoutingIndicator: cfg.RoutingIndicator,
+		Scheme:           scheme,
+		KeyID:            uint8(cfg.KeyID),
+	}
+	if scheme != suci.SchemeNull {
+		key, err := hex.DecodeString(cfg.HomeNetworkPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("app: invalid identity.suci.home_network_public_key hex: %w", err)
+		}
+		params.PublicKey = key
+	}
+	return params, nil
+}
+
+// buildAlgorithm constructs the USIM algorithm selected by sim.algorithm.
+func buildAlgorithm(sim config.SIMConfig) (usim.Algorithm, error) {
+	switch sim.Algorithm {
+	case "", "milenage":
+		ki, err := decodeHex("ki", sim.KI, 16)
+		if err != nil {
+			return nil, err
+		}
+		opc, err := milenageOPc(sim, ki)
+		if err != nil {
+			return nil, err
+		}
+		consts, err := buildMilenageConstants(sim.Milenage)
+		if err != nil {
+			return nil, err
+		}
+		return usim.NewMilenageWithConstants(ki, opc, consts)
+	case "tuak":
+		ki, err := decodeHex("ki", sim.KI, len(sim.KI)/2)
+		if err != nil {
+			return nil, err
+		}
+		topc, err := tuakTOPc(sim.TUAK, ki)
+		if err != nil {
+			return nil, err
+		}
+		return usim.NewTUAK(ki, topc, usim.TUAKOptions{
+			RESBits:    sim.TUAK.RESBits,
+			Iterations: sim.TUAK.Iterations,
+		})
+	case "xor":
+		ki, err := decodeHex("ki", sim.KI, 16)
+		if err != nil {
+			return nil, err
+		}
+		return usim.NewXOR(ki, sim.XOR.RESBits)
+	case "comp128v1":
+		return nil, fmt.Errorf("app: sim.algorithm comp128v1 is a GSM algorithm and supports EAP-SIM only")
+	default:
+		return nil, fmt.Errorf("app: unsupported sim.algorithm %q", sim.Algorithm)
+	}
+}
+
+// buildGSMAlgorithm returns A3/A8 for EAP-SIM: COMP128-1 for a comp128v1
+// SIM, otherwise the c2/c3 conversion of the USIM algorithm alg.
+func buildGSMAlgorithm(sim config.SIMConfig, alg usim.Algorithm) (usim.GSMAlgorithm, error) {
+	if sim.Algorithm == "comp128v1" {
+		ki, err := decodeHex("ki", sim.KI, 16)
+		if err != nil {
+			return nil, err
+		}
+		return usim.NewCOMP128(ki)
+	}
+	return usim.NewGSMContext(alg)
+}
+
+// milenageOPc returns sim.opc, or derives it from sim.op and Ki.
+func milenageOPc(sim config.SIMConfig, ki []byte) ([]byte, error) {
+	if sim.OP == "" {
+		return decodeHex("opc", sim.OPC, 16)
+	}
+	op, err := decodeHex("op", sim.OP, 16)
 	if err != nil {
 		return nil, err
 	}
-	akaPrimeMethod, err := aka.New(aka.Options{
-		MethodType:                        eap.TypeAKAPrime,
-		IMSI:                              merged.SIM.IMSI,
-		KI:                                ki,
-		OPC:                               opc,
-		AMF:                               amf,
-		NetName:                           merged.EAP.AKAPrime.NetName,
-		Realm:                             merged.Identity.Realm,
-		InitialSQN:                        sqnInitial,
-		SQNStore:                          store,
-		PermanentIDPolicy:                 permanentPolicy,
-		PermanentIdentityOverride:         permanentOverride,
-		OuterIdentityUpdateOnPermanentReq: outerUpdate,
-	})
+	return usim.ComputeOPc(ki, op)
+}
+
+func buildMilenageConstants(cfg config.MilenageConfig) (usim.MilenageConstants, error) {
+	consts := usim.DefaultMilenageConstants()
+	for i, r := range cfg.Rotations() {
+		if r != nil {
+			consts.R[i] = *r
+		}
+	}
+	for i, c := range cfg.Constants() {
+		if c == "" {
+			continue
+		}
+		b, err := decodeHex(fmt.Sprintf("milenage.c%d", i+1), c, 16)
+		if err != nil {
+			return consts, err
+		}
+		copy(consts.C[i][:], b)
+	}
+	return consts, nil
+}
+
+func tuakTOPc(cfg config.TUAKConfig, ki []byte) ([]byte, error) {
+	if cfg.TOPc != "" {
+		return decodeHex("tuak.topc", cfg.TOPc, 32)
+	}
+	top, err := decodeHex("tuak.top", cfg.TOP, 32)
 	if err != nil {
 		return nil, err
 	}
+	iterations := cfg.Iterations
+	if iterations == 0 {
+		iterations = config.DefaultTUAKIterations
+	}
+	return usim.ComputeTOPc(ki, top, iterations)
+}
 
-	session := &eap.Session{OuterIdentity: tc.Identity}
-	peer := eap.NewPeer(session, akaMethod, akaPrimeMethod)
-	if merged.EAP.MethodMismatchPolicy != "" {
-		peer.MethodPolicy = eap.MethodMismatchPolicy(merged.EAP.MethodMismatchPolicy)
+func buildSQNPolicy(cfg config.SQNPolicyConfig) sqnstore.Policy {
+	policy := sqnstore.DefaultPolicy()
+	if cfg.IndBits != nil {
+		policy.IndBits = *cfg.IndBits
+	}
+	policy.Delta = cfg.Delta
+	policy.L = cfg.L
+	policy.WrapAround = cfg.WrapAround
+	return policy
+}
+
+func buildResyncOptions(cfg *testcase.ForceResync) (*aka.ResyncOptions, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	opts := &aka.ResyncOptions{AheadBy: cfg.AheadBy}
+	if cfg.SQNMSHex != "" {
+		sqn, err := sqnstore.ParseSQNHex(cfg.SQNMSHex)
+		if err != nil {
+			return nil, err
+		}
+		opts.SQNMS = &sqn
 	}
-	return peer, nil
+	return opts, nil
 }
 
 func decodeHex(label, value string, expected int) ([]byte, error) {
@@ -6,6 +6,7 @@ import (
 	"github.com/oyaguma3/eapaka_test/config"
 	"github.com/oyaguma3/eapaka_test/eap"
 	"github.com/oyaguma3/eapaka_test/testcase"
+	"github.com/oyaguma3/eapaka_test/usim"
 
 	eapaka "github.com/oyaguma3/go-eapaka"
 )
@@ -97,3 +98,27 @@ func TestBuildPeerPermanentOverride(t *testing.T) {
 		t.Fatalf("expected outer identity unchanged")
 	}
 }
+
+func TestBuildAlgorithmSelection(t *testing.T) {
+	base := config.SIMConfig{KI: "00112233445566778899aabbccddeeff"}
+
+	xorSIM := base
+	xorSIM.Algorithm = "xor"
+	alg, err := buildAlgorithm(xorSIM)
+	if err != nil {
+		t.Fatalf("build xor failed: %v", err)
+	}
+	if _, ok := alg.(*usim.XOR); !ok {
+		t.Fatalf("expected xor algorithm, got %T", alg)
+	}
+
+	milenageSIM := base
+	milenageSIM.OP = "cdc202d5123e20f62b6d676ac72cb318"
+	alg, err = buildAlgorithm(milenageSIM)
+	if err != nil {
+		t.Fatalf("build milenage failed: %v", err)
+	}
+	if _, ok := alg.(*usim.Milenage); !ok {
+		t.Fatalf("expected milenage algorithm, got %T", alg)
+	}
+}
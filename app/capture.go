@@ -0,0 +1,44 @@
+package app
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/trace"
+)
+
+// pcapClientPort is the source port used for synthetic Access-Request frames.
+const pcapClientPort = 50000
+
+// openPcap creates the pcapng file for trace.pcap_path. The client address is
+// the configured NAS-IP-Address (or loopback) since the real source port is
+// chosen by the RADIUS library.
+func openPcap(cfg config.Config, path string, secretComment bool) (*os.File, *trace.PcapWriter, error) {
+	server, err := net.ResolveUDPAddr("udp", cfg.Radius.ServerAddr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("resolve server_addr: %w", err)
+	}
+	clientIP := net.IPv4(127, 0, 0, 1)
+	if server.IP.To4() == nil {
+		clientIP = net.IPv6loopback
+	}
+	if ip := net.ParseIP(cfg.RadiusAttrs.NASIPAddress); ip != nil && (ip.To4() == nil) == (server.IP.To4() == nil) {
+		clientIP = ip
+	}
+	comment := ""
+	if secretComment {
+		comment = "RADIUS shared secret: " + cfg.Radius.Secret
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	writer, err := trace.NewPcapWriter(file, &net.UDPAddr{IP: clientIP, Port: pcapClientPort}, server, comment)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return file, writer, nil
+}
@@ -0,0 +1,275 @@
+package app
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/trace"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"layeh.com/radius"
+)
+
+// DecodeOptions holds inputs of the decode subcommand.
+type DecodeOptions struct {
+	// EAPHex is a bare EAP packet; RadiusHex a full RADIUS packet. Exactly
+	// one must be set.
+	EAPHex    string
+	RadiusHex string
+	Secret    string
+	// RequestAuthenticator decrypts MPPE keys of a response (unsafe only).
+	RequestAuthenticator string
+
+	// Identity enables AT_MAC verification with the sim.* keys of the
+	// config. RAND, AUTN and NetName override values missing from the
+	// packet (e.g. when decoding a response).
+	Identity string
+	RAND     string
+	AUTN     string
+	NetName  string
+
+	Unsafe bool
+}
+
+// MACMismatchError reports an AT_MAC that does not verify.
+type MACMismatchError struct{}
+
+func (e *MACMismatchError) Error() string {
+	return "app: AT_MAC verification failed"
+}
+
+// Decode prints a human-readable decode of an EAP or RADIUS packet. cfg is
+// only needed for AT_MAC verification. It returns exit code 1 when AT_MAC
+// does not verify and 2 on invalid input.
+func Decode(cfg *config.Config, opts DecodeOptions, out io.Writer) (int, error) {
+	if (opts.EAPHex == "") == (opts.RadiusHex == "") {
+		return fail(2, "decode requires exactly one of --eap or --radius")
+	}
+	var payload []byte
+	if opts.RadiusHex != "" {
+		var err error
+		payload, err = decodeRadius(opts, out)
+		if err != nil {
+			return wrap(2, err, "decode radius")
+		}
+		if payload == nil {
+			return 0, nil
+		}
+	} else {
+		raw, err := hex.DecodeString(cleanHex(opts.EAPHex))
+		if err != nil {
+			return wrap(2, err, "decode eap hex")
+		}
+		payload = raw
+	}
+	if err := decodeEAP(payload, opts, out); err != nil {
+		return wrap(2, err, "decode eap")
+	}
+	if opts.Identity == "" {
+		return 0, nil
+	}
+	if cfg == nil {
+		return fail(2, "AT_MAC verification requires -c <config>")
+	}
+	ok, err := verifyMAC(*cfg, payload, opts)
+	if err != nil {
+		return wrap(2, err, "verify AT_MAC")
+	}
+	if !ok {
+		fmt.Fprintln(out, "AT_MAC: mismatch")
+		return 1, &RunError{Code: 1, Err: &MACMismatchError{}}
+	}
+	fmt.Fprintln(out, "AT_MAC: ok")
+	return 0, nil
+}
+
+// cleanHex accepts the eap_hex= trace form and whitespace/colon separated dumps.
+func cleanHex(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, "="); i >= 0 {
+		value = value[i+1:]
+	}
+	return strings.NewReplacer(" ", "", ":", "", "\n", "", "\t", "").Replace(value)
+}
+
+func decodeRadius(opts DecodeOptions, out io.Writer) ([]byte, error) {
+	raw, err := hex.DecodeString(cleanHex(opts.RadiusHex))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Secret == "" {
+		return nil, fmt.Errorf("--secret is required with --radius")
+	}
+	packet, err := radius.Parse(raw, []byte(opts.Secret))
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(out, "RADIUS %s id=%d len=%d\n", packet.Code, packet.Identifier, len(raw))
+	fmt.Fprintf(out, "  Authenticator: %s\n", hex.EncodeToString(packet.Authenticator[:]))
+	for _, avp := range packet.Attributes {
+		fmt.Fprintf(out, "  %s (%d) len=%d\n", radiusAttributeName(avp.Type), avp.Type, len(avp.Attribute)+2)
+	}
+	mppe, err := radiusc.ExtractMPPEKeys(packet)
+	if err != nil {
+		return nil, err
+	}
+	if mppe.SendKeyPresent || mppe.RecvKeyPresent {
+		fmt.Fprintf(out, "MPPE send=%t recv=%t\n", mppe.SendKeyPresent, mppe.RecvKeyPresent)
+		if err := decodeMPPE(mppe, opts, out); err != nil {
+			return nil, err
+		}
+	}
+	payload, ok, err := radiusc.LookupEAPMessage(packet)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	return payload, nil
+}
+
+func decodeMPPE(keys radiusc.MPPEKeys, opts DecodeOptions, out io.Writer) error {
+	if opts.RequestAuthenticator == "" || !opts.Unsafe {
+		return nil
+	}
+	reqAuth, err := hex.DecodeString(cleanHex(opts.RequestAuthenticator))
+	if err != nil || len(reqAuth) != 16 {
+		return fmt.Errorf("request authenticator must be 16 bytes hex")
+	}
+	for _, k := range []struct {
+		name    string
+		present bool
+		value   []byte
+	}{
+		{"send_key", keys.SendKeyPresent, keys.SendKey},
+		{"recv_key", keys.RecvKeyPresent, keys.RecvKey},
+	} {
+		if !k.present {
+			continue
+		}
+		key, err := radiusc.DecryptMPPEKey(k.value, []byte(opts.Secret), reqAuth)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "  %s: %s\n", k.name, hex.EncodeToString(key))
+	}
+	return nil
+}
+
+func decodeEAP(payload []byte, opts DecodeOptions, out io.Writer) error {
+	pkt, err := eap.Parse(payload)
+	if err != nil {
+		return err
+	}
+	if pkt.Type == eap.TypeAKA || pkt.Type == eap.TypeAKAPrime {
+		lines, err := trace.DecodeAKA(payload, trace.DecodeOptions{Unsafe: opts.Unsafe})
+		if err != nil {
+			return err
+		}
+		for _, line := range lines {
+			fmt.Fprintln(out, line)
+		}
+		return nil
+	}
+	code := map[uint8]string{
+		eap.CodeRequest:  "Request",
+		eap.CodeResponse: "Response",
+		eap.CodeSuccess:  "Success",
+		eap.CodeFailure:  "Failure",
+	}[pkt.Code]
+	if code == "" {
+		code = fmt.Sprintf("Code(%d)", pkt.Code)
+	}
+	fmt.Fprintf(out, "EAP %s id=%d len=%d", code, pkt.Identifier, len(payload))
+	if pkt.Code == eap.CodeRequest || pkt.Code == eap.CodeResponse {
+		fmt.Fprintf(out, " type=%d", pkt.Type)
+	}
+	fmt.Fprintln(out)
+	if pkt.Type == eap.TypeIdentity && pkt.Code == eap.CodeResponse {
+		identity := string(pkt.TypeData)
+		if !opts.Unsafe {
+			identity = trace.MaskIdentity(identity)
+		}
+		fmt.Fprintf(out, "  Identity: %s\n", identity)
+	}
+	return nil
+}
+
+// verifyMAC derives K_aut from the config SIM and the given identity and
+// checks AT_MAC of an AKA/AKA' packet.
+func verifyMAC(cfg config.Config, payload []byte, opts DecodeOptions) (bool, error) {
+	pkt, err := eapaka.Parse(payload)
+	if err != nil {
+		return false, err
+	}
+	netName := opts.NetName
+	var randBytes, autnBytes []byte
+	for _, attr := range pkt.Attributes {
+		switch a := attr.(type) {
+		case *eapaka.AtRand:
+			randBytes = a.Rand
+		case *eapaka.AtAutn:
+			autnBytes = a.Autn
+		case *eapaka.AtKdfInput:
+			if netName == "" {
+				netName = a.NetworkName
+			}
+		}
+	}
+	if randBytes == nil {
+		if randBytes, err = decodeHex("rand", opts.RAND, 16); err != nil {
+			return false, err
+		}
+	}
+	if pkt.Type == eapaka.TypeAKAPrime && autnBytes == nil {
+		if autnBytes, err = decodeHex("autn", opts.AUTN, 16); err != nil {
+			return false, err
+		}
+	}
+	if netName == "" {
+		netName = cfg.EAP.AKAPrime.NetName
+	}
+	alg, err := buildAlgorithm(cfg.SIM)
+	if err != nil {
+		return false, err
+	}
+	keys, err := aka.DeriveKeys(alg, aka.VectorInput{
+		MethodType: pkt.Type,
+		RAND:       randBytes,
+		AUTN:       autnBytes,
+		Identity:   opts.Identity,
+		NetName:    netName,
+		IMSI:       cfg.SIM.IMSI,
+	})
+	if err != nil {
+		return false, err
+	}
+	return pkt.VerifyMac(keys.KAut)
+}
+
+var radiusAttributeNames = map[radius.Type]string{
+	1:  "User-Name",
+	4:  "NAS-IP-Address",
+	18: "Reply-Message",
+	24: "State",
+	26: "Vendor-Specific",
+	30: "Called-Station-Id",
+	31: "Calling-Station-Id",
+	32: "NAS-Identifier",
+	79: "EAP-Message",
+	80: "Message-Authenticator",
+}
+
+func radiusAttributeName(t radius.Type) string {
+	if name, ok := radiusAttributeNames[t]; ok {
+		return name
+	}
+	return "Attribute"
+}
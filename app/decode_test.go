@@ -0,0 +1,101 @@
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/radiusc"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"layeh.com/radius"
+)
+
+func TestDecodeEAPVerifiesMAC(t *testing.T) {
+	cfg, err := config.LoadFile("../configs/example.yaml")
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	identity := "0" + cfg.SIM.IMSI + "@wlan.example"
+	raw := signedChallenge(t, cfg, identity)
+
+	out := &bytes.Buffer{}
+	code, err := Decode(&cfg, DecodeOptions{EAPHex: "eap_hex=" + hex.EncodeToString(raw), Identity: identity}, out)
+	if err != nil || code != 0 {
+		t.Fatalf("decode failed: code=%d err=%v", code, err)
+	}
+	for _, want := range []string{"EAP-AKA Request", "AT_RAND (1)", "AT_MAC (11)", "AT_MAC: ok"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in:\n%s", want, out.String())
+		}
+	}
+
+	code, err = Decode(&cfg, DecodeOptions{EAPHex: hex.EncodeToString(raw), Identity: "0other@wlan.example"}, &bytes.Buffer{})
+	if code != 1 || err == nil {
+		t.Fatalf("expected MAC mismatch exit 1, got code=%d err=%v", code, err)
+	}
+}
+
+func TestDecodeRadius(t *testing.T) {
+	cfg, err := config.LoadFile("../configs/example.yaml")
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	packet := radius.New(radius.CodeAccessChallenge, []byte("secret"))
+	if err := radiusc.AddEAPMessage(packet, signedChallenge(t, cfg, "0"+cfg.SIM.IMSI+"@wlan.example")); err != nil {
+		t.Fatalf("add eap failed: %v", err)
+	}
+	raw, err := packet.Encode()
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+
+	out := &bytes.Buffer{}
+	code, err := Decode(nil, DecodeOptions{RadiusHex: hex.EncodeToString(raw), Secret: "secret"}, out)
+	if err != nil || code != 0 {
+		t.Fatalf("decode failed: code=%d err=%v", code, err)
+	}
+	for _, want := range []string{"RADIUS Access-Challenge", "EAP-Message (79)", "EAP-AKA Request"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("expected %q in:\n%s", want, out.String())
+		}
+	}
+
+	if code, _ := Decode(nil, DecodeOptions{RadiusHex: hex.EncodeToString(raw)}, &bytes.Buffer{}); code != 2 {
+		t.Fatalf("expected exit 2 without secret, got %d", code)
+	}
+}
+
+func signedChallenge(t *testing.T, cfg config.Config, identity string) []byte {
+	t.Helper()
+	alg, err := buildAlgorithm(cfg.SIM)
+	if err != nil {
+		t.Fatalf("build algorithm failed: %v", err)
+	}
+	randBytes := bytes.Repeat([]byte{0x5a}, 16)
+	_, ck, ik, _, err := alg.F2345(randBytes)
+	if err != nil {
+		t.Fatalf("f2345 failed: %v", err)
+	}
+	pkt := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: 1,
+		Type:       eapaka.TypeAKA,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtRand{Rand: randBytes},
+			&eapaka.AtAutn{Autn: make([]byte, 16)},
+			&eapaka.AtMac{MAC: make([]byte, 16)},
+		},
+	}
+	if err := pkt.CalculateAndSetMac(eapaka.DeriveKeysAKA(identity, ck, ik).K_aut); err != nil {
+		t.Fatalf("mac failed: %v", err)
+	}
+	raw, err := pkt.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	return raw
+}
@@ -0,0 +1,375 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/session"
+	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/testcase"
+	"github.com/oyaguma3/eapaka_test/trace"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"gopkg.in/yaml.v3"
+)
+
+// Finding kinds reported by Fuzz.
+const (
+	FindingCrash            = "crash"
+	FindingTimeout          = "timeout"
+	FindingUnexpectedAccept = "unexpected_accept"
+)
+
+// FuzzOptions holds settings of the fuzz subcommand.
+type FuzzOptions struct {
+	// OutDir receives one reproducer testcase (and the mutated request as
+	// hex) per finding. Empty disables saving.
+	OutDir string
+	// Max limits the number of mutants run (0 = all).
+	Max int
+	// Timeout bounds each mutant session, so a server that keeps the
+	// conversation going without finishing it is reported as a timeout.
+	// Zero allows radius.timeout_ms × (retries+1) per baseline round, plus
+	// one round.
+	Timeout time.Duration
+	// Logf, when set, receives one line per mutant.
+	Logf func(format string, args ...interface{})
+}
+
+// FuzzFinding is one deduplicated problem.
+type FuzzFinding struct {
+	Kind     string
+	Category string
+	Round    int
+	// Count is how many mutants hit the same kind/category/round.
+	Count    int
+	Mutation testcase.Mutation
+	// Request is the mutated Access-Request of the first occurrence.
+	Request []byte
+	// Path is the reproducer testcase, when saved.
+	Path string
+}
+
+// FuzzReport summarizes a fuzz run.
+type FuzzReport struct {
+	Mutants  int
+	Replies  int
+	Findings []*FuzzFinding
+	// Aborted is set when the server stopped answering unmutated sessions.
+	Aborted bool
+}
+
+type fuzzCase struct {
+	category string
+	mutation testcase.Mutation
+	// protected is set when the mutated EAP packet carried AT_MAC, so an
+	// Access-Accept means the server ignored the damage.
+	protected bool
+}
+
+// Fuzz records a valid conversation for tc, then replays it once per
+// mutant with one packet damaged, and reports server crashes (the server
+// stops answering even unmutated sessions), timeouts, and accepts of
+// MAC-protected packets that were modified.
+func Fuzz(ctx context.Context, cfg config.Config, tc testcase.Case, opts FuzzOptions) (*FuzzReport, error) {
+	store := sqnstore.NewMemoryStore()
+	baseline, err := fuzzRun(ctx, cfg, tc, store, nil)
+	if err != nil {
+		return nil, fmt.Errorf("app: baseline session: %w", err)
+	}
+	var cases []fuzzCase
+	for _, round := range baseline.Transcript {
+		cases = append(cases, eapMutants(round.Index, round.RequestEAP)...)
+		cases = append(cases, radiusMutants(round.Index)...)
+	}
+	if opts.Max > 0 && len(cases) > opts.Max {
+		cases = cases[:opts.Max]
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		merged := config.ApplyTestcase(cfg, tc)
+		perRound := time.Duration(merged.Radius.TimeoutMS) * time.Millisecond * time.Duration(merged.Radius.Retries+1)
+		timeout = perRound * time.Duration(len(baseline.Transcript)+1)
+	}
+	run := func(m *testcase.Mutation) (*session.Result, error) {
+		mctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return fuzzRun(mctx, cfg, tc, store, m)
+	}
+
+	report := &FuzzReport{}
+	seen := make(map[string]*FuzzFinding)
+	for _, fc := range cases {
+		report.Mutants++
+		m := fc.mutation
+		result, err := run(&m)
+		if ctx.Err() != nil {
+			return report, ctx.Err()
+		}
+		kind := ""
+		switch {
+		case isTimeout(err):
+			kind = FindingTimeout
+			if _, healthErr := run(nil); healthErr != nil {
+				kind = FindingCrash
+				report.Aborted = true
+			}
+		case err == nil && result.Accepted && fc.protected:
+			kind = FindingUnexpectedAccept
+		}
+		if !isTimeout(err) {
+			report.Replies++
+		}
+		if opts.Logf != nil {
+			outcome := kind
+			if outcome == "" {
+				outcome = "ok"
+			}
+			opts.Logf("mutant %d round=%d %s: %s", report.Mutants, m.Round, fc.category, outcome)
+		}
+		if kind != "" {
+			key := fmt.Sprintf("%s|%s|%d", kind, fc.category, m.Round)
+			if finding, ok := seen[key]; ok {
+				finding.Count++
+			} else {
+				finding = &FuzzFinding{Kind: kind, Category: fc.category, Round: m.Round, Count: 1, Mutation: m}
+				if result != nil {
+					finding.Request = lastRequest(result, m.Round)
+				}
+				if opts.OutDir != "" {
+					path, err := saveReproducer(opts.OutDir, len(report.Findings)+1, tc, finding)
+					if err != nil {
+						return report, err
+					}
+					finding.Path = path
+				}
+				seen[key] = finding
+				report.Findings = append(report.Findings, finding)
+			}
+		}
+		if report.Aborted {
+			break
+		}
+	}
+	return report, nil
+}
+
+func fuzzRun(ctx context.Context, cfg config.Config, tc testcase.Case, store sqnstore.Store, m *testcase.Mutation) (*session.Result, error) {
+	merged := config.ApplyTestcase(cfg, tc)
+	sub, policies, err := buildSubscriber(cfg, tc, store, nil)
+	if err != nil {
+		return nil, err
+	}
+	opts := session.Options{
+		Subscriber: sub,
+		Server:     session.Server{Attributes: radiusAttributes(merged)},
+		Policies:   policies,
+		Client:     newClient(merged),
+	}
+	if m != nil {
+		opts.EAPMiddleware, opts.RadiusMiddleware = buildMutations([]testcase.Mutation{*m})
+	}
+	sess, err := session.New(opts)
+	if err != nil {
+		return nil, err
+	}
+	return sess.Run(ctx)
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+func lastRequest(result *session.Result, round int) []byte {
+	for i := len(result.Transcript) - 1; i >= 0; i-- {
+		if result.Transcript[i].Index == round {
+			return result.Transcript[i].Request
+		}
+	}
+	return nil
+}
+
+// eapMutants damages the EAP length, each AKA attribute's type and length,
+// and the AT_RES bit length of the EAP response sent in round.
+func eapMutants(round int, payload []byte) []fuzzCase {
+	if len(payload) < 4 {
+		return nil
+	}
+	var cases []fuzzCase
+	protected := false
+	add := func(category string, offset int, value []byte) {
+		cases = append(cases, fuzzCase{
+			category: category,
+			mutation: testcase.Mutation{Layer: "eap", Round: round, Action: "modify", Offset: offset, SetHex: hex.EncodeToString(value)},
+		})
+	}
+	length := len(payload)
+	for _, v := range []int{0, 4, length - 1, length + 1, 0xffff} {
+		add("eap_length", 2, uint16Bytes(v))
+	}
+	short := 4
+	cases = append(cases,
+		fuzzCase{category: "eap_truncated", mutation: testcase.Mutation{Layer: "eap", Round: round, Action: "modify", Truncate: &short}},
+		fuzzCase{category: "eap_trailing", mutation: testcase.Mutation{Layer: "eap", Round: round, Action: "modify", AppendHex: "00000000"}},
+	)
+	if length < 8 || (payload[4] != eap.TypeAKA && payload[4] != eap.TypeAKAPrime) {
+		return cases
+	}
+	for offset := 8; offset+2 <= length; {
+		attrType := payload[offset]
+		attrLen := int(payload[offset+1])
+		if attrLen == 0 {
+			break
+		}
+		name := trace.AttributeName(eapaka.AttributeType(attrType))
+		if eapaka.AttributeType(attrType) == eapaka.AT_MAC {
+			protected = true
+		}
+		for _, v := range []int{0, 1, attrLen - 1, attrLen + 1, 0xff} {
+			if v >= 0 && v != attrLen {
+				add("attr_length:"+name, offset+1, []byte{byte(v)})
+			}
+		}
+		for _, v := range []byte{0x00, 0x7f, 0xff} {
+			if v != attrType {
+				add("attr_type:"+name, offset, []byte{v})
+			}
+		}
+		if eapaka.AttributeType(attrType) == eapaka.AT_RES && offset+4 <= length {
+			bits := int(binary.BigEndian.Uint16(payload[offset+2:]))
+			for _, v := range []int{0, 1, bits - 1, bits + 1, 0xffff} {
+				if v >= 0 && v != bits {
+					add("res_bits", offset+2, uint16Bytes(v))
+				}
+			}
+		}
+		offset += attrLen * 4
+	}
+	for i := range cases {
+		// Octets past the EAP Length are padding and not covered by AT_MAC.
+		cases[i].protected = protected && cases[i].category != "eap_trailing"
+	}
+	return cases
+}
+
+// radiusMutants re-fragments EAP-Message and sends badly sized or unknown
+// attributes in the Access-Request of round.
+func radiusMutants(round int) []fuzzCase {
+	var cases []fuzzCase
+	for _, size := range []int{1, 16, 252} {
+		cases = append(cases, fuzzCase{
+			category: "eap_message_fragment",
+			mutation: testcase.Mutation{Layer: "radius", Round: round, Action: "modify", FragmentSize: size},
+		})
+	}
+	for _, a := range []struct {
+		attr  int
+		value string
+	}{
+		{1, strings.Repeat("61", 253)},
+		{4, "7f0000"},
+		{4, "7f00000101"},
+		{24, "00"},
+		{26, "000000"},
+		{80, strings.Repeat("00", 15)},
+		{255, "00"},
+	} {
+		cases = append(cases, fuzzCase{
+			category: fmt.Sprintf("radius_attr:%d", a.attr),
+			mutation: testcase.Mutation{Layer: "radius", Round: round, Action: "modify", Attribute: a.attr, ValueHex: a.value},
+		})
+	}
+	return cases
+}
+
+func uint16Bytes(v int) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, uint16(v))
+	return b
+}
+
+// reproMutation is testcase.Mutation with unset fields left out of the
+// reproducer YAML.
+type reproMutation struct {
+	Layer        string `yaml:"layer"`
+	Direction    string `yaml:"direction,omitempty"`
+	Round        int    `yaml:"round,omitempty"`
+	Action       string `yaml:"action"`
+	DelayMS      int    `yaml:"delay_ms,omitempty"`
+	Offset       int    `yaml:"offset,omitempty"`
+	SetHex       string `yaml:"set_hex,omitempty"`
+	Truncate     *int   `yaml:"truncate,omitempty"`
+	AppendHex    string `yaml:"append_hex,omitempty"`
+	Attribute    int    `yaml:"attribute,omitempty"`
+	ValueHex     string `yaml:"value_hex,omitempty"`
+	Remove       bool   `yaml:"remove,omitempty"`
+	FragmentSize int    `yaml:"fragment_size,omitempty"`
+}
+
+// reproducerResult is the expect.result of a reproducer: timeout findings
+// expect the timeout again, so run passes while the server still stays
+// silent; an unexpected accept expects the reject a fixed server sends.
+func reproducerResult(kind string) string {
+	if kind == FindingUnexpectedAccept {
+		return "reject"
+	}
+	return "timeout"
+}
+
+// saveReproducer writes a testcase that replays the mutant with run, and
+// the mutated Access-Request as hex next to it for bug reports. The hex is
+// not read back by any subcommand; run the testcase to reproduce.
+func saveReproducer(dir string, n int, tc testcase.Case, f *FuzzFinding) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", fmt.Errorf("app: create fuzz output dir: %w", err)
+	}
+	// Start from sqn_initial_hex so a file-backed SQN store advanced by
+	// later runs does not reject the server's challenge.
+	sqn := tc.SQN
+	sqn.Reset = true
+	name := fmt.Sprintf("%03d-%s-%s", n, f.Kind, strings.NewReplacer(":", "_", "'", "").Replace(f.Category))
+	repro := struct {
+		Version     int             `yaml:"version"`
+		Name        string          `yaml:"name"`
+		Description string          `yaml:"description"`
+		Identity    string          `yaml:"identity"`
+		Radius      testcase.Radius `yaml:"radius,omitempty"`
+		EAP         testcase.EAP    `yaml:"eap,omitempty"`
+		SQN         testcase.SQN    `yaml:"sqn"`
+		Expect      testcase.Expect `yaml:"expect"`
+		Mutations   []reproMutation `yaml:"mutations"`
+	}{
+		Version:     1,
+		Name:        name,
+		Description: fmt.Sprintf("fuzz %s: %s in round %d", f.Kind, f.Category, f.Round),
+		Identity:    tc.Identity,
+		Radius:      tc.Radius,
+		EAP:         tc.EAP,
+		SQN:         sqn,
+		Expect:      testcase.Expect{Result: reproducerResult(f.Kind)},
+		Mutations:   []reproMutation{reproMutation(f.Mutation)},
+	}
+	data, err := yaml.Marshal(repro)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, name+".yaml")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return "", fmt.Errorf("app: write reproducer: %w", err)
+	}
+	if len(f.Request) > 0 {
+		if err := os.WriteFile(filepath.Join(dir, name+".hex"), []byte(hex.EncodeToString(f.Request)+"\n"), 0o644); err != nil {
+			return "", fmt.Errorf("app: write reproducer packet: %w", err)
+		}
+	}
+	return path, nil
+}
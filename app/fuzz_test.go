@@ -0,0 +1,120 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oyaguma3/eapaka_test/testcase"
+)
+
+func TestFuzzAgainstMockServer(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	cfg.Radius.TimeoutMS = 50
+	cfg.Radius.Retries = 0
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	dir := t.TempDir()
+	var lines int
+	report, err := Fuzz(context.Background(), cfg, tc, FuzzOptions{
+		OutDir: dir,
+		Logf:   func(string, ...interface{}) { lines++ },
+	})
+	if err != nil {
+		t.Fatalf("fuzz failed: %v", err)
+	}
+	if report.Mutants == 0 || lines != report.Mutants {
+		t.Fatalf("unexpected mutant count %d (logged %d)", report.Mutants, lines)
+	}
+	if report.Aborted {
+		t.Fatalf("mock server should survive fuzzing")
+	}
+	for _, f := range report.Findings {
+		if f.Kind == FindingCrash || f.Path == "" {
+			t.Fatalf("unexpected finding %+v", f)
+		}
+		repro, err := testcase.LoadFile(f.Path)
+		if err != nil {
+			t.Fatalf("reproducer does not load: %v", err)
+		}
+		if len(repro.Mutations) != 1 || repro.Identity != tc.Identity || !repro.SQN.Reset {
+			t.Fatalf("unexpected reproducer %+v", repro)
+		}
+		repro.Trace.Level = ""
+		want := 1
+		if f.Kind == FindingTimeout {
+			want = 0
+		}
+		if code, _ := RunCase(context.Background(), cfg, repro); code != want {
+			t.Fatalf("reproducer %s: expected exit %d, got %d", f.Path, want, code)
+		}
+	}
+}
+
+func TestFuzzFindsUnexpectedAccept(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{Fault: "accept_any"})
+	cfg.Radius.TimeoutMS = 50
+	cfg.Radius.Retries = 0
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	report, err := Fuzz(context.Background(), cfg, tc, FuzzOptions{OutDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("fuzz failed: %v", err)
+	}
+	var finding *FuzzFinding
+	for _, f := range report.Findings {
+		if f.Kind == FindingUnexpectedAccept && f.Category == "attr_type:AT_MAC" {
+			finding = f
+		}
+	}
+	// AT_MAC's type is overwritten with 0x00, 0x7f and 0xff.
+	if finding == nil || finding.Count != 3 || finding.Round != 2 || len(finding.Request) == 0 {
+		t.Fatalf("expected one attr_type:AT_MAC finding with count 3, got %+v", report.Findings)
+	}
+	repro, err := testcase.LoadFile(finding.Path)
+	if err != nil {
+		t.Fatalf("reproducer does not load: %v", err)
+	}
+	if repro.Expect.Result != "reject" {
+		t.Fatalf("expected reject expectation, got %q", repro.Expect.Result)
+	}
+	if code, _ := RunCase(context.Background(), cfg, repro); code != 1 {
+		t.Fatalf("reproducer should fail while the fault persists, got exit %d", code)
+	}
+}
+
+func TestFuzzDetectsCrash(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{Fault: "wedge_on_malformed"})
+	cfg.Radius.TimeoutMS = 50
+	cfg.Radius.Retries = 0
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	report, err := Fuzz(context.Background(), cfg, tc, FuzzOptions{OutDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("fuzz failed: %v", err)
+	}
+	// The first mutant zeroes the EAP Length of round 1, which wedges the
+	// server; the health check then times out too.
+	if !report.Aborted || report.Mutants != 1 || len(report.Findings) != 1 {
+		t.Fatalf("expected fuzzing to abort after one mutant, got %+v", report)
+	}
+	f := report.Findings[0]
+	if f.Kind != FindingCrash || f.Category != "eap_length" || f.Round != 1 || f.Count != 1 {
+		t.Fatalf("unexpected finding %+v", f)
+	}
+	repro, err := testcase.LoadFile(f.Path)
+	if err != nil {
+		t.Fatalf("reproducer does not load: %v", err)
+	}
+	if repro.Expect.Result != "timeout" {
+		t.Fatalf("expected timeout expectation, got %q", repro.Expect.Result)
+	}
+	if code, err := RunCase(context.Background(), cfg, repro); code != 0 {
+		t.Fatalf("reproducer should time out again, got exit %d (err=%v)", code, err)
+	}
+}
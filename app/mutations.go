@@ -0,0 +1,118 @@
+package app
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/session"
+	"github.com/oyaguma3/eapaka_test/testcase"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// buildMutations turns testcase mutations into session middleware, in the
+// order they are listed.
+func buildMutations(mutations []testcase.Mutation) ([]session.EAPMiddleware, []session.RadiusMiddleware) {
+	var eapMW []session.EAPMiddleware
+	var radiusMW []session.RadiusMiddleware
+	for _, m := range mutations {
+		delay := time.Duration(m.DelayMS) * time.Millisecond
+		receive := m.Direction == "receive"
+		if m.Layer == "eap" {
+			switch m.Action {
+			case "drop":
+				eapMW = append(eapMW, session.DropEAP(m.Round))
+			case "delay":
+				eapMW = append(eapMW, session.DelayEAP(m.Round, delay))
+			case "modify":
+				if receive {
+					// The request received in round N is handled for round N+1.
+					round := m.Round
+					if round > 0 {
+						round++
+					}
+					eapMW = append(eapMW, session.ModifyEAPRequest(round, editBytes(m)))
+				} else {
+					eapMW = append(eapMW, session.ModifyEAP(m.Round, editBytes(m)))
+				}
+			}
+			continue
+		}
+		switch m.Action {
+		case "drop":
+			radiusMW = append(radiusMW, session.DropRadius(m.Round))
+		case "delay":
+			radiusMW = append(radiusMW, session.DelayRadius(m.Round, delay))
+		case "duplicate":
+			radiusMW = append(radiusMW, session.DuplicateRadius(m.Round))
+		case "reorder":
+			radiusMW = append(radiusMW, session.ReorderRadius(m.Round))
+		case "modify":
+			if receive {
+				radiusMW = append(radiusMW, session.ModifyRadiusReply(m.Round, editPacket(m, false)))
+			} else {
+				radiusMW = append(radiusMW, session.ModifyRadius(m.Round, editPacket(m, true)))
+			}
+		}
+	}
+	return eapMW, radiusMW
+}
+
+// editBytes applies set_hex at offset, then truncate, then append_hex.
+// Values were validated by testcase.Validate.
+func editBytes(m testcase.Mutation) func([]byte) []byte {
+	set, _ := hex.DecodeString(m.SetHex)
+	tail, _ := hex.DecodeString(m.AppendHex)
+	return func(data []byte) []byte {
+		out := append([]byte(nil), data...)
+		if len(set) > 0 {
+			if need := m.Offset + len(set); need > len(out) {
+				out = append(out, make([]byte, need-len(out))...)
+			}
+			copy(out[m.Offset:], set)
+		}
+		if m.Truncate != nil && *m.Truncate < len(out) {
+			out = out[:*m.Truncate]
+		}
+		return append(out, tail...)
+	}
+}
+
+// editPacket replaces or removes an attribute, or re-fragments
+// EAP-Message. Outgoing requests get a fresh Message-Authenticator unless
+// that attribute is the one edited.
+func editPacket(m testcase.Mutation, resign bool) func(*radius.Packet) error {
+	value, _ := hex.DecodeString(m.ValueHex)
+	attrType := radius.Type(m.Attribute)
+	if m.FragmentSize > 0 {
+		attrType = rfc2869.EAPMessage_Type
+	}
+	return func(p *radius.Packet) error {
+		if m.FragmentSize > 0 {
+			payload, _, err := radiusc.LookupEAPMessage(p)
+			if err != nil {
+				return err
+			}
+			p.Attributes.Del(attrType)
+			for len(payload) > 0 {
+				n := m.FragmentSize
+				if n > len(payload) {
+					n = len(payload)
+				}
+				p.Add(attrType, payload[:n])
+				payload = payload[n:]
+			}
+		} else {
+			p.Attributes.Del(attrType)
+			if !m.Remove {
+				p.Add(attrType, value)
+			}
+		}
+		if resign && attrType != rfc2869.MessageAuthenticator_Type {
+			return radiusc.SetMessageAuthenticator(p)
+		}
+		return nil
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -12,11 +13,18 @@ import (
 
 	"github.com/oyaguma3/eapaka_test/config"
 	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+	"github.com/oyaguma3/eapaka_test/eapmethod/sim"
+	"github.com/oyaguma3/eapaka_test/metrics"
 	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/session"
 	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/suci"
 	"github.com/oyaguma3/eapaka_test/testcase"
 	"github.com/oyaguma3/eapaka_test/trace"
+	"github.com/oyaguma3/eapaka_test/usim"
 
+	eapaka "github.com/oyaguma3/go-eapaka"
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
 )
@@ -35,8 +43,23 @@ func (e *RunError) Unwrap() error {
 	return e.Err
 }
 
+// RunOptions holds per-run settings that are not part of config or testcase.
+type RunOptions struct {
+	// RecordPath saves the RADIUS conversation (and a separate secrets file).
+	RecordPath string
+	// ReplayPath answers requests from a recording instead of the network.
+	ReplayPath string
+	// Metrics, when set, collects counters and round latencies.
+	Metrics *metrics.Metrics
+}
+
 // RunCase executes a single testcase and returns the exit code (0/1/2).
 func RunCase(ctx context.Context, cfg config.Config, tc testcase.Case) (int, error) {
+	return RunCaseWithOptions(ctx, cfg, tc, RunOptions{})
+}
+
+// RunCaseWithOptions executes a testcase with record/replay settings.
+func RunCaseWithOptions(ctx context.Context, cfg config.Config, tc testcase.Case, opts RunOptions) (code int, err error) {
 	merged := config.ApplyTestcase(cfg, tc)
 
 	store, err := buildStore(merged, tc)
@@ -49,90 +72,241 @@ func RunCase(ctx context.Context, cfg config.Config, tc testcase.Case) (int, err
 		}
 	}
 
-	peer, err := BuildPeer(cfg, tc, store)
+	ephemeralKey, err := suciEphemeralKey(merged, opts)
+	if err != nil {
+		return wrap(2, err, "suci ephemeral key")
+	}
+	sub, policies, err := buildSubscriber(cfg, tc, store, ephemeralKey)
 	if err != nil {
 		return wrap(2, err, "build peer")
 	}
-	if peer.Session == nil || peer.Session.OuterIdentity == "" {
+	if sub.Identity == "" {
 		return fail(2, "outer identity is required")
 	}
 
-	attrs := radiusc.Attributes{
-		NASIPAddress:     merged.RadiusAttrs.NASIPAddress,
-		NASIdentifier:    merged.RadiusAttrs.NASIdentifier,
-		CalledStationID:  merged.RadiusAttrs.CalledStationID,
-		CallingStationID: merged.RadiusAttrs.CallingStationID,
+	attrs := radiusAttributes(merged)
+	client := newClient(merged)
+	if opts.ReplayPath != "" {
+		rec, err := radiusc.LoadRecording(opts.ReplayPath)
+		if err != nil {
+			return wrap(2, err, "load replay")
+		}
+		client.Replay = rec
+		// EAP-SIM keys depend on NONCE_MT; reuse the recorded one.
+		if sub.NonceMT, err = recordedNonceMT(rec); err != nil {
+			return wrap(2, err, "load replay")
+		}
 	}
-
-	client := radiusc.NewClient(
-		merged.Radius.ServerAddr,
-		merged.Radius.Secret,
-		time.Duration(merged.Radius.TimeoutMS)*time.Millisecond,
-		merged.Radius.Retries,
-	)
-
-	logger := buildLogger(tc)
-	userName := peer.Session.OuterIdentity
-	respPkt := &eap.Packet{
-		Code:       eap.CodeResponse,
-		Identifier: 0,
-		Type:       eap.TypeIdentity,
-		TypeData:   []byte(userName),
+	if opts.RecordPath != "" {
+		client.Record = &radiusc.Recording{SUCIEphemeralKey: ephemeralKey}
+		defer func() {
+			if saveErr := client.Record.Save(opts.RecordPath, merged.Radius.Secret); saveErr != nil && err == nil {
+				code, err = wrap(2, saveErr, "save recording")
+			}
+		}()
 	}
 
-	for {
-		raw, err := respPkt.Encode()
-		if err != nil {
-			return wrap(2, err, "encode eap response")
-		}
-		resp, err := client.ExchangeEAP(ctx, userName, raw, attrs)
+	if opts.Metrics != nil {
+		client.Observer = opts.Metrics
+	}
+	if tc.Trace.PcapPath != "" {
+		file, writer, err := openPcap(merged, tc.Trace.PcapPath, tc.Trace.PcapSecretComment)
 		if err != nil {
-			return wrap(2, err, "radius exchange")
-		}
-		if logger != nil {
-			logger.LogRadius(resp.Code, resp.Packet, resp.EAP, peer.Session)
+			return wrap(2, err, "open pcap")
 		}
+		defer file.Close()
+		client.Capture = writer
+	}
 
-		switch resp.Code {
-		case radius.CodeAccessChallenge:
-			if len(resp.EAP) == 0 {
-				return fail(2, "missing EAP-Message in Access-Challenge")
-			}
-			reqPkt, err := eap.Parse(resp.EAP)
-			if err != nil {
-				return wrap(2, err, "parse EAP request")
-			}
-			nextResp, err := peer.Handle(reqPkt)
-			if err != nil {
-				if _, ok := err.(*eap.MethodMismatchError); ok {
-					return wrap(1, err, "method mismatch")
-				}
-				return wrap(2, err, "handle EAP request")
-			}
-			if nextResp == nil {
-				return fail(2, "no response for challenge")
-			}
+	logger := buildLogger(tc)
+	if logger != nil {
+		defer logger.Flush()
+	}
+	if milenage, ok := sub.Algorithm.(*usim.Milenage); ok && merged.SIM.OP != "" {
+		// Log the OPc the built Milenage derived from sim.op.
+		logger.LogSecret("sim_opc_derived", milenage.OPc())
+	}
+	// peer is set once session.New has built it from sub and policies.
+	var peer *eap.Peer
+	sentType := uint8(eap.TypeIdentity)
+	hooks := session.Hooks{
+		BeforeSend: func(round int, packet *radius.Packet, eapPayload []byte) {
 			if logger != nil {
-				logger.LogChallengeResponse(&reqPkt, nextResp, peer.Session)
+				logger.Round = round
+				logger.LogRadiusRequest(packet, eapPayload, peer.Session)
 			}
-			respPkt = nextResp
-			if peer.Session != nil && peer.Session.OuterIdentity != "" {
-				userName = peer.Session.OuterIdentity
-			}
-		case radius.CodeAccessAccept:
+		},
+		AfterReceive: func(round int, resp *radiusc.Response, rtt time.Duration) {
+			opts.Metrics.ObserveRound(merged.Radius.ServerAddr, methodLabel(sentType), round, rtt)
 			if logger != nil {
-				logger.LogMPPE(resp.MPPE)
+				logger.LogRadius(resp.Code, resp.Packet, resp.EAP, peer.Session)
+			}
+		},
+		AfterHandle: func(round int, req eap.Packet, resp *eap.Packet) {
+			sentType = resp.Type
+			if isSyncFailure(resp) {
+				opts.Metrics.SyncFailure(merged.Radius.ServerAddr)
 			}
-			return evaluateExpect(tc, resp, true)
-		case radius.CodeAccessReject:
 			if logger != nil {
-				logger.LogMPPE(resp.MPPE)
+				if method, ok := peer.Methods[req.Type].(interface{ KEncr() []byte }); ok {
+					logger.SetKEncr(method.KEncr())
+				}
+				logger.LogChallengeResponse(&req, resp, peer.Session)
 			}
-			return evaluateExpect(tc, resp, false)
-		default:
-			return fail(2, "unexpected RADIUS code %d", resp.Code)
+		},
+	}
+	if logger != nil {
+		hooks.Warn = func(err error) {
+			logger.Warn(err.Error())
+		}
+	}
+	eapMW, radiusMW := buildMutations(tc.Mutations)
+	sess, err := session.New(session.Options{
+		Subscriber:       sub,
+		Server:           session.Server{Attributes: attrs},
+		Policies:         policies,
+		Hooks:            hooks,
+		EAPMiddleware:    eapMW,
+		RadiusMiddleware: radiusMW,
+		Client:           client,
+	})
+	if err != nil {
+		return wrap(2, err, "build session")
+	}
+	peer = sess.Peer()
+	result, err := sess.Run(ctx)
+	if tc.Expect.Result == "timeout" {
+		return expectTimeout(result, err)
+	}
+	if err != nil {
+		var replayErr *radiusc.ReplayMismatchError
+		var mismatchErr *eap.MethodMismatchError
+		var resyncErr *aka.ResyncError
+		var kdfErr *aka.KDFError
+		var amfErr *aka.AMFMismatchError
+		var netNameErr *aka.NetNameMismatchError
+		switch {
+		case errors.As(err, &replayErr):
+			return wrap(1, err, "replay mismatch")
+		case errors.As(err, &mismatchErr):
+			return wrap(1, err, "method mismatch")
+		case errors.As(err, &resyncErr):
+			return wrap(1, err, "resync")
+		case errors.As(err, &kdfErr):
+			return wrap(1, err, "kdf negotiation")
+		case errors.As(err, &amfErr):
+			return wrap(1, err, "amf mismatch")
+		case errors.As(err, &netNameErr):
+			return wrap(1, err, "net_name mismatch")
+		}
+		return 2, &RunError{Code: 2, Err: err}
+	}
+	if logger != nil {
+		if m, ok := peer.Methods[eap.TypeAKA].(*aka.Method); ok && m.Bidding().Rejected {
+			logger.Warn("aka: refused EAP-AKA challenge whose AT_BIDDING offers AKA' (bidding down)")
 		}
+		logger.LogMPPE(result.Reply.MPPE)
+	}
+	if result.Accepted && tc.SQN.ForceResync != nil {
+		if code, err := verifyResync(peer); err != nil {
+			return code, err
+		}
+	}
+	if code, err := checkNegotiation(tc, peer); err != nil {
+		return code, err
 	}
+	return evaluateExpect(tc, result.Reply, result.Accepted)
+}
+
+// expectTimeout evaluates expect.result timeout: the server must stop
+// answering at some round.
+func expectTimeout(result *session.Result, err error) (int, error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, nil
+	}
+	if err != nil {
+		return 2, &RunError{Code: 2, Err: err}
+	}
+	actual := "reject"
+	if result.Accepted {
+		actual = "accept"
+	}
+	return fail(1, "expect result=timeout got=%s", actual)
+}
+
+// checkNegotiation evaluates expect.nak_sent, expect.method,
+// expect.bidding_aka_prime and expect.kdf against what the server requested.
+func checkNegotiation(tc testcase.Case, peer *eap.Peer) (int, error) {
+	if tc.Expect.NakSent != nil && *tc.Expect.NakSent != (len(peer.Naks) > 0) {
+		return fail(1, "expect nak_sent=%t got=%t", *tc.Expect.NakSent, len(peer.Naks) > 0)
+	}
+	if tc.Expect.Method != "" {
+		want, _ := eap.ParseMethodName(tc.Expect.Method)
+		if len(peer.Requested) == 0 {
+			return fail(1, "expect method=%s got=none", tc.Expect.Method)
+		}
+		if got := peer.Requested[len(peer.Requested)-1]; got != want {
+			return fail(1, "expect method=%s got=%s", tc.Expect.Method, methodLabel(got))
+		}
+	}
+	if tc.Expect.BiddingAKAPrime != nil {
+		akaMethod, _ := peer.Methods[eap.TypeAKA].(*aka.Method)
+		status := akaMethod.Bidding()
+		if !status.Challenged {
+			return fail(1, "expect bidding_aka_prime: no verified EAP-AKA challenge")
+		}
+		if status.AKAPrime != *tc.Expect.BiddingAKAPrime {
+			return fail(1, "expect bidding_aka_prime=%t got=%t", *tc.Expect.BiddingAKAPrime, status.AKAPrime)
+		}
+	}
+	if tc.Expect.KDF != 0 {
+		akaPrime, _ := peer.Methods[eap.TypeAKAPrime].(*aka.Method)
+		if got := akaPrime.KDF().Selected; got != tc.Expect.KDF {
+			return fail(1, "expect kdf=%d got=%d", tc.Expect.KDF, got)
+		}
+	}
+	return 0, nil
+}
+
+func radiusAttributes(cfg config.Config) radiusc.Attributes {
+	return radiusc.Attributes{
+		NASIPAddress:     cfg.RadiusAttrs.NASIPAddress,
+		NASIdentifier:    cfg.RadiusAttrs.NASIdentifier,
+		CalledStationID:  cfg.RadiusAttrs.CalledStationID,
+		CallingStationID: cfg.RadiusAttrs.CallingStationID,
+	}
+}
+
+func newClient(cfg config.Config) *radiusc.Client {
+	return radiusc.NewClient(
+		cfg.Radius.ServerAddr,
+		cfg.Radius.Secret,
+		time.Duration(cfg.Radius.TimeoutMS)*time.Millisecond,
+		cfg.Radius.Retries,
+	)
+}
+
+// methodLabel names the EAP method of a response for metrics labels.
+func methodLabel(methodType uint8) string {
+	switch methodType {
+	case eap.TypeIdentity:
+		return "identity"
+	case eap.TypeNak:
+		return "nak"
+	case eap.TypeSIM:
+		return "sim"
+	case eap.TypeAKA:
+		return "aka"
+	case eap.TypeAKAPrime:
+		return "aka_prime"
+	default:
+		return fmt.Sprintf("type_%d", methodType)
+	}
+}
+
+func isSyncFailure(pkt *eap.Packet) bool {
+	return (pkt.Type == eap.TypeAKA || pkt.Type == eap.TypeAKAPrime) &&
+		len(pkt.TypeData) > 0 && pkt.TypeData[0] == eapaka.SubtypeSynchronizationFailure
 }
 
 func buildStore(cfg config.Config, tc testcase.Case) (sqnstore.Store, error) {
@@ -156,6 +330,26 @@ func buildStore(cfg config.Config, tc testcase.Case) (sqnstore.Store, error) {
 	}
 }
 
+// verifyResync checks that a forced AKA-Synchronization-Failure was followed
+// by a fresh challenge before the server accepted.
+func verifyResync(peer *eap.Peer) (int, error) {
+	for _, method := range peer.Methods {
+		akaMethod, ok := method.(*aka.Method)
+		if !ok {
+			continue
+		}
+		status := akaMethod.Resync()
+		if !status.Forced {
+			continue
+		}
+		if !status.Rechallenged {
+			return fail(1, "accept without fresh challenge after forced resync (reported sqn_ms=%012x)", status.ReportedSQN)
+		}
+		return 0, nil
+	}
+	return fail(1, "forced resync was not performed")
+}
+
 func evaluateExpect(tc testcase.Case, resp *radiusc.Response, accepted bool) (int, error) {
 	expectedAccept := tc.Expect.Result == "accept"
 	actual := "reject"
@@ -229,6 +423,10 @@ func buildLogger(tc testcase.Case) *trace.Logger {
 	if tc.Trace.DumpRadiusAttrs != nil {
 		dumpRadius = *tc.Trace.DumpRadiusAttrs
 	}
+	format := trace.FormatText
+	if tc.Trace.Format == "json" {
+		format = trace.FormatJSON
+	}
 	out := os.Stderr
 	if tc.Trace.SavePath != "" {
 		file, err := os.OpenFile(tc.Trace.SavePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
@@ -240,6 +438,8 @@ func buildLogger(tc testcase.Case) *trace.Logger {
 		Level:           level,
 		Out:             out,
 		Unsafe:          tc.Trace.UnsafeLog,
+		Format:          format,
+		CaseName:        tc.Name,
 		DumpEAPHex:      dumpEAPHex,
 		DumpRadiusAttrs: dumpRadius,
 	}
@@ -256,3 +456,42 @@ func wrap(code int, err error, format string, args ...interface{}) (int, error)
 	message := fmt.Sprintf(format, args...)
 	return code, &RunError{Code: code, Err: fmt.Errorf("app: %s: %w", message, err)}
 }
+
+// recordedNonceMT returns the AT_NONCE_MT of the first EAP-SIM Start
+// response in rec, or nil when the recording has none.
+func recordedNonceMT(rec *radiusc.Recording) ([]byte, error) {
+	payloads, err := rec.RequestEAP()
+	if err != nil {
+		return nil, err
+	}
+	for _, payload := range payloads {
+		if nonce, ok := sim.StartNonceMT(payload); ok {
+			return nonce, nil
+		}
+	}
+	return nil, nil
+}
+
+// suciEphemeralKey returns the fixed ECIES key for a recorded or replayed
+// run with a profile A/B SUCI: a new one when recording, the recorded one
+// (from the secrets file) when replaying, and nil otherwise.
+func suciEphemeralKey(merged config.Config, opts RunOptions) ([]byte, error) {
+	scheme, ok := suci.ParseScheme(merged.Identity.SUCI.Scheme)
+	if !ok || scheme == suci.SchemeNull {
+		return nil, nil
+	}
+	if opts.ReplayPath != "" {
+		secrets, err := radiusc.LoadRecordingSecrets(opts.ReplayPath)
+		if err != nil {
+			return nil, fmt.Errorf("app: replaying a SUCI run needs %s: %w", radiusc.SecretsPath(opts.ReplayPath), err)
+		}
+		if secrets.SUCIEphemeralKey == "" {
+			return nil, fmt.Errorf("app: %s has no suci_ephemeral_key", radiusc.SecretsPath(opts.ReplayPath))
+		}
+		return decodeHex("suci_ephemeral_key", secrets.SUCIEphemeralKey, len(secrets.SUCIEphemeralKey)/2)
+	}
+	if opts.RecordPath != "" {
+		return suci.GenerateEphemeralKey(scheme)
+	}
+	return nil, nil
+}
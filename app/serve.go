@@ -0,0 +1,95 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/mockserver"
+	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/suci"
+)
+
+// ServeOptions configures the mock server started by the serve subcommand.
+type ServeOptions struct {
+	IdentityRequest string
+	IssuePseudonyms bool
+	Bidding         bool
+	// KDFs is the AT_KDF offer of AKA' challenges (default [1]).
+	KDFs       []uint16
+	Pseudonyms []string
+	AKAPrime   bool
+	// SIM selects EAP-SIM as the default method; it takes precedence over
+	// AKAPrime.
+	SIM bool
+	// SUCIPrivateKey is the hex home network private key matching
+	// identity.suci; it lets the server resolve ECIES SUCIs.
+	SUCIPrivateKey string
+	Fault          string
+	Logf           func(format string, args ...interface{})
+}
+
+// BuildMockServer creates a mock EAP-SIM/AKA/AKA' server whose single
+// subscriber is derived from the same sim.* settings the client uses.
+func BuildMockServer(cfg config.Config, opts ServeOptions) (*mockserver.Server, error) {
+	sub := mockserver.Subscriber{
+		IMSI:       cfg.SIM.IMSI,
+		Pseudonyms: opts.Pseudonyms,
+	}
+	if cfg.SIM.Algorithm == "comp128v1" {
+		gsm, err := buildGSMAlgorithm(cfg.SIM, nil)
+		if err != nil {
+			return nil, err
+		}
+		sub.GSM = gsm
+	} else {
+		alg, err := buildAlgorithm(cfg.SIM)
+		if err != nil {
+			return nil, err
+		}
+		amf, err := decodeHex("amf", cfg.SIM.AMF, 2)
+		if err != nil {
+			return nil, err
+		}
+		sqn, err := sqnstore.ParseSQNHex(cfg.SIM.SQNInitialHex)
+		if err != nil {
+			return nil, err
+		}
+		sub.Algorithm = alg
+		sub.AMF = amf
+		sub.SQN = sqn
+		sub.IndBits = buildSQNPolicy(cfg.SIM.SQNPolicy).IndBits
+	}
+	var suciKeys []suci.PrivateKey
+	if opts.SUCIPrivateKey != "" {
+		scheme, ok := suci.ParseScheme(cfg.Identity.SUCI.Scheme)
+		if !ok || scheme == suci.SchemeNull {
+			return nil, fmt.Errorf("app: a SUCI private key requires identity.suci.scheme profile_a or profile_b")
+		}
+		key, err := decodeHex("SUCI private key", opts.SUCIPrivateKey, 32)
+		if err != nil {
+			return nil, err
+		}
+		suciKeys = append(suciKeys, suci.PrivateKey{Scheme: scheme, KeyID: uint8(cfg.Identity.SUCI.KeyID), Key: key})
+	}
+	defaultMethod := eap.TypeAKA
+	switch {
+	case opts.SIM:
+		defaultMethod = eap.TypeSIM
+	case opts.AKAPrime:
+		defaultMethod = eap.TypeAKAPrime
+	}
+	return mockserver.New(mockserver.Options{
+		Secret:          cfg.Radius.Secret,
+		Subscribers:     []mockserver.Subscriber{sub},
+		NetName:         cfg.EAP.AKAPrime.NetName,
+		KDFs:            opts.KDFs,
+		DefaultMethod:   defaultMethod,
+		IdentityRequest: opts.IdentityRequest,
+		IssuePseudonyms: opts.IssuePseudonyms,
+		Bidding:         opts.Bidding,
+		SUCIKeys:        suciKeys,
+		Fault:           mockserver.Fault(opts.Fault),
+		Logf:            opts.Logf,
+	})
+}
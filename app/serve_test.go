@@ -0,0 +1,533 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+	"github.com/oyaguma3/eapaka_test/metrics"
+	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/testcase"
+)
+
+// TestRunCaseAgainstMockServer runs the shipped testcases end to end
+// against the built-in mock server.
+func TestRunCaseAgainstMockServer(t *testing.T) {
+	cases := []string{
+		"success_aka.yaml",
+		"success_aka_prime.yaml",
+		"success_sim.yaml",
+		"perm_id_req_from_pseudonym.yaml",
+		"perm_id_req_with_override.yaml",
+		"sqn_forced_resync.yaml",
+	}
+	for _, name := range cases {
+		t.Run(name, func(t *testing.T) {
+			cfg := startMockConfig(t, ServeOptions{})
+			tc, err := testcase.LoadFile("../testdata/cases/" + name)
+			if err != nil {
+				t.Fatalf("load testcase failed: %v", err)
+			}
+			tc.Trace.Level = ""
+			code, err := RunCase(context.Background(), cfg, tc)
+			if err != nil || code != 0 {
+				t.Fatalf("expected pass, got code=%d err=%v", code, err)
+			}
+		})
+	}
+}
+
+func TestRunCaseAgainstMockServerExpectMismatch(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	tc.Expect.Result = "reject"
+	code, err := RunCase(context.Background(), cfg, tc)
+	if code != 1 || err == nil {
+		t.Fatalf("expected exit 1, got code=%d err=%v", code, err)
+	}
+}
+
+// TestRunCaseCOMP128 runs EAP-SIM end to end with a GSM-only comp128v1 SIM
+// on both sides, and checks that the mock server rejects EAP-AKA for it.
+func TestRunCaseCOMP128(t *testing.T) {
+	cfg, err := config.LoadFile("../configs/example.yaml")
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	cfg.SIM = config.SIMConfig{IMSI: cfg.SIM.IMSI, KI: cfg.SIM.KI, Algorithm: "comp128v1"}
+	cfg = startMock(t, cfg, ServeOptions{IssuePseudonyms: true})
+	tc, err := testcase.LoadFile("../testdata/cases/success_sim.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	tc.Trace.Level = ""
+	if code, err := RunCase(context.Background(), cfg, tc); err != nil || code != 0 {
+		t.Fatalf("expected pass, got code=%d err=%v", code, err)
+	}
+
+	tc.Identity = "0" + cfg.SIM.IMSI + "@wlan.mnc010.mcc440.3gppnetwork.org"
+	if code, err := RunCase(context.Background(), cfg, tc); code == 0 || err == nil {
+		t.Fatalf("expected EAP-AKA to fail with a comp128v1 SIM, got code=%d err=%v", code, err)
+	}
+}
+
+// TestRunCaseSUCI sends a SUCI as the outer identity and in answer to a
+// permanent identity request, and lets the mock server resolve it.
+func TestRunCaseSUCI(t *testing.T) {
+	const hnPriv = "f1ab1074477ebcc7f554ea1c5fc368b1616730155e0041ac447d6301975fecda"
+	tests := []struct {
+		name, caseFile, identity string
+		outer                    bool
+	}{
+		{"outer", "success_aka_prime.yaml", "", true},
+		{"permanent_request", "perm_id_req_from_pseudonym.yaml", "7some-pseudonym@example", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := config.LoadFile("../configs/example.yaml")
+			if err != nil {
+				t.Fatalf("load config failed: %v", err)
+			}
+			cfg.Identity.SUCI = config.SUCIConfig{
+				Scheme:               "profile_b",
+				MNC:                  "10",
+				HomeNetworkPublicKey: "0272da71976234ce833a6907425867b82e074d44ef907dfb4b3e21c1c2256ebcd1",
+				KeyID:                1,
+				OuterIdentity:        tt.outer,
+			}
+			cfg = startMock(t, cfg, ServeOptions{SUCIPrivateKey: hnPriv, AKAPrime: true})
+			tc, err := testcase.LoadFile("../testdata/cases/" + tt.caseFile)
+			if err != nil {
+				t.Fatalf("load testcase failed: %v", err)
+			}
+			if tt.identity != "" {
+				tc.Identity = tt.identity
+			}
+			tracePath := filepath.Join(t.TempDir(), "trace.log")
+			tc.Trace = testcase.Trace{Level: "normal", SavePath: tracePath, UnsafeLog: true}
+			if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+				t.Fatalf("expected pass, got code=%d err=%v", code, err)
+			}
+			data, err := os.ReadFile(tracePath)
+			if err != nil {
+				t.Fatalf("read trace failed: %v", err)
+			}
+			if !strings.Contains(string(data), "type0.rid0.schid2.hnkey1.ecckey") {
+				t.Fatalf("expected SUCI in trace, got:\n%s", data)
+			}
+		})
+	}
+}
+
+func startMockConfig(t *testing.T, opts ServeOptions) config.Config {
+	t.Helper()
+	cfg, err := config.LoadFile("../configs/example.yaml")
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	return startMock(t, cfg, opts)
+}
+
+// startMock serves cfg's subscriber and points cfg at the mock server.
+func startMock(t *testing.T, cfg config.Config, opts ServeOptions) config.Config {
+	t.Helper()
+	cfg.SQNStore = config.SQNStoreConfig{Mode: "memory"}
+	server, err := BuildMockServer(cfg, opts)
+	if err != nil {
+		t.Fatalf("build mock server failed: %v", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	cfg.Radius.ServerAddr = conn.LocalAddr().String()
+	return cfg
+}
+
+// TestRunCaseMockFaults locks down the exit code RunCase reports for each
+// mock server fault.
+func TestRunCaseMockFaults(t *testing.T) {
+	tests := []struct {
+		fault    string
+		caseFile string
+		want     int
+	}{
+		{"bad_at_mac", "success_aka.yaml", 1},
+		{"wrong_mac_a", "success_aka.yaml", 1},
+		{"amf_mismatch", "success_aka.yaml", 1},
+		{"kdf_bidding_down", "success_aka_prime.yaml", 1},
+		{"missing_eap_message", "success_aka.yaml", 2},
+		{"drop_state", "success_aka.yaml", 1},
+		{"no_reply", "success_aka.yaml", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fault, func(t *testing.T) {
+			cfg := startMockConfig(t, ServeOptions{Fault: tt.fault})
+			cfg.Radius.TimeoutMS = 100
+			cfg.Radius.Retries = 0
+			tc, err := testcase.LoadFile("../testdata/cases/" + tt.caseFile)
+			if err != nil {
+				t.Fatalf("load testcase failed: %v", err)
+			}
+			code, err := RunCase(context.Background(), cfg, tc)
+			if code != tt.want {
+				t.Fatalf("expected exit %d, got %d (err=%v)", tt.want, code, err)
+			}
+			if err == nil {
+				t.Fatalf("expected error for fault %s", tt.fault)
+			}
+			// The bidding down must be caught at the re-offer, not as a
+			// malformed first offer.
+			var kdfErr *aka.KDFError
+			if tt.fault == "kdf_bidding_down" && (!errors.As(err, &kdfErr) || len(kdfErr.Offer) != 1) {
+				t.Fatalf("expected KDFError for the stripped re-offer, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "run.json")
+	code, err := RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{RecordPath: path})
+	if err != nil || code != 0 {
+		t.Fatalf("record run failed: code=%d err=%v", code, err)
+	}
+	if _, err := os.Stat(radiusc.SecretsPath(path)); err != nil {
+		t.Fatalf("expected secrets file: %v", err)
+	}
+
+	cfg.Radius.ServerAddr = "127.0.0.1:9"
+	code, err = RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{ReplayPath: path})
+	if err != nil || code != 0 {
+		t.Fatalf("replay failed: code=%d err=%v", code, err)
+	}
+
+	tc.Radius.Attrs.CalledStationID = "00-00-00-00-00-00:Other"
+	code, err = RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{ReplayPath: path})
+	if code != 1 || err == nil {
+		t.Fatalf("expected replay mismatch exit 1, got code=%d err=%v", code, err)
+	}
+}
+
+func TestRecordAndReplaySIM(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/success_sim.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "run.json")
+	code, err := RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{RecordPath: path})
+	if err != nil || code != 0 {
+		t.Fatalf("record run failed: code=%d err=%v", code, err)
+	}
+	// A fresh NONCE_MT would change the Start response and the keys.
+	cfg.Radius.ServerAddr = "127.0.0.1:9"
+	code, err = RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{ReplayPath: path})
+	if err != nil || code != 0 {
+		t.Fatalf("replay failed: code=%d err=%v", code, err)
+	}
+}
+
+func TestRecordAndReplaySUCI(t *testing.T) {
+	cfg, err := config.LoadFile("../configs/example.yaml")
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	cfg.Identity.SUCI = config.SUCIConfig{
+		Scheme:               "profile_b",
+		MNC:                  "10",
+		HomeNetworkPublicKey: "0272da71976234ce833a6907425867b82e074d44ef907dfb4b3e21c1c2256ebcd1",
+		KeyID:                1,
+		OuterIdentity:        true,
+	}
+	cfg = startMock(t, cfg, ServeOptions{SUCIPrivateKey: "f1ab1074477ebcc7f554ea1c5fc368b1616730155e0041ac447d6301975fecda", AKAPrime: true})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka_prime.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "run.json")
+	code, err := RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{RecordPath: path})
+	if err != nil || code != 0 {
+		t.Fatalf("record run failed: code=%d err=%v", code, err)
+	}
+	// The ephemeral key reveals the IMSI and stays out of the recording.
+	if data, _ := os.ReadFile(path); strings.Contains(string(data), "ephemeral") {
+		t.Fatalf("recording must not hold the ephemeral key")
+	}
+	cfg.Radius.ServerAddr = "127.0.0.1:9"
+	code, err = RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{ReplayPath: path})
+	if err != nil || code != 0 {
+		t.Fatalf("replay failed: code=%d err=%v", code, err)
+	}
+
+	if err := os.Remove(radiusc.SecretsPath(path)); err != nil {
+		t.Fatalf("remove secrets failed: %v", err)
+	}
+	if code, _ := RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{ReplayPath: path}); code != 2 {
+		t.Fatalf("expected exit 2 without the secrets file, got %d", code)
+	}
+}
+
+func TestRunCaseWritesPcap(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	tc.Trace.PcapPath = filepath.Join(t.TempDir(), "run.pcapng")
+	code, err := RunCase(context.Background(), cfg, tc)
+	if err != nil || code != 0 {
+		t.Fatalf("run failed: code=%d err=%v", code, err)
+	}
+	data, err := os.ReadFile(tc.Trace.PcapPath)
+	if err != nil {
+		t.Fatalf("read pcap failed: %v", err)
+	}
+	if len(data) < 4 || binary.LittleEndian.Uint32(data[0:4]) != 0x0a0d0d0a {
+		t.Fatalf("expected pcapng section header")
+	}
+	if bytes.Contains(data, []byte(cfg.Radius.Secret)) {
+		t.Fatalf("secret must not be written without pcap_secret_comment")
+	}
+}
+
+func TestRunCaseMetrics(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	m := metrics.New()
+	code, err := RunCaseWithOptions(context.Background(), cfg, tc, RunOptions{Metrics: m})
+	if err != nil || code != 0 {
+		t.Fatalf("run failed: code=%d err=%v", code, err)
+	}
+	buf := &bytes.Buffer{}
+	m.WriteTo(buf)
+	server := cfg.Radius.ServerAddr
+	for _, want := range []string{
+		fmt.Sprintf(`eapaka_access_requests_total{server="%s"} 2`, server),
+		fmt.Sprintf(`eapaka_access_challenges_total{server="%s"} 1`, server),
+		fmt.Sprintf(`eapaka_access_accepts_total{server="%s"} 1`, server),
+		fmt.Sprintf(`eapaka_round_duration_seconds_count{server="%s",method="identity",round="1"} 1`, server),
+		fmt.Sprintf(`eapaka_round_duration_seconds_count{server="%s",method="aka",round="2"} 1`, server),
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("expected %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRunCaseMutations(t *testing.T) {
+	truncate := 4
+	tests := []struct {
+		name      string
+		mutations []testcase.Mutation
+		result    string
+		want      int
+	}{
+		{"corrupt_res", []testcase.Mutation{{Layer: "eap", Round: 2, Action: "modify", Offset: 12, SetHex: "ffff"}}, "reject", 0},
+		{"short_eap", []testcase.Mutation{{Layer: "eap", Round: 2, Action: "modify", Truncate: &truncate}}, "reject", 0},
+		{"drop_eap", []testcase.Mutation{{Layer: "eap", Round: 2, Action: "drop"}}, "accept", 2},
+		{"delay_radius", []testcase.Mutation{{Layer: "radius", Action: "delay", DelayMS: 1}}, "accept", 0},
+		{"remove_calling_station", []testcase.Mutation{{Layer: "radius", Round: 1, Action: "modify", Attribute: 31, Remove: true}}, "accept", 0},
+		{"duplicate_radius", []testcase.Mutation{{Layer: "radius", Round: 1, Action: "duplicate"}}, "accept", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := startMockConfig(t, ServeOptions{})
+			cfg.Radius.TimeoutMS = 200
+			cfg.Radius.Retries = 0
+			tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+			if err != nil {
+				t.Fatalf("load testcase failed: %v", err)
+			}
+			tc.Trace.Level = ""
+			tc.Expect.Result = tt.result
+			if tt.result == "reject" {
+				tc.Expect.MPPE = testcase.MPPE{}
+			}
+			tc.Mutations = tt.mutations
+			if err := tc.Validate(); err != nil {
+				t.Fatalf("validate failed: %v", err)
+			}
+			code, err := RunCase(context.Background(), cfg, tc)
+			if code != tt.want {
+				t.Fatalf("expected exit %d, got %d (err=%v)", tt.want, code, err)
+			}
+		})
+	}
+}
+
+func TestRunCaseExpectedMethod(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/mismatch_strict_fail.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	code, err := RunCase(context.Background(), cfg, tc)
+	var mismatch *eap.MethodMismatchError
+	if code != 1 || !errors.As(err, &mismatch) {
+		t.Fatalf("expected method mismatch exit 1, got code=%d err=%v", code, err)
+	}
+
+	tracePath := filepath.Join(t.TempDir(), "trace.log")
+	tc.EAP.MethodMismatchPolicy = "warn"
+	tc.Expect = testcase.Expect{Result: "accept"}
+	tc.Trace.SavePath = tracePath
+	if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+		t.Fatalf("expected pass with warn policy, got code=%d err=%v", code, err)
+	}
+	data, err := os.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("read trace failed: %v", err)
+	}
+	if !strings.Contains(string(data), "method mismatch expected=50 received=23") {
+		t.Fatalf("expected mismatch warning in trace, got:\n%s", data)
+	}
+}
+
+func TestRunCaseAllowedMethodsNak(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/nak_to_aka_prime.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	tracePath := filepath.Join(t.TempDir(), "trace.log")
+	tc.Trace.SavePath = tracePath
+	if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+		t.Fatalf("expected pass after nak, got code=%d err=%v", code, err)
+	}
+	data, err := os.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("read trace failed: %v", err)
+	}
+	if !strings.Contains(string(data), "response=nak nak=aka'") {
+		t.Fatalf("expected nak in trace, got:\n%s", data)
+	}
+
+	noNak := false
+	tc.Expect.NakSent = &noNak
+	if code, _ := RunCase(context.Background(), cfg, tc); code != 1 {
+		t.Fatalf("expected nak_sent=false to fail, got code=%d", code)
+	}
+}
+
+func TestRunCaseBidding(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{Bidding: true})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	if code, _ := RunCase(context.Background(), cfg, tc); code != 1 {
+		t.Fatalf("expected bidding down to be refused, got code=%d", code)
+	}
+
+	offered := true
+	tc.EAP.BiddingPolicy = "ignore"
+	tc.Expect.BiddingAKAPrime = &offered
+	if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+		t.Fatalf("expected pass with bidding_policy ignore, got code=%d err=%v", code, err)
+	}
+
+	tc.EAP.BiddingPolicy = ""
+	tc.EAP.AllowedMethods = []string{"aka"}
+	if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+		t.Fatalf("expected pass for AKA-only peer, got code=%d err=%v", code, err)
+	}
+
+	plain := startMockConfig(t, ServeOptions{})
+	if code, _ := RunCase(context.Background(), plain, tc); code != 1 {
+		t.Fatalf("expected missing AT_BIDDING to fail expectation, got code=%d", code)
+	}
+}
+
+func TestRunCaseKDFNegotiation(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{KDFs: []uint16{2, 1}})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka_prime.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	tc.Expect.KDF = 1
+	if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+		t.Fatalf("expected negotiation down to KDF 1, got code=%d err=%v", code, err)
+	}
+
+	// A peer that only lists an unoffered KDF finds no common value.
+	tc.EAP.AKAPrime.KDFs = []uint16{3}
+	tc.Expect = testcase.Expect{Result: "accept"}
+	var kdfErr *aka.KDFError
+	if code, err := RunCase(context.Background(), cfg, tc); code != 1 || !errors.As(err, &kdfErr) {
+		t.Fatalf("expected kdf negotiation failure, got code=%d err=%v", code, err)
+	}
+}
+
+func TestRunCase5GNetworkName(t *testing.T) {
+	cfg, err := config.LoadFile("../configs/example.yaml")
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	cfg.EAP.AKAPrime.NetName = "5G:mnc010.mcc440.3gppnetwork.org"
+	cfg = startMock(t, cfg, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/aka_prime_5g_net_name.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+		t.Fatalf("expected 5G AKA' accept, got code=%d err=%v", code, err)
+	}
+}
+
+func TestRunCaseNetNameCheck(t *testing.T) {
+	cfg := startMockConfig(t, ServeOptions{})
+	tc, err := testcase.LoadFile("../testdata/cases/success_aka_prime.yaml")
+	if err != nil {
+		t.Fatalf("load testcase failed: %v", err)
+	}
+	// The mock sends the config name; the testcase claims another network.
+	tc.EAP.AKAPrime.NetName = "wlan.mnc020.mcc440.3gppnetwork.org"
+	tc.EAP.AKAPrime.NetNameCheck = "strict"
+	var mismatch *aka.NetNameMismatchError
+	if code, err := RunCase(context.Background(), cfg, tc); code != 1 || !errors.As(err, &mismatch) {
+		t.Fatalf("expected net_name mismatch exit 1, got code=%d err=%v", code, err)
+	}
+
+	tracePath := filepath.Join(t.TempDir(), "trace.log")
+	tc.EAP.AKAPrime.NetNameCheck = "warn"
+	tc.Trace.SavePath = tracePath
+	if code, err := RunCase(context.Background(), cfg, tc); code != 0 {
+		t.Fatalf("expected pass with warn, got code=%d err=%v", code, err)
+	}
+	data, err := os.ReadFile(tracePath)
+	if err != nil {
+		t.Fatalf("read trace failed: %v", err)
+	}
+	if !strings.Contains(string(data), "net_name mismatch") {
+		t.Fatalf("expected net_name warning in trace, got:\n%s", data)
+	}
+}
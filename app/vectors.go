@@ -0,0 +1,59 @@
+package app
+
+import (
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+)
+
+// VectorsOptions holds inputs of the vectors subcommand.
+type VectorsOptions struct {
+	RAND     string
+	AUTN     string
+	Identity string
+	// Method is aka or aka_prime; empty selects by identity prefix
+	// (6/7/8 for AKA'). EAP-SIM (sim or a 1/3/5 prefix) is rejected.
+	Method  string
+	NetName string
+}
+
+// ComputeVectors derives the AKA/AKA' vectors for a RAND/AUTN with the
+// sim.* settings of cfg.
+func ComputeVectors(cfg config.Config, opts VectorsOptions) (*aka.Vectors, error) {
+	methodType := uint8(eap.TypeAKA)
+	if opts.Method == "" {
+		if method, ok := eap.MethodForIdentity(opts.Identity); ok {
+			methodType = method
+		}
+	} else if method, ok := eap.ParseMethodName(opts.Method); ok {
+		methodType = method
+	} else {
+		return nil, fmt.Errorf("app: method must be aka or aka_prime")
+	}
+	alg, err := buildAlgorithm(cfg.SIM)
+	if err != nil {
+		return nil, err
+	}
+	rand, err := decodeHex("rand", opts.RAND, 16)
+	if err != nil {
+		return nil, err
+	}
+	autn, err := decodeHex("autn", opts.AUTN, 16)
+	if err != nil {
+		return nil, err
+	}
+	netName := opts.NetName
+	if netName == "" {
+		netName = cfg.EAP.AKAPrime.NetName
+	}
+	return aka.ComputeVectors(alg, aka.VectorInput{
+		MethodType: methodType,
+		RAND:       rand,
+		AUTN:       autn,
+		Identity:   opts.Identity,
+		NetName:    netName,
+		IMSI:       cfg.SIM.IMSI,
+	})
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/oyaguma3/eapaka_test/app"
 	"github.com/oyaguma3/eapaka_test/config"
+	"github.com/oyaguma3/eapaka_test/metrics"
 	"github.com/oyaguma3/eapaka_test/testcase"
 )
 
@@ -16,29 +21,51 @@ func main() {
 	var unsafeLog bool
 	var dumpEAPHex bool
 	var dumpRadiusAttrs bool
+	var recordPath string
+	var replayPath string
+	var pcapPath string
+	var metricsListen string
+	var repeat int
 	flag.StringVar(&cfgPath, "c", "", "config file path")
 	flag.BoolVar(&unsafeLog, "unsafe-log", false, "output sensitive EAP data in trace")
 	flag.BoolVar(&dumpEAPHex, "trace-eap-hex", false, "dump EAP hex in verbose trace")
 	flag.BoolVar(&dumpRadiusAttrs, "trace-radius-attrs", false, "dump RADIUS attrs in verbose trace")
+	flag.StringVar(&recordPath, "record", "", "save the RADIUS conversation to a file (secret stored in <file>.secrets.json)")
+	flag.StringVar(&replayPath, "replay", "", "answer requests from a recording instead of the server")
+	flag.StringVar(&pcapPath, "pcap", "", "write the RADIUS exchange as a pcapng file")
+	flag.StringVar(&metricsListen, "metrics-listen", "", "serve Prometheus metrics on this address at /metrics")
+	flag.IntVar(&repeat, "repeat", 1, "run the testcase this many times (0 = until interrupted)")
 	flag.Parse()
 
 	args := flag.Args()
-	if len(args) < 2 || args[0] != "run" {
+	if len(args) < 1 || ((args[0] == "run" || args[0] == "fuzz") && len(args) < 2) || (args[0] != "run" && args[0] != "serve" && args[0] != "decode" && args[0] != "vectors" && args[0] != "fuzz") {
 		usage()
 		os.Exit(2)
 	}
+	if args[0] == "decode" {
+		os.Exit(decode(cfgPath, unsafeLog, args[1:]))
+	}
 	if cfgPath == "" {
 		fmt.Fprintln(os.Stderr, "config path is required")
 		usage()
 		os.Exit(2)
 	}
-	casePath := args[1]
 
 	cfg, err := config.LoadFile(cfgPath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(2)
 	}
+	if args[0] == "serve" {
+		os.Exit(serve(cfg, args[1:]))
+	}
+	if args[0] == "vectors" {
+		os.Exit(vectors(cfg, args[1:]))
+	}
+	if args[0] == "fuzz" {
+		os.Exit(fuzz(cfg, args[1:]))
+	}
+	casePath := args[1]
 	caseData, err := testcase.LoadFile(casePath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -55,18 +82,202 @@ func main() {
 		value := true
 		caseData.Trace.DumpRadiusAttrs = &value
 	}
+	if pcapPath != "" {
+		caseData.Trace.PcapPath = pcapPath
+	}
+
+	opts := app.RunOptions{
+		RecordPath: recordPath,
+		ReplayPath: replayPath,
+	}
+	if metricsListen != "" {
+		opts.Metrics = metrics.New()
+		go func() {
+			if err := opts.Metrics.ListenAndServe(metricsListen); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+		}()
+	}
+
+	worst := 0
+	for i := 0; repeat <= 0 || i < repeat; i++ {
+		exitCode, err := app.RunCaseWithOptions(context.Background(), cfg, caseData, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if exitCode == 0 {
+				exitCode = 2
+			}
+		}
+		if exitCode > worst {
+			worst = exitCode
+		}
+	}
+	os.Exit(worst)
+}
+
+func serve(cfg config.Config, args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listen := fs.String("listen", cfg.Radius.ServerAddr, "UDP address to listen on")
+	identityRequest := fs.String("identity-request", "none", "AKA-Identity (or SIM/Start) identity request before challenge: none|any|fullauth|permanent")
+	pseudonyms := fs.String("pseudonyms", "", "comma-separated pseudonyms accepted for the subscriber")
+	issuePseudonyms := fs.Bool("issue-pseudonyms", false, "send AT_NEXT_PSEUDONYM in challenges")
+	kdfs := fs.String("kdfs", "", "comma-separated AT_KDF offer for EAP-AKA' challenges (default 1)")
+	bidding := fs.Bool("bidding", false, "send AT_BIDDING (AKA' supported) in EAP-AKA challenges")
+	akaPrime := fs.Bool("aka-prime", false, "use EAP-AKA' when the identity prefix does not select a method")
+	simMethod := fs.Bool("sim", false, "use EAP-SIM when the identity prefix does not select a method")
+	suciKey := fs.String("suci-private-key", "", "home network private key (hex) for the identity.suci ECIES profile")
+	fault := fs.String("fault", "", "inject a fault: bad_at_mac|wrong_mac_a|amf_mismatch|kdf_bidding_down|missing_eap_message|drop_state|no_reply|accept_any|wedge_on_malformed")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var pseudonymList []string
+	for _, p := range strings.Split(*pseudonyms, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			pseudonymList = append(pseudonymList, p)
+		}
+	}
+	var kdfList []uint16
+	for _, v := range strings.Split(*kdfs, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -kdfs value %q\n", v)
+			return 2
+		}
+		kdfList = append(kdfList, uint16(n))
+	}
+	logger := log.New(os.Stderr, "serve ", log.LstdFlags)
+	server, err := app.BuildMockServer(cfg, app.ServeOptions{
+		IdentityRequest: *identityRequest,
+		IssuePseudonyms: *issuePseudonyms,
+		Bidding:         *bidding,
+		KDFs:            kdfList,
+		Pseudonyms:      pseudonymList,
+		AKAPrime:        *akaPrime,
+		SIM:             *simMethod,
+		SUCIPrivateKey:  *suciKey,
+		Fault:           *fault,
+		Logf:            logger.Printf,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	logger.Printf("listening on %s", *listen)
+	if err := server.ListenAndServe(*listen); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	return 0
+}
 
-	exitCode, err := app.RunCase(context.Background(), cfg, caseData)
+func decode(cfgPath string, unsafeLog bool, args []string) int {
+	fs := flag.NewFlagSet("decode", flag.ContinueOnError)
+	opts := app.DecodeOptions{Unsafe: unsafeLog}
+	fs.StringVar(&opts.EAPHex, "eap", "", "EAP packet hex (eap_hex= trace lines are accepted)")
+	fs.StringVar(&opts.RadiusHex, "radius", "", "RADIUS packet hex")
+	fs.StringVar(&opts.Secret, "secret", "", "RADIUS shared secret (required with -radius)")
+	fs.StringVar(&opts.RequestAuthenticator, "request-authenticator", "", "Access-Request authenticator hex to decrypt MPPE keys (with -unsafe-log)")
+	fs.StringVar(&opts.Identity, "identity", "", "verify AT_MAC with the sim.* keys of -c and this identity")
+	fs.StringVar(&opts.RAND, "rand", "", "RAND hex for AT_MAC verification when the packet has no AT_RAND")
+	fs.StringVar(&opts.AUTN, "autn", "", "AUTN hex for AKA' AT_MAC verification when the packet has no AT_AUTN")
+	fs.StringVar(&opts.NetName, "net-name", "", "network name for AKA' AT_MAC verification")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	var cfg *config.Config
+	if cfgPath != "" {
+		loaded, err := config.LoadFile(cfgPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		cfg = &loaded
+	}
+	code, err := app.Decode(cfg, opts, os.Stdout)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		if exitCode == 0 {
-			exitCode = 2
+		if code == 0 {
+			code = 2
 		}
 	}
-	os.Exit(exitCode)
+	return code
+}
+
+func vectors(cfg config.Config, args []string) int {
+	fs := flag.NewFlagSet("vectors", flag.ContinueOnError)
+	opts := app.VectorsOptions{}
+	fs.StringVar(&opts.RAND, "rand", "", "RAND hex (16 bytes)")
+	fs.StringVar(&opts.AUTN, "autn", "", "AUTN hex (16 bytes)")
+	fs.StringVar(&opts.Identity, "identity", "", "EAP identity used for key derivation")
+	fs.StringVar(&opts.Method, "method", "", "aka|aka_prime (default: by identity prefix)")
+	fs.StringVar(&opts.NetName, "net-name", "", "AKA' network name (default eap.aka_prime.net_name)")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	v, err := app.ComputeVectors(cfg, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Println(string(data))
+	if !v.MACAValid {
+		fmt.Fprintln(os.Stderr, "MAC-A mismatch")
+		return 1
+	}
+	return 0
+}
+
+func fuzz(cfg config.Config, args []string) int {
+	fs := flag.NewFlagSet("fuzz", flag.ContinueOnError)
+	outDir := fs.String("out", "fuzz-findings", "directory for reproducer testcases")
+	maxMutants := fs.Int("max", 0, "run at most this many mutants (0 = all)")
+	verbose := fs.Bool("v", false, "print one line per mutant")
+	timeout := fs.Duration("timeout", 0, "limit per mutant session (default: radius.timeout_ms x (retries+1) per round)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: fuzz [-out dir] [-max n] [-timeout d] [-v] <testcase>")
+		return 2
+	}
+	caseData, err := testcase.LoadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	opts := app.FuzzOptions{OutDir: *outDir, Max: *maxMutants, Timeout: *timeout}
+	if *verbose {
+		opts.Logf = log.New(os.Stderr, "fuzz ", log.LstdFlags).Printf
+	}
+	report, err := app.Fuzz(context.Background(), cfg, caseData, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Printf("mutants=%d replies=%d findings=%d\n", report.Mutants, report.Replies, len(report.Findings))
+	for _, f := range report.Findings {
+		fmt.Printf("%s %s round=%d count=%d reproducer=%s\n", f.Kind, f.Category, f.Round, f.Count, f.Path)
+	}
+	if report.Aborted {
+		fmt.Fprintln(os.Stderr, "server stopped responding; fuzzing aborted")
+	}
+	if len(report.Findings) > 0 {
+		return 1
+	}
+	return 0
 }
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "Usage: eapaka_test -c <config> run <testcase>")
+	fmt.Fprintln(os.Stderr, "       eapaka_test [-c <config>] [-unsafe-log] decode (-eap <hex> | -radius <hex> -secret <secret>) [-identity id]")
+	fmt.Fprintln(os.Stderr, "       eapaka_test -c <config> vectors -rand <hex> -autn <hex> -identity <id> [-method aka|aka_prime] [-net-name name]")
+	fmt.Fprintln(os.Stderr, "       eapaka_test -c <config> fuzz [-out dir] [-max n] [-timeout d] [-v] <testcase>")
+	fmt.Fprintln(os.Stderr, "       eapaka_test -c <config> serve [-listen addr] [-identity-request mode] [-pseudonyms list] [-issue-pseudonyms] [-bidding] [-kdfs list] [-aka-prime] [-sim] [-suci-private-key hex] [-fault name]")
 	flag.PrintDefaults()
 }
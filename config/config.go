@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"strings"
+
+	"github.com/oyaguma3/eapaka_test/sqnstore"
 )
 
 // Config represents the tool configuration loaded from YAML.
@@ -30,26 +32,110 @@ type RadiusAttrs struct {
 }
 
 type EAPConfig struct {
-	MethodMismatchPolicy              string         `yaml:"method_mismatch_policy"`
-	OuterIdentityUpdateOnPermanentReq *bool          `yaml:"outer_identity_update_on_permanent_req"`
-	PermanentIDPolicy                 string         `yaml:"permanent_id_policy"`
-	AKAPrime                          AKAPrimeConfig `yaml:"aka_prime"`
+	// ExpectedMethod is sim, aka or aka_prime; empty derives it from the
+	// identity prefix.
+	ExpectedMethod string `yaml:"expected_method"`
+	// AllowedMethods lists sim/aka/aka_prime in order of preference; other
+	// methods are answered with EAP-Nak. Empty accepts all of them.
+	AllowedMethods                    []string `yaml:"allowed_methods"`
+	MethodMismatchPolicy              string   `yaml:"method_mismatch_policy"`
+	OuterIdentityUpdateOnPermanentReq *bool    `yaml:"outer_identity_update_on_permanent_req"`
+	PermanentIDPolicy                 string   `yaml:"permanent_id_policy"`
+	// BiddingPolicy is enforce or ignore; enforce refuses an EAP-AKA
+	// challenge whose AT_BIDDING offers AKA' while AKA' is allowed.
+	BiddingPolicy string         `yaml:"bidding_policy"`
+	AKAPrime      AKAPrimeConfig `yaml:"aka_prime"`
 }
 
 type AKAPrimeConfig struct {
 	NetName string `yaml:"net_name"`
+	// KDFs lists supported AT_KDF values in order of preference
+	// (default [1]).
+	KDFs []uint16 `yaml:"kdfs"`
+	// NetNameCheck compares AT_KDF_INPUT with NetName: strict, warn or off.
+	NetNameCheck string `yaml:"net_name_check"`
 }
 
 type IdentityConfig struct {
-	Realm string `yaml:"realm"`
+	Realm string     `yaml:"realm"`
+	SUCI  SUCIConfig `yaml:"suci"`
+}
+
+// SUCIConfig conceals the AKA' permanent identity as a SUCI (TS 33.501
+// Section 6.12). An empty Scheme disables it.
+type SUCIConfig struct {
+	// Scheme is null, profile_a or profile_b.
+	Scheme string `yaml:"scheme"`
+	// MNC has 2 or 3 digits and splits sim.imsi into PLMN and MSIN.
+	MNC              string `yaml:"mnc"`
+	RoutingIndicator string `yaml:"routing_indicator"`
+	// HomeNetworkPublicKey is hex: 32 bytes for profile_a, 33 or 65 bytes
+	// for profile_b.
+	HomeNetworkPublicKey string `yaml:"home_network_public_key"`
+	KeyID                int    `yaml:"key_id"`
+	// OuterIdentity sends the SUCI in EAP-Response/Identity instead of the
+	// testcase identity.
+	OuterIdentity bool `yaml:"outer_identity"`
 }
 
 type SIMConfig struct {
-	IMSI          string `yaml:"imsi"`
-	KI            string `yaml:"ki"`
-	OPC           string `yaml:"opc"`
-	AMF           string `yaml:"amf"`
-	SQNInitialHex string `yaml:"sqn_initial_hex"`
+	IMSI          string          `yaml:"imsi"`
+	Algorithm     string          `yaml:"algorithm"`
+	KI            string          `yaml:"ki"`
+	OP            string          `yaml:"op"`
+	OPC           string          `yaml:"opc"`
+	Milenage      MilenageConfig  `yaml:"milenage"`
+	TUAK          TUAKConfig      `yaml:"tuak"`
+	XOR           XORConfig       `yaml:"xor"`
+	AMF           string          `yaml:"amf"`
+	SQNInitialHex string          `yaml:"sqn_initial_hex"`
+	SQNPolicy     SQNPolicyConfig `yaml:"sqn_policy"`
+}
+
+// MilenageConfig overrides the TS 35.206 rotations (bits) and constants;
+// unset entries keep the specified defaults.
+type MilenageConfig struct {
+	R1 *int   `yaml:"r1"`
+	R2 *int   `yaml:"r2"`
+	R3 *int   `yaml:"r3"`
+	R4 *int   `yaml:"r4"`
+	R5 *int   `yaml:"r5"`
+	C1 string `yaml:"c1"`
+	C2 string `yaml:"c2"`
+	C3 string `yaml:"c3"`
+	C4 string `yaml:"c4"`
+	C5 string `yaml:"c5"`
+}
+
+// Rotations returns r1..r5 in order.
+func (m MilenageConfig) Rotations() [5]*int {
+	return [5]*int{m.R1, m.R2, m.R3, m.R4, m.R5}
+}
+
+// Constants returns c1..c5 in order.
+func (m MilenageConfig) Constants() [5]string {
+	return [5]string{m.C1, m.C2, m.C3, m.C4, m.C5}
+}
+
+// TUAKConfig holds TS 35.231 parameters; exactly one of TOP/TOPc is required.
+type TUAKConfig struct {
+	TOP        string `yaml:"top"`
+	TOPc       string `yaml:"topc"`
+	Iterations int    `yaml:"iterations"`
+	RESBits    int    `yaml:"res_bits"`
+}
+
+// XORConfig holds parameters of the TS 34.108 test algorithm.
+type XORConfig struct {
+	RESBits int `yaml:"res_bits"`
+}
+
+// SQNPolicyConfig configures the USIM freshness check (TS 33.102 Annex C).
+type SQNPolicyConfig struct {
+	IndBits    *int   `yaml:"ind_bits"`
+	Delta      uint64 `yaml:"delta"`
+	L          uint64 `yaml:"l"`
+	WrapAround bool   `yaml:"wrap_around"`
 }
 
 type SQNStoreConfig struct {
@@ -62,6 +148,13 @@ const (
 	DefaultRetries              = 3
 	DefaultMethodMismatchPolicy = "warn"
 	DefaultPermanentIDPolicy    = "always"
+	DefaultBiddingPolicy        = "enforce"
+	DefaultNetNameCheck         = "warn"
+	DefaultSQNIndBits           = sqnstore.IndBits
+	DefaultSIMAlgorithm         = "milenage"
+	DefaultTUAKIterations       = 1
+	DefaultTUAKRESBits          = 64
+	DefaultXORRESBits           = 64
 )
 
 // ApplyDefaults sets defaults for optional config fields.
@@ -78,10 +171,34 @@ func (c *Config) ApplyDefaults() {
 	if c.EAP.PermanentIDPolicy == "" {
 		c.EAP.PermanentIDPolicy = DefaultPermanentIDPolicy
 	}
+	if c.EAP.BiddingPolicy == "" {
+		c.EAP.BiddingPolicy = DefaultBiddingPolicy
+	}
+	if c.EAP.AKAPrime.NetNameCheck == "" {
+		c.EAP.AKAPrime.NetNameCheck = DefaultNetNameCheck
+	}
 	if c.EAP.OuterIdentityUpdateOnPermanentReq == nil {
 		value := true
 		c.EAP.OuterIdentityUpdateOnPermanentReq = &value
 	}
+	if c.SIM.Algorithm == "" {
+		c.SIM.Algorithm = DefaultSIMAlgorithm
+	}
+	if c.SIM.Algorithm == "xor" && c.SIM.XOR.RESBits == 0 {
+		c.SIM.XOR.RESBits = DefaultXORRESBits
+	}
+	if c.SIM.Algorithm == "tuak" {
+		if c.SIM.TUAK.Iterations == 0 {
+			c.SIM.TUAK.Iterations = DefaultTUAKIterations
+		}
+		if c.SIM.TUAK.RESBits == 0 {
+			c.SIM.TUAK.RESBits = DefaultTUAKRESBits
+		}
+	}
+	if c.SIM.SQNPolicy.IndBits == nil {
+		value := DefaultSQNIndBits
+		c.SIM.SQNPolicy.IndBits = &value
+	}
 	if c.SQNStore.Mode == "" {
 		c.SQNStore.Mode = "file"
 	}
@@ -98,16 +215,19 @@ func (c Config) Validate() error {
 	if strings.TrimSpace(c.SIM.IMSI) == "" {
 		return fmt.Errorf("config: sim.imsi is required")
 	}
-	if err := validateHexLen("config: sim.ki", c.SIM.KI, 32); err != nil {
-		return err
-	}
-	if err := validateHexLen("config: sim.opc", c.SIM.OPC, 32); err != nil {
+	if err := c.SIM.validateAlgorithm(); err != nil {
 		return err
 	}
-	if err := validateHexLen("config: sim.amf", c.SIM.AMF, 4); err != nil {
-		return err
+	// A GSM-only SIM has no AKA parameters.
+	if c.SIM.Algorithm != "comp128v1" {
+		if err := validateHexLen("config: sim.amf", c.SIM.AMF, 4); err != nil {
+			return err
+		}
+		if err := validateHexLen("config: sim.sqn_initial_hex", c.SIM.SQNInitialHex, 12); err != nil {
+			return err
+		}
 	}
-	if err := validateHexLen("config: sim.sqn_initial_hex", c.SIM.SQNInitialHex, 12); err != nil {
+	if err := c.SIM.SQNPolicy.validate(); err != nil {
 		return err
 	}
 	switch c.SQNStore.Mode {
@@ -118,12 +238,191 @@ func (c Config) Validate() error {
 	if c.SQNStore.Mode == "file" && strings.TrimSpace(c.SQNStore.Path) == "" {
 		return fmt.Errorf("config: sqn_store.path is required for file mode")
 	}
+	if err := c.Identity.SUCI.validate(c.SIM.IMSI); err != nil {
+		return err
+	}
+	if c.EAP.ExpectedMethod != "" && !isOneOf(c.EAP.ExpectedMethod, "sim", "aka", "aka_prime") {
+		return fmt.Errorf("config: eap.expected_method must be sim, aka, or aka_prime")
+	}
+	if err := validateMethodList("config: eap.allowed_methods", c.EAP.AllowedMethods); err != nil {
+		return err
+	}
+	if !isOneOf(c.EAP.AKAPrime.NetNameCheck, "strict", "warn", "off") {
+		return fmt.Errorf("config: eap.aka_prime.net_name_check must be strict, warn, or off")
+	}
+	if err := validateKDFs(c.EAP.AKAPrime.KDFs); err != nil {
+		return fmt.Errorf("config: eap.aka_prime.kdfs %w", err)
+	}
 	if !isOneOf(c.EAP.MethodMismatchPolicy, "strict", "warn", "allow") {
 		return fmt.Errorf("config: eap.method_mismatch_policy must be strict, warn, or allow")
 	}
 	if !isOneOf(c.EAP.PermanentIDPolicy, "always", "conservative", "deny") {
 		return fmt.Errorf("config: eap.permanent_id_policy must be always, conservative, or deny")
 	}
+	if !isOneOf(c.EAP.BiddingPolicy, "enforce", "ignore") {
+		return fmt.Errorf("config: eap.bidding_policy must be enforce or ignore")
+	}
+	return nil
+}
+
+// validateKDFs checks an AT_KDF preference list: no reserved value 0 and
+// no duplicates. An empty list selects the default.
+func validateKDFs(kdfs []uint16) error {
+	seen := make(map[uint16]bool)
+	for _, v := range kdfs {
+		if v == 0 {
+			return fmt.Errorf("must not include reserved value 0")
+		}
+		if seen[v] {
+			return fmt.Errorf("has duplicate %d", v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+func validateMethodList(name string, methods []string) error {
+	seen := make(map[string]bool)
+	for _, m := range methods {
+		if !isOneOf(m, "sim", "aka", "aka_prime") {
+			return fmt.Errorf("%s entries must be sim, aka, or aka_prime", name)
+		}
+		if seen[m] {
+			return fmt.Errorf("%s has duplicate %q", name, m)
+		}
+		seen[m] = true
+	}
+	return nil
+}
+
+func (s SIMConfig) validateAlgorithm() error {
+	switch s.Algorithm {
+	case "milenage":
+		if err := validateHexLen("config: sim.ki", s.KI, 32); err != nil {
+			return err
+		}
+		hasOP := strings.TrimSpace(s.OP) != ""
+		hasOPc := strings.TrimSpace(s.OPC) != ""
+		if hasOP == hasOPc {
+			return fmt.Errorf("config: exactly one of sim.op or sim.opc is required")
+		}
+		if hasOP {
+			if err := validateHexLen("config: sim.op", s.OP, 32); err != nil {
+				return err
+			}
+		} else if err := validateHexLen("config: sim.opc", s.OPC, 32); err != nil {
+			return err
+		}
+		return s.Milenage.validate()
+	case "tuak":
+		if len(strings.TrimSpace(s.KI)) == 64 {
+			if err := validateHexLen("config: sim.ki", s.KI, 64); err != nil {
+				return err
+			}
+		} else if err := validateHexLen("config: sim.ki", s.KI, 32); err != nil {
+			return err
+		}
+		hasTOP := strings.TrimSpace(s.TUAK.TOP) != ""
+		hasTOPc := strings.TrimSpace(s.TUAK.TOPc) != ""
+		if hasTOP == hasTOPc {
+			return fmt.Errorf("config: exactly one of sim.tuak.top or sim.tuak.topc is required")
+		}
+		if hasTOP {
+			if err := validateHexLen("config: sim.tuak.top", s.TUAK.TOP, 64); err != nil {
+				return err
+			}
+		} else if err := validateHexLen("config: sim.tuak.topc", s.TUAK.TOPc, 64); err != nil {
+			return err
+		}
+		if s.TUAK.Iterations < 1 {
+			return fmt.Errorf("config: sim.tuak.iterations must be at least 1")
+		}
+		if !isOneOfInt(s.TUAK.RESBits, 32, 64, 128) {
+			return fmt.Errorf("config: sim.tuak.res_bits must be 32, 64, or 128")
+		}
+		return nil
+	case "xor":
+		if err := validateHexLen("config: sim.ki", s.KI, 32); err != nil {
+			return err
+		}
+		if s.XOR.RESBits < 32 || s.XOR.RESBits > 128 || s.XOR.RESBits%8 != 0 {
+			return fmt.Errorf("config: sim.xor.res_bits must be 32 to 128 in steps of 8")
+		}
+		return nil
+	case "comp128v1":
+		return validateHexLen("config: sim.ki", s.KI, 32)
+	default:
+		return fmt.Errorf("config: sim.algorithm must be milenage, tuak, xor, or comp128v1")
+	}
+}
+
+func (p SQNPolicyConfig) validate() error {
+	bits := DefaultSQNIndBits
+	if p.IndBits != nil {
+		bits = *p.IndBits
+	}
+	if bits < 0 || bits > sqnstore.MaxIndBits {
+		return fmt.Errorf("config: sim.sqn_policy.ind_bits must be between 0 and %d", sqnstore.MaxIndBits)
+	}
+	// SEQ has 48-ind_bits bits; Δ and L must fit below its modulus.
+	maxSEQ := uint64(1)<<(sqnstore.SQNBits-bits) - 1
+	if p.Delta > maxSEQ {
+		return fmt.Errorf("config: sim.sqn_policy.delta must be at most %d for ind_bits=%d", maxSEQ, bits)
+	}
+	if p.L > maxSEQ {
+		return fmt.Errorf("config: sim.sqn_policy.l must be at most %d for ind_bits=%d", maxSEQ, bits)
+	}
+	return nil
+}
+
+func (s SUCIConfig) validate(imsi string) error {
+	if s.Scheme == "" {
+		if s.OuterIdentity {
+			return fmt.Errorf("config: identity.suci.outer_identity requires identity.suci.scheme")
+		}
+		return nil
+	}
+	if !isOneOf(s.Scheme, "null", "profile_a", "profile_b") {
+		return fmt.Errorf("config: identity.suci.scheme must be null, profile_a, or profile_b")
+	}
+	if (len(s.MNC) != 2 && len(s.MNC) != 3) || !isDigits(s.MNC) {
+		return fmt.Errorf("config: identity.suci.mnc must be 2 or 3 digits")
+	}
+	if len(imsi) <= 3+len(s.MNC) || imsi[3:3+len(s.MNC)] != s.MNC {
+		return fmt.Errorf("config: identity.suci.mnc %s does not match sim.imsi", s.MNC)
+	}
+	if s.RoutingIndicator != "" && (len(s.RoutingIndicator) > 4 || !isDigits(s.RoutingIndicator)) {
+		return fmt.Errorf("config: identity.suci.routing_indicator must be 1 to 4 digits")
+	}
+	if s.KeyID < 0 || s.KeyID > 255 {
+		return fmt.Errorf("config: identity.suci.key_id must be between 0 and 255")
+	}
+	switch s.Scheme {
+	case "profile_a":
+		return validateHexLen("config: identity.suci.home_network_public_key", s.HomeNetworkPublicKey, 64)
+	case "profile_b":
+		if len(strings.TrimSpace(s.HomeNetworkPublicKey)) == 130 {
+			return validateHexLen("config: identity.suci.home_network_public_key", s.HomeNetworkPublicKey, 130)
+		}
+		return validateHexLen("config: identity.suci.home_network_public_key", s.HomeNetworkPublicKey, 66)
+	}
+	return nil
+}
+
+func (m MilenageConfig) validate() error {
+	for i, r := range m.Rotations() {
+		if r != nil && (*r < 0 || *r > 127) {
+			return fmt.Errorf("config: sim.milenage.r%d must be between 0 and 127", i+1)
+		}
+	}
+	for i, c := range m.Constants() {
+		if c == "" {
+			continue
+		}
+		if err := validateHexLen(fmt.Sprintf("config: sim.milenage.c%d", i+1), c, 32); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -147,6 +446,27 @@ func validateHexLen(label, value string, expected int) error {
 	return nil
 }
 
+func isDigits(value string) bool {
+	if value == "" {
+		return false
+	}
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func isOneOfInt(value int, allowed ...int) bool {
+	for _, v := range allowed {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
 func isOneOf(value string, allowed ...string) bool {
 	for _, v := range allowed {
 		if value == v {
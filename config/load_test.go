@@ -1,6 +1,9 @@
 package config
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 func TestLoadBytesDefaults(t *testing.T) {
 	yaml := []byte(`radius:
@@ -59,3 +62,195 @@ sqn_store:
 		t.Fatalf("expected error for invalid amf length")
 	}
 }
+
+func TestLoadBytesTUAK(t *testing.T) {
+	yaml := []byte(`radius:
+  server_addr: "127.0.0.1:1812"
+  secret: "testing123"
+sim:
+  imsi: "440100123456789"
+  algorithm: "tuak"
+  ki: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+  tuak:
+    top: "5555555555555555555555555555555555555555555555555555555555555555"
+  amf: "8000"
+  sqn_initial_hex: "000000000000"
+sqn_store:
+  mode: "memory"
+`)
+	cfg, err := LoadBytes(yaml)
+	if err != nil {
+		t.Fatalf("expected valid config, got error: %v", err)
+	}
+	if cfg.SIM.TUAK.Iterations != DefaultTUAKIterations || cfg.SIM.TUAK.RESBits != DefaultTUAKRESBits {
+		t.Fatalf("expected tuak defaults, got %+v", cfg.SIM.TUAK)
+	}
+
+	bad := []byte(`radius:
+  server_addr: "127.0.0.1:1812"
+  secret: "testing123"
+sim:
+  imsi: "440100123456789"
+  algorithm: "tuak"
+  ki: "000102030405060708090a0b0c0d0e0f"
+  tuak:
+    top: "5555555555555555555555555555555555555555555555555555555555555555"
+    topc: "5555555555555555555555555555555555555555555555555555555555555555"
+  amf: "8000"
+  sqn_initial_hex: "000000000000"
+sqn_store:
+  mode: "memory"
+`)
+	if _, err := LoadBytes(bad); err == nil {
+		t.Fatalf("expected error when both top and topc are set")
+	}
+}
+
+func TestLoadBytesCOMP128(t *testing.T) {
+	yaml := []byte(`radius:
+  server_addr: "127.0.0.1:1812"
+  secret: "testing123"
+sim:
+  imsi: "440100123456789"
+  algorithm: "comp128v1"
+  ki: "000102030405060708090a0b0c0d0e0f"
+sqn_store:
+  mode: "memory"
+`)
+	if _, err := LoadBytes(yaml); err != nil {
+		t.Fatalf("expected valid config without amf/sqn, got error: %v", err)
+	}
+	short := bytes.Replace(yaml, []byte(`"000102030405060708090a0b0c0d0e0f"`), []byte(`"0001020304050607"`), 1)
+	if _, err := LoadBytes(short); err == nil {
+		t.Fatalf("expected error for short ki")
+	}
+}
+
+func TestLoadBytesSUCI(t *testing.T) {
+	yaml := []byte(`radius:
+  server_addr: "127.0.0.1:1812"
+  secret: "testing123"
+identity:
+  suci:
+    scheme: "profile_b"
+    mnc: "10"
+    routing_indicator: "678"
+    home_network_public_key: "0272da71976234ce833a6907425867b82e074d44ef907dfb4b3e21c1c2256ebcd1"
+    key_id: 2
+    outer_identity: true
+sim:
+  imsi: "440100123456789"
+  ki: "000102030405060708090a0b0c0d0e0f"
+  opc: "000102030405060708090a0b0c0d0e0f"
+  amf: "8000"
+  sqn_initial_hex: "000000000000"
+sqn_store:
+  mode: "memory"
+`)
+	cfg, err := LoadBytes(yaml)
+	if err != nil {
+		t.Fatalf("expected valid config, got error: %v", err)
+	}
+	if cfg.Identity.SUCI.KeyID != 2 || !cfg.Identity.SUCI.OuterIdentity {
+		t.Fatalf("unexpected suci config %+v", cfg.Identity.SUCI)
+	}
+
+	for name, bad := range map[string][]byte{
+		"scheme":     bytes.Replace(yaml, []byte(`"profile_b"`), []byte(`"profile_c"`), 1),
+		"mnc":        bytes.Replace(yaml, []byte(`mnc: "10"`), []byte(`mnc: "20"`), 1),
+		"key length": bytes.Replace(yaml, []byte(`"0272da`), []byte(`"72da`), 1),
+		"key_id":     bytes.Replace(yaml, []byte("key_id: 2"), []byte("key_id: 256"), 1),
+	} {
+		if _, err := LoadBytes(bad); err == nil {
+			t.Fatalf("expected error for invalid %s", name)
+		}
+	}
+}
+
+func TestLoadBytesMilenageOPExclusive(t *testing.T) {
+	yaml := []byte(`radius:
+  server_addr: "127.0.0.1:1812"
+  secret: "testing123"
+sim:
+  imsi: "440100123456789"
+  ki: "000102030405060708090a0b0c0d0e0f"
+  op: "cdc202d5123e20f62b6d676ac72cb318"
+  milenage:
+    r2: 0
+    c5: "00000000000000000000000000000008"
+  amf: "8000"
+  sqn_initial_hex: "000000000000"
+sqn_store:
+  mode: "memory"
+`)
+	cfg, err := LoadBytes(yaml)
+	if err != nil {
+		t.Fatalf("expected valid config, got error: %v", err)
+	}
+	if cfg.SIM.Milenage.R2 == nil || *cfg.SIM.Milenage.R2 != 0 {
+		t.Fatalf("expected explicit r2, got %v", cfg.SIM.Milenage.R2)
+	}
+
+	both := bytes.Replace(yaml, []byte(`  op: "cdc202d5123e20f62b6d676ac72cb318"
+`), []byte(`  op: "cdc202d5123e20f62b6d676ac72cb318"
+  opc: "cd63cb71954a9f4e48a5994e37a02baf"
+`), 1)
+	if _, err := LoadBytes(both); err == nil {
+		t.Fatalf("expected error when both op and opc are set")
+	}
+	badRot := bytes.Replace(yaml, []byte("r2: 0"), []byte("r2: 128"), 1)
+	if _, err := LoadBytes(badRot); err == nil {
+		t.Fatalf("expected error for out-of-range rotation")
+	}
+}
+
+func TestLoadBytesExpectedMethod(t *testing.T) {
+	base := `radius:
+  server_addr: "127.0.0.1:1812"
+  secret: "testing123"
+sim:
+  imsi: "440100123456789"
+  ki: "00112233445566778899aabbccddeeff"
+  opc: "00112233445566778899aabbccddeeff"
+  amf: "8000"
+  sqn_initial_hex: "000000000000"
+sqn_store:
+  mode: "memory"
+eap:
+  expected_method: `
+	cfg, err := LoadBytes([]byte(base + `"aka_prime"` + "\n"))
+	if err != nil {
+		t.Fatalf("expected valid config, got %v", err)
+	}
+	if cfg.EAP.ExpectedMethod != "aka_prime" {
+		t.Fatalf("unexpected expected_method %q", cfg.EAP.ExpectedMethod)
+	}
+	if _, err := LoadBytes([]byte(base + `"peap"` + "\n")); err == nil {
+		t.Fatalf("expected error for unknown expected_method")
+	}
+}
+
+func TestLoadBytesSQNPolicyRange(t *testing.T) {
+	base := `radius:
+  server_addr: "127.0.0.1:1812"
+  secret: "testing123"
+sim:
+  imsi: "440100123456789"
+  ki: "00112233445566778899aabbccddeeff"
+  opc: "00112233445566778899aabbccddeeff"
+  amf: "8000"
+  sqn_initial_hex: "000000000000"
+  sqn_policy:
+    ind_bits: 16
+`
+	tail := "sqn_store:\n  mode: \"memory\"\n"
+	if _, err := LoadBytes([]byte(base + "    delta: 4294967295\n" + tail)); err != nil {
+		t.Fatalf("expected delta 2^32-1 to fit ind_bits=16, got %v", err)
+	}
+	if _, err := LoadBytes([]byte(base + "    delta: 4294967296\n" + tail)); err == nil {
+		t.Fatalf("expected error for delta beyond the SEQ range")
+	}
+	if _, err := LoadBytes([]byte(base + "    l: 4294967296\n" + tail)); err == nil {
+		t.Fatalf("expected error for l beyond the SEQ range")
+	}
+}
@@ -25,15 +25,30 @@ func ApplyTestcase(base Config, tc testcase.Case) Config {
 		out.RadiusAttrs.CallingStationID = tc.Radius.Attrs.CallingStationID
 	}
 
+	if tc.EAP.ExpectedMethod != "" {
+		out.EAP.ExpectedMethod = tc.EAP.ExpectedMethod
+	}
+	if len(tc.EAP.AllowedMethods) > 0 {
+		out.EAP.AllowedMethods = tc.EAP.AllowedMethods
+	}
 	if tc.EAP.MethodMismatchPolicy != "" {
 		out.EAP.MethodMismatchPolicy = tc.EAP.MethodMismatchPolicy
 	}
 	if tc.EAP.OuterIdentityUpdateOnPermanentReq != nil {
 		out.EAP.OuterIdentityUpdateOnPermanentReq = tc.EAP.OuterIdentityUpdateOnPermanentReq
 	}
+	if tc.EAP.BiddingPolicy != "" {
+		out.EAP.BiddingPolicy = tc.EAP.BiddingPolicy
+	}
 	if tc.EAP.PermanentIDPolicy != "" {
 		out.EAP.PermanentIDPolicy = tc.EAP.PermanentIDPolicy
 	}
+	if tc.EAP.AKAPrime.NetNameCheck != "" {
+		out.EAP.AKAPrime.NetNameCheck = tc.EAP.AKAPrime.NetNameCheck
+	}
+	if len(tc.EAP.AKAPrime.KDFs) > 0 {
+		out.EAP.AKAPrime.KDFs = tc.EAP.AKAPrime.KDFs
+	}
 	if tc.EAP.AKAPrime.NetName != "" {
 		out.EAP.AKAPrime.NetName = tc.EAP.AKAPrime.NetName
 	}
@@ -13,11 +13,18 @@ const (
 )
 
 const (
-	TypeIdentity uint8 = 1
-	TypeAKA      uint8 = 23
-	TypeAKAPrime uint8 = 50
+	TypeIdentity     uint8 = 1
+	TypeNotification uint8 = 2
+	TypeNak          uint8 = 3
+	TypeSIM          uint8 = 18
+	TypeAKA          uint8 = 23
+	TypeAKAPrime     uint8 = 50
 )
 
+// firstAuthType is the lowest authentication method type; a Nak is only
+// valid in response to these (RFC 3748 Section 5.3.1).
+const firstAuthType uint8 = 4
+
 // Packet represents an EAP packet.
 type Packet struct {
 	Code       uint8
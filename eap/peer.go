@@ -25,6 +25,13 @@ func (e *MethodMismatchError) Error() string {
 	return fmt.Sprintf("eap: method mismatch expected=%d received=%d policy=%s", e.Expected, e.Received, e.Policy)
 }
 
+// Nak records an EAP-Response/Nak sent by the peer. Offered is empty when
+// the peer had no alternative (sent as type 0).
+type Nak struct {
+	Requested uint8
+	Offered   []uint8
+}
+
 // Peer handles EAP requests and dispatches to registered methods.
 type Peer struct {
 	Session        *Session
@@ -32,6 +39,15 @@ type Peer struct {
 	MethodPolicy   MethodMismatchPolicy
 	ExpectedMethod *uint8
 	Warn           func(error)
+	// AllowedMethods, when set, lists the accepted methods in order of
+	// preference; requests for any other authentication method (type 4 or
+	// above) are answered with a Nak.
+	AllowedMethods []uint8
+
+	// Requested holds the method of every non-identity request and Naks
+	// every Nak sent, in order.
+	Requested []uint8
+	Naks      []Nak
 }
 
 // NewPeer creates a peer with the given session and methods.
@@ -66,7 +82,11 @@ func (p *Peer) Handle(req Packet) (*Packet, error) {
 		return identityResponse(req.Identifier, sess.OuterIdentity)
 	}
 
+	p.Requested = append(p.Requested, req.Type)
 	method := p.Methods[req.Type]
+	if p.AllowedMethods != nil && req.Type >= firstAuthType && (method == nil || !containsType(p.AllowedMethods, req.Type)) {
+		return p.nak(req), nil
+	}
 	if method == nil {
 		return nil, fmt.Errorf("eap: unsupported method %d", req.Type)
 	}
@@ -86,6 +106,36 @@ func (p *Peer) Handle(req Packet) (*Packet, error) {
 	return method.Handle(req, sess)
 }
 
+// nak answers req with the allowed, registered methods (RFC 3748 5.3.1).
+func (p *Peer) nak(req Packet) *Packet {
+	var offered []uint8
+	for _, t := range p.AllowedMethods {
+		if t != req.Type && p.Methods[t] != nil && !containsType(offered, t) {
+			offered = append(offered, t)
+		}
+	}
+	p.Naks = append(p.Naks, Nak{Requested: req.Type, Offered: offered})
+	data := append([]byte(nil), offered...)
+	if len(data) == 0 {
+		data = []byte{0}
+	}
+	return &Packet{
+		Code:       CodeResponse,
+		Identifier: req.Identifier,
+		Type:       TypeNak,
+		TypeData:   data,
+	}
+}
+
+func containsType(types []uint8, t uint8) bool {
+	for _, v := range types {
+		if v == t {
+			return true
+		}
+	}
+	return false
+}
+
 func identityResponse(identifier uint8, identity string) (*Packet, error) {
 	if identity == "" {
 		return nil, fmt.Errorf("eap: outer identity is required")
@@ -74,3 +74,84 @@ func TestHandleUnsupportedMethod(t *testing.T) {
 		t.Fatalf("expected unsupported method error")
 	}
 }
+
+func TestHandleNak(t *testing.T) {
+	akaMethod := &stubMethod{typeID: TypeAKA}
+	akaPrime := &stubMethod{typeID: TypeAKAPrime}
+	peer := NewPeer(&Session{OuterIdentity: "user"}, akaMethod, akaPrime)
+	peer.AllowedMethods = []uint8{TypeAKAPrime}
+
+	resp, err := peer.Handle(Packet{Code: CodeRequest, Identifier: 4, Type: TypeAKA})
+	if err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	if resp.Type != TypeNak || resp.Identifier != 4 || len(resp.TypeData) != 1 || resp.TypeData[0] != TypeAKAPrime {
+		t.Fatalf("unexpected nak: %+v", resp)
+	}
+	if akaMethod.called {
+		t.Fatalf("disallowed method should not be called")
+	}
+	if _, err := peer.Handle(Packet{Code: CodeRequest, Identifier: 5, Type: TypeAKAPrime}); err != nil || !akaPrime.called {
+		t.Fatalf("expected allowed method to run, err=%v", err)
+	}
+	if len(peer.Naks) != 1 || peer.Naks[0].Requested != TypeAKA {
+		t.Fatalf("unexpected nak record: %+v", peer.Naks)
+	}
+	if len(peer.Requested) != 2 || peer.Requested[1] != TypeAKAPrime {
+		t.Fatalf("unexpected requested methods: %v", peer.Requested)
+	}
+}
+
+func TestHandleNakWithoutAlternative(t *testing.T) {
+	peer := NewPeer(&Session{OuterIdentity: "user"}, &stubMethod{typeID: TypeAKA})
+	peer.AllowedMethods = []uint8{TypeAKAPrime}
+
+	resp, err := peer.Handle(Packet{Code: CodeRequest, Identifier: 1, Type: TypeAKA})
+	if err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	if resp.Type != TypeNak || len(resp.TypeData) != 1 || resp.TypeData[0] != 0 {
+		t.Fatalf("expected nak with type 0, got %+v", resp)
+	}
+}
+
+func TestHandleNoNakForNonAuthTypes(t *testing.T) {
+	peer := NewPeer(&Session{OuterIdentity: "user"}, &stubMethod{typeID: TypeAKAPrime})
+	peer.AllowedMethods = []uint8{TypeAKAPrime}
+
+	for _, typ := range []uint8{TypeNotification, TypeNak} {
+		resp, err := peer.Handle(Packet{Code: CodeRequest, Identifier: 1, Type: typ})
+		if err == nil || resp != nil {
+			t.Fatalf("expected type %d to be rejected without a Nak, got resp=%+v err=%v", typ, resp, err)
+		}
+	}
+	if len(peer.Naks) != 0 {
+		t.Fatalf("unexpected naks: %+v", peer.Naks)
+	}
+}
+
+func TestMethodForIdentity(t *testing.T) {
+	tests := []struct {
+		identity string
+		want     uint8
+		ok       bool
+	}{
+		{"0440100123456789@realm", TypeAKA, true},
+		{"2pseudonym", TypeAKA, true},
+		{"4reauth", TypeAKA, true},
+		{"6440100123456789@realm", TypeAKAPrime, true},
+		{"7pseudonym", TypeAKAPrime, true},
+		{"8reauth", TypeAKAPrime, true},
+		{"1440100123456789@realm", TypeSIM, true},
+		{"3pseudonym", TypeSIM, true},
+		{"5reauth", TypeSIM, true},
+		{"9440100123456789@realm", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := MethodForIdentity(tt.identity)
+		if got != tt.want || ok != tt.ok {
+			t.Fatalf("MethodForIdentity(%q) = %d,%t want %d,%t", tt.identity, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -8,3 +8,36 @@ const (
 	MethodMismatchWarn   MethodMismatchPolicy = "warn"
 	MethodMismatchAllow  MethodMismatchPolicy = "allow"
 )
+
+// MethodForIdentity returns the method selected by the RFC 4186/4187/5448
+// identity prefix (1/3/5 for EAP-SIM, 0/2/4 for EAP-AKA, 6/7/8 for EAP-AKA').
+func MethodForIdentity(identity string) (uint8, bool) {
+	if identity == "" {
+		return 0, false
+	}
+	switch identity[0] {
+	case '1', '3', '5':
+		return TypeSIM, true
+	case '0', '2', '4':
+		return TypeAKA, true
+	case '6', '7', '8':
+		return TypeAKAPrime, true
+	default:
+		return 0, false
+	}
+}
+
+// ParseMethodName maps a config method name (sim, aka, aka_prime) to its
+// type.
+func ParseMethodName(name string) (uint8, bool) {
+	switch name {
+	case "sim":
+		return TypeSIM, true
+	case "aka":
+		return TypeAKA, true
+	case "aka_prime":
+		return TypeAKAPrime, true
+	default:
+		return 0, false
+	}
+}
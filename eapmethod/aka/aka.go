@@ -6,43 +6,157 @@ import (
 
 	"github.com/oyaguma3/eapaka_test/eap"
 	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/suci"
+	"github.com/oyaguma3/eapaka_test/usim"
 
 	eapaka "github.com/oyaguma3/go-eapaka"
-	"github.com/wmnsk/milenage"
 )
 
-// Options configures the EAP-AKA/AKA' method.
+// Options configures the EAP-AKA/AKA' method. Algorithm selects the USIM
+// functions; when nil, Milenage is built from KI and OPC.
 type Options struct {
 	MethodType uint8
 	IMSI       string
 	KI         []byte
 	OPC        []byte
+	Algorithm  usim.Algorithm
 	AMF        []byte
 	NetName    string
 	Realm      string
 	InitialSQN uint64
 	SQNStore   sqnstore.Store
+	SQNPolicy  *sqnstore.Policy
 
 	PermanentIDPolicy                 string
 	PermanentIdentityOverride         string
 	OuterIdentityUpdateOnPermanentReq *bool
+
+	ForceResync *ResyncOptions
+
+	// BiddingCheck makes an EAP-AKA method of a peer that also supports
+	// AKA' refuse challenges whose AT_BIDDING says the server supports AKA'
+	// (RFC 9048 Section 4).
+	BiddingCheck bool
+
+	// KDFs lists the supported AT_KDF values in order of preference
+	// (default DefaultKDFs).
+	KDFs []uint16
+
+	// NetNameCheck compares AT_KDF_INPUT with NetName: strict, warn
+	// (default) or off.
+	NetNameCheck string
+
+	// SUCI makes an AKA' method answer permanent identity requests with a
+	// freshly concealed SUCI instead of "6<IMSI>@realm".
+	SUCI *suci.Params
+}
+
+// ResyncOptions forces one AKA-Synchronization-Failure on the first valid
+// challenge. SQNMS reports an explicit SQN_MS; otherwise AheadBy is added to
+// the SQN received in that challenge.
+type ResyncOptions struct {
+	SQNMS   *uint64
+	AheadBy uint64
+}
+
+// ResyncStatus reports the progress of a forced re-synchronization.
+type ResyncStatus struct {
+	Forced       bool
+	ReportedSQN  uint64
+	Rechallenged bool
+	NextSQN      uint64
+}
+
+// BiddingStatus reports AT_BIDDING of the last EAP-AKA challenge whose
+// AT_MAC verified.
+type BiddingStatus struct {
+	Challenged bool
+	AKAPrime   bool
+	// Rejected is set when the challenge was refused as a bidding down.
+	Rejected bool
+}
+
+// NetNameMismatchError indicates AT_KDF_INPUT does not match the locally
+// configured network name.
+type NetNameMismatchError struct {
+	Received   string
+	Configured string
+	Policy     string
+}
+
+func (e *NetNameMismatchError) Error() string {
+	return fmt.Sprintf("aka: net_name mismatch received=%q configured=%q policy=%s", e.Received, e.Configured, e.Policy)
+}
+
+// AMFMismatchError indicates AUTN carries an AMF other than the configured
+// one.
+type AMFMismatchError struct {
+	Received   []byte
+	Configured []byte
+}
+
+func (e *AMFMismatchError) Error() string {
+	return fmt.Sprintf("aka: amf mismatch received=%x configured=%x", e.Received, e.Configured)
+}
+
+// ResyncError indicates the server's challenge after a forced
+// re-synchronization did not carry a SQN above the reported SQN_MS.
+type ResyncError struct {
+	Reported uint64
+	Received uint64
+}
+
+func (e *ResyncError) Error() string {
+	return fmt.Sprintf("aka: challenge after resync has sqn=%012x not above reported sqn_ms=%012x", e.Received, e.Reported)
 }
 
 // Method implements the EAP method for AKA and AKA'.
 type Method struct {
 	methodType uint8
 	imsi       string
-	ki         []byte
-	opc        []byte
+	alg        usim.Algorithm
 	amf        uint16
 	netName    string
 	realm      string
 	initialSQN uint64
 	store      sqnstore.Store
+	sqnPolicy  sqnstore.Policy
 
 	permanentIDPolicy                 string
 	permanentIdentityOverride         string
 	outerIdentityUpdateOnPermanentReq bool
+
+	forceResync *ResyncOptions
+	resync      ResyncStatus
+
+	biddingCheck bool
+	bidding      BiddingStatus
+
+	kdfs         []uint16
+	kdf          KDFStatus
+	kdfRequested uint16
+
+	netNameCheck string
+
+	suci *suci.Params
+
+	// Warn receives net_name mismatches under the warn policy and SQN
+	// state migrations after an ind_bits change.
+	Warn func(error)
+
+	keys sessionKeys
+}
+
+// sessionKeys holds key material derived in the last verified challenge.
+type sessionKeys struct {
+	kAut  []byte
+	kEncr []byte
+	msk   []byte
+	emsk  []byte
+	// ckPrime, ikPrime and kRe are only set for AKA'.
+	ckPrime []byte
+	ikPrime []byte
+	kRe     []byte
 }
 
 // New creates a new AKA/AKA' method handler.
@@ -50,11 +164,19 @@ func New(opts Options) (*Method, error) {
 	if opts.MethodType != eap.TypeAKA && opts.MethodType != eap.TypeAKAPrime {
 		return nil, fmt.Errorf("aka: unsupported method type %d", opts.MethodType)
 	}
-	if len(opts.KI) != 16 {
-		return nil, fmt.Errorf("aka: KI must be 16 bytes")
-	}
-	if len(opts.OPC) != 16 {
-		return nil, fmt.Errorf("aka: OPC must be 16 bytes")
+	alg := opts.Algorithm
+	if alg == nil {
+		if len(opts.KI) != 16 {
+			return nil, fmt.Errorf("aka: KI must be 16 bytes")
+		}
+		if len(opts.OPC) != 16 {
+			return nil, fmt.Errorf("aka: OPC must be 16 bytes")
+		}
+		mil, err := usim.NewMilenage(opts.KI, opts.OPC)
+		if err != nil {
+			return nil, err
+		}
+		alg = mil
 	}
 	if len(opts.AMF) != 2 {
 		return nil, fmt.Errorf("aka: AMF must be 2 bytes")
@@ -62,21 +184,56 @@ func New(opts Options) (*Method, error) {
 	if opts.IMSI == "" {
 		return nil, fmt.Errorf("aka: IMSI is required")
 	}
+	sqnPolicy := sqnstore.DefaultPolicy()
+	if opts.SQNPolicy != nil {
+		sqnPolicy = *opts.SQNPolicy
+	}
+	if err := sqnPolicy.Validate(); err != nil {
+		return nil, fmt.Errorf("aka: invalid SQN policy: %w", err)
+	}
+	var forceResync *ResyncOptions
+	if opts.ForceResync != nil {
+		if opts.ForceResync.SQNMS != nil && *opts.ForceResync.SQNMS > sqnstore.MaxSQN {
+			return nil, fmt.Errorf("aka: forced resync SQN_MS exceeds 48 bits")
+		}
+		if opts.ForceResync.SQNMS == nil && opts.ForceResync.AheadBy == 0 {
+			return nil, fmt.Errorf("aka: forced resync requires SQN_MS or ahead_by")
+		}
+		copied := *opts.ForceResync
+		forceResync = &copied
+	}
+	kdfs := DefaultKDFs
+	if len(opts.KDFs) > 0 {
+		if err := eapaka.ValidateKdfOffer(opts.KDFs); err != nil {
+			return nil, fmt.Errorf("aka: invalid KDF list: %w", err)
+		}
+		kdfs = append([]uint16(nil), opts.KDFs...)
+	}
 	amf := uint16(opts.AMF[0])<<8 | uint16(opts.AMF[1])
 	method := &Method{
 		methodType: opts.MethodType,
 		imsi:       opts.IMSI,
-		ki:         append([]byte(nil), opts.KI...),
-		opc:        append([]byte(nil), opts.OPC...),
+		alg:        alg,
 		amf:        amf,
 		netName:    opts.NetName,
 		realm:      opts.Realm,
 		initialSQN: opts.InitialSQN,
 		store:      opts.SQNStore,
+		sqnPolicy:  sqnPolicy,
 
 		permanentIDPolicy:                 normalizePermanentPolicy(opts.PermanentIDPolicy),
 		permanentIdentityOverride:         opts.PermanentIdentityOverride,
 		outerIdentityUpdateOnPermanentReq: defaultOuterUpdate(opts.OuterIdentityUpdateOnPermanentReq),
+
+		forceResync: forceResync,
+
+		biddingCheck: opts.BiddingCheck && opts.MethodType == eap.TypeAKA,
+		kdfs:         kdfs,
+		netNameCheck: normalizeNetNameCheck(opts.NetNameCheck),
+	}
+	if opts.SUCI != nil && opts.MethodType == eap.TypeAKAPrime {
+		params := *opts.SUCI
+		method.suci = &params
 	}
 	return method, nil
 }
@@ -86,6 +243,57 @@ func (m *Method) Type() uint8 {
 	return m.methodType
 }
 
+// Algorithm returns the USIM algorithm this method authenticates with.
+func (m *Method) Algorithm() usim.Algorithm {
+	if m == nil {
+		return nil
+	}
+	return m.alg
+}
+
+// Resync returns the forced re-synchronization status of this method.
+func (m *Method) Resync() ResyncStatus {
+	if m == nil {
+		return ResyncStatus{}
+	}
+	return m.resync
+}
+
+// Bidding returns the AT_BIDDING status of the last verified EAP-AKA
+// challenge.
+func (m *Method) Bidding() BiddingStatus {
+	if m == nil {
+		return BiddingStatus{}
+	}
+	return m.bidding
+}
+
+// KDF returns the AT_KDF negotiation status of the last AKA' challenge.
+func (m *Method) KDF() KDFStatus {
+	if m == nil {
+		return KDFStatus{}
+	}
+	return m.kdf
+}
+
+// KEncr returns K_encr of the last challenge whose AT_MAC verified, for
+// decrypting AT_ENCR_DATA in traces.
+func (m *Method) KEncr() []byte {
+	if m == nil {
+		return nil
+	}
+	return m.keys.kEncr
+}
+
+// SessionKeys returns MSK and EMSK of the last challenge whose AT_MAC
+// verified.
+func (m *Method) SessionKeys() (msk, emsk []byte) {
+	if m == nil {
+		return nil, nil
+	}
+	return m.keys.msk, m.keys.emsk
+}
+
 // Handle processes EAP-Request/AKA(-') messages.
 func (m *Method) Handle(req eap.Packet, sess *eap.Session) (*eap.Packet, error) {
 	if m == nil {
@@ -167,6 +375,17 @@ func (m *Method) handleChallenge(req *eapaka.Packet, sess *eap.Session) (*eap.Pa
 	if err != nil {
 		return nil, err
 	}
+	var kdf uint16
+	if req.Type == eapaka.TypeAKAPrime {
+		selected, request, err := m.negotiateKDF(eapaka.KdfValuesFromAttributes(req.Attributes))
+		if err != nil {
+			return nil, err
+		}
+		if request != 0 {
+			return m.kdfRequest(req, request)
+		}
+		kdf = selected
+	}
 	res, ck, ik, ak, err := m.computeVectors(rand)
 	if err != nil {
 		return nil, err
@@ -179,24 +398,29 @@ func (m *Method) handleChallenge(req *eapaka.Packet, sess *eap.Session) (*eap.Pa
 		return nil, fmt.Errorf("aka: inner identity is required")
 	}
 
-	kdfAttrs, err := selectKdfResponseAttrs(req)
-	if err != nil {
-		return nil, err
-	}
-	kAut, err := m.deriveKAut(identity, ck, ik, netName, autn)
+	keys, err := m.deriveKeys(identity, ck, ik, netName, autn, kdf)
 	if err != nil {
 		return nil, err
 	}
+	kAut := keys.kAut
 	if err := verifyRequestMac(req, kAut); err != nil {
 		return m.authenticationReject(req), nil
 	}
+	m.keys = keys
+	if m.methodType == eap.TypeAKA {
+		m.bidding = BiddingStatus{Challenged: true, AKAPrime: biddingAKAPrime(req)}
+		if m.biddingCheck && m.bidding.AKAPrime {
+			m.bidding.Rejected = true
+			return m.clientError(req, 0)
+		}
+	}
 
-	sqnBytes, amf, err := m.decodeAutn(autn, ak)
+	sqnBytes, amf, err := splitAutn(autn, ak)
 	if err != nil {
 		return nil, err
 	}
 	if !bytes.Equal(amf, m.amfBytes()) {
-		return nil, fmt.Errorf("aka: amf mismatch")
+		return nil, &AMFMismatchError{Received: amf, Configured: m.amfBytes()}
 	}
 
 	if ok, err := m.verifyMacA(rand, sqnBytes, amf, autn); err != nil {
@@ -205,13 +429,32 @@ func (m *Method) handleChallenge(req *eapaka.Packet, sess *eap.Session) (*eap.Pa
 		return m.authenticationReject(req), nil
 	}
 
+	sqnValue, err := sqnBytesToUint64(sqnBytes)
+	if err != nil {
+		return nil, err
+	}
+	if m.resync.Forced && !m.resync.Rechallenged {
+		m.resync.Rechallenged = true
+		m.resync.NextSQN = sqnValue
+		if sqnValue <= m.resync.ReportedSQN {
+			return nil, &ResyncError{Reported: m.resync.ReportedSQN, Received: sqnValue}
+		}
+	}
+	if m.forceResync != nil && !m.resync.Forced {
+		return m.forcedSynchronizationFailure(req, rand, sqnValue)
+	}
+
 	if m.store != nil {
-		accepted, err := m.acceptSQN(sqnBytes)
+		accepted, err := m.acceptSQN(sqnValue)
 		if err != nil {
 			return nil, err
 		}
 		if !accepted {
-			auts, err := m.generateAUTS(rand)
+			state, err := m.loadState()
+			if err != nil {
+				return nil, err
+			}
+			auts, err := m.generateAUTS(rand, state.SQNMS)
 			if err != nil {
 				return nil, err
 			}
@@ -221,11 +464,8 @@ func (m *Method) handleChallenge(req *eapaka.Packet, sess *eap.Session) (*eap.Pa
 
 	attrs := []eapaka.Attribute{
 		&eapaka.AtRes{Res: res},
+		&eapaka.AtMac{MAC: make([]byte, 16)},
 	}
-	if len(kdfAttrs) > 0 {
-		attrs = append(attrs, kdfAttrs...)
-	}
-	attrs = append(attrs, &eapaka.AtMac{MAC: make([]byte, 16)})
 	resp := &eapaka.Packet{
 		Code:       eapaka.CodeResponse,
 		Identifier: req.Identifier,
@@ -243,6 +483,7 @@ func (m *Method) extractChallengeParams(req *eapaka.Packet) ([]byte, []byte, str
 	var rand []byte
 	var autn []byte
 	var netName string
+	hasKdfInput := false
 	for _, attr := range req.Attributes {
 		switch a := attr.(type) {
 		case *eapaka.AtRand:
@@ -250,7 +491,7 @@ func (m *Method) extractChallengeParams(req *eapaka.Packet) ([]byte, []byte, str
 		case *eapaka.AtAutn:
 			autn = append([]byte(nil), a.Autn...)
 		case *eapaka.AtKdfInput:
-			netName = a.NetworkName
+			netName, hasKdfInput = a.NetworkName, true
 		}
 	}
 	if len(rand) != 16 {
@@ -260,6 +501,21 @@ func (m *Method) extractChallengeParams(req *eapaka.Packet) ([]byte, []byte, str
 		return nil, nil, "", fmt.Errorf("aka: AT_AUTN is required")
 	}
 	if req.Type == eapaka.TypeAKAPrime {
+		// RFC 9048 Section 3.1: a sent AT_KDF_INPUT must carry a name.
+		if hasKdfInput && netName == "" {
+			return nil, nil, "", fmt.Errorf("aka: AT_KDF_INPUT is empty")
+		}
+		if hasKdfInput && m.netName != "" && !NetNamesMatch(netName, m.netName) {
+			mismatch := &NetNameMismatchError{Received: netName, Configured: m.netName, Policy: m.netNameCheck}
+			switch m.netNameCheck {
+			case "strict":
+				return nil, nil, "", mismatch
+			case "warn":
+				if m.Warn != nil {
+					m.Warn(mismatch)
+				}
+			}
+		}
 		if netName == "" {
 			netName = m.netName
 		}
@@ -270,86 +526,83 @@ func (m *Method) extractChallengeParams(req *eapaka.Packet) ([]byte, []byte, str
 	return rand, autn, netName, nil
 }
 
-func selectKdfResponseAttrs(req *eapaka.Packet) ([]eapaka.Attribute, error) {
-	if req.Type != eapaka.TypeAKAPrime {
-		return nil, nil
-	}
-	offer := eapaka.KdfValuesFromAttributes(req.Attributes)
-	if len(offer) == 0 {
-		return nil, nil
-	}
-	if err := eapaka.ValidateKdfOffer(offer); err != nil {
-		return nil, fmt.Errorf("aka: invalid AT_KDF offer: %w", err)
-	}
-	supported := eapaka.KDFAKAPrimeWithCKIK
-	if offer[0] == supported {
-		return nil, nil
-	}
-	for _, v := range offer {
-		if v == supported {
-			return []eapaka.Attribute{&eapaka.AtKdf{KDF: supported}}, nil
-		}
+// kdfRequest asks the server to re-offer with an alternative KDF: an
+// AKA'-Challenge response carrying only AT_KDF (RFC 9048 Section 3.2).
+func (m *Method) kdfRequest(req *eapaka.Packet, kdf uint16) (*eap.Packet, error) {
+	resp := &eapaka.Packet{
+		Code:       eapaka.CodeResponse,
+		Identifier: req.Identifier,
+		Type:       req.Type,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: []eapaka.Attribute{&eapaka.AtKdf{KDF: kdf}},
 	}
-	return nil, fmt.Errorf("aka: unsupported AT_KDF offer")
+	return toEAPPacket(resp)
 }
 
 func (m *Method) computeVectors(rand []byte) ([]byte, []byte, []byte, []byte, error) {
-	mil := milenage.NewWithOPc(m.ki, m.opc, rand, 0, m.amf)
-	return mil.F2345()
+	return computeF2345(m.alg, rand)
 }
 
-func (m *Method) deriveKAut(identity string, ck, ik []byte, netName string, autn []byte) ([]byte, error) {
-	if m.methodType == eap.TypeAKA {
-		keys := eapaka.DeriveKeysAKA(identity, ck, ik)
-		return keys.K_aut, nil
-	}
-	ckPrime, ikPrime, err := eapaka.DeriveCKPrimeIKPrime(ck, ik, netName, autn)
+func (m *Method) deriveKeys(identity string, ck, ik []byte, netName string, autn []byte, kdf uint16) (sessionKeys, error) {
+	return deriveSessionKeys(m.methodType, identity, m.imsi, ck, ik, netName, autn, kdf)
+}
+
+// computeF2345 runs f2-f5 and checks the CK/IK length the EAP key
+// derivation needs.
+func computeF2345(alg usim.Algorithm, rand []byte) ([]byte, []byte, []byte, []byte, error) {
+	res, ck, ik, ak, err := alg.F2345(rand)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, nil, err
 	}
-	keys := eapaka.DeriveKeysAKAPrime(identity, ckPrime, ikPrime)
-	return keys.K_aut, nil
+	if len(ck) != 16 || len(ik) != 16 {
+		return nil, nil, nil, nil, fmt.Errorf("aka: CK/IK must be 128 bits")
+	}
+	return res, ck, ik, ak, nil
 }
 
-func (m *Method) decodeAutn(autn, ak []byte) ([]byte, []byte, error) {
-	if len(autn) != 16 {
-		return nil, nil, fmt.Errorf("aka: invalid AUTN length")
+// deriveSessionKeys derives the EAP key hierarchy from CK/IK: RFC 4187 for
+// AKA, or CK'/IK' with the AT_KDF kdf and RFC 5448 for AKA'.
+func deriveSessionKeys(methodType uint8, identity, imsi string, ck, ik []byte, netName string, autn []byte, kdf uint16) (sessionKeys, error) {
+	if methodType == eap.TypeAKA {
+		keys := eapaka.DeriveKeysAKA(identity, ck, ik)
+		return sessionKeys{kAut: keys.K_aut, kEncr: keys.K_encr, msk: keys.MSK, emsk: keys.EMSK}, nil
 	}
-	if len(ak) != 6 {
-		return nil, nil, fmt.Errorf("aka: invalid AK length")
+	derive, ok := keyDerivations[kdf]
+	if !ok {
+		return sessionKeys{}, fmt.Errorf("aka: AT_KDF %d has no key derivation", kdf)
 	}
-	sqn := make([]byte, 6)
-	for i := 0; i < 6; i++ {
-		sqn[i] = autn[i] ^ ak[i]
+	identity, err := KeyDerivationIdentity(identity, imsi, netName, kdf)
+	if err != nil {
+		return sessionKeys{}, err
+	}
+	ckPrime, ikPrime, err := derive(ck, ik, netName, autn)
+	if err != nil {
+		return sessionKeys{}, err
 	}
-	amf := append([]byte(nil), autn[6:8]...)
-	return sqn, amf, nil
+	keys := eapaka.DeriveKeysAKAPrime(identity, ckPrime, ikPrime)
+	return sessionKeys{
+		kAut: keys.K_aut, kEncr: keys.K_encr, msk: keys.MSK, emsk: keys.EMSK,
+		ckPrime: ckPrime, ikPrime: ikPrime, kRe: keys.K_re,
+	}, nil
 }
 
 func (m *Method) verifyMacA(rand, sqn, amf, autn []byte) (bool, error) {
-	mil := milenage.NewWithOPc(m.ki, m.opc, rand, 0, m.amf)
-	copy(mil.SQN, sqn)
-	copy(mil.AMF, amf)
-	macA, err := mil.F1()
+	macA, err := m.alg.F1(rand, sqn, amf)
 	if err != nil {
 		return false, err
 	}
+	if len(macA) != 8 {
+		return false, fmt.Errorf("aka: MAC-A must be 64 bits")
+	}
 	return bytes.Equal(macA, autn[8:16]), nil
 }
 
-func (m *Method) acceptSQN(sqnBytes []byte) (bool, error) {
-	sqnValue, err := sqnBytesToUint64(sqnBytes)
-	if err != nil {
-		return false, err
-	}
-	state, ok, err := m.store.Load(m.imsi)
+func (m *Method) acceptSQN(sqnValue uint64) (bool, error) {
+	state, err := m.loadState()
 	if err != nil {
 		return false, err
 	}
-	if !ok {
-		state = initialState(m.initialSQN)
-	}
-	accepted, err := state.AcceptSQN(sqnValue)
+	accepted, err := state.AcceptSQNWithPolicy(sqnValue, m.sqnPolicy)
 	if err != nil {
 		return false, err
 	}
@@ -361,16 +614,53 @@ func (m *Method) acceptSQN(sqnBytes []byte) (bool, error) {
 	return accepted, nil
 }
 
-func (m *Method) generateAUTS(rand []byte) ([]byte, error) {
+func (m *Method) loadState() (sqnstore.SubscriberState, error) {
 	state, ok, err := m.store.Load(m.imsi)
 	if err != nil {
-		return nil, err
+		return sqnstore.SubscriberState{}, err
 	}
 	if !ok {
-		state = initialState(m.initialSQN)
+		return m.sqnPolicy.InitialState(m.initialSQN)
+	}
+	migrated, changed, err := m.sqnPolicy.Migrate(state)
+	if err != nil {
+		return sqnstore.SubscriberState{}, err
 	}
-	mil := milenage.NewWithOPc(m.ki, m.opc, rand, state.SQNMS, 0)
-	return mil.GenerateAUTS()
+	if changed && m.Warn != nil {
+		m.Warn(fmt.Errorf("aka: stored SQN state has %d SEQ_MS entries; re-split SQN_MS %012x for ind_bits=%d", len(state.SeqMS), state.SQNMS, m.sqnPolicy.IndBits))
+	}
+	return migrated, nil
+}
+
+func (m *Method) generateAUTS(rand []byte, sqnMS uint64) ([]byte, error) {
+	return usim.GenerateAUTS(m.alg, rand, sqnMS)
+}
+
+// forcedSynchronizationFailure reports the configured SQN_MS in AUTS and
+// adopts it as the stored state, as a USIM holding that SQN_MS would.
+func (m *Method) forcedSynchronizationFailure(req *eapaka.Packet, rand []byte, received uint64) (*eap.Packet, error) {
+	reported := received + m.forceResync.AheadBy
+	if m.forceResync.SQNMS != nil {
+		reported = *m.forceResync.SQNMS
+	}
+	if reported > sqnstore.MaxSQN {
+		return nil, fmt.Errorf("aka: forced resync SQN_MS exceeds 48 bits")
+	}
+	if m.store != nil {
+		state, err := m.sqnPolicy.InitialState(reported)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.store.Save(m.imsi, state); err != nil {
+			return nil, err
+		}
+	}
+	auts, err := m.generateAUTS(rand, reported)
+	if err != nil {
+		return nil, err
+	}
+	m.resync = ResyncStatus{Forced: true, ReportedSQN: reported}
+	return m.synchronizationFailure(req, auts)
 }
 
 func (m *Method) synchronizationFailure(req *eapaka.Packet, auts []byte) (*eap.Packet, error) {
@@ -400,6 +690,19 @@ func (m *Method) authenticationReject(req *eapaka.Packet) *eap.Packet {
 	return packet
 }
 
+func (m *Method) clientError(req *eapaka.Packet, code uint16) (*eap.Packet, error) {
+	resp := &eapaka.Packet{
+		Code:       eapaka.CodeResponse,
+		Identifier: req.Identifier,
+		Type:       req.Type,
+		Subtype:    eapaka.SubtypeClientError,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtClientErrorCode{Code: code},
+		},
+	}
+	return toEAPPacket(resp)
+}
+
 func (m *Method) amfBytes() []byte {
 	return []byte{byte(m.amf >> 8), byte(m.amf)}
 }
@@ -413,6 +716,15 @@ func hasPermanentIDReq(req *eapaka.Packet) bool {
 	return false
 }
 
+func biddingAKAPrime(req *eapaka.Packet) bool {
+	for _, attr := range req.Attributes {
+		if bid, ok := attr.(*eapaka.AtBidding); ok {
+			return bid.SupportsAKAPrime()
+		}
+	}
+	return false
+}
+
 func (m *Method) selectPermanentIdentity(sess *eap.Session) (string, bool, error) {
 	switch m.permanentIDPolicy {
 	case "deny":
@@ -432,18 +744,27 @@ func (m *Method) selectPermanentIdentity(sess *eap.Session) (string, bool, error
 		if m.permanentIdentityOverride != "" {
 			return m.permanentIdentityOverride, true, nil
 		}
-		return m.generatePermanentIdentity(), true, nil
+		identity, err := m.generatePermanentIdentity()
+		if err != nil {
+			return "", false, err
+		}
+		return identity, true, nil
 	default:
 		return "", false, fmt.Errorf("aka: unsupported permanent_id_policy %q", m.permanentIDPolicy)
 	}
 }
 
-func (m *Method) generatePermanentIdentity() string {
+// generatePermanentIdentity builds "<prefix><IMSI>@realm", or a SUCI when
+// SUCI concealment is configured.
+func (m *Method) generatePermanentIdentity() (string, error) {
+	if m.suci != nil {
+		return suci.Conceal(m.imsi, *m.suci)
+	}
 	prefix := permanentPrefix(m.methodType)
 	if m.realm == "" {
-		return prefix + m.imsi
+		return prefix + m.imsi, nil
 	}
-	return prefix + m.imsi + "@" + m.realm
+	return prefix + m.imsi + "@" + m.realm, nil
 }
 
 func permanentPrefix(methodType uint8) string {
@@ -461,9 +782,19 @@ func isPermanentIdentity(identity string, methodType uint8) bool {
 	if identity == "" {
 		return false
 	}
+	if methodType == eap.TypeAKAPrime && suci.IsSUCI(identity) {
+		return true
+	}
 	return identity[:1] == permanentPrefix(methodType)
 }
 
+func normalizeNetNameCheck(policy string) string {
+	if policy == "" {
+		return "warn"
+	}
+	return policy
+}
+
 func normalizePermanentPolicy(policy string) string {
 	if policy == "" {
 		return "always"
@@ -524,13 +855,3 @@ func sqnBytesToUint64(b []byte) (uint64, error) {
 	}
 	return v, nil
 }
-
-func initialState(sqn uint64) sqnstore.SubscriberState {
-	var state sqnstore.SubscriberState
-	seq, ind, err := sqnstore.SplitSQN(sqn)
-	if err == nil {
-		state.SeqMS[ind] = seq
-		state.SQNMS = sqn
-	}
-	return state
-}
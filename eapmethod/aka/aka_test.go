@@ -1,10 +1,15 @@
 package aka
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/suci"
 	eapaka "github.com/oyaguma3/go-eapaka"
+	"github.com/wmnsk/milenage"
 )
 
 func TestHandleIdentityResponse(t *testing.T) {
@@ -130,6 +135,77 @@ func TestHandlePermanentIDAlways(t *testing.T) {
 	}
 }
 
+func TestHandlePermanentIDSUCI(t *testing.T) {
+	hnPriv := bytes.Repeat([]byte{0x42}, 32)
+	hnPub, err := suci.PublicKey(suci.SchemeProfileA, hnPriv)
+	if err != nil {
+		t.Fatalf("public key failed: %v", err)
+	}
+	method, err := New(Options{
+		MethodType:        eap.TypeAKAPrime,
+		IMSI:              "440100123456789",
+		KI:                make([]byte, 16),
+		OPC:               make([]byte, 16),
+		AMF:               []byte{0x80, 0x00},
+		Realm:             "wlan.mnc010.mcc440.3gppnetwork.org",
+		PermanentIDPolicy: "always",
+		SUCI:              &suci.Params{MNC: "10", Scheme: suci.SchemeProfileA, KeyID: 3, PublicKey: hnPub},
+	})
+	if err != nil {
+		t.Fatalf("new method failed: %v", err)
+	}
+
+	req := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: 2,
+		Type:       eapaka.TypeAKAPrime,
+		Subtype:    eapaka.SubtypeIdentity,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtPermanentIdReq{},
+		},
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("marshal request failed: %v", err)
+	}
+	eapReq, err := eap.Parse(raw)
+	if err != nil {
+		t.Fatalf("parse request failed: %v", err)
+	}
+	sess := &eap.Session{OuterIdentity: "7pseudonym@example"}
+	if _, err := method.Handle(eapReq, sess); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	if !suci.IsSUCI(sess.InnerIdentity) || sess.OuterIdentity != sess.InnerIdentity {
+		t.Fatalf("expected SUCI identity, got inner=%q outer=%q", sess.InnerIdentity, sess.OuterIdentity)
+	}
+	supi, err := suci.Deconceal(sess.InnerIdentity, []suci.PrivateKey{{Scheme: suci.SchemeProfileA, KeyID: 3, Key: hnPriv}})
+	if err != nil || !supi.Matches("440100123456789") {
+		t.Fatalf("expected SUCI for the IMSI, got %+v err=%v", supi, err)
+	}
+
+	conservative, err := New(Options{
+		MethodType:        eap.TypeAKAPrime,
+		IMSI:              "440100123456789",
+		KI:                make([]byte, 16),
+		OPC:               make([]byte, 16),
+		AMF:               []byte{0x80, 0x00},
+		PermanentIDPolicy: "conservative",
+		SUCI:              &suci.Params{MNC: "10"},
+	})
+	if err != nil {
+		t.Fatalf("new method failed: %v", err)
+	}
+	outer := "type0.rid0.schid0.userid0123456789@nai.5gc.mnc010.mcc440.3gppnetwork.org"
+	sess = &eap.Session{OuterIdentity: outer}
+	if _, err := conservative.Handle(eapReq, sess); err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	if sess.InnerIdentity != outer {
+		t.Fatalf("expected the SUCI outer identity to count as permanent, got %q", sess.InnerIdentity)
+	}
+}
+
 func TestHandlePermanentIDDeny(t *testing.T) {
 	method, err := New(Options{
 		MethodType:        eap.TypeAKA,
@@ -243,3 +319,220 @@ func TestHandleAnyFullauthIdReq(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleChallengeForcedResync(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	reported := uint64(0x000000001000)
+	store := sqnstore.NewMemoryStore()
+	method, err := New(Options{
+		MethodType:  eap.TypeAKA,
+		IMSI:        "440100123456789",
+		KI:          ki,
+		OPC:         opc,
+		AMF:         []byte{0x80, 0x00},
+		SQNStore:    store,
+		ForceResync: &ResyncOptions{SQNMS: &reported},
+	})
+	if err != nil {
+		t.Fatalf("new method failed: %v", err)
+	}
+	sess := &eap.Session{OuterIdentity: "0440100123456789@example"}
+
+	rand := bytes.Repeat([]byte{0x33}, 16)
+	resp := handleTestChallenge(t, method, sess, ki, opc, rand, 0x20, 1)
+	if resp.Subtype != eapaka.SubtypeSynchronizationFailure {
+		t.Fatalf("expected synchronization failure, got subtype %d", resp.Subtype)
+	}
+	var auts []byte
+	for _, attr := range resp.Attributes {
+		if a, ok := attr.(*eapaka.AtAuts); ok {
+			auts = a.Auts
+		}
+	}
+	mil := milenage.NewWithOPc(ki, opc, rand, 0, 0)
+	aks, err := mil.F5Star()
+	if err != nil {
+		t.Fatalf("f5* failed: %v", err)
+	}
+	sqnMS := make([]byte, 6)
+	for i := range sqnMS {
+		sqnMS[i] = auts[i] ^ aks[i]
+	}
+	if got, _ := sqnBytesToUint64(sqnMS); got != reported {
+		t.Fatalf("expected AUTS to carry sqn_ms=%x, got %x", reported, got)
+	}
+
+	resp = handleTestChallenge(t, method, sess, ki, opc, rand, reported+0x20, 2)
+	if resp.Subtype != eapaka.SubtypeChallenge {
+		t.Fatalf("expected challenge response after resync, got subtype %d", resp.Subtype)
+	}
+	status := method.Resync()
+	if !status.Forced || !status.Rechallenged || status.NextSQN != reported+0x20 {
+		t.Fatalf("unexpected resync status %+v", status)
+	}
+}
+
+func TestHandleChallengeForcedResyncStaleSQN(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	method, err := New(Options{
+		MethodType:  eap.TypeAKA,
+		IMSI:        "440100123456789",
+		KI:          ki,
+		OPC:         opc,
+		AMF:         []byte{0x80, 0x00},
+		ForceResync: &ResyncOptions{AheadBy: 0x100},
+	})
+	if err != nil {
+		t.Fatalf("new method failed: %v", err)
+	}
+	sess := &eap.Session{OuterIdentity: "0440100123456789@example"}
+	rand := bytes.Repeat([]byte{0x44}, 16)
+
+	handleTestChallenge(t, method, sess, ki, opc, rand, 0x40, 1)
+	if status := method.Resync(); status.ReportedSQN != 0x140 {
+		t.Fatalf("expected reported sqn 0x140, got %x", status.ReportedSQN)
+	}
+	req := buildTestChallenge(t, ki, opc, rand, 0x60, 2, sess.OuterIdentity)
+	_, err = method.Handle(req, sess)
+	if _, ok := err.(*ResyncError); !ok {
+		t.Fatalf("expected ResyncError, got %v", err)
+	}
+}
+
+func TestHandleChallengeMigratesIndBits(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	const imsi = "440100123456789"
+	store := sqnstore.NewMemoryStore()
+	saved, err := sqnstore.DefaultPolicy().InitialState(0x40) // 5-bit IND
+	if err != nil {
+		t.Fatalf("initial state failed: %v", err)
+	}
+	if err := store.Save(imsi, saved); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	var warnings []error
+	method, err := New(Options{
+		MethodType: eap.TypeAKA,
+		IMSI:       imsi,
+		KI:         ki,
+		OPC:        opc,
+		AMF:        []byte{0x80, 0x00},
+		SQNStore:   store,
+		SQNPolicy:  &sqnstore.Policy{IndBits: 3},
+	})
+	if err != nil {
+		t.Fatalf("new method failed: %v", err)
+	}
+	method.Warn = func(err error) { warnings = append(warnings, err) }
+	sess := &eap.Session{OuterIdentity: "0" + imsi + "@example"}
+
+	resp := handleTestChallenge(t, method, sess, ki, opc, bytes.Repeat([]byte{0x66}, 16), 0x48, 1)
+	if resp.Subtype != eapaka.SubtypeChallenge {
+		t.Fatalf("expected Challenge response, got subtype %d", resp.Subtype)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "ind_bits=3") {
+		t.Fatalf("expected one migration warning, got %v", warnings)
+	}
+	state, _, err := store.Load(imsi)
+	if err != nil || len(state.SeqMS) != 8 || state.SQNMS != 0x48 {
+		t.Fatalf("unexpected stored state %+v err=%v", state, err)
+	}
+}
+
+func TestHandleChallengeBidding(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	rand := bytes.Repeat([]byte{0x55}, 16)
+	bidding := &eapaka.AtBidding{Flags: eapaka.AtBiddingFlagAKAPrime}
+	for _, check := range []bool{true, false} {
+		method, err := New(Options{
+			MethodType:   eap.TypeAKA,
+			IMSI:         "440100123456789",
+			KI:           ki,
+			OPC:          opc,
+			AMF:          []byte{0x80, 0x00},
+			BiddingCheck: check,
+		})
+		if err != nil {
+			t.Fatalf("new method failed: %v", err)
+		}
+		sess := &eap.Session{OuterIdentity: "0440100123456789@example"}
+		req := buildTestChallenge(t, ki, opc, rand, 0x20, 1, sess.OuterIdentity, bidding)
+		resp, err := method.Handle(req, sess)
+		if err != nil {
+			t.Fatalf("handle failed: %v", err)
+		}
+		raw, _ := resp.Encode()
+		akaResp, err := eapaka.Parse(raw)
+		if err != nil {
+			t.Fatalf("parse response failed: %v", err)
+		}
+		want := eapaka.SubtypeChallenge
+		if check {
+			want = eapaka.SubtypeClientError
+		}
+		if akaResp.Subtype != want {
+			t.Fatalf("check=%t: expected subtype %d, got %d", check, want, akaResp.Subtype)
+		}
+		status := method.Bidding()
+		if !status.Challenged || !status.AKAPrime || status.Rejected != check {
+			t.Fatalf("check=%t: unexpected bidding status %+v", check, status)
+		}
+	}
+}
+
+func handleTestChallenge(t *testing.T, method *Method, sess *eap.Session, ki, opc, rand []byte, sqn uint64, id uint8) *eapaka.Packet {
+	t.Helper()
+	req := buildTestChallenge(t, ki, opc, rand, sqn, id, sess.OuterIdentity)
+	resp, err := method.Handle(req, sess)
+	if err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	raw, err := resp.Encode()
+	if err != nil {
+		t.Fatalf("encode response failed: %v", err)
+	}
+	akaResp, err := eapaka.Parse(raw)
+	if err != nil {
+		t.Fatalf("parse response failed: %v", err)
+	}
+	return akaResp
+}
+
+func buildTestChallenge(t *testing.T, ki, opc, rand []byte, sqn uint64, id uint8, identity string, extra ...eapaka.Attribute) eap.Packet {
+	t.Helper()
+	mil := milenage.NewWithOPc(ki, opc, rand, sqn, 0x8000)
+	if err := mil.ComputeAll(); err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	autn, err := mil.GenerateAUTN()
+	if err != nil {
+		t.Fatalf("autn failed: %v", err)
+	}
+	keys := eapaka.DeriveKeysAKA(identity, mil.CK, mil.IK)
+	req := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: id,
+		Type:       eapaka.TypeAKA,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: append(append([]eapaka.Attribute{
+			&eapaka.AtRand{Rand: rand},
+			&eapaka.AtAutn{Autn: autn},
+		}, extra...), &eapaka.AtMac{MAC: make([]byte, 16)}),
+	}
+	if err := req.CalculateAndSetMac(keys.K_aut); err != nil {
+		t.Fatalf("mac failed: %v", err)
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("marshal request failed: %v", err)
+	}
+	eapReq, err := eap.Parse(raw)
+	if err != nil {
+		t.Fatalf("parse request failed: %v", err)
+	}
+	return eapReq
+}
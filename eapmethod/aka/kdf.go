@@ -0,0 +1,126 @@
+package aka
+
+import (
+	"fmt"
+	"strings"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+// DefaultKDFs is the AT_KDF preference list used when Options.KDFs is empty.
+var DefaultKDFs = []uint16{eapaka.KDFAKAPrimeWithCKIK}
+
+// keyDerivations maps AT_KDF values to their CK'/IK' derivation. RFC 9048
+// Section 8.3 registers only KDF 1; other values can be listed for
+// negotiation tests but cannot complete a challenge.
+var keyDerivations = map[uint16]func(ck, ik []byte, netName string, autn []byte) ([]byte, []byte, error){
+	eapaka.KDFAKAPrimeWithCKIK: eapaka.DeriveCKPrimeIKPrime,
+}
+
+// KDFStatus reports the AT_KDF negotiation of the last AKA' challenge.
+type KDFStatus struct {
+	// Offer is the AT_KDF list of the first challenge.
+	Offer []uint16
+	// Selected is the KDF used for key derivation (0 until one is agreed).
+	Selected uint16
+	// Negotiated is set when the peer asked for an alternative KDF.
+	Negotiated bool
+}
+
+// KDFError indicates an AT_KDF offer the peer cannot use: a malformed
+// offer, no common KDF, or a re-offer that breaks RFC 9048 Section 3.2
+// (possible bidding down).
+type KDFError struct {
+	Offer  []uint16
+	Reason string
+}
+
+func (e *KDFError) Error() string {
+	return fmt.Sprintf("aka: AT_KDF offer %v: %s", e.Offer, e.Reason)
+}
+
+// negotiateKDF picks the KDF for a challenge. It returns the AT_KDF value
+// to request instead when the server's preferred KDF is not supported.
+func (m *Method) negotiateKDF(offer []uint16) (selected, request uint16, err error) {
+	if len(offer) == 0 {
+		// Servers predating AT_KDF negotiation imply KDF 1.
+		m.kdf = KDFStatus{Selected: eapaka.KDFAKAPrimeWithCKIK}
+		return eapaka.KDFAKAPrimeWithCKIK, 0, nil
+	}
+	if m.kdf.Negotiated && m.kdf.Selected == 0 {
+		// The re-offer repeats the requested value, so it is not checked
+		// as a fresh offer.
+		requested := m.kdfRequested
+		if err := eapaka.ValidateKdfReoffer(m.kdf.Offer, offer, requested); err != nil {
+			return 0, 0, &KDFError{Offer: offer, Reason: err.Error()}
+		}
+		m.kdf.Selected = requested
+		return requested, 0, nil
+	}
+	if err := eapaka.ValidateKdfOffer(offer); err != nil {
+		return 0, 0, &KDFError{Offer: offer, Reason: err.Error()}
+	}
+	m.kdf = KDFStatus{Offer: append([]uint16(nil), offer...)}
+	if containsKDF(m.kdfs, offer[0]) {
+		m.kdf.Selected = offer[0]
+		return offer[0], 0, nil
+	}
+	for _, v := range m.kdfs {
+		if containsKDF(offer[1:], v) {
+			m.kdf.Negotiated = true
+			m.kdfRequested = v
+			return 0, v, nil
+		}
+	}
+	return 0, 0, &KDFError{Offer: offer, Reason: fmt.Sprintf("no supported KDF (supported %v)", m.kdfs)}
+}
+
+func containsKDF(values []uint16, v uint16) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Is5GNetworkName reports whether an AT_KDF_INPUT name uses the 5G format
+// of RFC 9048 Section 3.1 ("5G:mnc<MNC>.mcc<MCC>.3gppnetwork.org").
+func Is5GNetworkName(name string) bool {
+	return eapaka.Is5GNetworkName(name)
+}
+
+// NetNamesMatch compares network names per RFC 5448 Section 3.1: equal
+// names match, and so do names where one is a prefix of the other that ends
+// right before a colon in the longer name ("WLAN" and "WLAN:example").
+func NetNamesMatch(a, b string) bool {
+	if a == b {
+		return true
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	return a != "" && strings.HasPrefix(b, a+":")
+}
+
+// KeyDerivationIdentity returns the identity used in MK derivation. With a
+// 5G network name and KDF 1 it is the SUPI in NAI format (RFC 9048 Section
+// 5.3.1), built from imsi and the name's PLMN; otherwise identity itself.
+func KeyDerivationIdentity(identity, imsi, netName string, kdf uint16) (string, error) {
+	if !eapaka.Requires5GIdentityForKdf(netName, kdf, false) {
+		return identity, nil
+	}
+	if imsi == "" {
+		return "", fmt.Errorf("aka: IMSI is required for 5G key derivation")
+	}
+	plmn := strings.TrimSuffix(strings.TrimPrefix(netName, "5G:"), ".3gppnetwork.org")
+	parts := strings.Split(plmn, ".")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "mnc") || !strings.HasPrefix(parts[1], "mcc") {
+		return "", fmt.Errorf("aka: 5G network name %q is not 5G:mnc<MNC>.mcc<MCC>.3gppnetwork.org", netName)
+	}
+	supi := imsi + "@nai.5gc." + plmn + ".3gppnetwork.org"
+	if err := eapaka.ValidateKdfIdentity(netName, kdf, supi, false); err != nil {
+		return "", fmt.Errorf("aka: %w", err)
+	}
+	return supi, nil
+}
@@ -0,0 +1,229 @@
+package aka
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"github.com/wmnsk/milenage"
+)
+
+func TestHandleChallengeKDFNegotiation(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	rand := bytes.Repeat([]byte{0x66}, 16)
+	method := newTestAKAPrime(t, ki, opc, nil)
+	sess := &eap.Session{OuterIdentity: "6440100123456789@example"}
+
+	resp := handleAKAPrime(t, method, sess, buildAKAPrimeChallenge(t, ki, opc, rand, 1, "WLAN", sess.OuterIdentity, 2, 1))
+	kdfs := eapaka.KdfValuesFromAttributes(resp.Attributes)
+	if len(resp.Attributes) != 1 || len(kdfs) != 1 || kdfs[0] != 1 {
+		t.Fatalf("expected AT_KDF-only request for KDF 1, got %+v", resp.Attributes)
+	}
+
+	resp = handleAKAPrime(t, method, sess, buildAKAPrimeChallenge(t, ki, opc, rand, 2, "WLAN", sess.OuterIdentity, 1, 2, 1))
+	if _, ok := findMac(resp); !ok {
+		t.Fatalf("expected full challenge response after re-offer")
+	}
+	status := method.KDF()
+	if !status.Negotiated || status.Selected != 1 {
+		t.Fatalf("unexpected kdf status %+v", status)
+	}
+}
+
+func TestHandleChallengeKDFErrors(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	rand := bytes.Repeat([]byte{0x66}, 16)
+	sess := &eap.Session{OuterIdentity: "6440100123456789@example"}
+
+	// The re-offer drops the original list: treated as bidding down.
+	method := newTestAKAPrime(t, ki, opc, nil)
+	handleAKAPrime(t, method, sess, buildAKAPrimeChallenge(t, ki, opc, rand, 1, "WLAN", sess.OuterIdentity, 2, 1))
+	_, err := method.Handle(buildAKAPrimeChallenge(t, ki, opc, rand, 2, "WLAN", sess.OuterIdentity, 1), sess)
+	var kdfErr *KDFError
+	if !errors.As(err, &kdfErr) {
+		t.Fatalf("expected KDFError for bad re-offer, got %v", err)
+	}
+
+	method = newTestAKAPrime(t, ki, opc, []uint16{1})
+	_, err = method.Handle(buildAKAPrimeChallenge(t, ki, opc, rand, 1, "WLAN", sess.OuterIdentity, 3), sess)
+	if !errors.As(err, &kdfErr) {
+		t.Fatalf("expected KDFError without common KDF, got %v", err)
+	}
+
+	method = newTestAKAPrime(t, ki, opc, nil)
+	_, err = method.Handle(buildAKAPrimeChallenge(t, ki, opc, rand, 1, "WLAN", sess.OuterIdentity, 0), sess)
+	if !errors.As(err, &kdfErr) {
+		t.Fatalf("expected KDFError for malformed offer, got %v", err)
+	}
+
+	// A listed KDF without a key derivation cannot complete the challenge.
+	method = newTestAKAPrime(t, ki, opc, []uint16{2, 1})
+	if _, err := method.Handle(buildAKAPrimeChallenge(t, ki, opc, rand, 1, "WLAN", sess.OuterIdentity, 2, 1), sess); err == nil {
+		t.Fatalf("expected error for KDF without derivation")
+	}
+}
+
+func TestHandleChallenge5GNetworkName(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	rand := bytes.Repeat([]byte{0x77}, 16)
+	netName := "5G:mnc010.mcc440.3gppnetwork.org"
+	method := newTestAKAPrime(t, ki, opc, nil)
+	sess := &eap.Session{OuterIdentity: "6440100123456789@example"}
+
+	supi, err := KeyDerivationIdentity(sess.OuterIdentity, "440100123456789", netName, 1)
+	if err != nil {
+		t.Fatalf("key identity failed: %v", err)
+	}
+	if supi != "440100123456789@nai.5gc.mnc010.mcc440.3gppnetwork.org" {
+		t.Fatalf("unexpected SUPI %q", supi)
+	}
+	resp := handleAKAPrime(t, method, sess, buildAKAPrimeChallenge(t, ki, opc, rand, 1, netName, supi, 1))
+	if resp.Subtype != eapaka.SubtypeChallenge || len(method.keys.msk) == 0 {
+		t.Fatalf("expected challenge keyed with the SUPI, got subtype %d", resp.Subtype)
+	}
+
+	if _, err := KeyDerivationIdentity("x", "440100123456789", "5G:example.org", 1); err == nil {
+		t.Fatalf("expected error for malformed 5G network name")
+	}
+}
+
+func TestNetNamesMatch(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"WLAN", "WLAN", true},
+		{"WLAN", "WLAN:example", true},
+		{"WLAN:example", "WLAN", true},
+		{"WLAN", "WLANx", false},
+		{"WLAN:a", "WLAN:b", false},
+		{"", "WLAN", false},
+	}
+	for _, tt := range tests {
+		if got := NetNamesMatch(tt.a, tt.b); got != tt.want {
+			t.Fatalf("NetNamesMatch(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestHandleChallengeNetNameCheck(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	rand := bytes.Repeat([]byte{0x88}, 16)
+	sess := &eap.Session{OuterIdentity: "6440100123456789@example"}
+	for _, policy := range []string{"strict", "warn", "off"} {
+		method, err := New(Options{
+			MethodType:   eap.TypeAKAPrime,
+			IMSI:         "440100123456789",
+			KI:           ki,
+			OPC:          opc,
+			AMF:          []byte{0x80, 0x00},
+			NetName:      "WLAN",
+			NetNameCheck: policy,
+		})
+		if err != nil {
+			t.Fatalf("new method failed: %v", err)
+		}
+		var warned error
+		method.Warn = func(err error) { warned = err }
+		_, err = method.Handle(buildAKAPrimeChallenge(t, ki, opc, rand, 1, "HRPD", sess.OuterIdentity, 1), sess)
+		var mismatch *NetNameMismatchError
+		switch policy {
+		case "strict":
+			if !errors.As(err, &mismatch) {
+				t.Fatalf("strict: expected NetNameMismatchError, got %v", err)
+			}
+		case "warn":
+			if err != nil || !errors.As(warned, &mismatch) {
+				t.Fatalf("warn: expected warning only, err=%v warned=%v", err, warned)
+			}
+		case "off":
+			if err != nil || warned != nil {
+				t.Fatalf("off: unexpected err=%v warned=%v", err, warned)
+			}
+		}
+	}
+}
+
+func newTestAKAPrime(t *testing.T, ki, opc []byte, kdfs []uint16) *Method {
+	t.Helper()
+	method, err := New(Options{
+		MethodType: eap.TypeAKAPrime,
+		IMSI:       "440100123456789",
+		KI:         ki,
+		OPC:        opc,
+		AMF:        []byte{0x80, 0x00},
+		KDFs:       kdfs,
+	})
+	if err != nil {
+		t.Fatalf("new method failed: %v", err)
+	}
+	return method
+}
+
+func handleAKAPrime(t *testing.T, method *Method, sess *eap.Session, req eap.Packet) *eapaka.Packet {
+	t.Helper()
+	resp, err := method.Handle(req, sess)
+	if err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	raw, err := resp.Encode()
+	if err != nil {
+		t.Fatalf("encode response failed: %v", err)
+	}
+	akaResp, err := eapaka.Parse(raw)
+	if err != nil {
+		t.Fatalf("parse response failed: %v", err)
+	}
+	return akaResp
+}
+
+// buildAKAPrimeChallenge signs with keys derived for keyIdentity and KDF 1.
+func buildAKAPrimeChallenge(t *testing.T, ki, opc, rand []byte, id uint8, netName, keyIdentity string, kdfs ...uint16) eap.Packet {
+	t.Helper()
+	mil := milenage.NewWithOPc(ki, opc, rand, 0x20, 0x8000)
+	if err := mil.ComputeAll(); err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	autn, err := mil.GenerateAUTN()
+	if err != nil {
+		t.Fatalf("autn failed: %v", err)
+	}
+	ckPrime, ikPrime, err := eapaka.DeriveCKPrimeIKPrime(mil.CK, mil.IK, netName, autn)
+	if err != nil {
+		t.Fatalf("ck'/ik' failed: %v", err)
+	}
+	keys := eapaka.DeriveKeysAKAPrime(keyIdentity, ckPrime, ikPrime)
+	attrs := []eapaka.Attribute{
+		&eapaka.AtRand{Rand: rand},
+		&eapaka.AtAutn{Autn: autn},
+		&eapaka.AtKdfInput{NetworkName: netName},
+	}
+	for _, kdf := range kdfs {
+		attrs = append(attrs, &eapaka.AtKdf{KDF: kdf})
+	}
+	req := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: id,
+		Type:       eapaka.TypeAKAPrime,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: append(attrs, &eapaka.AtMac{MAC: make([]byte, 16)}),
+	}
+	if err := req.CalculateAndSetMac(keys.K_aut); err != nil {
+		t.Fatalf("mac failed: %v", err)
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("marshal request failed: %v", err)
+	}
+	eapReq, err := eap.Parse(raw)
+	if err != nil {
+		t.Fatalf("parse request failed: %v", err)
+	}
+	return eapReq
+}
@@ -0,0 +1,177 @@
+package aka
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/usim"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+// VectorInput holds the challenge values for ComputeVectors.
+type VectorInput struct {
+	MethodType uint8
+	RAND       []byte
+	AUTN       []byte
+	Identity   string
+	// NetName is the AT_KDF_INPUT network name; required for AKA'.
+	NetName string
+	// IMSI builds the SUPI key identity for 5G network names.
+	IMSI string
+}
+
+// Vectors holds everything the peer derives from one RAND/AUTN.
+type Vectors struct {
+	MethodType uint8
+	RAND       []byte
+	AUTN       []byte
+	RES        []byte
+	CK         []byte
+	IK         []byte
+	AK         []byte
+	SQN        []byte
+	AMF        []byte
+	// MACA is the MAC-A carried in AUTN, XMACA the value computed by f1.
+	MACA      []byte
+	XMACA     []byte
+	MACAValid bool
+	// CKPrime, IKPrime and KRe are only set for AKA'.
+	CKPrime []byte
+	IKPrime []byte
+	KEncr   []byte
+	KAut    []byte
+	KRe     []byte
+	MSK     []byte
+	EMSK    []byte
+}
+
+// ComputeVectors runs f1-f5 for the given RAND/AUTN and derives the EAP
+// key hierarchy (RFC 4187 for AKA, RFC 5448 for AKA').
+func ComputeVectors(alg usim.Algorithm, in VectorInput) (*Vectors, error) {
+	v, err := DeriveKeys(alg, in)
+	if err != nil {
+		return nil, err
+	}
+	sqn, amf, err := splitAutn(in.AUTN, v.AK)
+	if err != nil {
+		return nil, err
+	}
+	xmac, err := alg.F1(in.RAND, sqn, amf)
+	if err != nil {
+		return nil, err
+	}
+	v.SQN, v.AMF = sqn, amf
+	v.MACA, v.XMACA = in.AUTN[8:16], xmac
+	v.MACAValid = bytes.Equal(xmac, in.AUTN[8:16])
+	return v, nil
+}
+
+// DeriveKeys runs f2-f5 and derives the EAP key hierarchy without looking
+// into AUTN, which only AKA' needs (for CK'/IK'). SQN, AMF and the MAC-A
+// fields are left empty.
+func DeriveKeys(alg usim.Algorithm, in VectorInput) (*Vectors, error) {
+	if alg == nil {
+		return nil, fmt.Errorf("aka: algorithm is required")
+	}
+	if in.MethodType == eap.TypeSIM {
+		return nil, fmt.Errorf("aka: vectors supports aka and aka_prime only, not EAP-SIM")
+	}
+	if in.MethodType != eap.TypeAKA && in.MethodType != eap.TypeAKAPrime {
+		return nil, fmt.Errorf("aka: unsupported method type %d", in.MethodType)
+	}
+	if len(in.RAND) != 16 {
+		return nil, fmt.Errorf("aka: RAND must be 16 bytes")
+	}
+	if in.Identity == "" {
+		return nil, fmt.Errorf("aka: identity is required")
+	}
+	if in.MethodType == eap.TypeAKAPrime {
+		if len(in.AUTN) != 16 {
+			return nil, fmt.Errorf("aka: AUTN must be 16 bytes")
+		}
+		if in.NetName == "" {
+			return nil, fmt.Errorf("aka: network name is required for AKA'")
+		}
+	}
+	res, ck, ik, ak, err := computeF2345(alg, in.RAND)
+	if err != nil {
+		return nil, err
+	}
+	// The same derivation the Method runs on a challenge, with KDF 1.
+	keys, err := deriveSessionKeys(in.MethodType, in.Identity, in.IMSI, ck, ik, in.NetName, in.AUTN, eapaka.KDFAKAPrimeWithCKIK)
+	if err != nil {
+		return nil, err
+	}
+	return &Vectors{
+		MethodType: in.MethodType,
+		RAND:       in.RAND,
+		AUTN:       in.AUTN,
+		RES:        res,
+		CK:         ck,
+		IK:         ik,
+		AK:         ak,
+		CKPrime:    keys.ckPrime,
+		IKPrime:    keys.ikPrime,
+		KEncr:      keys.kEncr,
+		KAut:       keys.kAut,
+		KRe:        keys.kRe,
+		MSK:        keys.msk,
+		EMSK:       keys.emsk,
+	}, nil
+}
+
+// MarshalJSON encodes byte fields as hex.
+func (v Vectors) MarshalJSON() ([]byte, error) {
+	method := "aka"
+	if v.MethodType == eap.TypeAKAPrime {
+		method = "aka_prime"
+	}
+	h := func(b []byte) string { return hex.EncodeToString(b) }
+	return json.Marshal(struct {
+		Method    string `json:"method"`
+		RAND      string `json:"rand"`
+		AUTN      string `json:"autn"`
+		RES       string `json:"res"`
+		CK        string `json:"ck"`
+		IK        string `json:"ik"`
+		AK        string `json:"ak"`
+		SQN       string `json:"sqn"`
+		AMF       string `json:"amf"`
+		MACA      string `json:"mac_a"`
+		XMACA     string `json:"xmac_a"`
+		MACAValid bool   `json:"mac_a_valid"`
+		CKPrime   string `json:"ck_prime,omitempty"`
+		IKPrime   string `json:"ik_prime,omitempty"`
+		KEncr     string `json:"k_encr"`
+		KAut      string `json:"k_aut"`
+		KRe       string `json:"k_re,omitempty"`
+		MSK       string `json:"msk"`
+		EMSK      string `json:"emsk"`
+	}{
+		Method: method, RAND: h(v.RAND), AUTN: h(v.AUTN), RES: h(v.RES),
+		CK: h(v.CK), IK: h(v.IK), AK: h(v.AK), SQN: h(v.SQN), AMF: h(v.AMF),
+		MACA: h(v.MACA), XMACA: h(v.XMACA), MACAValid: v.MACAValid,
+		CKPrime: h(v.CKPrime), IKPrime: h(v.IKPrime),
+		KEncr: h(v.KEncr), KAut: h(v.KAut), KRe: h(v.KRe), MSK: h(v.MSK), EMSK: h(v.EMSK),
+	})
+}
+
+// splitAutn recovers SQN and AMF from AUTN = (SQN xor AK) || AMF || MAC-A.
+func splitAutn(autn, ak []byte) ([]byte, []byte, error) {
+	if len(autn) != 16 {
+		return nil, nil, fmt.Errorf("aka: invalid AUTN length")
+	}
+	if len(ak) != 6 {
+		return nil, nil, fmt.Errorf("aka: invalid AK length")
+	}
+	sqn := make([]byte, 6)
+	for i := 0; i < 6; i++ {
+		sqn[i] = autn[i] ^ ak[i]
+	}
+	amf := append([]byte(nil), autn[6:8]...)
+	return sqn, amf, nil
+}
@@ -0,0 +1,166 @@
+package aka
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/usim"
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"github.com/wmnsk/milenage"
+)
+
+func TestComputeVectors(t *testing.T) {
+	ki := bytes.Repeat([]byte{0x11}, 16)
+	opc := bytes.Repeat([]byte{0x22}, 16)
+	rand := bytes.Repeat([]byte{0x33}, 16)
+	mil := milenage.NewWithOPc(ki, opc, rand, 0x20, 0x8000)
+	if err := mil.ComputeAll(); err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	autn, err := mil.GenerateAUTN()
+	if err != nil {
+		t.Fatalf("autn failed: %v", err)
+	}
+	alg, err := usim.NewMilenage(ki, opc)
+	if err != nil {
+		t.Fatalf("new milenage failed: %v", err)
+	}
+
+	v, err := ComputeVectors(alg, VectorInput{MethodType: eap.TypeAKA, RAND: rand, AUTN: autn, Identity: "0user@example"})
+	if err != nil {
+		t.Fatalf("compute failed: %v", err)
+	}
+	if !v.MACAValid || !bytes.Equal(v.RES, mil.RES) || !bytes.Equal(v.SQN, []byte{0, 0, 0, 0, 0, 0x20}) {
+		t.Fatalf("unexpected vectors: %+v", v)
+	}
+	keys := eapaka.DeriveKeysAKA("0user@example", mil.CK, mil.IK)
+	if !bytes.Equal(v.KAut, keys.K_aut) || !bytes.Equal(v.MSK, keys.MSK) || v.KRe != nil {
+		t.Fatalf("unexpected AKA keys")
+	}
+	// AKA keys do not depend on AUTN, e.g. when decode verifies a response.
+	noAutn, err := DeriveKeys(alg, VectorInput{MethodType: eap.TypeAKA, RAND: rand, Identity: "0user@example"})
+	if err != nil || !bytes.Equal(noAutn.KAut, v.KAut) {
+		t.Fatalf("unexpected keys without AUTN: %+v %v", noAutn, err)
+	}
+	if _, err := DeriveKeys(alg, VectorInput{MethodType: eap.TypeAKAPrime, RAND: rand, Identity: "6user@example", NetName: "WLAN"}); err == nil {
+		t.Fatalf("expected error for AKA' without AUTN")
+	}
+
+	prime, err := ComputeVectors(alg, VectorInput{MethodType: eap.TypeAKAPrime, RAND: rand, AUTN: autn, Identity: "6user@example", NetName: "WLAN"})
+	if err != nil {
+		t.Fatalf("compute AKA' failed: %v", err)
+	}
+	if len(prime.CKPrime) != 16 || len(prime.KAut) != 32 || len(prime.KRe) != 32 {
+		t.Fatalf("unexpected AKA' keys: %+v", prime)
+	}
+	data, err := json.Marshal(prime)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		t.Fatalf("unmarshal failed: %v", err)
+	}
+	if obj["method"] != "aka_prime" || obj["mac_a_valid"] != true || obj["sqn"] != "000000000020" {
+		t.Fatalf("unexpected JSON: %s", data)
+	}
+
+	autn[15] ^= 0x01
+	bad, err := ComputeVectors(alg, VectorInput{MethodType: eap.TypeAKA, RAND: rand, AUTN: autn, Identity: "0user@example"})
+	if err != nil {
+		t.Fatalf("compute failed: %v", err)
+	}
+	if bad.MACAValid {
+		t.Fatalf("expected invalid MAC-A")
+	}
+	if _, err := ComputeVectors(alg, VectorInput{MethodType: eap.TypeAKAPrime, RAND: rand, AUTN: autn, Identity: "6user@example"}); err == nil {
+		t.Fatalf("expected error without network name")
+	}
+}
+
+// fixedAlgorithm returns preset f2-f5 outputs, for published test vectors
+// that list RES/CK/IK but not the subscriber key.
+type fixedAlgorithm struct {
+	res, ck, ik, ak []byte
+}
+
+func (f fixedAlgorithm) F1(rand, sqn, amf []byte) ([]byte, error)     { return make([]byte, 8), nil }
+func (f fixedAlgorithm) F1Star(rand, sqn, amf []byte) ([]byte, error) { return make([]byte, 8), nil }
+func (f fixedAlgorithm) F5Star(rand []byte) ([]byte, error)           { return make([]byte, 6), nil }
+func (f fixedAlgorithm) F2345(rand []byte) ([]byte, []byte, []byte, []byte, error) {
+	return f.res, f.ck, f.ik, f.ak, nil
+}
+
+// TestComputeVectorsRFC5448 checks the AKA' key hierarchy against RFC 5448
+// Appendix C, Case 1.
+func TestComputeVectorsRFC5448(t *testing.T) {
+	alg := fixedAlgorithm{
+		res: mustHex(t, "28d7b0f2a2ec3de5"),
+		ck:  mustHex(t, "5349fbe098649f948f5d2e973a81c00f"),
+		ik:  mustHex(t, "9744871ad32bf9bbd1dd5ce54e3e2e5a"),
+		ak:  make([]byte, 6),
+	}
+	v, err := ComputeVectors(alg, VectorInput{
+		MethodType: eap.TypeAKAPrime,
+		RAND:       mustHex(t, "81e92b6c0ee0e12ebceba8d92a99dfa5"),
+		AUTN:       mustHex(t, "bb52e91c747ac3ab2a5c23d15ee351d5"),
+		Identity:   "0555444333222111",
+		NetName:    "WLAN",
+	})
+	if err != nil {
+		t.Fatalf("compute failed: %v", err)
+	}
+	expectHex(t, "CK'", v.CKPrime, "0093962d0dd84aa5684b045c9edffa04")
+	expectHex(t, "IK'", v.IKPrime, "ccfc230ca74fcc96c0a5d61164f5a76c")
+	expectHex(t, "K_encr", v.KEncr, "766fa0a6c317174b812d52fbcd11a179")
+	expectHex(t, "K_aut", v.KAut, "0842ea722ff6835bfa2032499fc3ec23c2f0e388b4f07543ffc677f1696d71ea")
+	expectHex(t, "K_re", v.KRe, "cf83aa8bc7e0aced892acc98e76a9b2095b558c7795c7094715cb3393aa7d17a")
+	expectHex(t, "MSK", v.MSK, "67c42d9aa56c1b79e295e3459fc3d187d42be0bf818d3070e362c5e967a4d544e8ecfe19358ab3039aff03b7c930588c055babee58a02650b067ec4e9347c75a")
+	expectHex(t, "EMSK", v.EMSK, "f861703cd775590e16c7679ea3874ada866311de290764d760cf76df647ea01c313f69924bdd7650ca9bac141ea075c4ef9e8029c0e290cdbad5638b63bc23fb")
+
+	// The Method derives the same keys for the same challenge.
+	method := &Method{methodType: eap.TypeAKAPrime}
+	keys, err := method.deriveKeys("0555444333222111", alg.ck, alg.ik, "WLAN", v.AUTN, eapaka.KDFAKAPrimeWithCKIK)
+	if err != nil {
+		t.Fatalf("derive failed: %v", err)
+	}
+	if !bytes.Equal(keys.kAut, v.KAut) || !bytes.Equal(keys.msk, v.MSK) || !bytes.Equal(keys.kRe, v.KRe) {
+		t.Fatalf("method keys differ from ComputeVectors")
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode %q failed: %v", s, err)
+	}
+	return b
+}
+
+func expectHex(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("%s mismatch: got %x want %s", name, got, want)
+	}
+}
+
+func TestComputeVectorsRejectsSIM(t *testing.T) {
+	alg, err := usim.NewMilenage(bytes.Repeat([]byte{0x11}, 16), bytes.Repeat([]byte{0x22}, 16))
+	if err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	_, err = ComputeVectors(alg, VectorInput{
+		MethodType: eap.TypeSIM,
+		RAND:       bytes.Repeat([]byte{0x33}, 16),
+		AUTN:       bytes.Repeat([]byte{0x44}, 16),
+		Identity:   "1440100123456789@wlan.example",
+	})
+	if err == nil || !strings.Contains(err.Error(), "not EAP-SIM") {
+		t.Fatalf("expected EAP-SIM rejection, got %v", err)
+	}
+}
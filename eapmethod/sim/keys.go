@@ -0,0 +1,100 @@
+package sim
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+// Keys holds the EAP-SIM key hierarchy (RFC 4186 Section 7).
+type Keys struct {
+	MK    []byte
+	KEncr []byte
+	KAut  []byte
+	MSK   []byte
+	EMSK  []byte
+}
+
+// DeriveKeys computes MK = SHA1(Identity | n*Kc | NONCE_MT | Version List |
+// Selected Version) and expands it with the FIPS 186-2 PRF.
+func DeriveKeys(identity string, kcs [][]byte, nonceMT []byte, versions []uint16, selected uint16) Keys {
+	h := sha1.New()
+	h.Write([]byte(identity))
+	for _, kc := range kcs {
+		h.Write(kc)
+	}
+	h.Write(nonceMT)
+	h.Write(versionBytes(versions))
+	h.Write(versionBytes([]uint16{selected}))
+	mk := h.Sum(nil)
+	block := prf(mk, 160)
+	return Keys{
+		MK:    mk,
+		KEncr: block[0:16],
+		KAut:  block[16:32],
+		MSK:   block[32:96],
+		EMSK:  block[96:160],
+	}
+}
+
+// prf is the FIPS 186-2 (Change Notice 1) pseudo-random function of RFC 4186
+// Appendix B with XSEED = 0 and G built on the SHA-1 compression function.
+func prf(key []byte, n int) []byte {
+	mod := new(big.Int).Lsh(big.NewInt(1), 160)
+	one := big.NewInt(1)
+	xkey := new(big.Int).SetBytes(key)
+	out := make([]byte, 0, n+20)
+	for len(out) < n {
+		var xval [20]byte
+		xkey.FillBytes(xval[:])
+		w := sha1G(xval[:])
+		out = append(out, w...)
+		// XKEY = (1 + XKEY + w) mod 2^160
+		xkey.Add(xkey, new(big.Int).SetBytes(w))
+		xkey.Add(xkey, one)
+		xkey.Mod(xkey, mod)
+	}
+	return out[:n]
+}
+
+// sha1G applies one SHA-1 compression to xval zero-padded to 512 bits, without
+// the usual message padding.
+func sha1G(xval []byte) []byte {
+	var block [64]byte
+	copy(block[:], xval)
+	var w [80]uint32
+	for i := 0; i < 16; i++ {
+		w[i] = binary.BigEndian.Uint32(block[4*i:])
+	}
+	for i := 16; i < 80; i++ {
+		w[i] = bits.RotateLeft32(w[i-3]^w[i-8]^w[i-14]^w[i-16], 1)
+	}
+	h := [5]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476, 0xc3d2e1f0}
+	a, b, c, d, e := h[0], h[1], h[2], h[3], h[4]
+	for i := 0; i < 80; i++ {
+		var f, k uint32
+		switch {
+		case i < 20:
+			f, k = b&c|^b&d, 0x5a827999
+		case i < 40:
+			f, k = b^c^d, 0x6ed9eba1
+		case i < 60:
+			f, k = b&c|b&d|c&d, 0x8f1bbcdc
+		default:
+			f, k = b^c^d, 0xca62c1d6
+		}
+		t := bits.RotateLeft32(a, 5) + f + e + k + w[i]
+		a, b, c, d, e = t, a, bits.RotateLeft32(b, 30), c, d
+	}
+	h[0] += a
+	h[1] += b
+	h[2] += c
+	h[3] += d
+	h[4] += e
+	out := make([]byte, 20)
+	for i, v := range h {
+		binary.BigEndian.PutUint32(out[4*i:], v)
+	}
+	return out
+}
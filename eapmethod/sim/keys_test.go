@@ -0,0 +1,47 @@
+package sim
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestDeriveKeysRFC4186 checks the key derivation of the RFC 4186
+// Appendix A test vector.
+func TestDeriveKeysRFC4186(t *testing.T) {
+	kcs := [][]byte{
+		mustHex(t, "a0a1a2a3a4a5a6a7"),
+		mustHex(t, "b0b1b2b3b4b5b6b7"),
+		mustHex(t, "c0c1c2c3c4c5c6c7"),
+	}
+	keys := DeriveKeys("1244070100000001@eapsim.foo", kcs, mustHex(t, "0123456789abcdeffedcba9876543210"), []uint16{1}, 1)
+	expectHex(t, "MK", keys.MK, "e576d5ca332e9930018bf1baee2763c795b3c712")
+	expectHex(t, "K_encr", keys.KEncr, "536e5ebc4465582aa6a8ec9986ebb620")
+	expectHex(t, "K_aut", keys.KAut, "25af1942efcbf4bc72b3943421f2a974")
+	expectHex(t, "MSK", keys.MSK, "39d45aeaf4e30601983e972b6cfd46d1c363773365690d09cd44976b525f47d3a60a985e955c53b090b2e4b73719196a402542968fd14a888f46b9a7886e4488")
+	if len(keys.EMSK) != 64 {
+		t.Fatalf("expected 64-byte EMSK, got %d", len(keys.EMSK))
+	}
+}
+
+// TestPRFFIPS186 checks the PRF against the FIPS 186-2 Appendix 3.1 example
+// with XSEED = 0.
+func TestPRFFIPS186(t *testing.T) {
+	out := prf(mustHex(t, "bd029bbe7f51960bcf9edb2b61f06f0feb5a38b6"), 40)
+	expectHex(t, "x", out, "2070b3223dba372fde1c0ffc7b2e3b498b2606143c6c18bacb0f6c55babb13788e20d737a3275116")
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode %q failed: %v", s, err)
+	}
+	return b
+}
+
+func expectHex(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("%s mismatch: got %x want %s", name, got, want)
+	}
+}
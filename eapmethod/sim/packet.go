@@ -0,0 +1,236 @@
+package sim
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+// EAP-SIM subtypes (RFC 4186 Section 11).
+const (
+	SubtypeStart        uint8 = 10
+	SubtypeChallenge    uint8 = 11
+	SubtypeNotification uint8 = 12
+	SubtypeClientError  uint8 = 14
+)
+
+// AT_CLIENT_ERROR_CODE values (RFC 4186 Section 10.19).
+const (
+	ClientErrorUnableToProcess        uint16 = 0
+	ClientErrorUnsupportedVersion     uint16 = 1
+	ClientErrorInsufficientChallenges uint16 = 2
+	ClientErrorRANDsNotFresh          uint16 = 3
+)
+
+// Version is the only EAP-SIM version defined (RFC 4186 Section 10.4).
+const Version uint16 = 1
+
+// Packet is an EAP-Request/Response/SIM message. The attribute types are
+// shared with EAP-AKA, so go-eapaka attributes are reused except for
+// AT_RAND, which carries several RANDs in EAP-SIM.
+type Packet struct {
+	Code       uint8
+	Identifier uint8
+	Subtype    uint8
+	Attributes []eapaka.Attribute
+}
+
+// AtRand is the EAP-SIM AT_RAND with two or three GSM RANDs.
+type AtRand struct {
+	Rands [][]byte
+}
+
+func (a *AtRand) Type() eapaka.AttributeType { return eapaka.AT_RAND }
+
+func (a *AtRand) Marshal() ([]byte, error) {
+	data := make([]byte, 2, 2+16*len(a.Rands))
+	for _, r := range a.Rands {
+		if len(r) != 16 {
+			return nil, fmt.Errorf("sim: RAND must be 16 bytes")
+		}
+		data = append(data, r...)
+	}
+	return marshalAttribute(eapaka.AT_RAND, data), nil
+}
+
+func (a *AtRand) Unmarshal(data []byte) error {
+	if len(data) < 2 || (len(data)-2)%16 != 0 {
+		return fmt.Errorf("sim: invalid AT_RAND length %d", len(data))
+	}
+	a.Rands = nil
+	for off := 2; off < len(data); off += 16 {
+		a.Rands = append(a.Rands, append([]byte(nil), data[off:off+16]...))
+	}
+	return nil
+}
+
+// Parse decodes an EAP-SIM request or response.
+func Parse(raw []byte) (*Packet, error) {
+	pkt, err := eap.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Code != eap.CodeRequest && pkt.Code != eap.CodeResponse {
+		return nil, fmt.Errorf("sim: unexpected EAP code %d", pkt.Code)
+	}
+	if pkt.Type != eap.TypeSIM {
+		return nil, fmt.Errorf("sim: method type mismatch %d", pkt.Type)
+	}
+	if len(pkt.TypeData) < 3 {
+		return nil, fmt.Errorf("sim: header truncated")
+	}
+	out := &Packet{Code: pkt.Code, Identifier: pkt.Identifier, Subtype: pkt.TypeData[0]}
+	data := pkt.TypeData[3:]
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("sim: attribute header truncated")
+		}
+		length := int(data[1]) * 4
+		if length == 0 || length > len(data) {
+			return nil, fmt.Errorf("sim: attribute %d has invalid length", data[0])
+		}
+		attr := newAttribute(eapaka.AttributeType(data[0]))
+		if err := attr.Unmarshal(data[2:length]); err != nil {
+			return nil, fmt.Errorf("sim: attribute %d: %w", data[0], err)
+		}
+		out.Attributes = append(out.Attributes, attr)
+		data = data[length:]
+	}
+	return out, nil
+}
+
+// Marshal encodes the packet as raw EAP.
+func (p *Packet) Marshal() ([]byte, error) {
+	typeData := []byte{p.Subtype, 0, 0}
+	for _, attr := range p.Attributes {
+		b, err := attr.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		typeData = append(typeData, b...)
+	}
+	return eap.Packet{Code: p.Code, Identifier: p.Identifier, Type: eap.TypeSIM, TypeData: typeData}.Encode()
+}
+
+// CalculateAndSetMac sets AT_MAC to HMAC-SHA1-128 over the packet followed
+// by extra: NONCE_MT for a Challenge request, the SRES values for its
+// response (RFC 4186 Section 10.14).
+func (p *Packet) CalculateAndSetMac(kAut, extra []byte) error {
+	mac, ok := p.mac()
+	if !ok {
+		return fmt.Errorf("sim: AT_MAC missing")
+	}
+	sum, err := p.computeMac(mac, kAut, extra)
+	if err != nil {
+		return err
+	}
+	mac.MAC = sum
+	return nil
+}
+
+// VerifyMac checks AT_MAC against kAut and extra.
+func (p *Packet) VerifyMac(kAut, extra []byte) (bool, error) {
+	mac, ok := p.mac()
+	if !ok {
+		return false, fmt.Errorf("sim: AT_MAC missing")
+	}
+	received := mac.MAC
+	sum, err := p.computeMac(mac, kAut, extra)
+	mac.MAC = received
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(received, sum) == 1, nil
+}
+
+func (p *Packet) computeMac(mac *eapaka.AtMac, kAut, extra []byte) ([]byte, error) {
+	mac.MAC = make([]byte, 16)
+	raw, err := p.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha1.New, kAut)
+	h.Write(raw)
+	h.Write(extra)
+	return h.Sum(nil)[:16], nil
+}
+
+func (p *Packet) mac() (*eapaka.AtMac, bool) {
+	for _, attr := range p.Attributes {
+		if mac, ok := attr.(*eapaka.AtMac); ok {
+			return mac, true
+		}
+	}
+	return nil, false
+}
+
+// Attribute returns the first attribute of type t.
+func (p *Packet) Attribute(t eapaka.AttributeType) (eapaka.Attribute, bool) {
+	for _, attr := range p.Attributes {
+		if attr.Type() == t {
+			return attr, true
+		}
+	}
+	return nil, false
+}
+
+// ToEAP converts the packet into an eap.Packet.
+func (p *Packet) ToEAP() (*eap.Packet, error) {
+	raw, err := p.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	pkt, err := eap.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &pkt, nil
+}
+
+func newAttribute(t eapaka.AttributeType) eapaka.Attribute {
+	switch t {
+	case eapaka.AT_RAND:
+		return &AtRand{}
+	case eapaka.AT_MAC:
+		return &eapaka.AtMac{}
+	case eapaka.AT_IDENTITY:
+		return &eapaka.AtIdentity{}
+	case eapaka.AT_PERMANENT_ID_REQ:
+		return &eapaka.AtPermanentIdReq{}
+	case eapaka.AT_ANY_ID_REQ:
+		return &eapaka.AtAnyIdReq{}
+	case eapaka.AT_FULLAUTH_ID_REQ:
+		return &eapaka.AtFullauthIdReq{}
+	case eapaka.AT_NONCE_MT:
+		return &eapaka.AtNonceMt{}
+	case eapaka.AT_VERSION_LIST:
+		return &eapaka.AtVersionList{}
+	case eapaka.AT_SELECTED_VERSION:
+		return &eapaka.AtSelectedVersion{}
+	case eapaka.AT_CLIENT_ERROR_CODE:
+		return &eapaka.AtClientErrorCode{}
+	default:
+		return &eapaka.GenericAttribute{AttrType: t}
+	}
+}
+
+func marshalAttribute(t eapaka.AttributeType, data []byte) []byte {
+	b := make([]byte, 2, 2+len(data))
+	b[0] = byte(t)
+	b[1] = byte((2 + len(data)) / 4)
+	return append(b, data...)
+}
+
+func versionBytes(versions []uint16) []byte {
+	b := make([]byte, 2*len(versions))
+	for i, v := range versions {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+	return b
+}
@@ -0,0 +1,314 @@
+// Package sim implements the peer side of EAP-SIM (RFC 4186).
+package sim
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/usim"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+// Options configures the EAP-SIM method. Algorithm provides A3/A8.
+type Options struct {
+	IMSI      string
+	Algorithm usim.GSMAlgorithm
+	Realm     string
+
+	PermanentIDPolicy                 string
+	PermanentIdentityOverride         string
+	OuterIdentityUpdateOnPermanentReq *bool
+	// NonceMT, when set, is sent as AT_NONCE_MT instead of a random value,
+	// e.g. to replay a recorded run.
+	NonceMT []byte
+}
+
+// Method implements the EAP method for SIM.
+type Method struct {
+	imsi  string
+	alg   usim.GSMAlgorithm
+	realm string
+
+	permanentIDPolicy                 string
+	permanentIdentityOverride         string
+	outerIdentityUpdateOnPermanentReq bool
+	fixedNonceMT                      []byte
+
+	// Start state used by the key derivation of the next challenge.
+	nonceMT  []byte
+	versions []uint16
+	selected uint16
+
+	keys Keys
+}
+
+// New creates a new EAP-SIM method handler.
+func New(opts Options) (*Method, error) {
+	if opts.Algorithm == nil {
+		return nil, fmt.Errorf("sim: A3/A8 algorithm is required")
+	}
+	if opts.IMSI == "" {
+		return nil, fmt.Errorf("sim: IMSI is required")
+	}
+	if opts.NonceMT != nil && len(opts.NonceMT) != 16 {
+		return nil, fmt.Errorf("sim: NONCE_MT must be 16 bytes")
+	}
+	policy := opts.PermanentIDPolicy
+	if policy == "" {
+		policy = "always"
+	}
+	outerUpdate := true
+	if opts.OuterIdentityUpdateOnPermanentReq != nil {
+		outerUpdate = *opts.OuterIdentityUpdateOnPermanentReq
+	}
+	return &Method{
+		imsi:                              opts.IMSI,
+		alg:                               opts.Algorithm,
+		realm:                             opts.Realm,
+		permanentIDPolicy:                 policy,
+		permanentIdentityOverride:         opts.PermanentIdentityOverride,
+		outerIdentityUpdateOnPermanentReq: outerUpdate,
+		fixedNonceMT:                      append([]byte(nil), opts.NonceMT...),
+	}, nil
+}
+
+// Type returns eap.TypeSIM.
+func (m *Method) Type() uint8 {
+	return eap.TypeSIM
+}
+
+// SessionKeys returns MSK and EMSK of the last challenge whose AT_MAC
+// verified.
+func (m *Method) SessionKeys() (msk, emsk []byte) {
+	if m == nil {
+		return nil, nil
+	}
+	return m.keys.MSK, m.keys.EMSK
+}
+
+// Handle processes EAP-Request/SIM messages.
+func (m *Method) Handle(req eap.Packet, sess *eap.Session) (*eap.Packet, error) {
+	if m == nil {
+		return nil, fmt.Errorf("sim: method is nil")
+	}
+	raw, err := req.Encode()
+	if err != nil {
+		return nil, err
+	}
+	simReq, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	session := sess
+	if session == nil {
+		session = &eap.Session{}
+	}
+	switch simReq.Subtype {
+	case SubtypeStart:
+		return m.handleStart(simReq, session)
+	case SubtypeChallenge:
+		return m.handleChallenge(simReq, session)
+	default:
+		return nil, fmt.Errorf("sim: unsupported subtype %d", simReq.Subtype)
+	}
+}
+
+func (m *Method) handleStart(req *Packet, sess *eap.Session) (*eap.Packet, error) {
+	attr, ok := req.Attribute(eapaka.AT_VERSION_LIST)
+	if !ok {
+		return nil, fmt.Errorf("sim: AT_VERSION_LIST is required")
+	}
+	versions := attr.(*eapaka.AtVersionList).Versions
+	if !containsVersion(versions, Version) {
+		return m.clientError(req, ClientErrorUnsupportedVersion)
+	}
+
+	var identity string
+	if _, ok := req.Attribute(eapaka.AT_PERMANENT_ID_REQ); ok {
+		permanent, ok, err := m.selectPermanentIdentity(sess)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return m.clientError(req, ClientErrorUnableToProcess)
+		}
+		identity = permanent
+		if m.outerIdentityUpdateOnPermanentReq {
+			sess.OuterIdentity = permanent
+		}
+	} else if hasAnyAttribute(req, eapaka.AT_FULLAUTH_ID_REQ, eapaka.AT_ANY_ID_REQ) {
+		identity = sess.InnerIdentity
+		if identity == "" {
+			identity = sess.OuterIdentity
+		}
+		if identity == "" {
+			return nil, fmt.Errorf("sim: inner identity is required")
+		}
+	}
+
+	nonce := make([]byte, 16)
+	if len(m.fixedNonceMT) > 0 {
+		copy(nonce, m.fixedNonceMT)
+	} else if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	m.nonceMT = nonce
+	m.versions = append([]uint16(nil), versions...)
+	m.selected = Version
+	attrs := []eapaka.Attribute{
+		&eapaka.AtNonceMt{NonceMt: nonce},
+		&eapaka.AtSelectedVersion{Version: Version},
+	}
+	if identity != "" {
+		sess.InnerIdentity = identity
+		attrs = append(attrs, &eapaka.AtIdentity{Identity: identity})
+	}
+	resp := &Packet{Code: eap.CodeResponse, Identifier: req.Identifier, Subtype: SubtypeStart, Attributes: attrs}
+	return resp.ToEAP()
+}
+
+func (m *Method) handleChallenge(req *Packet, sess *eap.Session) (*eap.Packet, error) {
+	if m.nonceMT == nil {
+		return nil, fmt.Errorf("sim: challenge before start")
+	}
+	attr, ok := req.Attribute(eapaka.AT_RAND)
+	if !ok {
+		return nil, fmt.Errorf("sim: AT_RAND is required")
+	}
+	rands := attr.(*AtRand).Rands
+	if len(rands) < 2 {
+		return m.clientError(req, ClientErrorInsufficientChallenges)
+	}
+	if len(rands) > 3 {
+		return m.clientError(req, ClientErrorUnableToProcess)
+	}
+	for i := range rands {
+		for j := i + 1; j < len(rands); j++ {
+			if bytes.Equal(rands[i], rands[j]) {
+				return m.clientError(req, ClientErrorRANDsNotFresh)
+			}
+		}
+	}
+	var sres, kcs [][]byte
+	for _, r := range rands {
+		s, kc, err := m.alg.A3A8(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(s) != 4 || len(kc) != 8 {
+			return nil, fmt.Errorf("sim: SRES/Kc must be 32/64 bits")
+		}
+		sres = append(sres, s)
+		kcs = append(kcs, kc)
+	}
+	identity := sess.InnerIdentity
+	if identity == "" {
+		identity = sess.OuterIdentity
+	}
+	if identity == "" {
+		return nil, fmt.Errorf("sim: inner identity is required")
+	}
+
+	keys := DeriveKeys(identity, kcs, m.nonceMT, m.versions, m.selected)
+	ok, err := req.VerifyMac(keys.KAut, m.nonceMT)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return m.clientError(req, ClientErrorUnableToProcess)
+	}
+	m.keys = keys
+
+	resp := &Packet{
+		Code:       eap.CodeResponse,
+		Identifier: req.Identifier,
+		Subtype:    SubtypeChallenge,
+		Attributes: []eapaka.Attribute{&eapaka.AtMac{MAC: make([]byte, 16)}},
+	}
+	if err := resp.CalculateAndSetMac(keys.KAut, bytes.Join(sres, nil)); err != nil {
+		return nil, err
+	}
+	return resp.ToEAP()
+}
+
+func (m *Method) clientError(req *Packet, code uint16) (*eap.Packet, error) {
+	resp := &Packet{
+		Code:       eap.CodeResponse,
+		Identifier: req.Identifier,
+		Subtype:    SubtypeClientError,
+		Attributes: []eapaka.Attribute{&eapaka.AtClientErrorCode{Code: code}},
+	}
+	return resp.ToEAP()
+}
+
+func (m *Method) selectPermanentIdentity(sess *eap.Session) (string, bool, error) {
+	switch m.permanentIDPolicy {
+	case "deny":
+		return "", false, nil
+	case "conservative":
+		if isPermanentIdentity(sess.InnerIdentity) {
+			return sess.InnerIdentity, true, nil
+		}
+		if isPermanentIdentity(sess.OuterIdentity) {
+			return sess.OuterIdentity, true, nil
+		}
+		if m.permanentIdentityOverride != "" {
+			return m.permanentIdentityOverride, true, nil
+		}
+		return "", false, nil
+	case "always":
+		if m.permanentIdentityOverride != "" {
+			return m.permanentIdentityOverride, true, nil
+		}
+		return m.generatePermanentIdentity(), true, nil
+	default:
+		return "", false, fmt.Errorf("sim: unsupported permanent_id_policy %q", m.permanentIDPolicy)
+	}
+}
+
+// generatePermanentIdentity builds the RFC 4186 Section 4.2.1.3 permanent
+// identity: "1" followed by the IMSI.
+func (m *Method) generatePermanentIdentity() string {
+	if m.realm == "" {
+		return "1" + m.imsi
+	}
+	return "1" + m.imsi + "@" + m.realm
+}
+
+func isPermanentIdentity(identity string) bool {
+	return identity != "" && identity[0] == '1'
+}
+
+func containsVersion(versions []uint16, v uint16) bool {
+	for _, x := range versions {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyAttribute(pkt *Packet, types ...eapaka.AttributeType) bool {
+	for _, t := range types {
+		if _, ok := pkt.Attribute(t); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// StartNonceMT returns AT_NONCE_MT of a raw EAP-Response/SIM/Start.
+func StartNonceMT(raw []byte) ([]byte, bool) {
+	pkt, err := Parse(raw)
+	if err != nil || pkt.Code != eap.CodeResponse || pkt.Subtype != SubtypeStart {
+		return nil, false
+	}
+	attr, ok := pkt.Attribute(eapaka.AT_NONCE_MT)
+	if !ok {
+		return nil, false
+	}
+	return attr.(*eapaka.AtNonceMt).NonceMt, true
+}
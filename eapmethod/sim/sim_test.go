@@ -0,0 +1,236 @@
+package sim
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/usim"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+const testIMSI = "440100123456789"
+
+var testKI = bytes.Repeat([]byte{0x11}, 16)
+
+func TestHandleStartAndChallenge(t *testing.T) {
+	method := newTestMethod(t, Options{})
+	sess := &eap.Session{OuterIdentity: "1" + testIMSI + "@wlan.example"}
+
+	start := handleTestPacket(t, method, sess, &Packet{
+		Code:       eap.CodeRequest,
+		Identifier: 1,
+		Subtype:    SubtypeStart,
+		Attributes: []eapaka.Attribute{&eapaka.AtVersionList{Versions: []uint16{Version}}},
+	})
+	if start.Subtype != SubtypeStart {
+		t.Fatalf("expected Start response, got subtype %d", start.Subtype)
+	}
+	attr, ok := start.Attribute(eapaka.AT_NONCE_MT)
+	if !ok {
+		t.Fatalf("expected AT_NONCE_MT")
+	}
+	nonceMT := attr.(*eapaka.AtNonceMt).NonceMt
+	if _, ok := start.Attribute(eapaka.AT_IDENTITY); ok {
+		t.Fatalf("unexpected AT_IDENTITY without identity request")
+	}
+
+	req, sres, keys := buildTestChallenge(t, 2, sess.OuterIdentity, nonceMT, 3)
+	resp := handleTestPacket(t, method, sess, req)
+	if resp.Subtype != SubtypeChallenge {
+		t.Fatalf("expected Challenge response, got subtype %d", resp.Subtype)
+	}
+	ok, err := resp.VerifyMac(keys.KAut, sres)
+	if err != nil || !ok {
+		t.Fatalf("response MAC invalid: ok=%v err=%v", ok, err)
+	}
+	msk, emsk := method.SessionKeys()
+	if !bytes.Equal(msk, keys.MSK) || !bytes.Equal(emsk, keys.EMSK) {
+		t.Fatalf("session keys do not match the server side")
+	}
+}
+
+func TestHandleStartFixedNonceMT(t *testing.T) {
+	nonce := bytes.Repeat([]byte{0x5a}, 16)
+	method := newTestMethod(t, Options{NonceMT: nonce})
+	start := handleTestPacket(t, method, &eap.Session{OuterIdentity: "1" + testIMSI + "@wlan.example"}, &Packet{
+		Code:       eap.CodeRequest,
+		Identifier: 1,
+		Subtype:    SubtypeStart,
+		Attributes: []eapaka.Attribute{&eapaka.AtVersionList{Versions: []uint16{Version}}},
+	})
+	raw, err := start.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	if got, ok := StartNonceMT(raw); !ok || !bytes.Equal(got, nonce) {
+		t.Fatalf("expected fixed NONCE_MT, got %x", got)
+	}
+	if _, err := New(Options{IMSI: testIMSI, Algorithm: method.alg, NonceMT: []byte{1}}); err == nil {
+		t.Fatalf("expected error for short NONCE_MT")
+	}
+}
+
+func TestHandleStartPermanentIDReq(t *testing.T) {
+	method := newTestMethod(t, Options{Realm: "wlan.example"})
+	sess := &eap.Session{OuterIdentity: "3pseudonym@wlan.example"}
+	resp := handleTestPacket(t, method, sess, &Packet{
+		Code:       eap.CodeRequest,
+		Identifier: 1,
+		Subtype:    SubtypeStart,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtVersionList{Versions: []uint16{Version}},
+			&eapaka.AtPermanentIdReq{},
+		},
+	})
+	attr, ok := resp.Attribute(eapaka.AT_IDENTITY)
+	if !ok {
+		t.Fatalf("expected AT_IDENTITY")
+	}
+	want := "1" + testIMSI + "@wlan.example"
+	if got := attr.(*eapaka.AtIdentity).Identity; got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	if sess.OuterIdentity != want || sess.InnerIdentity != want {
+		t.Fatalf("expected session identities to be updated, got outer=%q inner=%q", sess.OuterIdentity, sess.InnerIdentity)
+	}
+
+	deny := newTestMethod(t, Options{PermanentIDPolicy: "deny"})
+	resp = handleTestPacket(t, deny, &eap.Session{OuterIdentity: "3pseudonym"}, &Packet{
+		Code:       eap.CodeRequest,
+		Identifier: 1,
+		Subtype:    SubtypeStart,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtVersionList{Versions: []uint16{Version}},
+			&eapaka.AtPermanentIdReq{},
+		},
+	})
+	expectClientError(t, resp, ClientErrorUnableToProcess)
+}
+
+func TestHandleClientErrors(t *testing.T) {
+	method := newTestMethod(t, Options{})
+	sess := &eap.Session{OuterIdentity: "1" + testIMSI}
+	resp := handleTestPacket(t, method, sess, &Packet{
+		Code:       eap.CodeRequest,
+		Identifier: 1,
+		Subtype:    SubtypeStart,
+		Attributes: []eapaka.Attribute{&eapaka.AtVersionList{Versions: []uint16{2}}},
+	})
+	expectClientError(t, resp, ClientErrorUnsupportedVersion)
+
+	start := handleTestPacket(t, method, sess, &Packet{
+		Code:       eap.CodeRequest,
+		Identifier: 2,
+		Subtype:    SubtypeStart,
+		Attributes: []eapaka.Attribute{&eapaka.AtVersionList{Versions: []uint16{Version}}},
+	})
+	attr, _ := start.Attribute(eapaka.AT_NONCE_MT)
+	nonceMT := attr.(*eapaka.AtNonceMt).NonceMt
+
+	req, _, _ := buildTestChallenge(t, 3, sess.OuterIdentity, nonceMT, 1)
+	expectClientError(t, handleTestPacket(t, method, sess, req), ClientErrorInsufficientChallenges)
+
+	req, _, _ = buildTestChallenge(t, 4, sess.OuterIdentity, nonceMT, 2)
+	rands := req.Attributes[0].(*AtRand).Rands
+	copy(rands[1], rands[0])
+	if err := req.CalculateAndSetMac(make([]byte, 16), nonceMT); err != nil {
+		t.Fatalf("set mac failed: %v", err)
+	}
+	expectClientError(t, handleTestPacket(t, method, sess, req), ClientErrorRANDsNotFresh)
+
+	req, _, _ = buildTestChallenge(t, 5, sess.OuterIdentity, nonceMT, 3)
+	mac, _ := req.mac()
+	mac.MAC[0] ^= 0xff
+	expectClientError(t, handleTestPacket(t, method, sess, req), ClientErrorUnableToProcess)
+	if msk, _ := method.SessionKeys(); msk != nil {
+		t.Fatalf("expected no session keys after MAC failure")
+	}
+}
+
+func newTestMethod(t *testing.T, opts Options) *Method {
+	t.Helper()
+	alg, err := usim.NewCOMP128(testKI)
+	if err != nil {
+		t.Fatalf("comp128 failed: %v", err)
+	}
+	opts.IMSI = testIMSI
+	opts.Algorithm = alg
+	method, err := New(opts)
+	if err != nil {
+		t.Fatalf("new method failed: %v", err)
+	}
+	return method
+}
+
+// buildTestChallenge builds a SIM/Challenge with n RANDs as the server would
+// and returns the SRES values and keys it expects.
+func buildTestChallenge(t *testing.T, id uint8, identity string, nonceMT []byte, n int) (*Packet, []byte, Keys) {
+	t.Helper()
+	alg, err := usim.NewCOMP128(testKI)
+	if err != nil {
+		t.Fatalf("comp128 failed: %v", err)
+	}
+	var rands, kcs [][]byte
+	var sres []byte
+	for i := 0; i < n; i++ {
+		r := bytes.Repeat([]byte{byte(0x20 + i)}, 16)
+		s, kc, err := alg.A3A8(r)
+		if err != nil {
+			t.Fatalf("a3a8 failed: %v", err)
+		}
+		rands = append(rands, r)
+		kcs = append(kcs, kc)
+		sres = append(sres, s...)
+	}
+	keys := DeriveKeys(identity, kcs, nonceMT, []uint16{Version}, Version)
+	req := &Packet{
+		Code:       eap.CodeRequest,
+		Identifier: id,
+		Subtype:    SubtypeChallenge,
+		Attributes: []eapaka.Attribute{
+			&AtRand{Rands: rands},
+			&eapaka.AtMac{MAC: make([]byte, 16)},
+		},
+	}
+	if err := req.CalculateAndSetMac(keys.KAut, nonceMT); err != nil {
+		t.Fatalf("set mac failed: %v", err)
+	}
+	return req, sres, keys
+}
+
+func handleTestPacket(t *testing.T, method *Method, sess *eap.Session, req *Packet) *Packet {
+	t.Helper()
+	eapReq, err := req.ToEAP()
+	if err != nil {
+		t.Fatalf("encode request failed: %v", err)
+	}
+	resp, err := method.Handle(*eapReq, sess)
+	if err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	raw, err := resp.Encode()
+	if err != nil {
+		t.Fatalf("encode response failed: %v", err)
+	}
+	out, err := Parse(raw)
+	if err != nil {
+		t.Fatalf("parse response failed: %v", err)
+	}
+	return out
+}
+
+func expectClientError(t *testing.T, resp *Packet, code uint16) {
+	t.Helper()
+	if resp.Subtype != SubtypeClientError {
+		t.Fatalf("expected Client-Error, got subtype %d", resp.Subtype)
+	}
+	attr, ok := resp.Attribute(eapaka.AT_CLIENT_ERROR_CODE)
+	if !ok {
+		t.Fatalf("expected AT_CLIENT_ERROR_CODE")
+	}
+	if got := attr.(*eapaka.AtClientErrorCode).Code; got != code {
+		t.Fatalf("expected client error %d, got %d", code, got)
+	}
+}
@@ -0,0 +1,220 @@
+// Package metrics collects client-side counters and latency histograms and
+// serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// DefaultBuckets are the latency histogram bounds in seconds.
+var DefaultBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+const (
+	counterRequests     = "eapaka_access_requests_total"
+	counterChallenges   = "eapaka_access_challenges_total"
+	counterAccepts      = "eapaka_access_accepts_total"
+	counterRejects      = "eapaka_access_rejects_total"
+	counterTimeouts     = "eapaka_timeouts_total"
+	counterRetransmits  = "eapaka_retransmits_total"
+	counterSyncFailures = "eapaka_sync_failures_total"
+	histogramRound      = "eapaka_round_duration_seconds"
+)
+
+var help = map[string]string{
+	counterRequests:     "Access-Requests sent.",
+	counterChallenges:   "Access-Challenges received.",
+	counterAccepts:      "Access-Accepts received.",
+	counterRejects:      "Access-Rejects received.",
+	counterTimeouts:     "Exchanges that got no reply before the timeout.",
+	counterRetransmits:  "Access-Request retransmissions.",
+	counterSyncFailures: "AKA-Synchronization-Failure responses sent.",
+	histogramRound:      "RADIUS round trip latency by method and round.",
+}
+
+// Metrics is safe for concurrent use.
+type Metrics struct {
+	mu         sync.Mutex
+	buckets    []float64
+	counters   map[string]map[string]uint64
+	histograms map[string]map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// New creates an empty metrics set using DefaultBuckets.
+func New() *Metrics {
+	return &Metrics{
+		buckets:    DefaultBuckets,
+		counters:   make(map[string]map[string]uint64),
+		histograms: make(map[string]map[string]*histogram),
+	}
+}
+
+// RequestSent counts an Access-Request; retransmits counts the extra copies
+// sent by the retry timer before the exchange ended.
+func (m *Metrics) RequestSent(server string, retransmits int) {
+	if m == nil {
+		return
+	}
+	labels := labelString("server", server)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(counterRequests, labels, 1)
+	if retransmits > 0 {
+		m.add(counterRetransmits, labels, uint64(retransmits))
+	}
+}
+
+// Timeout counts an exchange that ended without a reply.
+func (m *Metrics) Timeout(server string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(counterTimeouts, labelString("server", server), 1)
+}
+
+// Response counts a reply by code.
+func (m *Metrics) Response(server string, code radius.Code) {
+	if m == nil {
+		return
+	}
+	var name string
+	switch code {
+	case radius.CodeAccessChallenge:
+		name = counterChallenges
+	case radius.CodeAccessAccept:
+		name = counterAccepts
+	case radius.CodeAccessReject:
+		name = counterRejects
+	default:
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(name, labelString("server", server), 1)
+}
+
+// SyncFailure counts an AKA-Synchronization-Failure sent by the peer.
+func (m *Metrics) SyncFailure(server string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(counterSyncFailures, labelString("server", server), 1)
+}
+
+// ObserveRound records the latency of one round trip. method is the EAP
+// method of the request sent (identity, aka or aka_prime).
+func (m *Metrics) ObserveRound(server, method string, round int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	labels := labelString("server", server, "method", method, "round", fmt.Sprintf("%d", round))
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	series, ok := m.histograms[histogramRound]
+	if !ok {
+		series = make(map[string]*histogram)
+		m.histograms[histogramRound] = series
+	}
+	h, ok := series[labels]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(m.buckets))}
+		series[labels] = h
+	}
+	seconds := d.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *Metrics) add(name, labels string, delta uint64) {
+	series, ok := m.counters[name]
+	if !ok {
+		series = make(map[string]uint64)
+		m.counters[name] = series
+	}
+	series[labels] += delta
+}
+
+// WriteTo writes all series in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	for _, name := range sortedKeys(m.counters) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", name, help[name], name)
+		series := m.counters[name]
+		for _, labels := range sortedKeys(series) {
+			fmt.Fprintf(&b, "%s{%s} %d\n", name, labels, series[labels])
+		}
+	}
+	for _, name := range sortedKeys(m.histograms) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s histogram\n", name, help[name], name)
+		series := m.histograms[name]
+		for _, labels := range sortedKeys(series) {
+			h := series[labels]
+			for i, bound := range m.buckets {
+				fmt.Fprintf(&b, "%s_bucket{%s,le=\"%g\"} %d\n", name, labels, bound, h.counts[i])
+			}
+			fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+			fmt.Fprintf(&b, "%s_sum{%s} %g\n", name, labels, h.sum)
+			fmt.Fprintf(&b, "%s_count{%s} %d\n", name, labels, h.count)
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Handler serves the metrics for /metrics.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		m.WriteTo(w)
+	})
+}
+
+// ListenAndServe serves /metrics on addr until the listener fails.
+func (m *Metrics) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// labelString renders name/value pairs as a Prometheus label set.
+func labelString(pairs ...string) string {
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	m := New()
+	m.RequestSent("127.0.0.1:1812", 0)
+	m.RequestSent("127.0.0.1:1812", 2)
+	m.Response("127.0.0.1:1812", radius.CodeAccessChallenge)
+	m.Response("127.0.0.1:1812", radius.CodeAccessAccept)
+	m.Timeout("127.0.0.1:1812")
+	m.SyncFailure("127.0.0.1:1812")
+	m.ObserveRound("127.0.0.1:1812", "aka", 2, 3*time.Millisecond)
+
+	buf := &bytes.Buffer{}
+	if _, err := m.WriteTo(buf); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE eapaka_access_requests_total counter",
+		`eapaka_access_requests_total{server="127.0.0.1:1812"} 2`,
+		`eapaka_retransmits_total{server="127.0.0.1:1812"} 2`,
+		`eapaka_access_challenges_total{server="127.0.0.1:1812"} 1`,
+		`eapaka_access_accepts_total{server="127.0.0.1:1812"} 1`,
+		`eapaka_timeouts_total{server="127.0.0.1:1812"} 1`,
+		`eapaka_sync_failures_total{server="127.0.0.1:1812"} 1`,
+		"# TYPE eapaka_round_duration_seconds histogram",
+		`eapaka_round_duration_seconds_bucket{server="127.0.0.1:1812",method="aka",round="2",le="0.0025"} 0`,
+		`eapaka_round_duration_seconds_bucket{server="127.0.0.1:1812",method="aka",round="2",le="0.005"} 1`,
+		`eapaka_round_duration_seconds_count{server="127.0.0.1:1812",method="aka",round="2"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || rec.Body.Len() == 0 {
+		t.Fatalf("unexpected handler response")
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	if got := labelString("server", `a"b\c`); got != `server="a\"b\\c"` {
+		t.Fatalf("unexpected labels %s", got)
+	}
+}
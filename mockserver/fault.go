@@ -0,0 +1,60 @@
+package mockserver
+
+import "fmt"
+
+// Fault selects a deliberate misbehavior used to exercise client error paths.
+type Fault string
+
+const (
+	FaultNone Fault = ""
+	// FaultBadATMAC corrupts AT_MAC in AKA-Challenge.
+	FaultBadATMAC Fault = "bad_at_mac"
+	// FaultWrongMACA corrupts MAC-A in AT_AUTN; AT_MAC stays valid.
+	FaultWrongMACA Fault = "wrong_mac_a"
+	// FaultAMFMismatch builds AUTN with an AMF other than the subscriber's.
+	FaultAMFMismatch Fault = "amf_mismatch"
+	// FaultKDFBiddingDown answers the peer's AT_KDF request in AKA' with a
+	// re-offer that drops the original list (RFC 9048 Section 3.2).
+	FaultKDFBiddingDown Fault = "kdf_bidding_down"
+	// FaultMissingEAPMessage sends Access-Challenge without EAP-Message.
+	FaultMissingEAPMessage Fault = "missing_eap_message"
+	// FaultDropState sends Access-Challenge without State.
+	FaultDropState Fault = "drop_state"
+	// FaultNoReply never answers.
+	FaultNoReply Fault = "no_reply"
+	// FaultAcceptAny accepts any response in the challenge round without
+	// checking RES or AT_MAC.
+	FaultAcceptAny Fault = "accept_any"
+	// FaultWedgeOnMalformed stops answering every request once one fails
+	// before reaching the EAP method (e.g. an EAP-Message that does not
+	// parse).
+	FaultWedgeOnMalformed Fault = "wedge_on_malformed"
+)
+
+// Faults lists the supported fault names.
+func Faults() []Fault {
+	return []Fault{
+		FaultBadATMAC,
+		FaultWrongMACA,
+		FaultAMFMismatch,
+		FaultKDFBiddingDown,
+		FaultMissingEAPMessage,
+		FaultDropState,
+		FaultNoReply,
+		FaultAcceptAny,
+		FaultWedgeOnMalformed,
+	}
+}
+
+// Validate checks that f is empty or a known fault.
+func (f Fault) Validate() error {
+	if f == FaultNone {
+		return nil
+	}
+	for _, known := range Faults() {
+		if f == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("mockserver: unsupported fault %q", string(f))
+}
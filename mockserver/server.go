@@ -0,0 +1,437 @@
+package mockserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/suci"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// Identity request modes sent in the first EAP-Request/AKA-Identity or
+// EAP-Request/SIM/Start.
+const (
+	IdentityRequestNone      = "none"
+	IdentityRequestAny       = "any"
+	IdentityRequestFullauth  = "fullauth"
+	IdentityRequestPermanent = "permanent"
+)
+
+// Options configures the mock EAP-SIM/AKA/AKA' RADIUS server.
+type Options struct {
+	Secret      string
+	Subscribers []Subscriber
+	// NetName is sent in AT_KDF_INPUT for EAP-AKA'.
+	NetName string
+	// KDFs is the AT_KDF offer of EAP-AKA' challenges (default [1]). Keys
+	// are always derived with KDF 1, so another first value only works
+	// when the peer negotiates down to 1.
+	KDFs []uint16
+	// DefaultMethod is used when the identity prefix does not select
+	// SIM, AKA or AKA'. Zero selects EAP-AKA.
+	DefaultMethod uint8
+	// IdentityRequest selects the AKA-Identity round, or the identity
+	// request in the SIM/Start, sent before the challenge: none, any,
+	// fullauth or permanent.
+	IdentityRequest string
+	// IssuePseudonyms adds AT_NEXT_PSEUDONYM (encrypted) to each challenge.
+	IssuePseudonyms bool
+	// Bidding adds AT_BIDDING with the AKA' bit to EAP-AKA challenges, as
+	// an AKA'-capable server does (RFC 9048).
+	Bidding bool
+	// SUCIKeys are the home network private keys used to resolve ECIES
+	// SUCI identities. Null-scheme SUCIs need no key.
+	SUCIKeys []suci.PrivateKey
+	// Fault injects a misbehavior into every exchange.
+	Fault Fault
+	// Logf receives one line per protocol event when set.
+	Logf func(format string, args ...interface{})
+}
+
+// Server runs the authenticator side of EAP-SIM/AKA/AKA' over RADIUS.
+type Server struct {
+	secret          []byte
+	netName         string
+	kdfs            []uint16
+	defaultMethod   uint8
+	identityRequest string
+	issuePseudonyms bool
+	bidding         bool
+	suciKeys        []suci.PrivateKey
+	fault           Fault
+	logf            func(format string, args ...interface{})
+
+	mu          sync.Mutex
+	subscribers map[string]*subscriberState
+	pseudonyms  map[string]string
+	sessions    map[string]*session
+	// wedged is set by FaultWedgeOnMalformed.
+	wedged bool
+
+	packetServer *radius.PacketServer
+}
+
+// New creates a mock server from the given options.
+func New(opts Options) (*Server, error) {
+	if opts.Secret == "" {
+		return nil, fmt.Errorf("mockserver: secret is required")
+	}
+	if len(opts.Subscribers) == 0 {
+		return nil, fmt.Errorf("mockserver: at least one subscriber is required")
+	}
+	identityRequest := opts.IdentityRequest
+	if identityRequest == "" {
+		identityRequest = IdentityRequestNone
+	}
+	switch identityRequest {
+	case IdentityRequestNone, IdentityRequestAny, IdentityRequestFullauth, IdentityRequestPermanent:
+	default:
+		return nil, fmt.Errorf("mockserver: unsupported identity request %q", opts.IdentityRequest)
+	}
+	if err := opts.Fault.Validate(); err != nil {
+		return nil, err
+	}
+	if len(opts.KDFs) == 0 {
+		opts.KDFs = []uint16{eapaka.KDFAKAPrimeWithCKIK}
+	}
+	defaultMethod := opts.DefaultMethod
+	if defaultMethod == 0 {
+		defaultMethod = eap.TypeAKA
+	}
+	if defaultMethod != eap.TypeSIM && defaultMethod != eap.TypeAKA && defaultMethod != eap.TypeAKAPrime {
+		return nil, fmt.Errorf("mockserver: unsupported default method %d", opts.DefaultMethod)
+	}
+	s := &Server{
+		secret:          []byte(opts.Secret),
+		netName:         opts.NetName,
+		kdfs:            opts.KDFs,
+		defaultMethod:   defaultMethod,
+		identityRequest: identityRequest,
+		issuePseudonyms: opts.IssuePseudonyms,
+		bidding:         opts.Bidding,
+		suciKeys:        opts.SUCIKeys,
+		fault:           opts.Fault,
+		logf:            opts.Logf,
+		subscribers:     make(map[string]*subscriberState),
+		pseudonyms:      make(map[string]string),
+		sessions:        make(map[string]*session),
+	}
+	for _, sub := range opts.Subscribers {
+		state, err := newSubscriberState(sub)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := s.subscribers[sub.IMSI]; exists {
+			return nil, fmt.Errorf("mockserver: duplicate subscriber %s", sub.IMSI)
+		}
+		s.subscribers[sub.IMSI] = state
+		for _, pseudonym := range sub.Pseudonyms {
+			s.pseudonyms[pseudonym] = sub.IMSI
+		}
+	}
+	return s, nil
+}
+
+// SQN returns the last SQN generated for the subscriber.
+func (s *Server) SQN(imsi string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sub, ok := s.subscribers[imsi]
+	if !ok {
+		return 0, false
+	}
+	return sub.SQN, true
+}
+
+// Serve handles RADIUS requests on conn until Shutdown is called.
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.packetServer == nil {
+		s.packetServer = &radius.PacketServer{
+			SecretSource: radius.StaticSecretSource(s.secret),
+			Handler:      s,
+		}
+	}
+	ps := s.packetServer
+	s.mu.Unlock()
+	return ps.Serve(conn)
+}
+
+// ListenAndServe listens on the UDP address and serves requests.
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return s.Serve(conn)
+}
+
+// Shutdown stops a running Serve.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	ps := s.packetServer
+	s.mu.Unlock()
+	if ps == nil {
+		return nil
+	}
+	return ps.Shutdown(ctx)
+}
+
+// ServeRADIUS implements radius.Handler.
+func (s *Server) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccessRequest {
+		return
+	}
+	if s.fault == FaultNoReply || s.isWedged() {
+		s.log("fault=%s dropping request", s.fault)
+		return
+	}
+	resp, err := s.handle(r.Packet)
+	if err != nil {
+		s.log("error %v", err)
+		if s.fault == FaultWedgeOnMalformed {
+			s.mu.Lock()
+			s.wedged = true
+			s.mu.Unlock()
+			return
+		}
+		resp = s.reject(r.Packet, 0)
+	}
+	if resp == nil {
+		return
+	}
+	if err := radiusc.SetMessageAuthenticator(resp); err != nil {
+		s.log("error %v", err)
+		return
+	}
+	if err := w.Write(resp); err != nil {
+		s.log("error %v", err)
+	}
+}
+
+func (s *Server) isWedged() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.wedged
+}
+
+func (s *Server) handle(req *radius.Packet) (*radius.Packet, error) {
+	payload, ok, err := radiusc.LookupEAPMessage(req)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("mockserver: missing EAP-Message")
+	}
+	eapPkt, err := eap.Parse(payload)
+	if err != nil {
+		return nil, err
+	}
+	if eapPkt.Code != eap.CodeResponse {
+		return nil, fmt.Errorf("mockserver: unexpected EAP code %d", eapPkt.Code)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var sess *session
+	if state := rfc2865.State_Get(req); len(state) > 0 {
+		sess = s.sessions[string(state)]
+		if sess == nil {
+			return nil, fmt.Errorf("mockserver: unknown State")
+		}
+	} else {
+		if eapPkt.Type != eap.TypeIdentity {
+			return nil, fmt.Errorf("mockserver: session must start with EAP-Response/Identity")
+		}
+		sess, err = s.newSession(string(eapPkt.TypeData))
+		if err != nil {
+			return nil, err
+		}
+		sess.identifier = eapPkt.Identifier
+	}
+	if eapPkt.Identifier != sess.identifier {
+		return nil, fmt.Errorf("mockserver: EAP identifier %d does not match %d", eapPkt.Identifier, sess.identifier)
+	}
+
+	out, err := s.step(sess, eapPkt, payload)
+	if err != nil {
+		delete(s.sessions, sess.state)
+		s.log("failure identity=%s: %v", sess.identity, err)
+		return s.reject(req, sess.identifier), nil
+	}
+	if out.success {
+		delete(s.sessions, sess.state)
+		return s.accept(req, sess)
+	}
+	return s.challenge(req, sess, out.eap)
+}
+
+func (s *Server) newSession(identity string) (*session, error) {
+	state := make([]byte, 16)
+	if _, err := rand.Read(state); err != nil {
+		return nil, err
+	}
+	sess := &session{
+		state:      string(state),
+		identity:   identity,
+		methodType: s.methodForIdentity(identity),
+	}
+	s.sessions[sess.state] = sess
+	return sess, nil
+}
+
+func (s *Server) challenge(req *radius.Packet, sess *session, payload []byte) (*radius.Packet, error) {
+	resp := req.Response(radius.CodeAccessChallenge)
+	if s.fault != FaultMissingEAPMessage {
+		if err := radiusc.AddEAPMessage(resp, payload); err != nil {
+			return nil, err
+		}
+	}
+	if s.fault != FaultDropState {
+		if err := rfc2865.State_Set(resp, []byte(sess.state)); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) accept(req *radius.Packet, sess *session) (*radius.Packet, error) {
+	resp := req.Response(radius.CodeAccessAccept)
+	success := eap.Packet{Code: eap.CodeSuccess, Identifier: sess.identifier}
+	raw, err := success.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := radiusc.AddEAPMessage(resp, raw); err != nil {
+		return nil, err
+	}
+	if err := rfc2865.UserName_SetString(resp, sess.identity); err != nil {
+		return nil, err
+	}
+	if err := addMPPEKeys(resp, sess.msk, req.Authenticator[:]); err != nil {
+		return nil, err
+	}
+	s.log("accept identity=%s imsi=%s", sess.identity, sess.sub.IMSI)
+	return resp, nil
+}
+
+func (s *Server) reject(req *radius.Packet, identifier uint8) *radius.Packet {
+	resp := req.Response(radius.CodeAccessReject)
+	failure := eap.Packet{Code: eap.CodeFailure, Identifier: identifier}
+	if raw, err := failure.Encode(); err == nil {
+		_ = radiusc.AddEAPMessage(resp, raw)
+	}
+	return resp
+}
+
+// methodForIdentity selects the method from the RFC 4186/4187/5448 identity
+// prefix.
+func (s *Server) methodForIdentity(identity string) uint8 {
+	if suci.IsSUCI(identity) {
+		return eap.TypeAKAPrime
+	}
+	if method, ok := eap.MethodForIdentity(identity); ok {
+		return method
+	}
+	return s.defaultMethod
+}
+
+// resolve maps an identity (permanent, pseudonym or SUCI) to a subscriber.
+func (s *Server) resolve(identity string) *subscriberState {
+	if suci.IsSUCI(identity) {
+		return s.resolveSUCI(identity)
+	}
+	user := identity
+	if at := strings.IndexByte(user, '@'); at >= 0 {
+		user = user[:at]
+	}
+	if user == "" {
+		return nil
+	}
+	if imsi, ok := s.pseudonyms[user]; ok {
+		return s.subscribers[imsi]
+	}
+	switch user[0] {
+	case '0', '1', '6':
+		return s.subscribers[user[1:]]
+	case '2', '3', '7':
+		if imsi, ok := s.pseudonyms[user[1:]]; ok {
+			return s.subscribers[imsi]
+		}
+	}
+	return nil
+}
+
+func (s *Server) resolveSUCI(identity string) *subscriberState {
+	supi, err := suci.Deconceal(identity, s.suciKeys)
+	if err != nil {
+		s.log("suci identity=%s: %v", identity, err)
+		return nil
+	}
+	for imsi, sub := range s.subscribers {
+		if supi.Matches(imsi) {
+			return sub
+		}
+	}
+	return nil
+}
+
+func (s *Server) newPseudonym(imsi string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	pseudonym := hex.EncodeToString(b)
+	s.pseudonyms[pseudonym] = imsi
+	return pseudonym, nil
+}
+
+func (s *Server) log(format string, args ...interface{}) {
+	if s.logf != nil {
+		s.logf(format, args...)
+	}
+}
+
+func addMPPEKeys(p *radius.Packet, msk, reqAuth []byte) error {
+	if len(msk) < 64 {
+		return fmt.Errorf("mockserver: MSK must be 64 bytes")
+	}
+	recv, err := eapaka.EncryptMPPEKey(msk[0:32], p.Secret, reqAuth)
+	if err != nil {
+		return err
+	}
+	send, err := eapaka.EncryptMPPEKey(msk[32:64], p.Secret, reqAuth)
+	if err != nil {
+		return err
+	}
+	for _, tlv := range []struct {
+		typ   byte
+		value []byte
+	}{{msMPPESendKeyType, send}, {msMPPERecvKeyType, recv}} {
+		value := append([]byte{tlv.typ, byte(len(tlv.value) + 2)}, tlv.value...)
+		vsa, err := radius.NewVendorSpecific(vendorMicrosoftID, value)
+		if err != nil {
+			return err
+		}
+		p.Add(rfc2865.VendorSpecific_Type, vsa)
+	}
+	return nil
+}
+
+const (
+	vendorMicrosoftID = 311
+	msMPPESendKeyType = 16
+	msMPPERecvKeyType = 17
+)
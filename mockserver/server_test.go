@@ -0,0 +1,289 @@
+package mockserver
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+	"github.com/oyaguma3/eapaka_test/eapmethod/sim"
+	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/usim"
+
+	"layeh.com/radius"
+)
+
+const (
+	testIMSI    = "440100123456789"
+	testSecret  = "testing123"
+	testNetName = "WLAN"
+)
+
+var (
+	testKI  = bytes.Repeat([]byte{0x11}, 16)
+	testOPc = bytes.Repeat([]byte{0x22}, 16)
+)
+
+func TestServerAKAAccept(t *testing.T) {
+	addr := startServer(t, Options{})
+	peer, _ := newTestPeer(t, "0"+testIMSI+"@wlan.example", nil)
+	resp := runExchange(t, addr, peer)
+	if resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept, got %v", resp.Code)
+	}
+	if !resp.MPPE.SendKeyPresent || !resp.MPPE.RecvKeyPresent {
+		t.Fatalf("expected MPPE keys")
+	}
+}
+
+func TestServerAKAPrimeAccept(t *testing.T) {
+	addr := startServer(t, Options{IssuePseudonyms: true})
+	peer, _ := newTestPeer(t, "6"+testIMSI+"@wlan.example", nil)
+	resp := runExchange(t, addr, peer)
+	if resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept, got %v", resp.Code)
+	}
+}
+
+func TestServerResync(t *testing.T) {
+	server, addr := startServerWith(t, Options{})
+	store := sqnstore.NewMemoryStore()
+	state, err := sqnstore.DefaultPolicy().InitialState(0x100000)
+	if err != nil {
+		t.Fatalf("initial state failed: %v", err)
+	}
+	if err := store.Save(testIMSI, state); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	peer, _ := newTestPeer(t, "0"+testIMSI+"@wlan.example", store)
+	resp := runExchange(t, addr, peer)
+	if resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept after resync, got %v", resp.Code)
+	}
+	sqn, _ := server.SQN(testIMSI)
+	if sqn <= 0x100000 {
+		t.Fatalf("expected server SQN above SQN_MS, got %012x", sqn)
+	}
+}
+
+func TestServerPseudonymAndPermanentRequest(t *testing.T) {
+	addr := startServer(t, Options{})
+	peer, _ := newTestPeer(t, "2known@wlan.example", nil)
+	if resp := runExchange(t, addr, peer); resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept for known pseudonym, got %v", resp.Code)
+	}
+
+	peer, sess := newTestPeer(t, "2unknown@wlan.example", nil)
+	if resp := runExchange(t, addr, peer); resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept after permanent identity request, got %v", resp.Code)
+	}
+	if sess.InnerIdentity != "0"+testIMSI+"@wlan.example" {
+		t.Fatalf("expected permanent identity to be sent, got %q", sess.InnerIdentity)
+	}
+}
+
+func TestServerSIMAccept(t *testing.T) {
+	addr := startServer(t, Options{IssuePseudonyms: true})
+	peer, _ := newTestPeer(t, "1"+testIMSI+"@wlan.example", nil)
+	resp := runExchange(t, addr, peer)
+	if resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept, got %v", resp.Code)
+	}
+	if !resp.MPPE.SendKeyPresent || !resp.MPPE.RecvKeyPresent {
+		t.Fatalf("expected MPPE keys")
+	}
+
+	addr = startServer(t, Options{DefaultMethod: eap.TypeSIM, IdentityRequest: IdentityRequestPermanent})
+	peer, sess := newTestPeer(t, "anonymous@wlan.example", nil)
+	if resp := runExchange(t, addr, peer); resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept after SIM/Start permanent request, got %v", resp.Code)
+	}
+	if sess.InnerIdentity != "1"+testIMSI+"@wlan.example" {
+		t.Fatalf("expected permanent identity to be sent, got %q", sess.InnerIdentity)
+	}
+}
+
+func TestServerCOMP128SubscriberIsSIMOnly(t *testing.T) {
+	alg, err := usim.NewCOMP128(testKI)
+	if err != nil {
+		t.Fatalf("comp128 failed: %v", err)
+	}
+	server, err := New(Options{
+		Secret:      testSecret,
+		Subscribers: []Subscriber{{IMSI: testIMSI, GSM: alg}},
+	})
+	if err != nil {
+		t.Fatalf("new server failed: %v", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	addr := conn.LocalAddr().String()
+
+	method, err := sim.New(sim.Options{IMSI: testIMSI, Algorithm: alg})
+	if err != nil {
+		t.Fatalf("sim new failed: %v", err)
+	}
+	peer := eap.NewPeer(&eap.Session{OuterIdentity: "1" + testIMSI}, method)
+	if resp := runExchange(t, addr, peer); resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept, got %v", resp.Code)
+	}
+
+	peer, _ = newTestPeer(t, "0"+testIMSI, nil)
+	if resp := runExchange(t, addr, peer); resp.Code != radius.CodeAccessReject {
+		t.Fatalf("expected reject for EAP-AKA, got %v", resp.Code)
+	}
+}
+
+func TestServerWrongKeyRejects(t *testing.T) {
+	addr := startServer(t, Options{})
+	alg, err := usim.NewMilenage(bytes.Repeat([]byte{0x33}, 16), testOPc)
+	if err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	sess := &eap.Session{OuterIdentity: "0" + testIMSI + "@wlan.example"}
+	method, err := aka.New(aka.Options{
+		MethodType: eap.TypeAKA,
+		IMSI:       testIMSI,
+		Algorithm:  alg,
+		AMF:        []byte{0x80, 0x00},
+		Realm:      "wlan.example",
+	})
+	if err != nil {
+		t.Fatalf("aka new failed: %v", err)
+	}
+	resp := runExchange(t, addr, eap.NewPeer(sess, method))
+	if resp.Code != radius.CodeAccessReject {
+		t.Fatalf("expected reject, got %v", resp.Code)
+	}
+}
+
+func startServer(t *testing.T, opts Options) string {
+	t.Helper()
+	_, addr := startServerWith(t, opts)
+	return addr
+}
+
+func startServerWith(t *testing.T, opts Options) (*Server, string) {
+	t.Helper()
+	alg, err := usim.NewMilenage(testKI, testOPc)
+	if err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	opts.Secret = testSecret
+	opts.NetName = testNetName
+	opts.Subscribers = []Subscriber{{
+		IMSI:       testIMSI,
+		Algorithm:  alg,
+		AMF:        []byte{0x80, 0x00},
+		Pseudonyms: []string{"known"},
+	}}
+	server, err := New(opts)
+	if err != nil {
+		t.Fatalf("new server failed: %v", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return server, conn.LocalAddr().String()
+}
+
+func newTestPeer(t *testing.T, identity string, store sqnstore.Store) (*eap.Peer, *eap.Session) {
+	t.Helper()
+	if store == nil {
+		store = sqnstore.NewMemoryStore()
+	}
+	alg, err := usim.NewMilenage(testKI, testOPc)
+	if err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	sess := &eap.Session{OuterIdentity: identity}
+	gsm, err := usim.NewGSMContext(alg)
+	if err != nil {
+		t.Fatalf("gsm context failed: %v", err)
+	}
+	simMethod, err := sim.New(sim.Options{IMSI: testIMSI, Algorithm: gsm, Realm: "wlan.example"})
+	if err != nil {
+		t.Fatalf("sim new failed: %v", err)
+	}
+	methods := []eap.Method{simMethod}
+	for _, methodType := range []uint8{eap.TypeAKA, eap.TypeAKAPrime} {
+		method, err := aka.New(aka.Options{
+			MethodType: methodType,
+			IMSI:       testIMSI,
+			Algorithm:  alg,
+			AMF:        []byte{0x80, 0x00},
+			Realm:      "wlan.example",
+			SQNStore:   store,
+		})
+		if err != nil {
+			t.Fatalf("aka new failed: %v", err)
+		}
+		methods = append(methods, method)
+	}
+	return eap.NewPeer(sess, methods...), sess
+}
+
+func runExchange(t *testing.T, addr string, peer *eap.Peer) *radiusc.Response {
+	t.Helper()
+	client := radiusc.NewClient(addr, testSecret, time.Second, 0)
+	userName := peer.Session.OuterIdentity
+	next := &eap.Packet{Code: eap.CodeResponse, Type: eap.TypeIdentity, TypeData: []byte(userName)}
+	for i := 0; i < 10; i++ {
+		raw, err := next.Encode()
+		if err != nil {
+			t.Fatalf("encode failed: %v", err)
+		}
+		resp, err := client.ExchangeEAP(context.Background(), userName, raw, radiusc.Attributes{})
+		if err != nil {
+			t.Fatalf("exchange failed: %v", err)
+		}
+		if resp.Code != radius.CodeAccessChallenge {
+			return resp
+		}
+		req, err := eap.Parse(resp.EAP)
+		if err != nil {
+			t.Fatalf("parse failed: %v", err)
+		}
+		next, err = peer.Handle(req)
+		if err != nil {
+			t.Fatalf("peer handle failed: %v", err)
+		}
+		userName = peer.Session.OuterIdentity
+	}
+	t.Fatalf("too many round trips")
+	return nil
+}
+
+func TestNewRejectsUnknownFault(t *testing.T) {
+	alg, err := usim.NewMilenage(testKI, testOPc)
+	if err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	_, err = New(Options{
+		Secret:      testSecret,
+		Subscribers: []Subscriber{{IMSI: testIMSI, Algorithm: alg, AMF: []byte{0x80, 0x00}}},
+		Fault:       "garbled",
+	})
+	if err == nil {
+		t.Fatalf("expected error for unknown fault")
+	}
+}
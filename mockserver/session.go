@@ -0,0 +1,396 @@
+package mockserver
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+type stage int
+
+// kdfUnassigned is an AT_KDF value without a defined key derivation.
+const kdfUnassigned uint16 = 2
+
+const (
+	stageStart stage = iota
+	stageIdentity
+	stageChallenge
+)
+
+// session tracks one EAP conversation, keyed by the RADIUS State.
+type session struct {
+	state      string
+	identifier uint8
+	identity   string
+	methodType uint8
+	stage      stage
+	sub        *subscriberState
+
+	identityRequested  bool
+	permanentRequested bool
+	resynced           bool
+	nakked             bool
+	// kdfOffer is the AT_KDF list of the last AKA' challenge.
+	kdfOffer      []uint16
+	kdfNegotiated bool
+	// nonceMT is the AT_NONCE_MT of the last EAP-SIM Start response and
+	// sres the SRES values of the current EAP-SIM challenge.
+	nonceMT []byte
+	sres    []byte
+
+	vec  vector
+	kAut []byte
+	msk  []byte
+}
+
+type stepResult struct {
+	eap     []byte
+	success bool
+}
+
+func (s *Server) step(sess *session, pkt eap.Packet, raw []byte) (stepResult, error) {
+	if sess.stage == stageStart {
+		return s.afterIdentity(sess)
+	}
+	if s.fault == FaultAcceptAny && sess.stage == stageChallenge {
+		return stepResult{success: true}, nil
+	}
+	if pkt.Type == eap.TypeNak {
+		return s.nak(sess, pkt)
+	}
+	if pkt.Type != sess.methodType {
+		return stepResult{}, fmt.Errorf("mockserver: expected method %d, got %d", sess.methodType, pkt.Type)
+	}
+	if pkt.Type == eap.TypeSIM {
+		return s.simStep(sess, raw)
+	}
+	akaPkt, err := eapaka.Parse(raw)
+	if err != nil {
+		return stepResult{}, err
+	}
+	switch akaPkt.Subtype {
+	case eapaka.SubtypeIdentity:
+		if sess.stage != stageIdentity {
+			return stepResult{}, fmt.Errorf("mockserver: unexpected AKA-Identity")
+		}
+		for _, attr := range akaPkt.Attributes {
+			if id, ok := attr.(*eapaka.AtIdentity); ok {
+				sess.identity = id.Identity
+			}
+		}
+		return s.afterIdentity(sess)
+	case eapaka.SubtypeChallenge:
+		if sess.stage != stageChallenge {
+			return stepResult{}, fmt.Errorf("mockserver: unexpected AKA-Challenge")
+		}
+		if kdfs := eapaka.KdfValuesFromAttributes(akaPkt.Attributes); len(kdfs) > 0 && sess.methodType == eap.TypeAKAPrime {
+			return s.kdfReoffer(sess, kdfs)
+		}
+		return s.verifyChallenge(sess, akaPkt)
+	case eapaka.SubtypeSynchronizationFailure:
+		if sess.stage != stageChallenge {
+			return stepResult{}, fmt.Errorf("mockserver: unexpected AKA-Synchronization-Failure")
+		}
+		return s.resync(sess, akaPkt)
+	case eapaka.SubtypeAuthenticationReject:
+		return stepResult{}, fmt.Errorf("mockserver: peer sent AKA-Authentication-Reject")
+	case eapaka.SubtypeClientError:
+		return stepResult{}, fmt.Errorf("mockserver: peer sent AKA-Client-Error")
+	default:
+		return stepResult{}, fmt.Errorf("mockserver: unsupported subtype %d", akaPkt.Subtype)
+	}
+}
+
+// nak restarts the conversation with the first SIM, AKA or AKA' type the
+// peer offered. A second Nak ends the session.
+func (s *Server) nak(sess *session, pkt eap.Packet) (stepResult, error) {
+	if sess.nakked {
+		return stepResult{}, fmt.Errorf("mockserver: repeated Nak")
+	}
+	sess.nakked = true
+	for _, t := range pkt.TypeData {
+		if t != sess.methodType && (t == eap.TypeSIM || t == eap.TypeAKA || t == eap.TypeAKAPrime) {
+			s.log("nak method=%d -> %d identity=%s", sess.methodType, t, sess.identity)
+			sess.methodType = t
+			sess.identityRequested = false
+			sess.permanentRequested = false
+			sess.nonceMT = nil
+			return s.afterIdentity(sess)
+		}
+	}
+	return stepResult{}, fmt.Errorf("mockserver: Nak offers no supported method (%x)", pkt.TypeData)
+}
+
+// afterIdentity sends an identity request or starts the challenge.
+func (s *Server) afterIdentity(sess *session) (stepResult, error) {
+	if !sess.identityRequested && s.identityRequest != IdentityRequestNone {
+		sess.identityRequested = true
+		if s.identityRequest == IdentityRequestPermanent {
+			sess.permanentRequested = true
+		}
+		return s.identityRequestFor(sess, s.identityRequest)
+	}
+	if sess.methodType == eap.TypeSIM && sess.nonceMT == nil {
+		// EAP-SIM always starts with a Start round.
+		return s.simStart(sess, IdentityRequestNone)
+	}
+	sub := s.resolve(sess.identity)
+	if sub == nil {
+		if sess.permanentRequested {
+			return stepResult{}, fmt.Errorf("mockserver: unknown identity %q", sess.identity)
+		}
+		sess.permanentRequested = true
+		s.log("identity=%s unknown, requesting permanent identity", sess.identity)
+		return s.identityRequestFor(sess, IdentityRequestPermanent)
+	}
+	sess.sub = sub
+	return s.newChallenge(sess)
+}
+
+func (s *Server) identityRequestFor(sess *session, mode string) (stepResult, error) {
+	if sess.methodType == eap.TypeSIM {
+		return s.simStart(sess, mode)
+	}
+	var attr eapaka.Attribute
+	switch mode {
+	case IdentityRequestAny:
+		attr = &eapaka.AtAnyIdReq{}
+	case IdentityRequestFullauth:
+		attr = &eapaka.AtFullauthIdReq{}
+	default:
+		attr = &eapaka.AtPermanentIdReq{}
+	}
+	sess.stage = stageIdentity
+	sess.identifier++
+	req := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: sess.identifier,
+		Type:       sess.methodType,
+		Subtype:    eapaka.SubtypeIdentity,
+		Attributes: []eapaka.Attribute{attr},
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		return stepResult{}, err
+	}
+	s.log("identity_request mode=%s identity=%s", mode, sess.identity)
+	return stepResult{eap: raw}, nil
+}
+
+func (s *Server) newChallenge(sess *session) (stepResult, error) {
+	if sess.methodType == eap.TypeSIM {
+		return s.simChallenge(sess)
+	}
+	if sess.sub.Algorithm == nil {
+		return stepResult{}, fmt.Errorf("mockserver: subscriber %s supports EAP-SIM only", sess.sub.IMSI)
+	}
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return stepResult{}, err
+	}
+	var amf []byte
+	if s.fault == FaultAMFMismatch {
+		amf = []byte{sess.sub.AMF[0], sess.sub.AMF[1] ^ 0x01}
+	}
+	vec, err := sess.sub.nextVector(randBytes, amf)
+	if err != nil {
+		return stepResult{}, err
+	}
+	if s.fault == FaultWrongMACA {
+		vec.autn[15] ^= 0xff
+	}
+	sess.vec = vec
+	sess.kdfNegotiated = false
+	offer := s.kdfs
+	if s.fault == FaultKDFBiddingDown {
+		// Lead with a KDF the peer cannot derive so that it asks for KDF 1;
+		// kdfReoffer then strips the original list.
+		offer = []uint16{kdfUnassigned, eapaka.KDFAKAPrimeWithCKIK}
+	}
+	return s.challengeRequest(sess, offer)
+}
+
+// kdfReoffer answers an AKA'-Challenge response that only selects an
+// alternative KDF with the same challenge, re-offered as the selected value
+// followed by the original list (RFC 9048 Section 3.2).
+func (s *Server) kdfReoffer(sess *session, values []uint16) (stepResult, error) {
+	if sess.kdfNegotiated {
+		return stepResult{}, fmt.Errorf("mockserver: repeated AT_KDF negotiation")
+	}
+	selected, err := eapaka.ValidateKdfResponse(sess.kdfOffer, values)
+	if err != nil {
+		return stepResult{}, fmt.Errorf("mockserver: %w", err)
+	}
+	if selected != eapaka.KDFAKAPrimeWithCKIK {
+		return stepResult{}, fmt.Errorf("mockserver: AT_KDF %d has no key derivation", selected)
+	}
+	sess.kdfNegotiated = true
+	s.log("kdf_negotiation selected=%d offer=%v", selected, sess.kdfOffer)
+	if s.fault == FaultKDFBiddingDown {
+		return s.challengeRequest(sess, []uint16{selected})
+	}
+	return s.challengeRequest(sess, append([]uint16{selected}, sess.kdfOffer...))
+}
+
+// challengeRequest sends the AKA/AKA' challenge for sess.vec with the given
+// AT_KDF list (AKA' only).
+func (s *Server) challengeRequest(sess *session, kdfs []uint16) (stepResult, error) {
+	vec := sess.vec
+	attrs := []eapaka.Attribute{
+		&eapaka.AtRand{Rand: vec.rand},
+		&eapaka.AtAutn{Autn: vec.autn},
+	}
+	var kEncr []byte
+	if sess.methodType == eap.TypeAKAPrime {
+		if s.netName == "" {
+			return stepResult{}, fmt.Errorf("mockserver: net_name is required for AKA'")
+		}
+		ckPrime, ikPrime, err := eapaka.DeriveCKPrimeIKPrime(vec.ck, vec.ik, s.netName, vec.autn)
+		if err != nil {
+			return stepResult{}, err
+		}
+		identity, err := aka.KeyDerivationIdentity(sess.identity, sess.sub.IMSI, s.netName, eapaka.KDFAKAPrimeWithCKIK)
+		if err != nil {
+			return stepResult{}, err
+		}
+		keys := eapaka.DeriveKeysAKAPrime(identity, ckPrime, ikPrime)
+		sess.kAut, sess.msk, kEncr = keys.K_aut, keys.MSK, keys.K_encr
+		sess.kdfOffer = kdfs
+		if sess.kdfNegotiated {
+			sess.kdfOffer = kdfs[1:]
+		}
+		attrs = append(attrs, &eapaka.AtKdfInput{NetworkName: s.netName})
+		for _, kdf := range kdfs {
+			attrs = append(attrs, &eapaka.AtKdf{KDF: kdf})
+		}
+	} else {
+		keys := eapaka.DeriveKeysAKA(sess.identity, vec.ck, vec.ik)
+		sess.kAut, sess.msk, kEncr = keys.K_aut, keys.MSK, keys.K_encr
+		if s.bidding {
+			attrs = append(attrs, &eapaka.AtBidding{Flags: eapaka.AtBiddingFlagAKAPrime})
+		}
+	}
+	if s.issuePseudonyms {
+		pseudonym, err := s.newPseudonym(sess.sub.IMSI)
+		if err != nil {
+			return stepResult{}, err
+		}
+		encrAttrs, err := encryptAttributes(kEncr, &eapaka.AtNextPseudonym{Pseudonym: pseudonym})
+		if err != nil {
+			return stepResult{}, err
+		}
+		attrs = append(attrs, encrAttrs...)
+	}
+	attrs = append(attrs, &eapaka.AtMac{MAC: make([]byte, 16)})
+
+	sess.stage = stageChallenge
+	sess.identifier++
+	req := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: sess.identifier,
+		Type:       sess.methodType,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: attrs,
+	}
+	if err := req.CalculateAndSetMac(sess.kAut); err != nil {
+		return stepResult{}, err
+	}
+	if s.fault == FaultBadATMAC {
+		mac, _ := findMac(req)
+		mac.MAC[0] ^= 0xff
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		return stepResult{}, err
+	}
+	s.log("challenge identity=%s imsi=%s sqn=%012x", sess.identity, sess.sub.IMSI, sess.sub.SQN)
+	return stepResult{eap: raw}, nil
+}
+
+func (s *Server) verifyChallenge(sess *session, resp *eapaka.Packet) (stepResult, error) {
+	ok, err := resp.VerifyMac(sess.kAut)
+	if err != nil {
+		return stepResult{}, err
+	}
+	if !ok {
+		return stepResult{}, fmt.Errorf("mockserver: response MAC mismatch")
+	}
+	var res []byte
+	for _, attr := range resp.Attributes {
+		if r, ok := attr.(*eapaka.AtRes); ok {
+			res = r.Res
+		}
+	}
+	if !bytes.Equal(res, sess.vec.xres) {
+		return stepResult{}, fmt.Errorf("mockserver: RES mismatch")
+	}
+	return stepResult{success: true}, nil
+}
+
+func (s *Server) resync(sess *session, resp *eapaka.Packet) (stepResult, error) {
+	if sess.resynced {
+		return stepResult{}, fmt.Errorf("mockserver: repeated synchronization failure")
+	}
+	var auts []byte
+	for _, attr := range resp.Attributes {
+		if a, ok := attr.(*eapaka.AtAuts); ok {
+			auts = a.Auts
+		}
+	}
+	if err := sess.sub.resync(sess.vec.rand, auts); err != nil {
+		return stepResult{}, err
+	}
+	sess.resynced = true
+	s.log("resync imsi=%s sqn_ms=%012x", sess.sub.IMSI, sess.sub.SQN)
+	return s.newChallenge(sess)
+}
+
+// encryptAttributes builds AT_IV and AT_ENCR_DATA (RFC 4187 10.12) with
+// AES-128-CBC under K_encr, padding the plaintext with AT_PADDING.
+func encryptAttributes(kEncr []byte, attrs ...eapaka.Attribute) ([]eapaka.Attribute, error) {
+	var plain []byte
+	for _, attr := range attrs {
+		b, err := attr.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, b...)
+	}
+	if rem := len(plain) % aes.BlockSize; rem != 0 {
+		pad, err := (&eapaka.AtPadding{Length: aes.BlockSize - rem - 2}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		plain = append(plain, pad...)
+	}
+	block, err := aes.NewCipher(kEncr)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+	return []eapaka.Attribute{
+		&eapaka.AtIv{IV: iv},
+		&eapaka.AtEncrData{EncryptedData: encrypted},
+	}, nil
+}
+
+func findMac(pkt *eapaka.Packet) (*eapaka.AtMac, bool) {
+	for _, attr := range pkt.Attributes {
+		if mac, ok := attr.(*eapaka.AtMac); ok {
+			return mac, true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,142 @@
+package mockserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/eapmethod/sim"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+// simRands is the number of GSM triplets used per EAP-SIM challenge.
+const simRands = 3
+
+// simStart sends EAP-Request/SIM/Start offering version 1, with an identity
+// request attribute unless mode is none.
+func (s *Server) simStart(sess *session, mode string) (stepResult, error) {
+	attrs := []eapaka.Attribute{&eapaka.AtVersionList{Versions: []uint16{sim.Version}}}
+	switch mode {
+	case IdentityRequestNone:
+	case IdentityRequestAny:
+		attrs = append(attrs, &eapaka.AtAnyIdReq{})
+	case IdentityRequestFullauth:
+		attrs = append(attrs, &eapaka.AtFullauthIdReq{})
+	default:
+		attrs = append(attrs, &eapaka.AtPermanentIdReq{})
+	}
+	sess.stage = stageIdentity
+	sess.identifier++
+	req := &sim.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: sess.identifier,
+		Subtype:    sim.SubtypeStart,
+		Attributes: attrs,
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		return stepResult{}, err
+	}
+	s.log("sim_start mode=%s identity=%s", mode, sess.identity)
+	return stepResult{eap: raw}, nil
+}
+
+func (s *Server) simStep(sess *session, raw []byte) (stepResult, error) {
+	pkt, err := sim.Parse(raw)
+	if err != nil {
+		return stepResult{}, err
+	}
+	switch pkt.Subtype {
+	case sim.SubtypeStart:
+		if sess.stage != stageIdentity {
+			return stepResult{}, fmt.Errorf("mockserver: unexpected SIM/Start")
+		}
+		attr, ok := pkt.Attribute(eapaka.AT_NONCE_MT)
+		if !ok {
+			return stepResult{}, fmt.Errorf("mockserver: SIM/Start response without AT_NONCE_MT")
+		}
+		sess.nonceMT = attr.(*eapaka.AtNonceMt).NonceMt
+		if attr, ok := pkt.Attribute(eapaka.AT_IDENTITY); ok {
+			sess.identity = attr.(*eapaka.AtIdentity).Identity
+		}
+		return s.afterIdentity(sess)
+	case sim.SubtypeChallenge:
+		if sess.stage != stageChallenge {
+			return stepResult{}, fmt.Errorf("mockserver: unexpected SIM/Challenge")
+		}
+		ok, err := pkt.VerifyMac(sess.kAut, sess.sres)
+		if err != nil {
+			return stepResult{}, err
+		}
+		if !ok {
+			return stepResult{}, fmt.Errorf("mockserver: response MAC mismatch")
+		}
+		return stepResult{success: true}, nil
+	case sim.SubtypeClientError:
+		var code uint16
+		if attr, ok := pkt.Attribute(eapaka.AT_CLIENT_ERROR_CODE); ok {
+			code = attr.(*eapaka.AtClientErrorCode).Code
+		}
+		return stepResult{}, fmt.Errorf("mockserver: peer sent SIM/Client-Error code=%d", code)
+	default:
+		return stepResult{}, fmt.Errorf("mockserver: unsupported SIM subtype %d", pkt.Subtype)
+	}
+}
+
+// simChallenge sends EAP-Request/SIM/Challenge built from fresh GSM triplets.
+func (s *Server) simChallenge(sess *session) (stepResult, error) {
+	rands := make([][]byte, simRands)
+	var sres, kcs [][]byte
+	for i := range rands {
+		rands[i] = make([]byte, 16)
+		if _, err := rand.Read(rands[i]); err != nil {
+			return stepResult{}, err
+		}
+		sr, kc, err := sess.sub.GSM.A3A8(rands[i])
+		if err != nil {
+			return stepResult{}, err
+		}
+		sres = append(sres, sr)
+		kcs = append(kcs, kc)
+	}
+	keys := sim.DeriveKeys(sess.identity, kcs, sess.nonceMT, []uint16{sim.Version}, sim.Version)
+	sess.kAut, sess.msk = keys.KAut, keys.MSK
+	sess.sres = bytes.Join(sres, nil)
+
+	attrs := []eapaka.Attribute{&sim.AtRand{Rands: rands}}
+	if s.issuePseudonyms {
+		pseudonym, err := s.newPseudonym(sess.sub.IMSI)
+		if err != nil {
+			return stepResult{}, err
+		}
+		encrAttrs, err := encryptAttributes(keys.KEncr, &eapaka.AtNextPseudonym{Pseudonym: pseudonym})
+		if err != nil {
+			return stepResult{}, err
+		}
+		attrs = append(attrs, encrAttrs...)
+	}
+	mac := &eapaka.AtMac{MAC: make([]byte, 16)}
+	attrs = append(attrs, mac)
+
+	sess.stage = stageChallenge
+	sess.identifier++
+	req := &sim.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: sess.identifier,
+		Subtype:    sim.SubtypeChallenge,
+		Attributes: attrs,
+	}
+	if err := req.CalculateAndSetMac(sess.kAut, sess.nonceMT); err != nil {
+		return stepResult{}, err
+	}
+	if s.fault == FaultBadATMAC {
+		mac.MAC[0] ^= 0xff
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		return stepResult{}, err
+	}
+	s.log("sim_challenge identity=%s imsi=%s", sess.identity, sess.sub.IMSI)
+	return stepResult{eap: raw}, nil
+}
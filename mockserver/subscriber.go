@@ -0,0 +1,167 @@
+package mockserver
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/usim"
+)
+
+// Subscriber is the HSS-side record used to generate authentication vectors.
+// SQN is the last sequence number handed out; each new vector advances SEQ
+// by one with IND=0.
+type Subscriber struct {
+	IMSI      string
+	Algorithm usim.Algorithm
+	// GSM computes EAP-SIM triplets. It defaults to the c2/c3 conversion of
+	// Algorithm; a subscriber with only GSM set supports EAP-SIM only.
+	GSM        usim.GSMAlgorithm
+	AMF        []byte
+	SQN        uint64
+	IndBits    int
+	Pseudonyms []string
+}
+
+// vector is one authentication quintet.
+type vector struct {
+	rand []byte
+	autn []byte
+	xres []byte
+	ck   []byte
+	ik   []byte
+}
+
+type subscriberState struct {
+	Subscriber
+}
+
+func newSubscriberState(sub Subscriber) (*subscriberState, error) {
+	if sub.IMSI == "" {
+		return nil, fmt.Errorf("mockserver: subscriber IMSI is required")
+	}
+	if sub.Algorithm == nil && sub.GSM == nil {
+		return nil, fmt.Errorf("mockserver: subscriber %s has no algorithm", sub.IMSI)
+	}
+	if sub.Algorithm != nil && len(sub.AMF) != 2 {
+		return nil, fmt.Errorf("mockserver: subscriber %s AMF must be 2 bytes", sub.IMSI)
+	}
+	if sub.GSM == nil {
+		gsm, err := usim.NewGSMContext(sub.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		sub.GSM = gsm
+	}
+	if sub.SQN > sqnstore.MaxSQN {
+		return nil, fmt.Errorf("mockserver: subscriber %s SQN exceeds 48 bits", sub.IMSI)
+	}
+	indBits := sub.IndBits
+	if indBits == 0 {
+		indBits = sqnstore.IndBits
+	}
+	if indBits < 0 || indBits > sqnstore.MaxIndBits {
+		return nil, fmt.Errorf("mockserver: subscriber %s ind_bits out of range", sub.IMSI)
+	}
+	sub.IndBits = indBits
+	sub.AMF = append([]byte(nil), sub.AMF...)
+	sub.Pseudonyms = append([]string(nil), sub.Pseudonyms...)
+	return &subscriberState{Subscriber: sub}, nil
+}
+
+// nextVector advances SQN and computes a vector for rand. amf overrides the
+// subscriber AMF when non-nil.
+func (s *subscriberState) nextVector(rand, amf []byte) (vector, error) {
+	seq, _, err := sqnstore.SplitSQNBits(s.SQN, s.IndBits)
+	if err != nil {
+		return vector{}, err
+	}
+	next, err := sqnstore.CombineSQNBits((seq+1)&(sqnstore.MaxSQN>>uint(s.IndBits)), 0, s.IndBits)
+	if err != nil {
+		return vector{}, err
+	}
+	if amf == nil {
+		amf = s.AMF
+	}
+	v, err := s.vectorFor(rand, next, amf)
+	if err != nil {
+		return vector{}, err
+	}
+	s.SQN = next
+	return v, nil
+}
+
+func (s *subscriberState) vectorFor(rand []byte, sqn uint64, amf []byte) (vector, error) {
+	sqnBytes := encodeSQN(sqn)
+	macA, err := s.Algorithm.F1(rand, sqnBytes, amf)
+	if err != nil {
+		return vector{}, err
+	}
+	res, ck, ik, ak, err := s.Algorithm.F2345(rand)
+	if err != nil {
+		return vector{}, err
+	}
+	if len(macA) != 8 || len(ak) != 6 {
+		return vector{}, fmt.Errorf("mockserver: invalid MAC-A/AK length")
+	}
+	if len(ck) != 16 || len(ik) != 16 {
+		return vector{}, fmt.Errorf("mockserver: CK/IK must be 128 bits")
+	}
+	autn := make([]byte, 16)
+	for i := 0; i < 6; i++ {
+		autn[i] = sqnBytes[i] ^ ak[i]
+	}
+	copy(autn[6:8], amf)
+	copy(autn[8:16], macA)
+	return vector{
+		rand: append([]byte(nil), rand...),
+		autn: autn,
+		xres: res,
+		ck:   ck,
+		ik:   ik,
+	}, nil
+}
+
+// resync verifies AUTS for rand and adopts SQN_MS (TS 33.102 6.3.5).
+func (s *subscriberState) resync(rand, auts []byte) error {
+	if len(auts) != 14 {
+		return fmt.Errorf("mockserver: AUTS must be 14 bytes")
+	}
+	aks, err := s.Algorithm.F5Star(rand)
+	if err != nil {
+		return err
+	}
+	if len(aks) != 6 {
+		return fmt.Errorf("mockserver: invalid AK* length")
+	}
+	sqnMS := make([]byte, 6)
+	for i := 0; i < 6; i++ {
+		sqnMS[i] = auts[i] ^ aks[i]
+	}
+	macS, err := s.Algorithm.F1Star(rand, sqnMS, []byte{0x00, 0x00})
+	if err != nil {
+		return err
+	}
+	if len(macS) < 8 || !bytes.Equal(macS[:8], auts[6:14]) {
+		return fmt.Errorf("mockserver: AUTS MAC-S mismatch")
+	}
+	s.SQN = decodeSQN(sqnMS)
+	return nil
+}
+
+func encodeSQN(sqn uint64) []byte {
+	out := make([]byte, 6)
+	for i := 5; i >= 0; i-- {
+		out[i] = byte(sqn)
+		sqn >>= 8
+	}
+	return out
+}
+
+func decodeSQN(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
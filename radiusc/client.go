@@ -2,6 +2,7 @@ package radiusc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"time"
@@ -36,7 +37,35 @@ type Client struct {
 
 	State []byte
 
-	client *radius.Client
+	// Record, when set, receives every request/response pair in wire format.
+	Record *Recording
+	// Replay, when set, answers requests from a recording instead of the
+	// network after checking each request against the recorded one.
+	Replay *Recording
+	// Capture, when set, receives each request and response with the time
+	// it was sent or received.
+	Capture PacketCapture
+	// Observer, when set, is told about requests, replies and timeouts of
+	// network exchanges (not replays).
+	Observer Observer
+
+	replayer *replayer
+}
+
+// PacketCapture receives RADIUS packets in wire format. outbound is true
+// for Access-Requests.
+type PacketCapture interface {
+	CapturePacket(outbound bool, data []byte, at time.Time) error
+}
+
+// Observer receives per-exchange events for metrics. server is the
+// configured server address.
+type Observer interface {
+	// RequestSent reports an Access-Request and how many times it was
+	// resent before the exchange ended.
+	RequestSent(server string, retransmits int)
+	Timeout(server string)
+	Response(server string, code radius.Code)
 }
 
 // NewClient initializes a new RADIUS client.
@@ -51,15 +80,19 @@ func NewClient(addr, secret string, timeout time.Duration, retries int) *Client
 
 // ExchangeEAP sends an Access-Request with EAP-Message and returns the response.
 func (c *Client) ExchangeEAP(ctx context.Context, userName string, eap []byte, attrs Attributes) (*Response, error) {
+	packet, err := c.NewRequest(userName, eap, attrs)
+	if err != nil {
+		return nil, err
+	}
+	return c.Exchange(ctx, packet)
+}
+
+// NewRequest builds the Access-Request ExchangeEAP would send, echoing the
+// retained State, so callers can inspect it before calling Exchange.
+func (c *Client) NewRequest(userName string, eap []byte, attrs Attributes) (*radius.Packet, error) {
 	if c == nil {
 		return nil, fmt.Errorf("radiusc: client is nil")
 	}
-	if ctx == nil {
-		ctx = context.Background()
-	}
-	if c.Addr == "" {
-		return nil, fmt.Errorf("radiusc: server address is required")
-	}
 	if c.Secret == "" {
 		return nil, fmt.Errorf("radiusc: secret is required")
 	}
@@ -81,7 +114,20 @@ func (c *Client) ExchangeEAP(ctx context.Context, userName string, eap []byte, a
 	if err := SetMessageAuthenticator(packet); err != nil {
 		return nil, err
 	}
+	return packet, nil
+}
 
+// Exchange sends a request built by NewRequest and parses the response.
+func (c *Client) Exchange(ctx context.Context, packet *radius.Packet) (*Response, error) {
+	if c == nil {
+		return nil, fmt.Errorf("radiusc: client is nil")
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if c.Addr == "" {
+		return nil, fmt.Errorf("radiusc: server address is required")
+	}
 	resp, err := c.exchange(ctx, packet)
 	if err != nil {
 		return nil, err
@@ -114,14 +160,29 @@ func (c *Client) ResetState() {
 }
 
 func (c *Client) exchange(ctx context.Context, packet *radius.Packet) (*radius.Packet, error) {
-	client := c.client
-	if client == nil {
-		client = &radius.Client{}
+	if c.Capture != nil {
+		if err := c.capture(true, packet); err != nil {
+			return nil, err
+		}
 	}
-	if c.Timeout > 0 && c.Retries > 0 {
-		client.Retry = c.Timeout
-	} else {
-		client.Retry = 0
+	resp, err := c.send(ctx, packet)
+	if err != nil {
+		return nil, err
+	}
+	if c.Capture != nil {
+		if err := c.capture(false, resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (c *Client) send(ctx context.Context, packet *radius.Packet) (*radius.Packet, error) {
+	if c.Replay != nil {
+		if c.replayer == nil || c.replayer.rec != c.Replay {
+			c.replayer = &replayer{rec: c.Replay}
+		}
+		return c.replayer.exchange(packet)
 	}
 	if c.Timeout > 0 {
 		total := c.Timeout
@@ -132,7 +193,109 @@ func (c *Client) exchange(ctx context.Context, packet *radius.Packet) (*radius.P
 		ctx, cancel = context.WithTimeout(ctx, total)
 		defer cancel()
 	}
-	return client.Exchange(ctx, packet, c.Addr)
+	resp, retransmits, err := c.roundTrip(ctx, packet)
+	if c.Observer != nil {
+		c.Observer.RequestSent(c.Addr, retransmits)
+		if err == nil {
+			c.Observer.Response(c.Addr, resp.Code)
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			c.Observer.Timeout(c.Addr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.Record != nil {
+		if err := c.record(packet, resp); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// roundTrip sends packet from one UDP socket, resends it every c.Timeout
+// up to c.Retries times, and returns the first authentic reply with the
+// number of resends. Replies that do not parse or verify are dropped.
+func (c *Client) roundTrip(ctx context.Context, packet *radius.Packet) (*radius.Packet, int, error) {
+	wire, err := packet.Encode()
+	if err != nil {
+		return nil, 0, err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", c.Addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		return nil, 0, err
+	}
+	defer conn.Close()
+	// Unblock Read once ctx ends.
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	if _, err := conn.Write(wire); err != nil {
+		return nil, 0, err
+	}
+	retransmits := 0
+	var resendAt time.Time
+	if c.Timeout > 0 && c.Retries > 0 {
+		resendAt = time.Now().Add(c.Timeout)
+	}
+	var incoming [radius.MaxPacketLength]byte
+	for {
+		if err := conn.SetReadDeadline(resendAt); err != nil {
+			return nil, retransmits, err
+		}
+		if ctx.Err() != nil {
+			return nil, retransmits, ctx.Err()
+		}
+		n, err := conn.Read(incoming[:])
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, retransmits, ctx.Err()
+			}
+			var netErr net.Error
+			if !resendAt.IsZero() && errors.As(err, &netErr) && netErr.Timeout() {
+				if _, err := conn.Write(wire); err != nil {
+					return nil, retransmits, err
+				}
+				retransmits++
+				resendAt = time.Time{}
+				if retransmits < c.Retries {
+					resendAt = time.Now().Add(c.Timeout)
+				}
+				continue
+			}
+			return nil, retransmits, err
+		}
+		resp, err := radius.Parse(incoming[:n], packet.Secret)
+		if err != nil || !radius.IsAuthenticResponse(incoming[:n], wire, packet.Secret) {
+			continue
+		}
+		return resp, retransmits, nil
+	}
+}
+
+func (c *Client) capture(outbound bool, packet *radius.Packet) error {
+	data, err := packet.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.Capture.CapturePacket(outbound, data, time.Now())
+}
+
+func (c *Client) record(request, response *radius.Packet) error {
+	req, err := request.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	resp, err := response.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.Record.add(req, resp)
+	return nil
 }
 
 func applyAttrs(packet *radius.Packet, attrs Attributes) error {
@@ -0,0 +1,85 @@
+package radiusc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+type countingObserver struct {
+	requests, retransmits, timeouts int
+}
+
+func (o *countingObserver) RequestSent(server string, retransmits int) {
+	o.requests++
+	o.retransmits += retransmits
+}
+func (o *countingObserver) Timeout(server string)                    { o.timeouts++ }
+func (o *countingObserver) Response(server string, code radius.Code) {}
+
+// TestExchangeCountsResends drops the first two copies of a request and
+// checks that the observer sees exactly the resends, all from one socket.
+func TestExchangeCountsResends(t *testing.T) {
+	secret := []byte("secret")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer conn.Close()
+	sources := make(chan string, 8)
+	go func() {
+		var buf [radius.MaxPacketLength]byte
+		for seen := 0; ; seen++ {
+			n, addr, err := conn.ReadFrom(buf[:])
+			if err != nil {
+				return
+			}
+			sources <- addr.String()
+			if seen < 2 {
+				continue
+			}
+			req, err := radius.Parse(buf[:n], secret)
+			if err != nil {
+				return
+			}
+			reply, _ := req.Response(radius.CodeAccessAccept).Encode()
+			conn.WriteTo(reply, addr)
+		}
+	}()
+
+	obs := &countingObserver{}
+	client := NewClient(conn.LocalAddr().String(), string(secret), 50*time.Millisecond, 3)
+	client.Observer = obs
+	resp, err := client.Exchange(context.Background(), radius.New(radius.CodeAccessRequest, secret))
+	if err != nil || resp.Code != radius.CodeAccessAccept {
+		t.Fatalf("exchange failed: %+v %v", resp, err)
+	}
+	if obs.requests != 1 || obs.retransmits != 2 || obs.timeouts != 0 {
+		t.Fatalf("unexpected observer counts %+v", obs)
+	}
+	first := <-sources
+	for i := 0; i < 2; i++ {
+		if src := <-sources; src != first {
+			t.Fatalf("resend came from %s, first copy from %s", src, first)
+		}
+	}
+
+	// Without an answer every allowed resend is counted once.
+	obs = &countingObserver{}
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	defer silent.Close()
+	client = NewClient(silent.LocalAddr().String(), string(secret), 20*time.Millisecond, 2)
+	client.Observer = obs
+	if _, err := client.Exchange(context.Background(), radius.New(radius.CodeAccessRequest, secret)); err == nil {
+		t.Fatalf("expected timeout")
+	}
+	if obs.retransmits != 2 || obs.timeouts != 1 {
+		t.Fatalf("unexpected observer counts %+v", obs)
+	}
+}
@@ -1,6 +1,7 @@
 package radiusc
 
 import (
+	"crypto/md5"
 	"fmt"
 
 	"layeh.com/radius"
@@ -78,3 +79,36 @@ func parseVendorTLVs(b []byte) ([]vendorTLV, error) {
 	}
 	return out, nil
 }
+
+// DecryptMPPEKey reverses the RFC 2548 2.4.2 salt-encryption of an
+// MS-MPPE-Send/Recv-Key value using the Access-Request authenticator.
+func DecryptMPPEKey(value, secret, reqAuth []byte) ([]byte, error) {
+	if len(value) < 2+16 || (len(value)-2)%16 != 0 {
+		return nil, fmt.Errorf("radiusc: invalid MPPE key length")
+	}
+	if len(reqAuth) != 16 {
+		return nil, fmt.Errorf("radiusc: request authenticator must be 16 bytes")
+	}
+	salt := value[:2]
+	cipherText := value[2:]
+	plain := make([]byte, len(cipherText))
+	h := md5.New()
+	h.Write(secret)
+	h.Write(reqAuth)
+	h.Write(salt)
+	b := h.Sum(nil)
+	for i := 0; i < len(cipherText); i += 16 {
+		for j := 0; j < 16; j++ {
+			plain[i+j] = cipherText[i+j] ^ b[j]
+		}
+		h.Reset()
+		h.Write(secret)
+		h.Write(cipherText[i : i+16])
+		b = h.Sum(nil)
+	}
+	keyLen := int(plain[0])
+	if keyLen > len(plain)-1 {
+		return nil, fmt.Errorf("radiusc: invalid decrypted MPPE key length")
+	}
+	return plain[1 : 1+keyLen], nil
+}
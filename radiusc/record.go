@@ -0,0 +1,250 @@
+package radiusc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+const recordingVersion = 1
+
+// Recording is a captured RADIUS conversation. Packets are stored in wire
+// format; the shared secret and decrypted keys are kept in a separate
+// secrets file so the recording itself can be shared.
+type Recording struct {
+	Version   int                `json:"version"`
+	Exchanges []RecordedExchange `json:"exchanges"`
+	// SUCIEphemeralKey is the fixed ECIES key the run concealed its SUCI
+	// with. It reveals the IMSI, so Save writes it to the secrets file.
+	SUCIEphemeralKey []byte `json:"-"`
+}
+
+// RecordedExchange holds one Access-Request and its response as hex.
+type RecordedExchange struct {
+	Request  string `json:"request"`
+	Response string `json:"response"`
+}
+
+// RecordingSecrets holds the material excluded from a Recording.
+type RecordingSecrets struct {
+	Secret           string             `json:"secret"`
+	Keys             []RecordedMPPEKeys `json:"keys,omitempty"`
+	SUCIEphemeralKey string             `json:"suci_ephemeral_key,omitempty"`
+}
+
+// RecordedMPPEKeys holds decrypted MPPE keys of one exchange.
+type RecordedMPPEKeys struct {
+	Exchange int    `json:"exchange"`
+	SendKey  string `json:"send_key,omitempty"`
+	RecvKey  string `json:"recv_key,omitempty"`
+}
+
+// ReplayMismatchError reports a generated request that differs from the
+// recorded one outside of the identifier and authenticators.
+type ReplayMismatchError struct {
+	Exchange int
+	Expected []byte
+	Actual   []byte
+}
+
+func (e *ReplayMismatchError) Error() string {
+	return fmt.Sprintf("radiusc: replay request %d mismatch: expected %x got %x", e.Exchange, e.Expected, e.Actual)
+}
+
+// SecretsPath returns the secrets file path used for a recording path.
+func SecretsPath(path string) string {
+	return path + ".secrets.json"
+}
+
+// LoadRecording reads a recording file.
+func LoadRecording(path string) (*Recording, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rec Recording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("radiusc: parse recording: %w", err)
+	}
+	if rec.Version != recordingVersion {
+		return nil, fmt.Errorf("radiusc: unsupported recording version %d", rec.Version)
+	}
+	return &rec, nil
+}
+
+// LoadRecordingSecrets reads the secrets file written next to the
+// recording at path.
+func LoadRecordingSecrets(path string) (*RecordingSecrets, error) {
+	data, err := os.ReadFile(SecretsPath(path))
+	if err != nil {
+		return nil, err
+	}
+	var secrets RecordingSecrets
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("radiusc: parse recording secrets: %w", err)
+	}
+	return &secrets, nil
+}
+
+// Save writes the recording to path and the secret, decrypted MPPE keys and
+// SUCI ephemeral key to SecretsPath(path) with owner-only permissions.
+func (r *Recording) Save(path, secret string) error {
+	if r == nil {
+		return fmt.Errorf("radiusc: recording is nil")
+	}
+	r.Version = recordingVersion
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	secrets := RecordingSecrets{Secret: secret, SUCIEphemeralKey: hex.EncodeToString(r.SUCIEphemeralKey)}
+	for i, ex := range r.Exchanges {
+		keys, ok, err := ex.decryptMPPE([]byte(secret))
+		if err != nil {
+			return err
+		}
+		if ok {
+			keys.Exchange = i
+			secrets.Keys = append(secrets.Keys, keys)
+		}
+	}
+	data, err = json.MarshalIndent(secrets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(SecretsPath(path), append(data, '\n'), 0o600)
+}
+
+// RequestEAP returns the EAP payload of every recorded Access-Request (nil
+// for a request without EAP-Message).
+func (r *Recording) RequestEAP() ([][]byte, error) {
+	out := make([][]byte, 0, len(r.Exchanges))
+	for i, ex := range r.Exchanges {
+		raw, err := hex.DecodeString(ex.Request)
+		if err != nil {
+			return nil, fmt.Errorf("radiusc: invalid recorded request %d", i)
+		}
+		// Only plain attributes are read, so no secret is needed.
+		packet, err := radius.Parse(raw, nil)
+		if err != nil {
+			return nil, fmt.Errorf("radiusc: parse recorded request %d: %w", i, err)
+		}
+		payload, _, err := LookupEAPMessage(packet)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, payload)
+	}
+	return out, nil
+}
+
+func (r *Recording) add(request, response []byte) {
+	r.Exchanges = append(r.Exchanges, RecordedExchange{
+		Request:  hex.EncodeToString(request),
+		Response: hex.EncodeToString(response),
+	})
+}
+
+func (ex RecordedExchange) decryptMPPE(secret []byte) (RecordedMPPEKeys, bool, error) {
+	req, err := hex.DecodeString(ex.Request)
+	if err != nil || len(req) < 20 {
+		return RecordedMPPEKeys{}, false, fmt.Errorf("radiusc: invalid recorded request")
+	}
+	raw, err := hex.DecodeString(ex.Response)
+	if err != nil {
+		return RecordedMPPEKeys{}, false, fmt.Errorf("radiusc: invalid recorded response")
+	}
+	resp, err := radius.Parse(raw, secret)
+	if err != nil {
+		return RecordedMPPEKeys{}, false, err
+	}
+	mppe, err := ExtractMPPEKeys(resp)
+	if err != nil {
+		return RecordedMPPEKeys{}, false, err
+	}
+	if !mppe.SendKeyPresent && !mppe.RecvKeyPresent {
+		return RecordedMPPEKeys{}, false, nil
+	}
+	var keys RecordedMPPEKeys
+	if mppe.SendKeyPresent {
+		key, err := DecryptMPPEKey(mppe.SendKey, secret, req[4:20])
+		if err != nil {
+			return RecordedMPPEKeys{}, false, err
+		}
+		keys.SendKey = hex.EncodeToString(key)
+	}
+	if mppe.RecvKeyPresent {
+		key, err := DecryptMPPEKey(mppe.RecvKey, secret, req[4:20])
+		if err != nil {
+			return RecordedMPPEKeys{}, false, err
+		}
+		keys.RecvKey = hex.EncodeToString(key)
+	}
+	return keys, true, nil
+}
+
+// replayer serves recorded responses in order.
+type replayer struct {
+	rec  *Recording
+	next int
+}
+
+func (r *replayer) exchange(packet *radius.Packet) (*radius.Packet, error) {
+	if r.next >= len(r.rec.Exchanges) {
+		return nil, fmt.Errorf("radiusc: replay has no recorded exchange %d", r.next)
+	}
+	ex := r.rec.Exchanges[r.next]
+	index := r.next
+	r.next++
+	expected, err := hex.DecodeString(ex.Request)
+	if err != nil {
+		return nil, fmt.Errorf("radiusc: invalid recorded request %d", index)
+	}
+	actual, err := packet.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(maskAuthenticators(expected), maskAuthenticators(actual)) {
+		return nil, &ReplayMismatchError{Exchange: index, Expected: expected, Actual: actual}
+	}
+	raw, err := hex.DecodeString(ex.Response)
+	if err != nil {
+		return nil, fmt.Errorf("radiusc: invalid recorded response %d", index)
+	}
+	return radius.Parse(raw, packet.Secret)
+}
+
+// maskAuthenticators zeroes the random per-packet fields (identifier and
+// authenticator) and any Message-Authenticator value so packets can be
+// compared byte for byte.
+func maskAuthenticators(b []byte) []byte {
+	out := append([]byte(nil), b...)
+	if len(out) < 20 {
+		return out
+	}
+	out[1] = 0
+	for i := 4; i < 20; i++ {
+		out[i] = 0
+	}
+	for i := 20; i+2 <= len(out); {
+		length := int(out[i+1])
+		if length < 2 || i+length > len(out) {
+			break
+		}
+		if radius.Type(out[i]) == rfc2869.MessageAuthenticator_Type {
+			for j := i + 2; j < i+length; j++ {
+				out[j] = 0
+			}
+		}
+		i += length
+	}
+	return out
+}
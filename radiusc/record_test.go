@@ -0,0 +1,63 @@
+package radiusc
+
+import (
+	"bytes"
+	"testing"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestDecryptMPPEKeyRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{0x5a}, 32)
+	secret := []byte("secret")
+	reqAuth := bytes.Repeat([]byte{0x01}, 16)
+	enc, err := eapaka.EncryptMPPEKey(key, secret, reqAuth)
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	dec, err := DecryptMPPEKey(enc, secret, reqAuth)
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if !bytes.Equal(dec, key) {
+		t.Fatalf("expected %x, got %x", key, dec)
+	}
+}
+
+func TestReplayIgnoresAuthenticators(t *testing.T) {
+	build := func() *radius.Packet {
+		p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+		_ = rfc2865.UserName_SetString(p, "user")
+		_ = AddEAPMessage(p, []byte{0x02, 0x00, 0x00, 0x05, 0x01})
+		if err := SetMessageAuthenticator(p); err != nil {
+			t.Fatalf("message authenticator failed: %v", err)
+		}
+		return p
+	}
+	first := build()
+	reqRaw, _ := first.MarshalBinary()
+	resp := first.Response(radius.CodeAccessReject)
+	respRaw, _ := resp.Encode()
+	rec := &Recording{}
+	rec.add(reqRaw, respRaw)
+
+	r := &replayer{rec: rec}
+	got, err := r.exchange(build())
+	if err != nil {
+		t.Fatalf("replay failed: %v", err)
+	}
+	if got.Code != radius.CodeAccessReject {
+		t.Fatalf("expected recorded response, got %v", got.Code)
+	}
+
+	changed := build()
+	_ = rfc2865.UserName_SetString(changed, "other")
+	r = &replayer{rec: rec}
+	if _, err := r.exchange(changed); err == nil {
+		t.Fatalf("expected mismatch for changed request")
+	} else if _, ok := err.(*ReplayMismatchError); !ok {
+		t.Fatalf("expected ReplayMismatchError, got %T", err)
+	}
+}
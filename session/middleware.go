@@ -0,0 +1,234 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/radiusc"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// ErrDropped is returned when a middleware drops a packet.
+var ErrDropped = errors.New("session: packet dropped by middleware")
+
+// EAPHandler turns the EAP request received in the previous round into the
+// EAP response sent in round. req is nil for round 1 (EAP-Response/Identity).
+// Both sides are raw packets so middleware can produce malformed ones.
+type EAPHandler func(ctx context.Context, round int, req []byte) ([]byte, error)
+
+// EAPMiddleware wraps the EAP layer.
+type EAPMiddleware func(next EAPHandler) EAPHandler
+
+// RadiusExchanger sends the Access-Request of round and returns the reply.
+type RadiusExchanger func(ctx context.Context, round int, packet *radius.Packet) (*radiusc.Response, error)
+
+// RadiusMiddleware wraps the RADIUS layer.
+type RadiusMiddleware func(next RadiusExchanger) RadiusExchanger
+
+func chainEAP(base EAPHandler, middleware []EAPMiddleware) EAPHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		base = middleware[i](base)
+	}
+	return base
+}
+
+func chainRadius(base RadiusExchanger, middleware []RadiusMiddleware) RadiusExchanger {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		base = middleware[i](base)
+	}
+	return base
+}
+
+// matchRound reports whether want (0 = every round) selects round.
+func matchRound(want, round int) bool {
+	return want == 0 || want == round
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// DropEAP discards the EAP response of round (0 = every round).
+func DropEAP(round int) EAPMiddleware {
+	return func(next EAPHandler) EAPHandler {
+		return func(ctx context.Context, r int, req []byte) ([]byte, error) {
+			if matchRound(round, r) {
+				return nil, ErrDropped
+			}
+			return next(ctx, r, req)
+		}
+	}
+}
+
+// DelayEAP holds the EAP request of round for d before the peer sees it.
+func DelayEAP(round int, d time.Duration) EAPMiddleware {
+	return func(next EAPHandler) EAPHandler {
+		return func(ctx context.Context, r int, req []byte) ([]byte, error) {
+			if matchRound(round, r) {
+				if err := sleep(ctx, d); err != nil {
+					return nil, err
+				}
+			}
+			return next(ctx, r, req)
+		}
+	}
+}
+
+// ModifyEAP rewrites the EAP response sent in round.
+func ModifyEAP(round int, fn func([]byte) []byte) EAPMiddleware {
+	return func(next EAPHandler) EAPHandler {
+		return func(ctx context.Context, r int, req []byte) ([]byte, error) {
+			resp, err := next(ctx, r, req)
+			if err != nil || !matchRound(round, r) {
+				return resp, err
+			}
+			return fn(resp), nil
+		}
+	}
+}
+
+// ModifyEAPRequest rewrites the EAP request received before round, before
+// the peer parses it.
+func ModifyEAPRequest(round int, fn func([]byte) []byte) EAPMiddleware {
+	return func(next EAPHandler) EAPHandler {
+		return func(ctx context.Context, r int, req []byte) ([]byte, error) {
+			if req != nil && matchRound(round, r) {
+				req = fn(req)
+			}
+			return next(ctx, r, req)
+		}
+	}
+}
+
+// DropRadius does not send the Access-Request of round; the exchange fails
+// with ErrDropped.
+func DropRadius(round int) RadiusMiddleware {
+	return func(next RadiusExchanger) RadiusExchanger {
+		return func(ctx context.Context, r int, packet *radius.Packet) (*radiusc.Response, error) {
+			if matchRound(round, r) {
+				return nil, ErrDropped
+			}
+			return next(ctx, r, packet)
+		}
+	}
+}
+
+// DelayRadius waits d before sending the Access-Request of round.
+func DelayRadius(round int, d time.Duration) RadiusMiddleware {
+	return func(next RadiusExchanger) RadiusExchanger {
+		return func(ctx context.Context, r int, packet *radius.Packet) (*radiusc.Response, error) {
+			if matchRound(round, r) {
+				if err := sleep(ctx, d); err != nil {
+					return nil, err
+				}
+			}
+			return next(ctx, r, packet)
+		}
+	}
+}
+
+// DuplicateRadius sends the Access-Request of round twice, unchanged, and
+// returns the reply to the second copy. Each copy goes out from a new UDP
+// socket, so the server sees a second request with the same Identifier and
+// Request Authenticator from another source port, not an RFC 5080 duplicate.
+func DuplicateRadius(round int) RadiusMiddleware {
+	return func(next RadiusExchanger) RadiusExchanger {
+		return func(ctx context.Context, r int, packet *radius.Packet) (*radiusc.Response, error) {
+			if !matchRound(round, r) {
+				return next(ctx, r, packet)
+			}
+			first, err := next(ctx, r, packet)
+			if err != nil {
+				return nil, err
+			}
+			if second, err := next(ctx, r, packet); err == nil {
+				return second, nil
+			}
+			return first, nil
+		}
+	}
+}
+
+// ReorderRadius sends the previous round's Access-Request again, byte for
+// byte, right before the one of round, as if a copy had been delayed in the
+// network. The copy keeps its Identifier and Request Authenticator but goes
+// out from a new UDP socket, so the server sees it as a new request from
+// another source port rather than a retransmission. Its reply is
+// discarded, and a failed resend (e.g. a server that silently drops it) is
+// tolerated; both appear in the transcript. Only cancellation of ctx aborts
+// the round.
+func ReorderRadius(round int) RadiusMiddleware {
+	return func(next RadiusExchanger) RadiusExchanger {
+		var previous *radius.Packet
+		return func(ctx context.Context, r int, packet *radius.Packet) (*radiusc.Response, error) {
+			if previous != nil && matchRound(round, r) {
+				if _, err := next(ctx, r, previous); err != nil && ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+			}
+			previous = packet
+			return next(ctx, r, packet)
+		}
+	}
+}
+
+// ModifyRadius rewrites the Access-Request of round. fn is responsible for
+// recomputing Message-Authenticator (radiusc.SetMessageAuthenticator) when
+// the rewrite should stay valid.
+func ModifyRadius(round int, fn func(*radius.Packet) error) RadiusMiddleware {
+	return func(next RadiusExchanger) RadiusExchanger {
+		return func(ctx context.Context, r int, packet *radius.Packet) (*radiusc.Response, error) {
+			if matchRound(round, r) {
+				if err := fn(packet); err != nil {
+					return nil, err
+				}
+			}
+			return next(ctx, r, packet)
+		}
+	}
+}
+
+// ModifyRadiusReply rewrites the reply of round before the session looks at
+// it. EAP, State and MPPE are re-read from the modified packet.
+func ModifyRadiusReply(round int, fn func(*radius.Packet) error) RadiusMiddleware {
+	return func(next RadiusExchanger) RadiusExchanger {
+		return func(ctx context.Context, r int, packet *radius.Packet) (*radiusc.Response, error) {
+			resp, err := next(ctx, r, packet)
+			if err != nil || !matchRound(round, r) {
+				return resp, err
+			}
+			if err := fn(resp.Packet); err != nil {
+				return nil, err
+			}
+			return reparse(resp.Packet)
+		}
+	}
+}
+
+func reparse(packet *radius.Packet) (*radiusc.Response, error) {
+	out := &radiusc.Response{Code: packet.Code, Packet: packet}
+	if payload, ok, err := radiusc.LookupEAPMessage(packet); err != nil {
+		return nil, err
+	} else if ok {
+		out.EAP = payload
+	}
+	if state, err := rfc2865.State_Lookup(packet); err == nil {
+		out.State = append([]byte(nil), state...)
+	}
+	mppe, err := radiusc.ExtractMPPEKeys(packet)
+	if err != nil {
+		return nil, err
+	}
+	out.MPPE = mppe
+	return out, nil
+}
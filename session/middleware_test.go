@@ -0,0 +1,113 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/radiusc"
+
+	"layeh.com/radius"
+)
+
+func TestRadiusMiddlewareChain(t *testing.T) {
+	var sent []*radius.Packet
+	base := func(ctx context.Context, round int, packet *radius.Packet) (*radiusc.Response, error) {
+		sent = append(sent, packet)
+		return &radiusc.Response{Code: radius.CodeAccessChallenge, Packet: packet}, nil
+	}
+	exchange := chainRadius(base, []RadiusMiddleware{DuplicateRadius(1), ReorderRadius(2), DropRadius(3)})
+
+	first := radius.New(radius.CodeAccessRequest, []byte(testSecret))
+	second := radius.New(radius.CodeAccessRequest, []byte(testSecret))
+	if _, err := exchange(context.Background(), 1, first); err != nil {
+		t.Fatalf("round 1 failed: %v", err)
+	}
+	if _, err := exchange(context.Background(), 2, second); err != nil {
+		t.Fatalf("round 2 failed: %v", err)
+	}
+	want := []*radius.Packet{first, first, first, second}
+	if len(sent) != len(want) {
+		t.Fatalf("expected %d packets, got %d", len(want), len(sent))
+	}
+	for i := range want {
+		if sent[i] != want[i] {
+			t.Fatalf("packet %d out of order", i)
+		}
+	}
+	if _, err := exchange(context.Background(), 3, second); !errors.Is(err, ErrDropped) {
+		t.Fatalf("expected ErrDropped, got %v", err)
+	}
+}
+
+func TestEAPMiddlewareModify(t *testing.T) {
+	base := func(ctx context.Context, round int, req []byte) ([]byte, error) {
+		return append([]byte(nil), req...), nil
+	}
+	handle := chainEAP(base, []EAPMiddleware{
+		ModifyEAP(2, func(b []byte) []byte { return append(b, 0xff) }),
+		ModifyEAPRequest(2, func(b []byte) []byte { return b[:1] }),
+	})
+	out, err := handle(context.Background(), 2, []byte{1, 2, 3})
+	if err != nil {
+		t.Fatalf("handle failed: %v", err)
+	}
+	if string(out) != string([]byte{1, 0xff}) {
+		t.Fatalf("unexpected output %x", out)
+	}
+	out, _ = handle(context.Background(), 3, []byte{1, 2, 3})
+	if len(out) != 3 {
+		t.Fatalf("round 3 should be untouched, got %x", out)
+	}
+}
+
+func TestMiddlewareCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	handle := chainEAP(func(ctx context.Context, round int, req []byte) ([]byte, error) {
+		return req, nil
+	}, []EAPMiddleware{DelayEAP(1, time.Hour)})
+	if _, err := handle(ctx, 1, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected DelayEAP to stop on cancel, got %v", err)
+	}
+
+	sent := 0
+	base := func(ctx context.Context, round int, packet *radius.Packet) (*radiusc.Response, error) {
+		sent++
+		if round == 2 {
+			return nil, ctx.Err()
+		}
+		return &radiusc.Response{Code: radius.CodeAccessChallenge, Packet: packet}, nil
+	}
+	exchange := chainRadius(base, []RadiusMiddleware{ReorderRadius(2)})
+	packet := radius.New(radius.CodeAccessRequest, []byte(testSecret))
+	if _, err := exchange(context.Background(), 1, packet); err != nil {
+		t.Fatalf("round 1 failed: %v", err)
+	}
+	if _, err := exchange(ctx, 2, packet); !errors.Is(err, context.Canceled) || sent != 2 {
+		t.Fatalf("expected cancel after the stale resend, got %v after %d sends", err, sent)
+	}
+}
+
+func TestReorderRadiusToleratesStaleFailure(t *testing.T) {
+	var sent []*radius.Packet
+	first := radius.New(radius.CodeAccessRequest, []byte(testSecret))
+	second := radius.New(radius.CodeAccessRequest, []byte(testSecret))
+	base := func(ctx context.Context, round int, packet *radius.Packet) (*radiusc.Response, error) {
+		sent = append(sent, packet)
+		if round == 2 && packet == first {
+			return nil, errors.New("timeout")
+		}
+		return &radiusc.Response{Code: radius.CodeAccessChallenge, Packet: packet}, nil
+	}
+	exchange := chainRadius(base, []RadiusMiddleware{ReorderRadius(2)})
+	if _, err := exchange(context.Background(), 1, first); err != nil {
+		t.Fatalf("round 1 failed: %v", err)
+	}
+	resp, err := exchange(context.Background(), 2, second)
+	if err != nil || resp.Packet != second || len(sent) != 3 {
+		t.Fatalf("expected the current request to go through, got %v (%d sends)", err, len(sent))
+	}
+}
@@ -0,0 +1,450 @@
+// Package session drives one EAP-SIM/AKA/AKA' authentication against a RADIUS
+// server from Go code and reports the outcome as a Result.
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/eapmethod/aka"
+	"github.com/oyaguma3/eapaka_test/eapmethod/sim"
+	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/sqnstore"
+	"github.com/oyaguma3/eapaka_test/suci"
+	"github.com/oyaguma3/eapaka_test/usim"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// DefaultMaxRounds bounds the number of RADIUS round trips per session.
+const DefaultMaxRounds = 32
+
+var (
+	// ErrMissingEAPMessage is returned for an Access-Challenge without EAP.
+	ErrMissingEAPMessage = errors.New("session: missing EAP-Message in Access-Challenge")
+	// ErrNoResponse is returned when the peer has nothing to answer with.
+	ErrNoResponse = errors.New("session: no response for challenge")
+	// ErrTooManyRounds is returned after MaxRounds challenges.
+	ErrTooManyRounds = errors.New("session: too many rounds")
+)
+
+// UnexpectedCodeError reports a reply that is not Challenge/Accept/Reject.
+type UnexpectedCodeError struct {
+	Code radius.Code
+}
+
+func (e *UnexpectedCodeError) Error() string {
+	return fmt.Sprintf("session: unexpected RADIUS code %d", e.Code)
+}
+
+// Subscriber describes the USIM side.
+type Subscriber struct {
+	IMSI string
+	// Identity is the outer identity sent in EAP-Response/Identity.
+	Identity  string
+	Realm     string
+	Algorithm usim.Algorithm
+	// GSMAlgorithm provides A3/A8 for EAP-SIM. It defaults to the c2/c3
+	// conversion of Algorithm; with only GSMAlgorithm set the subscriber
+	// is a GSM SIM and AKA/AKA' are not offered.
+	GSMAlgorithm usim.GSMAlgorithm
+	AMF          []byte
+	// NetName is the AKA' network name used when AT_KDF_INPUT is checked.
+	NetName string
+	// KDFs lists supported AT_KDF values in order of preference.
+	KDFs       []uint16
+	InitialSQN uint64
+	// SQNStore defaults to an in-memory store.
+	SQNStore  sqnstore.Store
+	SQNPolicy *sqnstore.Policy
+	// NonceMT fixes the EAP-SIM AT_NONCE_MT (random when nil), e.g. to
+	// replay a recorded run.
+	NonceMT []byte
+	// SUCI makes AKA' answer permanent identity requests with a concealed
+	// SUCI. Identity may itself be a SUCI (see suci.Conceal).
+	SUCI *suci.Params
+}
+
+// Server describes the RADIUS server and the NAS attributes to send.
+type Server struct {
+	Addr       string
+	Secret     string
+	Timeout    time.Duration
+	Retries    int
+	Attributes radiusc.Attributes
+}
+
+// Policies mirror the eap.* testcase settings.
+type Policies struct {
+	// ExpectedMethod defaults to the method implied by the identity prefix
+	// (AKA' for a SUCI).
+	ExpectedMethod *uint8
+	// AllowedMethods lists accepted methods in order of preference; other
+	// requested methods are answered with EAP-Nak.
+	AllowedMethods                    []uint8
+	MethodMismatch                    eap.MethodMismatchPolicy
+	PermanentIDPolicy                 string
+	PermanentIdentityOverride         string
+	OuterIdentityUpdateOnPermanentReq *bool
+	ForceResync                       *aka.ResyncOptions
+	// NetNameCheck compares AT_KDF_INPUT with Subscriber.NetName: strict,
+	// warn (default) or off.
+	NetNameCheck string
+	// IgnoreBidding accepts EAP-AKA challenges whose AT_BIDDING offers
+	// AKA' even though the peer supports AKA'.
+	IgnoreBidding bool
+}
+
+// Hooks observe the exchange; any of them may be nil.
+type Hooks struct {
+	// BeforeSend is called with each Access-Request and its EAP payload.
+	BeforeSend func(round int, packet *radius.Packet, eapPayload []byte)
+	// AfterReceive is called with each reply and its round trip time.
+	AfterReceive func(round int, resp *radiusc.Response, rtt time.Duration)
+	// AfterHandle is called with each EAP request and the peer's answer;
+	// round is the one the request arrived in.
+	AfterHandle func(round int, req eap.Packet, resp *eap.Packet)
+	// Warn receives method and net_name mismatches under the warn policy.
+	Warn func(error)
+}
+
+// Options configure a Session. Peer and Client, when set, replace the ones
+// built from Subscriber/Policies and Server.
+type Options struct {
+	Subscriber Subscriber
+	Server     Server
+	Policies   Policies
+	Hooks      Hooks
+	MaxRounds  int
+
+	// EAPMiddleware and RadiusMiddleware wrap the two layers; the first
+	// element is the outermost.
+	EAPMiddleware    []EAPMiddleware
+	RadiusMiddleware []RadiusMiddleware
+
+	Peer   *eap.Peer
+	Client *radiusc.Client
+}
+
+// Round is one Access-Request and its reply.
+type Round struct {
+	Index       int
+	Request     []byte
+	Response    []byte
+	RequestEAP  []byte
+	ResponseEAP []byte
+	Code        radius.Code
+	Sent        time.Time
+	Received    time.Time
+	RTT         time.Duration
+}
+
+// Keys holds the key material of a finished session.
+type Keys struct {
+	// MSK and EMSK are derived by the peer.
+	MSK  []byte
+	EMSK []byte
+	// MPPESendKey and MPPERecvKey are decrypted from the final reply.
+	MPPESendKey []byte
+	MPPERecvKey []byte
+}
+
+// Result describes a finished (or failed) session.
+type Result struct {
+	Code     radius.Code
+	Accepted bool
+	// Transcript holds every round, including the final one.
+	Transcript    []Round
+	Reply         *radiusc.Response
+	ReplyMessage  string
+	Keys          Keys
+	OuterIdentity string
+	InnerIdentity string
+	Started       time.Time
+	Duration      time.Duration
+}
+
+// Session runs one authentication.
+type Session struct {
+	opts   Options
+	peer   *eap.Peer
+	client *radiusc.Client
+}
+
+// New validates the options and builds the peer and client.
+func New(opts Options) (*Session, error) {
+	peer := opts.Peer
+	if peer == nil {
+		var err error
+		peer, err = NewPeer(opts.Subscriber, opts.Policies)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if peer.Session == nil || peer.Session.OuterIdentity == "" {
+		return nil, fmt.Errorf("session: outer identity is required")
+	}
+	if opts.Hooks.Warn != nil && peer.Warn == nil {
+		peer.Warn = opts.Hooks.Warn
+	}
+	for _, method := range peer.Methods {
+		if m, ok := method.(*aka.Method); ok && opts.Hooks.Warn != nil && m.Warn == nil {
+			m.Warn = opts.Hooks.Warn
+		}
+	}
+	client := opts.Client
+	if client == nil {
+		if opts.Server.Addr == "" || opts.Server.Secret == "" {
+			return nil, fmt.Errorf("session: server address and secret are required")
+		}
+		client = radiusc.NewClient(opts.Server.Addr, opts.Server.Secret, opts.Server.Timeout, opts.Server.Retries)
+	}
+	if opts.MaxRounds <= 0 {
+		opts.MaxRounds = DefaultMaxRounds
+	}
+	return &Session{opts: opts, peer: peer, client: client}, nil
+}
+
+// Peer returns the EAP peer, e.g. to inspect method state after Run.
+func (s *Session) Peer() *eap.Peer {
+	return s.peer
+}
+
+// Run performs the authentication. On error the partial Result is returned
+// alongside it.
+func (s *Session) Run(ctx context.Context) (*Result, error) {
+	result := &Result{Started: time.Now()}
+	defer func() {
+		result.Duration = time.Since(result.Started)
+		result.OuterIdentity = s.peer.Session.OuterIdentity
+		result.InnerIdentity = s.peer.Session.InnerIdentity
+	}()
+
+	handle := chainEAP(s.handleEAP, s.opts.EAPMiddleware)
+	exchange := chainRadius(s.exchanger(result), s.opts.RadiusMiddleware)
+	var reqEAP []byte
+	for round := 1; round <= s.opts.MaxRounds; round++ {
+		raw, err := handle(ctx, round, reqEAP)
+		if err != nil {
+			return result, err
+		}
+		userName := s.peer.Session.OuterIdentity
+		reqPacket, err := s.client.NewRequest(userName, raw, s.opts.Server.Attributes)
+		if err != nil {
+			return result, fmt.Errorf("session: build access-request: %w", err)
+		}
+		resp, err := exchange(ctx, round, reqPacket)
+		if err != nil {
+			if errors.Is(err, ErrDropped) {
+				return result, err
+			}
+			return result, fmt.Errorf("session: radius exchange: %w", err)
+		}
+		if resp.State != nil {
+			s.client.State = resp.State
+		}
+		result.Code = resp.Code
+		result.Reply = resp
+
+		switch resp.Code {
+		case radius.CodeAccessChallenge:
+			if len(resp.EAP) == 0 {
+				return result, ErrMissingEAPMessage
+			}
+			reqEAP = resp.EAP
+		case radius.CodeAccessAccept, radius.CodeAccessReject:
+			result.Accepted = resp.Code == radius.CodeAccessAccept
+			result.ReplyMessage = rfc2865.ReplyMessage_GetString(resp.Packet)
+			result.Keys = s.keys(resp, reqPacket)
+			return result, nil
+		default:
+			return result, &UnexpectedCodeError{Code: resp.Code}
+		}
+	}
+	return result, ErrTooManyRounds
+}
+
+// handleEAP is the innermost EAPHandler: it answers with the identity in
+// round 1 and passes later requests to the peer.
+func (s *Session) handleEAP(ctx context.Context, round int, req []byte) ([]byte, error) {
+	if req == nil {
+		identity := &eap.Packet{
+			Code:     eap.CodeResponse,
+			Type:     eap.TypeIdentity,
+			TypeData: []byte(s.peer.Session.OuterIdentity),
+		}
+		return identity.Encode()
+	}
+	reqPkt, err := eap.Parse(req)
+	if err != nil {
+		return nil, fmt.Errorf("session: parse EAP request: %w", err)
+	}
+	resp, err := s.peer.Handle(reqPkt)
+	if err != nil {
+		return nil, fmt.Errorf("session: handle EAP request: %w", err)
+	}
+	if resp == nil {
+		return nil, ErrNoResponse
+	}
+	if s.opts.Hooks.AfterHandle != nil {
+		s.opts.Hooks.AfterHandle(round-1, reqPkt, resp)
+	}
+	raw, err := resp.Encode()
+	if err != nil {
+		return nil, fmt.Errorf("session: encode eap response: %w", err)
+	}
+	return raw, nil
+}
+
+// exchanger is the innermost RadiusExchanger. Every packet that actually
+// goes out, including middleware duplicates, is passed to the hooks and
+// recorded in the transcript.
+func (s *Session) exchanger(result *Result) RadiusExchanger {
+	hooks := s.opts.Hooks
+	return func(ctx context.Context, round int, packet *radius.Packet) (*radiusc.Response, error) {
+		payload, _, _ := radiusc.LookupEAPMessage(packet)
+		if hooks.BeforeSend != nil {
+			hooks.BeforeSend(round, packet, payload)
+		}
+		entry := Round{Index: round, RequestEAP: payload, Sent: time.Now()}
+		entry.Request, _ = packet.MarshalBinary()
+		resp, err := s.client.Exchange(ctx, packet)
+		entry.Received = time.Now()
+		entry.RTT = entry.Received.Sub(entry.Sent)
+		if err != nil {
+			result.Transcript = append(result.Transcript, entry)
+			return nil, err
+		}
+		entry.Code = resp.Code
+		entry.ResponseEAP = resp.EAP
+		entry.Response, _ = resp.Packet.MarshalBinary()
+		result.Transcript = append(result.Transcript, entry)
+		if hooks.AfterReceive != nil {
+			hooks.AfterReceive(round, resp, entry.RTT)
+		}
+		return resp, nil
+	}
+}
+
+// keys collects MSK/EMSK from the method that ran and decrypts MPPE keys
+// with the authenticator of the final request. Keys that cannot be
+// recovered are left nil.
+func (s *Session) keys(resp *radiusc.Response, req *radius.Packet) Keys {
+	var keys Keys
+	for _, method := range s.peer.Methods {
+		if m, ok := method.(interface{ SessionKeys() ([]byte, []byte) }); ok {
+			if msk, emsk := m.SessionKeys(); msk != nil {
+				keys.MSK, keys.EMSK = msk, emsk
+			}
+		}
+	}
+	if resp.MPPE.SendKeyPresent {
+		keys.MPPESendKey, _ = radiusc.DecryptMPPEKey(resp.MPPE.SendKey, req.Secret, req.Authenticator[:])
+	}
+	if resp.MPPE.RecvKeyPresent {
+		keys.MPPERecvKey, _ = radiusc.DecryptMPPEKey(resp.MPPE.RecvKey, req.Secret, req.Authenticator[:])
+	}
+	return keys
+}
+
+// NewPeer builds the EAP peer with EAP-SIM and, when sub.Algorithm is set,
+// EAP-AKA and AKA' methods. New uses it when Options.Peer is nil.
+func NewPeer(sub Subscriber, policies Policies) (*eap.Peer, error) {
+	if sub.Identity == "" {
+		return nil, fmt.Errorf("session: subscriber identity is required")
+	}
+	store := sub.SQNStore
+	if store == nil {
+		store = sqnstore.NewMemoryStore()
+	}
+	gsm := sub.GSMAlgorithm
+	if gsm == nil {
+		var err error
+		if gsm, err = usim.NewGSMContext(sub.Algorithm); err != nil {
+			return nil, err
+		}
+	}
+	simMethod, err := sim.New(sim.Options{
+		IMSI:                              sub.IMSI,
+		Algorithm:                         gsm,
+		Realm:                             sub.Realm,
+		PermanentIDPolicy:                 policies.PermanentIDPolicy,
+		PermanentIdentityOverride:         policies.PermanentIdentityOverride,
+		OuterIdentityUpdateOnPermanentReq: policies.OuterIdentityUpdateOnPermanentReq,
+		NonceMT:                           sub.NonceMT,
+	})
+	if err != nil {
+		return nil, err
+	}
+	methods := []eap.Method{simMethod}
+	if sub.Algorithm != nil {
+		base := aka.Options{
+			IMSI:                              sub.IMSI,
+			Algorithm:                         sub.Algorithm,
+			AMF:                               sub.AMF,
+			Realm:                             sub.Realm,
+			InitialSQN:                        sub.InitialSQN,
+			SQNStore:                          store,
+			SQNPolicy:                         sub.SQNPolicy,
+			PermanentIDPolicy:                 policies.PermanentIDPolicy,
+			PermanentIdentityOverride:         policies.PermanentIdentityOverride,
+			OuterIdentityUpdateOnPermanentReq: policies.OuterIdentityUpdateOnPermanentReq,
+			ForceResync:                       policies.ForceResync,
+		}
+		akaOpts := base
+		akaOpts.MethodType = eap.TypeAKA
+		// The check only applies while the peer would also run AKA'.
+		akaOpts.BiddingCheck = !policies.IgnoreBidding && (len(policies.AllowedMethods) == 0 || allowed(policies.AllowedMethods, eap.TypeAKAPrime))
+		primeOpts := base
+		primeOpts.MethodType = eap.TypeAKAPrime
+		primeOpts.NetName = sub.NetName
+		primeOpts.KDFs = sub.KDFs
+		primeOpts.NetNameCheck = policies.NetNameCheck
+		primeOpts.SUCI = sub.SUCI
+		for _, o := range []aka.Options{akaOpts, primeOpts} {
+			method, err := aka.New(o)
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, method)
+		}
+	}
+	peer := eap.NewPeer(&eap.Session{OuterIdentity: sub.Identity}, methods...)
+	if policies.MethodMismatch != "" {
+		peer.MethodPolicy = policies.MethodMismatch
+	}
+	peer.AllowedMethods = append([]uint8(nil), policies.AllowedMethods...)
+	if policies.ExpectedMethod != nil {
+		expected := *policies.ExpectedMethod
+		peer.ExpectedMethod = &expected
+	} else if expected, ok := identityMethod(sub.Identity); ok {
+		// A prefix-derived method the peer will Nak is not an expectation.
+		if len(peer.AllowedMethods) > 0 && !allowed(peer.AllowedMethods, expected) {
+			expected = peer.AllowedMethods[0]
+		}
+		peer.ExpectedMethod = &expected
+	}
+	return peer, nil
+}
+
+// identityMethod returns the method implied by the identity prefix. A SUCI
+// implies AKA'.
+func identityMethod(identity string) (uint8, bool) {
+	if suci.IsSUCI(identity) {
+		return eap.TypeAKAPrime, true
+	}
+	return eap.MethodForIdentity(identity)
+}
+
+func allowed(methods []uint8, t uint8) bool {
+	for _, m := range methods {
+		if m == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package session
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oyaguma3/eapaka_test/eap"
+	"github.com/oyaguma3/eapaka_test/mockserver"
+	"github.com/oyaguma3/eapaka_test/radiusc"
+	"github.com/oyaguma3/eapaka_test/suci"
+	"github.com/oyaguma3/eapaka_test/usim"
+
+	"layeh.com/radius"
+)
+
+const (
+	testIMSI   = "440100123456789"
+	testSecret = "testing123"
+)
+
+var (
+	testKI  = bytes.Repeat([]byte{0x11}, 16)
+	testOPc = bytes.Repeat([]byte{0x22}, 16)
+)
+
+func TestRunAccept(t *testing.T) {
+	addr := startServer(t, mockserver.Options{})
+	var sent, received, handled int
+	opts := testOptions(t, "0"+testIMSI+"@wlan.example", addr)
+	opts.Hooks = Hooks{
+		BeforeSend:   func(int, *radius.Packet, []byte) { sent++ },
+		AfterReceive: func(int, *radiusc.Response, time.Duration) { received++ },
+		AfterHandle:  func(int, eap.Packet, *eap.Packet) { handled++ },
+	}
+	sess, err := New(opts)
+	if err != nil {
+		t.Fatalf("new failed: %v", err)
+	}
+	result, err := sess.Run(context.Background())
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if !result.Accepted || result.Code != radius.CodeAccessAccept {
+		t.Fatalf("expected accept, got %v", result.Code)
+	}
+	if len(result.Transcript) != 2 || sent != 2 || received != 2 || handled != 1 {
+		t.Fatalf("unexpected rounds: transcript=%d sent=%d received=%d handled=%d", len(result.Transcript), sent, received, handled)
+	}
+	for i, round := range result.Transcript {
+		if round.Index != i+1 || len(round.Request) == 0 || len(round.Response) == 0 || round.RTT <= 0 {
+			t.Fatalf("incomplete round %d: %+v", i, round)
+		}
+	}
+	keys := result.Keys
+	if len(keys.MSK) != 64 || len(keys.EMSK) != 64 {
+		t.Fatalf("unexpected key lengths msk=%d emsk=%d", len(keys.MSK), len(keys.EMSK))
+	}
+	if !bytes.Equal(keys.MPPERecvKey, keys.MSK[:32]) || !bytes.Equal(keys.MPPESendKey, keys.MSK[32:]) {
+		t.Fatalf("MPPE keys do not match MSK")
+	}
+	if result.OuterIdentity != opts.Subscriber.Identity || result.Duration <= 0 {
+		t.Fatalf("unexpected result metadata: %+v", result)
+	}
+}
+
+func TestRunReject(t *testing.T) {
+	addr := startServer(t, mockserver.Options{Fault: mockserver.FaultBadATMAC})
+	sess, err := New(testOptions(t, "0"+testIMSI+"@wlan.example", addr))
+	if err != nil {
+		t.Fatalf("new failed: %v", err)
+	}
+	result, err := sess.Run(context.Background())
+	if err == nil && result.Accepted {
+		t.Fatalf("expected failure, got accept")
+	}
+	if len(result.Transcript) == 0 {
+		t.Fatalf("expected partial transcript")
+	}
+}
+
+func TestRunMissingEAPMessage(t *testing.T) {
+	addr := startServer(t, mockserver.Options{Fault: mockserver.FaultMissingEAPMessage})
+	sess, err := New(testOptions(t, "0"+testIMSI+"@wlan.example", addr))
+	if err != nil {
+		t.Fatalf("new failed: %v", err)
+	}
+	result, err := sess.Run(context.Background())
+	if !errors.Is(err, ErrMissingEAPMessage) {
+		t.Fatalf("expected ErrMissingEAPMessage, got %v", err)
+	}
+	if result == nil || len(result.Transcript) != 1 {
+		t.Fatalf("expected one round in partial result")
+	}
+}
+
+func TestNewValidates(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Fatalf("expected error without identity")
+	}
+	opts := testOptions(t, "0"+testIMSI+"@wlan.example", "")
+	if _, err := New(opts); err == nil {
+		t.Fatalf("expected error without server address")
+	}
+}
+
+func TestNewPeerExpectedMethod(t *testing.T) {
+	sub := testOptions(t, "", "").Subscriber
+	sub.SUCI = &suci.Params{MNC: "10", Scheme: suci.SchemeNull}
+	var err error
+	if sub.Identity, err = suci.Conceal(testIMSI, *sub.SUCI); err != nil {
+		t.Fatalf("conceal failed: %v", err)
+	}
+	peer, err := NewPeer(sub, Policies{})
+	if err != nil {
+		t.Fatalf("new peer failed: %v", err)
+	}
+	if len(peer.Methods) != 3 || peer.ExpectedMethod == nil || *peer.ExpectedMethod != eap.TypeAKAPrime {
+		t.Fatalf("expected AKA' for a SUCI identity, got %v", peer.ExpectedMethod)
+	}
+
+	// A prefix-derived method outside allowed_methods falls back to the
+	// first allowed one.
+	sub.Identity = "0" + testIMSI + "@wlan.example"
+	peer, err = NewPeer(sub, Policies{AllowedMethods: []uint8{eap.TypeSIM}})
+	if err != nil {
+		t.Fatalf("new peer failed: %v", err)
+	}
+	if peer.ExpectedMethod == nil || *peer.ExpectedMethod != eap.TypeSIM {
+		t.Fatalf("expected SIM fallback, got %v", peer.ExpectedMethod)
+	}
+
+	// A GSM-only subscriber offers EAP-SIM alone.
+	gsm, err := usim.NewCOMP128(testKI)
+	if err != nil {
+		t.Fatalf("comp128 failed: %v", err)
+	}
+	peer, err = NewPeer(Subscriber{IMSI: testIMSI, Identity: "1" + testIMSI + "@wlan.example", GSMAlgorithm: gsm}, Policies{})
+	if err != nil {
+		t.Fatalf("new peer failed: %v", err)
+	}
+	if len(peer.Methods) != 1 || peer.Methods[eap.TypeSIM] == nil {
+		t.Fatalf("expected EAP-SIM only, got %v", peer.Methods)
+	}
+}
+
+func testOptions(t *testing.T, identity, addr string) Options {
+	t.Helper()
+	alg, err := usim.NewMilenage(testKI, testOPc)
+	if err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	return Options{
+		Subscriber: Subscriber{
+			IMSI:      testIMSI,
+			Identity:  identity,
+			Realm:     "wlan.example",
+			Algorithm: alg,
+			AMF:       []byte{0x80, 0x00},
+		},
+		Server: Server{Addr: addr, Secret: testSecret, Timeout: time.Second},
+	}
+}
+
+func startServer(t *testing.T, opts mockserver.Options) string {
+	t.Helper()
+	alg, err := usim.NewMilenage(testKI, testOPc)
+	if err != nil {
+		t.Fatalf("milenage failed: %v", err)
+	}
+	opts.Secret = testSecret
+	opts.NetName = "WLAN"
+	opts.Subscribers = []mockserver.Subscriber{{IMSI: testIMSI, Algorithm: alg, AMF: []byte{0x80, 0x00}}}
+	server, err := mockserver.New(opts)
+	if err != nil {
+		t.Fatalf("new server failed: %v", err)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	})
+	return conn.LocalAddr().String()
+}
@@ -81,6 +81,7 @@ type fileData struct {
 }
 
 type subscriberJSON struct {
+	IndBits   *int     `json:"ind_bits,omitempty"`
 	SeqMS     []uint64 `json:"seqms"`
 	SQNMSHex  string   `json:"sqnms_hex"`
 	UpdatedAt string   `json:"updated_at"`
@@ -150,11 +151,17 @@ func (fs *FileStore) saveFile(data fileData) error {
 }
 
 func (s subscriberJSON) toState() (SubscriberState, error) {
-	if len(s.SeqMS) != ArraySize {
-		return SubscriberState{}, fmt.Errorf("sqnstore: seqms length must be %d", ArraySize)
+	indBits := IndBits
+	if s.IndBits != nil {
+		indBits = *s.IndBits
 	}
-	var seqs [ArraySize]uint64
-	copy(seqs[:], s.SeqMS)
+	if err := validateIndBits(indBits); err != nil {
+		return SubscriberState{}, err
+	}
+	if len(s.SeqMS) != 1<<indBits {
+		return SubscriberState{}, fmt.Errorf("sqnstore: seqms length must be %d", 1<<indBits)
+	}
+	seqs := append([]uint64(nil), s.SeqMS...)
 	sqn, err := ParseSQNHex(s.SQNMSHex)
 	if err != nil {
 		return SubscriberState{}, err
@@ -183,8 +190,21 @@ func fromState(state SubscriberState) (subscriberJSON, error) {
 		updated = state.UpdatedAt.UTC().Format(time.RFC3339)
 	}
 	seqms := make([]uint64, ArraySize)
-	copy(seqms, state.SeqMS[:])
+	var indBits *int
+	if state.SeqMS != nil {
+		bits, ok := state.IndWidth()
+		if !ok {
+			return subscriberJSON{}, fmt.Errorf("sqnstore: seqms length %d is not a power of two", len(state.SeqMS))
+		}
+		// Records keep the legacy file-level shape unless the width differs,
+		// so stores written for 5-bit IND stay readable by older builds.
+		if bits != IndBits {
+			indBits = &bits
+		}
+		seqms = append([]uint64(nil), state.SeqMS...)
+	}
 	return subscriberJSON{
+		IndBits:   indBits,
 		SeqMS:     seqms,
 		SQNMSHex:  sqnHex,
 		UpdatedAt: updated,
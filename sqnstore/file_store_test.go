@@ -17,7 +17,10 @@ func TestFileStoreSaveLoadRoundTrip(t *testing.T) {
 		},
 	}
 
-	var state SubscriberState
+	state, err := NewSubscriberState(IndBits)
+	if err != nil {
+		t.Fatalf("new state failed: %v", err)
+	}
 	state.SeqMS[3] = 7
 	state.SQNMS = 0x1234
 
@@ -75,3 +78,35 @@ func TestFileStoreLoadMissing(t *testing.T) {
 		t.Fatalf("expected missing record")
 	}
 }
+
+func TestFileStoreCustomIndWidth(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sqn.json")
+	store := &FileStore{Path: path}
+
+	state, err := NewSubscriberState(3)
+	if err != nil {
+		t.Fatalf("new state failed: %v", err)
+	}
+	state.SeqMS[5] = 9
+	if err := store.Save("440100123456789", state); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	if err := store.Save("440100000000001", SubscriberState{}); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	loaded, ok, err := store.Load("440100123456789")
+	if err != nil || !ok {
+		t.Fatalf("load failed: ok=%t err=%v", ok, err)
+	}
+	if bits, _ := loaded.IndWidth(); bits != 3 || loaded.SeqMS[5] != 9 {
+		t.Fatalf("unexpected state %+v", loaded)
+	}
+	legacy, ok, err := store.Load("440100000000001")
+	if err != nil || !ok {
+		t.Fatalf("load failed: ok=%t err=%v", ok, err)
+	}
+	if len(legacy.SeqMS) != ArraySize {
+		t.Fatalf("expected legacy seqms length %d, got %d", ArraySize, len(legacy.SeqMS))
+	}
+}
@@ -19,7 +19,7 @@ func (m *MemoryStore) Load(imsi string) (SubscriberState, bool, error) {
 		return SubscriberState{}, false, fmt.Errorf("sqnstore: store is nil")
 	}
 	state, ok := m.data[imsi]
-	return state, ok, nil
+	return state.Clone(), ok, nil
 }
 
 func (m *MemoryStore) Save(imsi string, state SubscriberState) error {
@@ -32,7 +32,7 @@ func (m *MemoryStore) Save(imsi string, state SubscriberState) error {
 	if m.data == nil {
 		m.data = make(map[string]SubscriberState)
 	}
-	m.data[imsi] = state
+	m.data[imsi] = state.Clone()
 	return nil
 }
 
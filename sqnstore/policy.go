@@ -0,0 +1,101 @@
+package sqnstore
+
+import "fmt"
+
+// Policy configures the USIM-side SQN freshness check (TS 33.102 Annex C).
+//
+// Delta limits how far SEQ may run ahead of the highest accepted SEQ_MS and
+// L limits how far behind it a SEQ may be for its IND slot to still accept it.
+// Zero disables the corresponding check. With WrapAround set, SEQ values are
+// compared modulo 2^(48-ind_bits) so a counter that wrapped is still fresh.
+type Policy struct {
+	IndBits    int
+	Delta      uint64
+	L          uint64
+	WrapAround bool
+}
+
+// DefaultPolicy returns the policy matching the tool's historical behavior:
+// 5-bit IND, no Δ/L limits and no wrap-around.
+func DefaultPolicy() Policy {
+	return Policy{IndBits: IndBits}
+}
+
+// Validate checks the policy parameters.
+func (p Policy) Validate() error {
+	if err := validateIndBits(p.IndBits); err != nil {
+		return err
+	}
+	if p.Delta > p.seqModulus()-1 {
+		return fmt.Errorf("sqnstore: delta exceeds SEQ range for ind_bits=%d", p.IndBits)
+	}
+	if p.L > p.seqModulus()-1 {
+		return fmt.Errorf("sqnstore: l exceeds SEQ range for ind_bits=%d", p.IndBits)
+	}
+	return nil
+}
+
+// NewState returns an empty state sized for the policy's IND width.
+func (p Policy) NewState() (SubscriberState, error) {
+	return NewSubscriberState(p.IndBits)
+}
+
+// InitialState returns a state whose SEQ_MS array is seeded from sqn.
+func (p Policy) InitialState(sqn uint64) (SubscriberState, error) {
+	state, err := p.NewState()
+	if err != nil {
+		return SubscriberState{}, err
+	}
+	seq, ind, err := SplitSQNBits(sqn, p.IndBits)
+	if err != nil {
+		return SubscriberState{}, err
+	}
+	state.SeqMS[ind] = seq
+	state.SQNMS = sqn
+	return state, nil
+}
+
+// Migrate resizes a state saved under another IND width. SQN_MS is kept
+// and every SEQ_MS slot is set to its SEQ under p.IndBits, so no SQN at or
+// below the highest accepted one becomes fresh again. It reports whether
+// the state was changed.
+func (p Policy) Migrate(state SubscriberState) (SubscriberState, bool, error) {
+	if len(state.SeqMS) == 1<<p.IndBits {
+		return state, false, nil
+	}
+	out, err := p.NewState()
+	if err != nil {
+		return SubscriberState{}, false, err
+	}
+	seq, _, err := SplitSQNBits(state.SQNMS, p.IndBits)
+	if err != nil {
+		return SubscriberState{}, false, err
+	}
+	for i := range out.SeqMS {
+		out.SeqMS[i] = seq
+	}
+	out.SQNMS = state.SQNMS
+	out.UpdatedAt = state.UpdatedAt
+	return out, true, nil
+}
+
+func (p Policy) seqModulus() uint64 {
+	return 1 << (SQNBits - p.IndBits)
+}
+
+// after reports whether a is newer than b.
+func (p Policy) after(a, b uint64) bool {
+	if !p.WrapAround {
+		return a > b
+	}
+	diff := (a - b) & (p.seqModulus() - 1)
+	return diff != 0 && diff < p.seqModulus()/2
+}
+
+// distance returns how far a is ahead of b; callers check after(a, b) first.
+func (p Policy) distance(a, b uint64) uint64 {
+	if !p.WrapAround {
+		return a - b
+	}
+	return (a - b) & (p.seqModulus() - 1)
+}
@@ -0,0 +1,133 @@
+package sqnstore
+
+import "testing"
+
+func TestPolicyDeltaLimit(t *testing.T) {
+	policy := Policy{IndBits: 5, Delta: 10}
+	state, err := policy.InitialState(0)
+	if err != nil {
+		t.Fatalf("initial state failed: %v", err)
+	}
+	sqn, _ := CombineSQNBits(11, 1, 5)
+	accepted, err := state.AcceptSQNWithPolicy(sqn, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if accepted {
+		t.Fatalf("expected SQN beyond delta to be rejected")
+	}
+	sqn, _ = CombineSQNBits(10, 1, 5)
+	accepted, err = state.AcceptSQNWithPolicy(sqn, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !accepted {
+		t.Fatalf("expected SQN within delta to be accepted")
+	}
+}
+
+func TestPolicyAgeLimit(t *testing.T) {
+	policy := Policy{IndBits: 5, L: 4}
+	start, _ := CombineSQNBits(20, 0, 5)
+	state, err := policy.InitialState(start)
+	if err != nil {
+		t.Fatalf("initial state failed: %v", err)
+	}
+	old, _ := CombineSQNBits(16, 3, 5)
+	accepted, err := state.AcceptSQNWithPolicy(old, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if accepted {
+		t.Fatalf("expected SQN at age limit to be rejected")
+	}
+	recent, _ := CombineSQNBits(17, 3, 5)
+	accepted, err = state.AcceptSQNWithPolicy(recent, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !accepted {
+		t.Fatalf("expected SQN within age limit to be accepted")
+	}
+	if state.SQNMS != start {
+		t.Fatalf("expected sqnms unchanged for older SEQ, got 0x%x", state.SQNMS)
+	}
+}
+
+func TestPolicyWrapAround(t *testing.T) {
+	policy := Policy{IndBits: 5, WrapAround: true}
+	maxSeq := uint64(MaxSQN >> 5)
+	start, _ := CombineSQNBits(maxSeq, 2, 5)
+	state, err := policy.InitialState(start)
+	if err != nil {
+		t.Fatalf("initial state failed: %v", err)
+	}
+	wrapped, _ := CombineSQNBits(1, 2, 5)
+	accepted, err := state.AcceptSQNWithPolicy(wrapped, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !accepted {
+		t.Fatalf("expected wrapped SEQ to be accepted")
+	}
+	if state.SQNMS != wrapped {
+		t.Fatalf("expected sqnms=0x%x, got 0x%x", wrapped, state.SQNMS)
+	}
+
+	noWrap := Policy{IndBits: 5}
+	state, _ = noWrap.InitialState(start)
+	accepted, err = state.AcceptSQNWithPolicy(wrapped, noWrap)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if accepted {
+		t.Fatalf("expected wrapped SEQ to be rejected without wrap_around")
+	}
+}
+
+func TestPolicyIndWidth(t *testing.T) {
+	policy := Policy{IndBits: 3}
+	var state SubscriberState
+	accepted, err := state.AcceptSQNWithPolicy(0x0f, policy) // seq=1, ind=7
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !accepted {
+		t.Fatalf("expected accepted SQN")
+	}
+	if len(state.SeqMS) != 8 || state.SeqMS[7] != 1 {
+		t.Fatalf("unexpected seqms %v", state.SeqMS)
+	}
+	if _, err := state.AcceptSQNWithPolicy(0x2f, DefaultPolicy()); err == nil {
+		t.Fatalf("expected error for ind width mismatch")
+	}
+}
+
+func TestPolicyMigrate(t *testing.T) {
+	var state SubscriberState
+	if _, err := state.AcceptSQNWithPolicy(0x2f, DefaultPolicy()); err != nil { // seq=1, ind=15
+		t.Fatalf("unexpected error: %v", err)
+	}
+	policy := Policy{IndBits: 3}
+	migrated, changed, err := policy.Migrate(state)
+	if err != nil || !changed {
+		t.Fatalf("expected migration, changed=%v err=%v", changed, err)
+	}
+	if len(migrated.SeqMS) != 8 || migrated.SQNMS != 0x2f {
+		t.Fatalf("unexpected migrated state %+v", migrated)
+	}
+	for i, seq := range migrated.SeqMS {
+		if seq != 5 { // 0x2f >> 3
+			t.Fatalf("slot %d: expected SEQ 5, got %d", i, seq)
+		}
+	}
+	if accepted, _ := migrated.AcceptSQNWithPolicy(0x2f, policy); accepted {
+		t.Fatalf("expected the highest accepted SQN to stay stale")
+	}
+	if accepted, err := migrated.AcceptSQNWithPolicy(0x30, policy); err != nil || !accepted {
+		t.Fatalf("expected the next SEQ to be accepted, got %v err=%v", accepted, err)
+	}
+	if _, changed, _ := policy.Migrate(migrated); changed {
+		t.Fatalf("expected no migration for a matching width")
+	}
+}
@@ -7,56 +7,124 @@ import (
 )
 
 const (
-	IndBits   = 5
-	ArraySize = 1 << IndBits
-	SQNHexLen = 12
-	MaxSQN    = (1 << 48) - 1
-	MaxSeq    = MaxSQN >> IndBits
+	IndBits    = 5
+	ArraySize  = 1 << IndBits
+	MaxIndBits = 16
+	SQNBits    = 48
+	SQNHexLen  = 12
+	MaxSQN     = (1 << SQNBits) - 1
+	MaxSeq     = MaxSQN >> IndBits
 )
 
 // SubscriberState holds the per-IMSI SQN state tracked by the tool.
+// The IND width is implied by len(SeqMS) (2^ind_bits entries).
 type SubscriberState struct {
-	SeqMS     [ArraySize]uint64
+	SeqMS     []uint64
 	SQNMS     uint64
 	UpdatedAt time.Time
 }
 
+// NewSubscriberState returns an empty state sized for the given IND width.
+func NewSubscriberState(indBits int) (SubscriberState, error) {
+	if err := validateIndBits(indBits); err != nil {
+		return SubscriberState{}, err
+	}
+	return SubscriberState{SeqMS: make([]uint64, 1<<indBits)}, nil
+}
+
+// IndWidth returns the IND bit width implied by the SEQ_MS array size.
+func (s SubscriberState) IndWidth() (int, bool) {
+	for bits := 0; bits <= MaxIndBits; bits++ {
+		if len(s.SeqMS) == 1<<bits {
+			return bits, true
+		}
+	}
+	return 0, false
+}
+
+// Clone returns a deep copy of the state.
+func (s SubscriberState) Clone() SubscriberState {
+	out := s
+	if s.SeqMS != nil {
+		out.SeqMS = append([]uint64(nil), s.SeqMS...)
+	}
+	return out
+}
+
 // SplitSQN breaks SQN into SEQ and IND (lower 5 bits).
 func SplitSQN(sqn uint64) (uint64, uint8, error) {
+	seq, ind, err := SplitSQNBits(sqn, IndBits)
+	return seq, uint8(ind), err
+}
+
+// CombineSQN combines SEQ and IND into a 48-bit SQN.
+func CombineSQN(seq uint64, ind uint8) (uint64, error) {
+	return CombineSQNBits(seq, uint64(ind), IndBits)
+}
+
+// SplitSQNBits breaks SQN into SEQ and IND using the given IND width.
+func SplitSQNBits(sqn uint64, indBits int) (uint64, uint64, error) {
+	if err := validateIndBits(indBits); err != nil {
+		return 0, 0, err
+	}
 	if sqn > MaxSQN {
 		return 0, 0, fmt.Errorf("sqnstore: sqn exceeds 48 bits: %x", sqn)
 	}
-	ind := uint8(sqn & ((1 << IndBits) - 1))
-	seq := sqn >> IndBits
+	ind := sqn & ((1 << indBits) - 1)
+	seq := sqn >> indBits
 	return seq, ind, nil
 }
 
-// CombineSQN combines SEQ and IND into a 48-bit SQN.
-func CombineSQN(seq uint64, ind uint8) (uint64, error) {
-	if int(ind) >= ArraySize {
+// CombineSQNBits combines SEQ and IND into a 48-bit SQN using the given IND width.
+func CombineSQNBits(seq, ind uint64, indBits int) (uint64, error) {
+	if err := validateIndBits(indBits); err != nil {
+		return 0, err
+	}
+	if ind >= 1<<indBits {
 		return 0, fmt.Errorf("sqnstore: ind out of range: %d", ind)
 	}
-	if seq > MaxSeq {
+	if seq > MaxSQN>>indBits {
 		return 0, fmt.Errorf("sqnstore: seq out of range: %d", seq)
 	}
-	sqn := (seq << IndBits) | uint64(ind)
-	return sqn, nil
+	return (seq << indBits) | ind, nil
 }
 
-// AcceptSQN applies freshness rules and updates the state when accepted.
+// AcceptSQN applies the default freshness rules and updates the state when accepted.
 func (s *SubscriberState) AcceptSQN(sqn uint64) (bool, error) {
-	seq, ind, err := SplitSQN(sqn)
+	return s.AcceptSQNWithPolicy(sqn, DefaultPolicy())
+}
+
+// AcceptSQNWithPolicy applies the TS 33.102 Annex C freshness rules of the
+// given policy and updates the state when accepted.
+func (s *SubscriberState) AcceptSQNWithPolicy(sqn uint64, policy Policy) (bool, error) {
+	if err := policy.Validate(); err != nil {
+		return false, err
+	}
+	if s.SeqMS == nil {
+		s.SeqMS = make([]uint64, 1<<policy.IndBits)
+	}
+	if len(s.SeqMS) != 1<<policy.IndBits {
+		return false, fmt.Errorf("sqnstore: state has %d seqms entries, policy ind_bits=%d expects %d", len(s.SeqMS), policy.IndBits, 1<<policy.IndBits)
+	}
+	seq, ind, err := SplitSQNBits(sqn, policy.IndBits)
 	if err != nil {
 		return false, err
 	}
-	if seq > s.SeqMS[ind] {
-		s.SeqMS[ind] = seq
-		if sqn > s.SQNMS {
-			s.SQNMS = sqn
-		}
-		return true, nil
+	highest := s.SQNMS >> policy.IndBits
+	if policy.Delta > 0 && policy.after(seq, highest) && policy.distance(seq, highest) > policy.Delta {
+		return false, nil
+	}
+	if policy.L > 0 && policy.after(highest, seq) && policy.distance(highest, seq) >= policy.L {
+		return false, nil
+	}
+	if !policy.after(seq, s.SeqMS[ind]) {
+		return false, nil
 	}
-	return false, nil
+	s.SeqMS[ind] = seq
+	if policy.after(seq, highest) || (seq == highest && sqn > s.SQNMS) {
+		s.SQNMS = sqn
+	}
+	return true, nil
 }
 
 // ParseSQNHex parses a 12-hex-digit SQN string.
@@ -81,3 +149,10 @@ func FormatSQNHex(sqn uint64) (string, error) {
 	}
 	return fmt.Sprintf("%012x", sqn), nil
 }
+
+func validateIndBits(indBits int) error {
+	if indBits < 0 || indBits > MaxIndBits {
+		return fmt.Errorf("sqnstore: ind_bits must be between 0 and %d: %d", MaxIndBits, indBits)
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+// Package suci builds and resolves 5G Subscription Concealed Identifiers
+// (TS 33.501 Section 6.12 and Annex C) in the NAI format of TS 23.003
+// Section 28.7.3.
+package suci
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Protection scheme identifiers (TS 33.501 Annex C.1).
+const (
+	SchemeNull     uint8 = 0
+	SchemeProfileA uint8 = 1
+	SchemeProfileB uint8 = 2
+)
+
+// ECIES profile sizes (TS 33.501 Annex C.3.4): AES-128 key, CTR initial
+// counter block, HMAC-SHA-256 key and the truncated MAC tag.
+const (
+	encKeyLen = 16
+	icbLen    = 16
+	macKeyLen = 32
+	macLen    = 8
+)
+
+// Params configures SUCI generation for an IMSI-type SUPI.
+type Params struct {
+	// MNC has 2 or 3 digits and splits the IMSI into PLMN and MSIN.
+	MNC string
+	// RoutingIndicator has 1 to 4 digits (default "0").
+	RoutingIndicator string
+	Scheme           uint8
+	// KeyID is the home network public key identifier (0-255).
+	KeyID uint8
+	// PublicKey is the home network public key: 32 bytes for Profile A,
+	// 33 (compressed) or 65 bytes for Profile B. Unused by the null scheme.
+	PublicKey []byte
+	// EphemeralKey fixes the ECIES ephemeral private key so that every
+	// Conceal returns the same SUCI, e.g. to record and replay a run. A
+	// fresh key is generated per call when it is nil.
+	EphemeralKey []byte
+}
+
+// PrivateKey is a home network private key used to resolve a SUCI.
+type PrivateKey struct {
+	Scheme uint8
+	KeyID  uint8
+	Key    []byte
+}
+
+// SUPI is the IMSI recovered from a SUCI. MNC is the 3-digit form used in
+// the NAI realm, so a 2-digit MNC carries a leading zero.
+type SUPI struct {
+	MCC  string
+	MNC  string
+	MSIN string
+}
+
+// ParseScheme maps a config scheme name (null, profile_a, profile_b) to its
+// identifier.
+func ParseScheme(name string) (uint8, bool) {
+	switch name {
+	case "null":
+		return SchemeNull, true
+	case "profile_a":
+		return SchemeProfileA, true
+	case "profile_b":
+		return SchemeProfileB, true
+	default:
+		return 0, false
+	}
+}
+
+// IsSUCI reports whether identity is in the SUCI NAI format.
+func IsSUCI(identity string) bool {
+	return strings.HasPrefix(identity, "type0.rid")
+}
+
+// Conceal returns the SUCI NAI for imsi. ECIES schemes use a fresh
+// ephemeral key on every call unless p.EphemeralKey is set.
+func Conceal(imsi string, p Params) (string, error) {
+	if p.Scheme == SchemeNull {
+		return conceal(imsi, p, nil)
+	}
+	curve, err := schemeCurve(p.Scheme)
+	if err != nil {
+		return "", err
+	}
+	var eph *ecdh.PrivateKey
+	if p.EphemeralKey != nil {
+		if eph, err = curve.NewPrivateKey(p.EphemeralKey); err != nil {
+			return "", fmt.Errorf("suci: invalid ephemeral key: %w", err)
+		}
+	} else if eph, err = curve.GenerateKey(rand.Reader); err != nil {
+		return "", err
+	}
+	return conceal(imsi, p, eph)
+}
+
+// GenerateEphemeralKey returns a new ECIES ephemeral private key for
+// Params.EphemeralKey.
+func GenerateEphemeralKey(scheme uint8) ([]byte, error) {
+	curve, err := schemeCurve(scheme)
+	if err != nil {
+		return nil, err
+	}
+	eph, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return eph.Bytes(), nil
+}
+
+func conceal(imsi string, p Params, eph *ecdh.PrivateKey) (string, error) {
+	mcc, mnc, msin, err := splitIMSI(imsi, p.MNC)
+	if err != nil {
+		return "", err
+	}
+	rid := p.RoutingIndicator
+	if rid == "" {
+		rid = "0"
+	}
+	if len(rid) > 4 || !isDigits(rid) {
+		return "", fmt.Errorf("suci: routing indicator must be 1 to 4 digits")
+	}
+	realm := "@nai.5gc.mnc" + mnc + ".mcc" + mcc + ".3gppnetwork.org"
+	if p.Scheme == SchemeNull {
+		return fmt.Sprintf("type0.rid%s.schid0.userid%s%s", rid, msin, realm), nil
+	}
+	hnPub, err := parsePublicKey(p.Scheme, p.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	shared, err := eph.ECDH(hnPub)
+	if err != nil {
+		return "", fmt.Errorf("suci: %w", err)
+	}
+	ephPub := encodePublicKey(p.Scheme, eph.PublicKey())
+	cip, mac, err := seal(shared, ephPub, encodeBCD(msin))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("type0.rid%s.schid%d.hnkey%d.ecckey%x.cip%x.mac%x%s", rid, p.Scheme, p.KeyID, ephPub, cip, mac, realm), nil
+}
+
+// Deconceal recovers the SUPI from a SUCI NAI with the matching home
+// network private key. The null scheme needs no key.
+func Deconceal(suci string, keys []PrivateKey) (SUPI, error) {
+	user, realm, ok := strings.Cut(suci, "@")
+	if !ok {
+		return SUPI{}, fmt.Errorf("suci: missing realm")
+	}
+	var out SUPI
+	plmn := strings.TrimSuffix(strings.TrimPrefix(realm, "nai.5gc."), ".3gppnetwork.org")
+	parts := strings.Split(plmn, ".")
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "mnc") || !strings.HasPrefix(parts[1], "mcc") {
+		return SUPI{}, fmt.Errorf("suci: realm %q is not nai.5gc.mnc<MNC>.mcc<MCC>.3gppnetwork.org", realm)
+	}
+	out.MNC = strings.TrimPrefix(parts[0], "mnc")
+	out.MCC = strings.TrimPrefix(parts[1], "mcc")
+
+	fields := make(map[string]string)
+	for _, f := range strings.Split(user, ".") {
+		for _, name := range []string{"type", "rid", "schid", "userid", "hnkey", "ecckey", "cip", "mac"} {
+			if strings.HasPrefix(f, name) {
+				fields[name] = strings.TrimPrefix(f, name)
+				break
+			}
+		}
+	}
+	if fields["type"] != "0" {
+		return SUPI{}, fmt.Errorf("suci: only IMSI-type SUPI (type0) is supported")
+	}
+	schid, err := strconv.ParseUint(fields["schid"], 10, 8)
+	if err != nil {
+		return SUPI{}, fmt.Errorf("suci: invalid schid %q", fields["schid"])
+	}
+	scheme := uint8(schid)
+	if scheme == SchemeNull {
+		out.MSIN = fields["userid"]
+		return out, nil
+	}
+	keyID, err := strconv.ParseUint(fields["hnkey"], 10, 8)
+	if err != nil {
+		return SUPI{}, fmt.Errorf("suci: invalid hnkey %q", fields["hnkey"])
+	}
+	var priv []byte
+	for _, k := range keys {
+		if k.Scheme == scheme && k.KeyID == uint8(keyID) {
+			priv = k.Key
+		}
+	}
+	if priv == nil {
+		return SUPI{}, fmt.Errorf("suci: no private key for scheme %d key %d", scheme, keyID)
+	}
+	ephPub, err1 := hex.DecodeString(fields["ecckey"])
+	cip, err2 := hex.DecodeString(fields["cip"])
+	mac, err3 := hex.DecodeString(fields["mac"])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return SUPI{}, fmt.Errorf("suci: scheme output must be hex")
+	}
+	plain, err := Open(scheme, priv, ephPub, cip, mac)
+	if err != nil {
+		return SUPI{}, err
+	}
+	out.MSIN, err = decodeBCD(plain)
+	if err != nil {
+		return SUPI{}, err
+	}
+	return out, nil
+}
+
+// Open verifies and decrypts an ECIES scheme output (ephemeral public key,
+// ciphertext and MAC tag) with the home network private key.
+func Open(scheme uint8, priv, ephPub, cip, mac []byte) ([]byte, error) {
+	curve, err := schemeCurve(scheme)
+	if err != nil {
+		return nil, err
+	}
+	key, err := curve.NewPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("suci: %w", err)
+	}
+	pub, err := parsePublicKey(scheme, ephPub)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := key.ECDH(pub)
+	if err != nil {
+		return nil, fmt.Errorf("suci: %w", err)
+	}
+	encKey, icb, macKey := deriveKeys(shared, ephPub)
+	if subtle.ConstantTimeCompare(computeMac(macKey, cip), mac) != 1 {
+		return nil, fmt.Errorf("suci: MAC tag mismatch")
+	}
+	return ctr(encKey, icb, cip)
+}
+
+// PublicKey returns the home network public key for priv in the encoding
+// Conceal expects (compressed for Profile B).
+func PublicKey(scheme uint8, priv []byte) ([]byte, error) {
+	curve, err := schemeCurve(scheme)
+	if err != nil {
+		return nil, err
+	}
+	key, err := curve.NewPrivateKey(priv)
+	if err != nil {
+		return nil, fmt.Errorf("suci: %w", err)
+	}
+	return encodePublicKey(scheme, key.PublicKey()), nil
+}
+
+// Matches reports whether imsi is the SUPI, trying both MNC lengths when
+// the realm MNC has a leading zero.
+func (s SUPI) Matches(imsi string) bool {
+	if imsi == s.MCC+s.MNC+s.MSIN {
+		return true
+	}
+	return strings.HasPrefix(s.MNC, "0") && imsi == s.MCC+s.MNC[1:]+s.MSIN
+}
+
+func seal(shared, ephPub, plain []byte) (cip, mac []byte, err error) {
+	encKey, icb, macKey := deriveKeys(shared, ephPub)
+	cip, err = ctr(encKey, icb, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cip, computeMac(macKey, cip), nil
+}
+
+// deriveKeys runs the ANSI X9.63 KDF with SHA-256 and SharedInfo1 = the
+// ephemeral public key, and splits the output into encryption key, ICB and
+// MAC key.
+func deriveKeys(shared, ephPub []byte) (encKey, icb, macKey []byte) {
+	var out []byte
+	for counter := uint32(1); len(out) < encKeyLen+icbLen+macKeyLen; counter++ {
+		h := sha256.New()
+		h.Write(shared)
+		var c [4]byte
+		binary.BigEndian.PutUint32(c[:], counter)
+		h.Write(c[:])
+		h.Write(ephPub)
+		out = h.Sum(out)
+	}
+	return out[:encKeyLen], out[encKeyLen : encKeyLen+icbLen], out[encKeyLen+icbLen : encKeyLen+icbLen+macKeyLen]
+}
+
+func ctr(key, icb, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCTR(block, icb).XORKeyStream(out, data)
+	return out, nil
+}
+
+func computeMac(key, cip []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(cip)
+	return h.Sum(nil)[:macLen]
+}
+
+func schemeCurve(scheme uint8) (ecdh.Curve, error) {
+	switch scheme {
+	case SchemeProfileA:
+		return ecdh.X25519(), nil
+	case SchemeProfileB:
+		return ecdh.P256(), nil
+	default:
+		return nil, fmt.Errorf("suci: unsupported protection scheme %d", scheme)
+	}
+}
+
+func parsePublicKey(scheme uint8, b []byte) (*ecdh.PublicKey, error) {
+	curve, err := schemeCurve(scheme)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == SchemeProfileB && len(b) == 33 {
+		if b, err = decompressP256(b); err != nil {
+			return nil, err
+		}
+	}
+	pub, err := curve.NewPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("suci: invalid public key for scheme %d: %w", scheme, err)
+	}
+	return pub, nil
+}
+
+// encodePublicKey returns X25519 keys as is and P-256 keys compressed, as
+// Profile B uses point compression.
+func encodePublicKey(scheme uint8, pub *ecdh.PublicKey) []byte {
+	b := pub.Bytes()
+	if scheme != SchemeProfileB {
+		return b
+	}
+	out := make([]byte, 33)
+	out[0] = 0x02 | b[64]&1
+	copy(out[1:], b[1:33])
+	return out
+}
+
+// decompressP256 expands a compressed P-256 point: y = sqrt(x^3 - 3x + b)
+// with the parity of the prefix byte.
+func decompressP256(b []byte) ([]byte, error) {
+	if b[0] != 0x02 && b[0] != 0x03 {
+		return nil, fmt.Errorf("suci: invalid compressed point prefix %#x", b[0])
+	}
+	params := elliptic.P256().Params()
+	p := params.P
+	x := new(big.Int).SetBytes(b[1:])
+	if x.Cmp(p) >= 0 {
+		return nil, fmt.Errorf("suci: invalid compressed point")
+	}
+	y2 := new(big.Int).Exp(x, big.NewInt(3), p)
+	y2.Sub(y2, new(big.Int).Mul(x, big.NewInt(3)))
+	y2.Add(y2, params.B)
+	y2.Mod(y2, p)
+	// p = 3 mod 4, so sqrt(a) = a^((p+1)/4).
+	exp := new(big.Int).Add(p, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(y2, exp, p)
+	if new(big.Int).Exp(y, big.NewInt(2), p).Cmp(y2) != 0 {
+		return nil, fmt.Errorf("suci: compressed point is not on P-256")
+	}
+	if y.Bit(0) != uint(b[0]&1) {
+		y.Sub(p, y)
+	}
+	out := make([]byte, 65)
+	out[0] = 0x04
+	x.FillBytes(out[1:33])
+	y.FillBytes(out[33:])
+	return out, nil
+}
+
+func splitIMSI(imsi, mnc string) (mccOut, mncOut, msin string, err error) {
+	if len(mnc) != 2 && len(mnc) != 3 || !isDigits(mnc) {
+		return "", "", "", fmt.Errorf("suci: MNC must be 2 or 3 digits")
+	}
+	if !isDigits(imsi) || len(imsi) <= 3+len(mnc) || len(imsi) > 15 {
+		return "", "", "", fmt.Errorf("suci: invalid IMSI %q", imsi)
+	}
+	if imsi[3:3+len(mnc)] != mnc {
+		return "", "", "", fmt.Errorf("suci: IMSI %s does not carry MNC %s", imsi, mnc)
+	}
+	if len(mnc) == 2 {
+		mncOut = "0" + mnc
+	} else {
+		mncOut = mnc
+	}
+	return imsi[:3], mncOut, imsi[3+len(mnc):], nil
+}
+
+// encodeBCD packs MSIN digits as in TS 24.501 9.11.3.4: the first digit in
+// the low nibble and an 0xF filler for an odd count.
+func encodeBCD(digits string) []byte {
+	out := make([]byte, (len(digits)+1)/2)
+	for i := range out {
+		lo := digits[2*i] - '0'
+		hi := byte(0x0f)
+		if 2*i+1 < len(digits) {
+			hi = digits[2*i+1] - '0'
+		}
+		out[i] = hi<<4 | lo
+	}
+	return out
+}
+
+func decodeBCD(b []byte) (string, error) {
+	var sb strings.Builder
+	for i, v := range b {
+		for _, d := range []byte{v & 0x0f, v >> 4} {
+			if d == 0x0f && i == len(b)-1 {
+				continue
+			}
+			if d > 9 {
+				return "", fmt.Errorf("suci: invalid BCD digit in scheme output")
+			}
+			sb.WriteByte('0' + d)
+		}
+	}
+	return sb.String(), nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,172 @@
+package suci
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// Home network keys and scheme outputs of TS 33.501 Annex C.4.
+const (
+	profileAPrivate = "c53c22208b61860b06c62e5406a7b330c2b577aa5558981510d128247d38bd1d"
+	profileAPublic  = "5a8d38864820197c3394b92613b20b91633cbd897119273bf8e4a6f4eec0a650"
+	profileBPrivate = "f1ab1074477ebcc7f554ea1c5fc368b1616730155e0041ac447d6301975fecda"
+	profileBPublic  = "0272da71976234ce833a6907425867b82e074d44ef907dfb4b3e21c1c2256ebcd1"
+	annexCPlaintext = "00012080f6"
+	annexCMSIN      = "001002086"
+)
+
+func TestOpenAnnexC(t *testing.T) {
+	tests := []struct {
+		name          string
+		scheme        uint8
+		priv, pub     string
+		eph, cip, mac string
+	}{
+		{"profile_a", SchemeProfileA, profileAPrivate, profileAPublic,
+			"b2e92f836055a255837debf850b528997ce0201cb82adfe4be1f587d07d8457d", "cb02352410", "cddd9e730ef3fa87"},
+		{"profile_b", SchemeProfileB, profileBPrivate, profileBPublic,
+			"039aab8376597021e855679a9778ea0b67396e68c66df32c0f41e9acca2da9b9d1", "46a33fc271", "6ac7dae96aa30a4d"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub, err := PublicKey(tt.scheme, mustHex(t, tt.priv))
+			if err != nil {
+				t.Fatalf("public key failed: %v", err)
+			}
+			expectHex(t, "public key", pub, tt.pub)
+			plain, err := Open(tt.scheme, mustHex(t, tt.priv), mustHex(t, tt.eph), mustHex(t, tt.cip), mustHex(t, tt.mac))
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			expectHex(t, "plaintext", plain, annexCPlaintext)
+
+			badMac := mustHex(t, tt.mac)
+			badMac[0] ^= 0xff
+			if _, err := Open(tt.scheme, mustHex(t, tt.priv), mustHex(t, tt.eph), mustHex(t, tt.cip), badMac); err == nil {
+				t.Fatalf("expected MAC tag mismatch")
+			}
+		})
+	}
+}
+
+func TestBCD(t *testing.T) {
+	expectHex(t, "BCD", encodeBCD(annexCMSIN), annexCPlaintext)
+	msin, err := decodeBCD(mustHex(t, annexCPlaintext))
+	if err != nil || msin != annexCMSIN {
+		t.Fatalf("expected %s, got %q err=%v", annexCMSIN, msin, err)
+	}
+	expectHex(t, "BCD (even)", encodeBCD("0123456789"), "1032547698")
+}
+
+func TestConcealNull(t *testing.T) {
+	got, err := Conceal("440100123456789", Params{MNC: "10"})
+	if err != nil {
+		t.Fatalf("conceal failed: %v", err)
+	}
+	want := "type0.rid0.schid0.userid0123456789@nai.5gc.mnc010.mcc440.3gppnetwork.org"
+	if got != want {
+		t.Fatalf("expected %q, got %q", want, got)
+	}
+	supi, err := Deconceal(got, nil)
+	if err != nil {
+		t.Fatalf("deconceal failed: %v", err)
+	}
+	if !supi.Matches("440100123456789") || supi.Matches("440010123456789") {
+		t.Fatalf("unexpected SUPI %+v", supi)
+	}
+	if _, err := Conceal("440100123456789", Params{MNC: "20"}); err == nil {
+		t.Fatalf("expected error for MNC not in IMSI")
+	}
+}
+
+func TestConcealDeconcealECIES(t *testing.T) {
+	const imsi = "440020012345678"
+	tests := []struct {
+		name      string
+		scheme    uint8
+		priv, pub string
+	}{
+		{"profile_a", SchemeProfileA, profileAPrivate, profileAPublic},
+		{"profile_b", SchemeProfileB, profileBPrivate, profileBPublic},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := Params{MNC: "020", RoutingIndicator: "678", Scheme: tt.scheme, KeyID: 27, PublicKey: mustHex(t, tt.pub)}
+			first, err := Conceal(imsi, params)
+			if err != nil {
+				t.Fatalf("conceal failed: %v", err)
+			}
+			if !IsSUCI(first) || !strings.HasPrefix(first, "type0.rid678.schid") || !strings.Contains(first, ".hnkey27.ecckey") {
+				t.Fatalf("unexpected SUCI %q", first)
+			}
+			if !strings.HasSuffix(first, "@nai.5gc.mnc020.mcc440.3gppnetwork.org") {
+				t.Fatalf("unexpected realm in %q", first)
+			}
+			second, _ := Conceal(imsi, params)
+			if first == second {
+				t.Fatalf("expected a fresh ephemeral key per SUCI")
+			}
+			keys := []PrivateKey{{Scheme: tt.scheme, KeyID: 27, Key: mustHex(t, tt.priv)}}
+			supi, err := Deconceal(first, keys)
+			if err != nil {
+				t.Fatalf("deconceal failed: %v", err)
+			}
+			if !supi.Matches(imsi) {
+				t.Fatalf("expected %s, got %+v", imsi, supi)
+			}
+			if _, err := Deconceal(first, []PrivateKey{{Scheme: tt.scheme, KeyID: 1, Key: mustHex(t, tt.priv)}}); err == nil {
+				t.Fatalf("expected error without a key for hnkey 27")
+			}
+
+			// A fixed ephemeral key repeats the SUCI, as record/replay needs.
+			if params.EphemeralKey, err = GenerateEphemeralKey(tt.scheme); err != nil {
+				t.Fatalf("generate ephemeral key failed: %v", err)
+			}
+			fixed, _ := Conceal(imsi, params)
+			if again, _ := Conceal(imsi, params); fixed != again {
+				t.Fatalf("expected the same SUCI with a fixed ephemeral key")
+			}
+			if supi, err := Deconceal(fixed, keys); err != nil || !supi.Matches(imsi) {
+				t.Fatalf("deconceal of fixed-key SUCI failed: %+v %v", supi, err)
+			}
+		})
+	}
+}
+
+func TestUncompressedProfileBKey(t *testing.T) {
+	compressed := mustHex(t, profileBPublic)
+	full, err := decompressP256(compressed)
+	if err != nil {
+		t.Fatalf("decompress failed: %v", err)
+	}
+	params := Params{MNC: "10", Scheme: SchemeProfileB, PublicKey: full}
+	suci, err := Conceal("440100123456789", params)
+	if err != nil {
+		t.Fatalf("conceal failed: %v", err)
+	}
+	supi, err := Deconceal(suci, []PrivateKey{{Scheme: SchemeProfileB, Key: mustHex(t, profileBPrivate)}})
+	if err != nil || !supi.Matches("440100123456789") {
+		t.Fatalf("unexpected result %+v err=%v", supi, err)
+	}
+	if !bytes.Equal(full[1:33], compressed[1:]) {
+		t.Fatalf("x coordinate changed by decompression")
+	}
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("decode %q failed: %v", s, err)
+	}
+	return b
+}
+
+func expectHex(t *testing.T, name string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Fatalf("%s mismatch: got %x want %s", name, got, want)
+	}
+}
@@ -1,8 +1,11 @@
 package testcase
 
 import (
+	"encoding/hex"
 	"fmt"
 	"strings"
+
+	"github.com/oyaguma3/eapaka_test/sqnstore"
 )
 
 // Case represents a single test case session definition.
@@ -18,6 +21,8 @@ type Case struct {
 	SQN    SQN    `yaml:"sqn"`
 	Expect Expect `yaml:"expect"`
 	Trace  Trace  `yaml:"trace"`
+
+	Mutations []Mutation `yaml:"mutations"`
 }
 
 type Radius struct {
@@ -34,26 +39,45 @@ type RadiusAttrs struct {
 }
 
 type EAP struct {
+	ExpectedMethod                    string   `yaml:"expected_method"`
+	AllowedMethods                    []string `yaml:"allowed_methods"`
 	MethodMismatchPolicy              string   `yaml:"method_mismatch_policy"`
 	OuterIdentityUpdateOnPermanentReq *bool    `yaml:"outer_identity_update_on_permanent_req"`
 	PermanentIDPolicy                 string   `yaml:"permanent_id_policy"`
+	BiddingPolicy                     string   `yaml:"bidding_policy"`
 	PermanentIdentityOverride         string   `yaml:"permanent_identity_override"`
 	AKAPrime                          AKAPrime `yaml:"aka_prime"`
 }
 
 type AKAPrime struct {
-	NetName string `yaml:"net_name"`
+	NetName      string   `yaml:"net_name"`
+	KDFs         []uint16 `yaml:"kdfs"`
+	NetNameCheck string   `yaml:"net_name_check"`
 }
 
 type SQN struct {
-	Reset   bool  `yaml:"reset"`
-	Persist *bool `yaml:"persist"`
+	Reset       bool         `yaml:"reset"`
+	Persist     *bool        `yaml:"persist"`
+	ForceResync *ForceResync `yaml:"force_resync"`
+}
+
+type ForceResync struct {
+	SQNMSHex string `yaml:"sqn_ms_hex"`
+	AheadBy  uint64 `yaml:"ahead_by"`
 }
 
 type Expect struct {
 	Result             string `yaml:"result"`
 	RejectHintContains string `yaml:"reject_hint_contains"`
 	MPPE               MPPE   `yaml:"mppe"`
+	// NakSent checks whether the peer sent an EAP-Nak.
+	NakSent *bool `yaml:"nak_sent"`
+	// Method is the method (sim|aka|aka_prime) of the last EAP request.
+	Method string `yaml:"method"`
+	// BiddingAKAPrime checks the AT_BIDDING AKA' bit of EAP-AKA challenges.
+	BiddingAKAPrime *bool `yaml:"bidding_aka_prime"`
+	// KDF is the AT_KDF value the last AKA' challenge was completed with.
+	KDF uint16 `yaml:"kdf"`
 }
 
 type MPPE struct {
@@ -68,6 +92,34 @@ type Trace struct {
 	DumpEAPHex      *bool  `yaml:"dump_eap_hex"`
 	DumpRadiusAttrs *bool  `yaml:"dump_radius_attrs"`
 	SavePath        string `yaml:"save_path"`
+	Format          string `yaml:"format"`
+	// PcapPath writes the RADIUS exchange as a pcapng capture.
+	PcapPath string `yaml:"pcap_path"`
+	// PcapSecretComment stores the shared secret as a pcapng comment.
+	PcapSecretComment bool `yaml:"pcap_secret_comment"`
+}
+
+// Mutation rewrites, drops, delays, duplicates or reorders a packet in
+// flight. Round is the RADIUS round the packet travels in (0 = every round).
+type Mutation struct {
+	Layer     string `yaml:"layer"`
+	Direction string `yaml:"direction"`
+	Round     int    `yaml:"round"`
+	Action    string `yaml:"action"`
+	DelayMS   int    `yaml:"delay_ms"`
+
+	// EAP modify: overwrite at Offset, then truncate, then append.
+	Offset    int    `yaml:"offset"`
+	SetHex    string `yaml:"set_hex"`
+	Truncate  *int   `yaml:"truncate"`
+	AppendHex string `yaml:"append_hex"`
+
+	// RADIUS modify: replace or remove every instance of Attribute, or
+	// re-split EAP-Message into FragmentSize byte attributes.
+	Attribute    int    `yaml:"attribute"`
+	ValueHex     string `yaml:"value_hex"`
+	Remove       bool   `yaml:"remove"`
+	FragmentSize int    `yaml:"fragment_size"`
 }
 
 // Validate checks the schema constraints defined in docs/TESTCASE_SCHEMA.md.
@@ -79,9 +131,30 @@ func (c Case) Validate() error {
 		return fmt.Errorf("testcase: identity is required")
 	}
 	switch c.Expect.Result {
-	case "accept", "reject":
+	case "accept", "reject", "timeout":
 	default:
-		return fmt.Errorf("testcase: expect.result must be accept or reject")
+		return fmt.Errorf("testcase: expect.result must be accept, reject, or timeout")
+	}
+	if c.EAP.ExpectedMethod != "" && !isOneOf(c.EAP.ExpectedMethod, "sim", "aka", "aka_prime") {
+		return fmt.Errorf("testcase: eap.expected_method must be sim, aka, or aka_prime")
+	}
+	for _, m := range c.EAP.AllowedMethods {
+		if !isOneOf(m, "sim", "aka", "aka_prime") {
+			return fmt.Errorf("testcase: eap.allowed_methods entries must be sim, aka, or aka_prime")
+		}
+	}
+	if c.EAP.AKAPrime.NetNameCheck != "" && !isOneOf(c.EAP.AKAPrime.NetNameCheck, "strict", "warn", "off") {
+		return fmt.Errorf("testcase: eap.aka_prime.net_name_check must be strict, warn, or off")
+	}
+	seenKDF := make(map[uint16]bool)
+	for _, v := range c.EAP.AKAPrime.KDFs {
+		if v == 0 || seenKDF[v] {
+			return fmt.Errorf("testcase: eap.aka_prime.kdfs must not include 0 or duplicates")
+		}
+		seenKDF[v] = true
+	}
+	if c.Expect.Method != "" && !isOneOf(c.Expect.Method, "sim", "aka", "aka_prime") {
+		return fmt.Errorf("testcase: expect.method must be sim, aka, or aka_prime")
 	}
 	if c.EAP.MethodMismatchPolicy != "" && !isOneOf(c.EAP.MethodMismatchPolicy, "strict", "warn", "allow") {
 		return fmt.Errorf("testcase: eap.method_mismatch_policy must be strict, warn, or allow")
@@ -89,9 +162,25 @@ func (c Case) Validate() error {
 	if c.EAP.PermanentIDPolicy != "" && !isOneOf(c.EAP.PermanentIDPolicy, "always", "conservative", "deny") {
 		return fmt.Errorf("testcase: eap.permanent_id_policy must be always, conservative, or deny")
 	}
+	if c.EAP.BiddingPolicy != "" && !isOneOf(c.EAP.BiddingPolicy, "enforce", "ignore") {
+		return fmt.Errorf("testcase: eap.bidding_policy must be enforce or ignore")
+	}
+	if c.SQN.ForceResync != nil {
+		if err := c.SQN.ForceResync.validate(); err != nil {
+			return err
+		}
+	}
 	if c.Trace.Level != "" && !isOneOf(c.Trace.Level, "normal", "verbose") {
 		return fmt.Errorf("testcase: trace.level must be normal or verbose")
 	}
+	if c.Trace.Format != "" && !isOneOf(c.Trace.Format, "text", "json") {
+		return fmt.Errorf("testcase: trace.format must be text or json")
+	}
+	for i, m := range c.Mutations {
+		if err := m.validate(); err != nil {
+			return fmt.Errorf("testcase: mutations[%d]: %w", i, err)
+		}
+	}
 	if c.Expect.MPPE.SendKey != "" && !hasKeyPrefix(c.Expect.MPPE.SendKey) {
 		return fmt.Errorf("testcase: expect.mppe.send_key must start with hex: or b64:")
 	}
@@ -101,6 +190,80 @@ func (c Case) Validate() error {
 	return nil
 }
 
+func (f ForceResync) validate() error {
+	hasSQN := f.SQNMSHex != ""
+	hasAhead := f.AheadBy > 0
+	if hasSQN == hasAhead {
+		return fmt.Errorf("testcase: sqn.force_resync requires exactly one of sqn_ms_hex or ahead_by")
+	}
+	if hasSQN {
+		if _, err := sqnstore.ParseSQNHex(f.SQNMSHex); err != nil {
+			return fmt.Errorf("testcase: sqn.force_resync.sqn_ms_hex: %w", err)
+		}
+	}
+	return nil
+}
+
+func (m Mutation) validate() error {
+	switch m.Layer {
+	case "eap":
+		if !isOneOf(m.Action, "drop", "delay", "modify") {
+			return fmt.Errorf("action must be drop, delay, or modify on layer eap")
+		}
+	case "radius":
+		if !isOneOf(m.Action, "drop", "delay", "duplicate", "reorder", "modify") {
+			return fmt.Errorf("action must be drop, delay, duplicate, reorder, or modify")
+		}
+	default:
+		return fmt.Errorf("layer must be eap or radius")
+	}
+	if m.Direction != "" && !isOneOf(m.Direction, "send", "receive") {
+		return fmt.Errorf("direction must be send or receive")
+	}
+	if m.Direction == "receive" && m.Action != "modify" {
+		return fmt.Errorf("direction receive is only supported with modify")
+	}
+	if m.Round < 0 {
+		return fmt.Errorf("round must not be negative")
+	}
+	if m.Action == "delay" && m.DelayMS <= 0 {
+		return fmt.Errorf("delay requires delay_ms")
+	}
+	if m.Action != "modify" {
+		return nil
+	}
+	if m.Layer == "eap" {
+		if m.SetHex == "" && m.Truncate == nil && m.AppendHex == "" {
+			return fmt.Errorf("modify requires set_hex, truncate, or append_hex")
+		}
+		if m.Offset < 0 || (m.Truncate != nil && *m.Truncate < 0) {
+			return fmt.Errorf("offset and truncate must not be negative")
+		}
+		for _, v := range []string{m.SetHex, m.AppendHex} {
+			if _, err := hex.DecodeString(v); err != nil {
+				return fmt.Errorf("invalid hex %q", v)
+			}
+		}
+		return nil
+	}
+	if m.FragmentSize != 0 {
+		if m.Attribute != 0 || m.FragmentSize < 1 || m.FragmentSize > 253 {
+			return fmt.Errorf("fragment_size must be 1-253 and excludes attribute")
+		}
+		return nil
+	}
+	if m.Attribute < 1 || m.Attribute > 255 {
+		return fmt.Errorf("modify requires attribute 1-255 or fragment_size")
+	}
+	if m.Remove == (m.ValueHex != "") {
+		return fmt.Errorf("modify requires exactly one of value_hex or remove")
+	}
+	if _, err := hex.DecodeString(m.ValueHex); err != nil {
+		return fmt.Errorf("invalid value_hex")
+	}
+	return nil
+}
+
 func hasKeyPrefix(v string) bool {
 	return strings.HasPrefix(v, "hex:") || strings.HasPrefix(v, "b64:")
 }
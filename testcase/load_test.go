@@ -43,3 +43,54 @@ expect:
 		t.Fatalf("expected error for invalid mppe prefix")
 	}
 }
+
+func TestLoadBytesForceResyncExclusive(t *testing.T) {
+	yaml := []byte(`version: 1
+name: resync_bad
+identity: "0440100123456789@wlan.mnc010.mcc440.3gppnetwork.org"
+sqn:
+  force_resync:
+    sqn_ms_hex: "000000001000"
+    ahead_by: 32
+expect:
+  result: accept
+`)
+	_, err := LoadBytes(yaml)
+	if err == nil {
+		t.Fatalf("expected error for sqn_ms_hex with ahead_by")
+	}
+}
+
+func TestLoadBytesMutations(t *testing.T) {
+	valid := []byte(`version: 1
+identity: "0440100123456789@wlan.mnc010.mcc440.3gppnetwork.org"
+expect:
+  result: reject
+mutations:
+  - layer: eap
+    round: 2
+    action: modify
+    offset: 12
+    set_hex: "ffff"
+  - layer: radius
+    action: duplicate
+`)
+	c, err := LoadBytes(valid)
+	if err != nil {
+		t.Fatalf("expected valid testcase, got error: %v", err)
+	}
+	if len(c.Mutations) != 2 || c.Mutations[0].SetHex != "ffff" {
+		t.Fatalf("unexpected mutations: %+v", c.Mutations)
+	}
+	invalid := []byte(`version: 1
+identity: "0440100123456789@wlan.mnc010.mcc440.3gppnetwork.org"
+expect:
+  result: reject
+mutations:
+  - layer: eap
+    action: duplicate
+`)
+	if _, err := LoadBytes(invalid); err == nil {
+		t.Fatalf("expected error for duplicate on eap layer")
+	}
+}
@@ -0,0 +1,339 @@
+package trace
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+)
+
+// DecodeOptions controls how DecodeAKA renders sensitive values.
+type DecodeOptions struct {
+	// Unsafe shows RAND/AUTN/RES/MAC and identities in full and enables
+	// decryption of AT_ENCR_DATA.
+	Unsafe bool
+	// KEncr decrypts AT_ENCR_DATA when Unsafe is set.
+	KEncr []byte
+}
+
+var attributeNames = map[eapaka.AttributeType]string{
+	eapaka.AT_RAND:              "AT_RAND",
+	eapaka.AT_AUTN:              "AT_AUTN",
+	eapaka.AT_RES:               "AT_RES",
+	eapaka.AT_AUTS:              "AT_AUTS",
+	eapaka.AT_PADDING:           "AT_PADDING",
+	eapaka.AT_NONCE_MT:          "AT_NONCE_MT",
+	eapaka.AT_PERMANENT_ID_REQ:  "AT_PERMANENT_ID_REQ",
+	eapaka.AT_MAC:               "AT_MAC",
+	eapaka.AT_NOTIFICATION:      "AT_NOTIFICATION",
+	eapaka.AT_ANY_ID_REQ:        "AT_ANY_ID_REQ",
+	eapaka.AT_IDENTITY:          "AT_IDENTITY",
+	eapaka.AT_VERSION_LIST:      "AT_VERSION_LIST",
+	eapaka.AT_SELECTED_VERSION:  "AT_SELECTED_VERSION",
+	eapaka.AT_FULLAUTH_ID_REQ:   "AT_FULLAUTH_ID_REQ",
+	eapaka.AT_COUNTER:           "AT_COUNTER",
+	eapaka.AT_COUNTER_TOO_SMALL: "AT_COUNTER_TOO_SMALL",
+	eapaka.AT_NONCE_S:           "AT_NONCE_S",
+	eapaka.AT_CLIENT_ERROR_CODE: "AT_CLIENT_ERROR_CODE",
+	eapaka.AT_KDF_INPUT:         "AT_KDF_INPUT",
+	eapaka.AT_KDF:               "AT_KDF",
+	eapaka.AT_IV:                "AT_IV",
+	eapaka.AT_ENCR_DATA:         "AT_ENCR_DATA",
+	eapaka.AT_NEXT_PSEUDONYM:    "AT_NEXT_PSEUDONYM",
+	eapaka.AT_NEXT_REAUTH_ID:    "AT_NEXT_REAUTH_ID",
+	eapaka.AT_CHECKCODE:         "AT_CHECKCODE",
+	eapaka.AT_RESULT_IND:        "AT_RESULT_IND",
+	eapaka.AT_BIDDING:           "AT_BIDDING",
+}
+
+var subtypeNames = map[uint8]string{
+	eapaka.SubtypeChallenge:              "AKA-Challenge",
+	eapaka.SubtypeAuthenticationReject:   "AKA-Authentication-Reject",
+	eapaka.SubtypeSynchronizationFailure: "AKA-Synchronization-Failure",
+	eapaka.SubtypeIdentity:               "AKA-Identity",
+	eapaka.SubtypeNotification:           "AKA-Notification",
+	eapaka.SubtypeReauthentication:       "AKA-Reauthentication",
+	eapaka.SubtypeClientError:            "AKA-Client-Error",
+}
+
+var notificationNames = map[uint16]string{
+	0:     "General failure after authentication",
+	1026:  "User has been temporarily denied access",
+	1031:  "User has not subscribed to the requested service",
+	16384: "General failure",
+	32768: "Success",
+}
+
+var clientErrorNames = map[uint16]string{
+	0: "unable to process packet",
+	1: "unsupported version",
+	2: "insufficient number of challenges",
+	3: "RANDs are not fresh",
+}
+
+// AttributeName returns the RFC name of an AKA attribute type.
+func AttributeName(t eapaka.AttributeType) string {
+	if name, ok := attributeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("AT_UNKNOWN(%d)", t)
+}
+
+// DecodeAKA renders an EAP-AKA/AKA' packet as an indented attribute tree.
+func DecodeAKA(payload []byte, opts DecodeOptions) ([]string, error) {
+	decoded, err := decodeAKA(payload, opts)
+	if err != nil {
+		return nil, err
+	}
+	return decoded.lines, nil
+}
+
+// decodedAKA is one decode of an AKA packet: the tree plus the members of
+// the JSON aka_attributes and kdf events.
+type decodedAKA struct {
+	lines     []string
+	subtype   uint8
+	names     []string
+	values    map[string]interface{}
+	kdfInput  *string
+	kdfs      []int
+	encrypted bool
+}
+
+func decodeAKA(payload []byte, opts DecodeOptions) (*decodedAKA, error) {
+	pkt, err := eapaka.Parse(payload)
+	if err != nil {
+		return nil, err
+	}
+	if pkt.Type != eapaka.TypeAKA && pkt.Type != eapaka.TypeAKAPrime {
+		return nil, fmt.Errorf("trace: not an EAP-AKA packet (type %d)", pkt.Type)
+	}
+	method := "EAP-AKA"
+	if pkt.Type == eapaka.TypeAKAPrime {
+		method = "EAP-AKA'"
+	}
+	code := "Response"
+	if pkt.Code == eapaka.CodeRequest {
+		code = "Request"
+	}
+	subtype, ok := subtypeNames[pkt.Subtype]
+	if !ok {
+		subtype = "Unknown"
+	}
+	lines := []string{fmt.Sprintf("%s %s id=%d len=%d subtype=%s(%d)", method, code, pkt.Identifier, len(payload), subtype, pkt.Subtype)}
+	decoded := &decodedAKA{
+		lines:   append(lines, decodeAttributes(pkt.Attributes, opts, "  ")...),
+		subtype: pkt.Subtype,
+		values:  map[string]interface{}{},
+	}
+	for _, attr := range pkt.Attributes {
+		decoded.names = append(decoded.names, AttributeName(attr.Type()))
+		switch a := attr.(type) {
+		case *eapaka.AtKdfInput:
+			name := a.NetworkName
+			decoded.kdfInput = &name
+		case *eapaka.AtKdf:
+			decoded.kdfs = append(decoded.kdfs, int(a.KDF))
+		case *eapaka.AtEncrData:
+			decoded.encrypted = true
+		}
+		if key, value := attributeField(attr, opts); key != "" {
+			decoded.values[key] = value
+		}
+	}
+	return decoded, nil
+}
+
+// attributeField returns the aka_attributes member for the attributes the
+// JSON trace reports individually.
+func attributeField(attr eapaka.Attribute, opts DecodeOptions) (string, interface{}) {
+	secret := func(b []byte) string { return maskAKABytes(b, opts.Unsafe) }
+	switch a := attr.(type) {
+	case *eapaka.AtPermanentIdReq:
+		return "perm_id_req", true
+	case *eapaka.AtBidding:
+		return "bidding_aka_prime", a.SupportsAKAPrime()
+	case *eapaka.AtRand:
+		return "rand", secret(a.Rand)
+	case *eapaka.AtAutn:
+		return "autn", secret(a.Autn)
+	case *eapaka.AtRes:
+		return "res", secret(a.Res)
+	case *eapaka.AtAuts:
+		return "auts", secret(a.Auts)
+	case *eapaka.AtMac:
+		return "mac", secret(a.MAC)
+	case *eapaka.AtIdentity:
+		if opts.Unsafe {
+			return "identity", a.Identity
+		}
+		return "identity", maskIdentity(a.Identity)
+	default:
+		return "", nil
+	}
+}
+
+func decodeAttributes(attrs []eapaka.Attribute, opts DecodeOptions, indent string) []string {
+	var lines []string
+	var iv []byte
+	for _, attr := range attrs {
+		if a, ok := attr.(*eapaka.AtIv); ok {
+			iv = a.IV
+		}
+	}
+	for _, attr := range attrs {
+		length := 0
+		if b, err := attr.Marshal(); err == nil {
+			length = len(b)
+		}
+		lines = append(lines, fmt.Sprintf("%s%s (%d) len=%d", indent, AttributeName(attr.Type()), attr.Type(), length))
+		for _, value := range attributeValues(attr, opts) {
+			lines = append(lines, indent+"  "+value)
+		}
+		if encr, ok := attr.(*eapaka.AtEncrData); ok {
+			lines = append(lines, decryptedLines(encr.EncryptedData, iv, opts, indent+"  ")...)
+		}
+	}
+	return lines
+}
+
+func attributeValues(attr eapaka.Attribute, opts DecodeOptions) []string {
+	secret := func(b []byte) string { return maskAKABytes(b, opts.Unsafe) }
+	identity := func(v string) string {
+		if opts.Unsafe {
+			return v
+		}
+		return maskIdentity(v)
+	}
+	switch a := attr.(type) {
+	case *eapaka.AtRand:
+		return []string{"RAND: " + secret(a.Rand)}
+	case *eapaka.AtAutn:
+		return []string{"AUTN: " + secret(a.Autn)}
+	case *eapaka.AtRes:
+		return []string{fmt.Sprintf("RES length: %d bits", len(a.Res)*8), "RES: " + secret(a.Res)}
+	case *eapaka.AtAuts:
+		return []string{"AUTS: " + secret(a.Auts)}
+	case *eapaka.AtMac:
+		return []string{"MAC: " + secret(a.MAC)}
+	case *eapaka.AtIdentity:
+		return []string{fmt.Sprintf("Identity length: %d", len(a.Identity)), "Identity: " + identity(a.Identity)}
+	case *eapaka.AtNextPseudonym:
+		return []string{"Pseudonym: " + identity(a.Pseudonym)}
+	case *eapaka.AtNextReauthId:
+		return []string{"Re-auth identity: " + identity(a.Identity)}
+	case *eapaka.AtBidding:
+		return []string{fmt.Sprintf("Flags: 0x%04x D=%t (supports EAP-AKA')", a.Flags, a.SupportsAKAPrime())}
+	case *eapaka.AtCheckcode:
+		if len(a.Checkcode) == 0 {
+			return []string{"Checkcode: none"}
+		}
+		return []string{"Checkcode: " + secret(a.Checkcode)}
+	case *eapaka.AtPadding:
+		return []string{fmt.Sprintf("Padding: %d bytes", a.Length)}
+	case *eapaka.AtKdfInput:
+		return []string{"Network name: " + a.NetworkName}
+	case *eapaka.AtKdf:
+		name := "unassigned"
+		switch a.KDF {
+		case eapaka.KDFReserved:
+			name = "reserved"
+		case eapaka.KDFAKAPrimeWithCKIK:
+			name = "EAP-AKA' with CK'/IK'"
+		}
+		return []string{fmt.Sprintf("KDF: %d (%s)", a.KDF, name)}
+	case *eapaka.AtNonceMt:
+		return []string{"NONCE_MT: " + secret(a.NonceMt)}
+	case *eapaka.AtNonceS:
+		return []string{"NONCE_S: " + secret(a.NonceS)}
+	case *eapaka.AtNotification:
+		name, ok := notificationNames[a.Code]
+		if !ok {
+			name = "unknown"
+		}
+		return []string{
+			fmt.Sprintf("S bit: %t (success)", a.S),
+			fmt.Sprintf("P bit: %t (before challenge)", a.P),
+			fmt.Sprintf("Code: %d (%s)", a.Code, name),
+		}
+	case *eapaka.AtVersionList:
+		versions := make([]string, 0, len(a.Versions))
+		for _, v := range a.Versions {
+			versions = append(versions, fmt.Sprintf("%d", v))
+		}
+		return []string{"Versions: " + strings.Join(versions, ",")}
+	case *eapaka.AtSelectedVersion:
+		return []string{fmt.Sprintf("Version: %d", a.Version)}
+	case *eapaka.AtCounter:
+		return []string{fmt.Sprintf("Counter: %d", a.Counter)}
+	case *eapaka.AtClientErrorCode:
+		name, ok := clientErrorNames[a.Code]
+		if !ok {
+			name = "unknown"
+		}
+		return []string{fmt.Sprintf("Code: %d (%s)", a.Code, name)}
+	case *eapaka.AtIv:
+		return []string{"IV: " + secret(a.IV)}
+	case *eapaka.AtEncrData:
+		return []string{fmt.Sprintf("Encrypted data: %d bytes", len(a.EncryptedData))}
+	case *eapaka.GenericAttribute:
+		return []string{"Data: " + secret(a.Data)}
+	default:
+		return nil
+	}
+}
+
+// decryptedLines decodes AT_ENCR_DATA (RFC 4187 10.12): AES-128-CBC under
+// K_encr with the IV from AT_IV, holding nested attributes.
+func decryptedLines(encrypted, iv []byte, opts DecodeOptions, indent string) []string {
+	if !opts.Unsafe {
+		return []string{indent + "Decrypted: hidden (unsafe log disabled)"}
+	}
+	if len(opts.KEncr) == 0 {
+		return []string{indent + "Decrypted: unavailable (K_encr unknown)"}
+	}
+	plain, err := decryptEncrData(opts.KEncr, iv, encrypted)
+	if err != nil {
+		return []string{indent + "Decrypted: " + err.Error()}
+	}
+	attrs, err := parseAttributes(plain)
+	if err != nil {
+		return []string{indent + "Decrypted: " + err.Error()}
+	}
+	return append([]string{indent + "Decrypted:"}, decodeAttributes(attrs, opts, indent+"  ")...)
+}
+
+func decryptEncrData(kEncr, iv, encrypted []byte) ([]byte, error) {
+	if len(iv) != aes.BlockSize {
+		return nil, fmt.Errorf("missing AT_IV")
+	}
+	if len(encrypted) == 0 || len(encrypted)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("invalid encrypted data length %d", len(encrypted))
+	}
+	block, err := aes.NewCipher(kEncr)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(encrypted))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, encrypted)
+	return plain, nil
+}
+
+// parseAttributes decodes a bare attribute list by wrapping it in a
+// synthetic EAP-AKA header so the library parser can be reused.
+func parseAttributes(data []byte) ([]eapaka.Attribute, error) {
+	raw := make([]byte, 8, 8+len(data))
+	raw[0] = eapaka.CodeRequest
+	binary.BigEndian.PutUint16(raw[2:4], uint16(8+len(data)))
+	raw[4] = eapaka.TypeAKA
+	raw[5] = eapaka.SubtypeChallenge
+	raw = append(raw, data...)
+	pkt, err := eapaka.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return pkt.Attributes, nil
+}
@@ -0,0 +1,126 @@
+package trace
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"strings"
+	"testing"
+
+	eapaka "github.com/oyaguma3/go-eapaka"
+	"layeh.com/radius"
+)
+
+func TestDecodeAKAAttributes(t *testing.T) {
+	pkt := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: 3,
+		Type:       eapaka.TypeAKA,
+		Subtype:    eapaka.SubtypeNotification,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtNotification{S: false, P: true, Code: 1026},
+			&eapaka.AtCounter{Counter: 7},
+			&eapaka.AtResultInd{},
+			&eapaka.AtBidding{Flags: eapaka.AtBiddingFlagAKAPrime},
+			&eapaka.AtCheckcode{},
+			&eapaka.AtClientErrorCode{Code: 3},
+		},
+	}
+	raw, err := pkt.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	lines, err := DecodeAKA(raw, DecodeOptions{})
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	out := strings.Join(lines, "\n")
+	for _, want := range []string{
+		"EAP-AKA Request id=3",
+		"subtype=AKA-Notification(12)",
+		"  AT_NOTIFICATION (12) len=4",
+		"    Code: 1026 (User has been temporarily denied access)",
+		"    P bit: true (before challenge)",
+		"    Counter: 7",
+		"  AT_RESULT_IND (135) len=4",
+		"    Flags: 0x8000 D=true (supports EAP-AKA')",
+		"    Checkcode: none",
+		"    Code: 3 (RANDs are not fresh)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestDecodeAKAEncryptedData(t *testing.T) {
+	kEncr := bytes.Repeat([]byte{0x42}, 16)
+	iv := bytes.Repeat([]byte{0x24}, 16)
+	plain, err := (&eapaka.AtNextPseudonym{Pseudonym: "pseudo01"}).Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	pad, err := (&eapaka.AtPadding{Length: aes.BlockSize - len(plain)%aes.BlockSize - 2}).Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	plain = append(plain, pad...)
+	block, _ := aes.NewCipher(kEncr)
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+
+	pkt := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: 1,
+		Type:       eapaka.TypeAKAPrime,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtIv{IV: iv},
+			&eapaka.AtEncrData{EncryptedData: encrypted},
+		},
+	}
+	raw, err := pkt.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+
+	masked, err := DecodeAKA(raw, DecodeOptions{KEncr: kEncr})
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if out := strings.Join(masked, "\n"); strings.Contains(out, "pseudo01") || !strings.Contains(out, "hidden") {
+		t.Fatalf("expected encrypted data hidden without unsafe:\n%s", out)
+	}
+
+	lines, err := DecodeAKA(raw, DecodeOptions{Unsafe: true, KEncr: kEncr})
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	out := strings.Join(lines, "\n")
+	if !strings.Contains(out, "      AT_NEXT_PSEUDONYM (132)") || !strings.Contains(out, "Pseudonym: pseudo01") {
+		t.Fatalf("expected decrypted pseudonym in:\n%s", out)
+	}
+
+	// The received challenge is held back until its K_encr is known and
+	// then written once, decrypted.
+	buf := &bytes.Buffer{}
+	logger := &Logger{Level: LevelVerbose, Out: buf, Unsafe: true}
+	logger.LogRadius(radius.CodeAccessChallenge, nil, raw, nil)
+	if strings.Contains(buf.String(), "AT_ENCR_DATA") {
+		t.Fatalf("expected tree to wait for K_encr, got %q", buf.String())
+	}
+	logger.SetKEncr(kEncr)
+	out = buf.String()
+	if strings.Count(out, "AT_ENCR_DATA") != 1 || !strings.Contains(out, "Pseudonym: pseudo01") {
+		t.Fatalf("expected one decrypted tree, got %q", out)
+	}
+
+	// Without K_encr the tree is still written when flushed.
+	buf.Reset()
+	logger = &Logger{Level: LevelVerbose, Out: buf, Unsafe: true}
+	logger.LogRadius(radius.CodeAccessChallenge, nil, raw, nil)
+	logger.Flush()
+	if !strings.Contains(buf.String(), "Decrypted: unavailable (K_encr unknown)") {
+		t.Fatalf("expected flushed tree, got %q", buf.String())
+	}
+}
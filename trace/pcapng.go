@@ -0,0 +1,185 @@
+package trace
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	pcapngBlockSHB  = 0x0a0d0d0a
+	pcapngBlockIDB  = 0x00000001
+	pcapngBlockEPB  = 0x00000006
+	pcapngByteMagic = 0x1a2b3c4d
+
+	pcapngOptEnd     = 0
+	pcapngOptComment = 1
+
+	// linkTypeRaw carries bare IPv4/IPv6 packets.
+	linkTypeRaw = 101
+)
+
+// PcapWriter writes RADIUS packets as synthetic UDP/IP frames in pcapng
+// format. Timestamps use the default microsecond resolution.
+type PcapWriter struct {
+	w      io.Writer
+	client *net.UDPAddr
+	server *net.UDPAddr
+	ipID   uint16
+}
+
+// NewPcapWriter writes the section and interface headers. comment, when
+// non-empty, is stored in the section header (e.g. the RADIUS shared secret
+// so Wireshark users know which key to configure).
+func NewPcapWriter(w io.Writer, client, server *net.UDPAddr, comment string) (*PcapWriter, error) {
+	if w == nil {
+		return nil, fmt.Errorf("trace: pcap writer is nil")
+	}
+	if client == nil || server == nil {
+		return nil, fmt.Errorf("trace: pcap client and server addresses are required")
+	}
+	if (client.IP.To4() == nil) != (server.IP.To4() == nil) {
+		return nil, fmt.Errorf("trace: pcap client and server must use the same IP version")
+	}
+	p := &PcapWriter{w: w, client: client, server: server}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], pcapngByteMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint16(shb[6:8], 0)
+	binary.LittleEndian.PutUint64(shb[8:16], 0xffffffffffffffff)
+	if comment != "" {
+		shb = append(shb, pcapngOptions(comment)...)
+	}
+	if err := p.writeBlock(pcapngBlockSHB, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:8], 0)
+	if err := p.writeBlock(pcapngBlockIDB, idb); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// CapturePacket writes one RADIUS datagram; outbound packets travel from
+// the client to the server.
+func (p *PcapWriter) CapturePacket(outbound bool, data []byte, at time.Time) error {
+	if p == nil {
+		return nil
+	}
+	src, dst := p.client, p.server
+	if !outbound {
+		src, dst = p.server, p.client
+	}
+	frame := p.udpFrame(src, dst, data)
+
+	micros := uint64(at.UnixNano() / int64(time.Microsecond))
+	epb := make([]byte, 20)
+	binary.LittleEndian.PutUint32(epb[0:4], 0)
+	binary.LittleEndian.PutUint32(epb[4:8], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(epb[8:12], uint32(micros))
+	binary.LittleEndian.PutUint32(epb[12:16], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(epb[16:20], uint32(len(frame)))
+	epb = append(epb, pad4(frame)...)
+	return p.writeBlock(pcapngBlockEPB, epb)
+}
+
+func (p *PcapWriter) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	buf := make([]byte, 0, total)
+	buf = binary.LittleEndian.AppendUint32(buf, blockType)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, total)
+	_, err := p.w.Write(buf)
+	return err
+}
+
+func (p *PcapWriter) udpFrame(src, dst *net.UDPAddr, payload []byte) []byte {
+	udp := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(udp)))
+	copy(udp[8:], payload)
+
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		pseudo := make([]byte, 0, 12)
+		pseudo = append(pseudo, src4...)
+		pseudo = append(pseudo, dst4...)
+		pseudo = append(pseudo, 0, 17, byte(len(udp)>>8), byte(len(udp)))
+		binary.BigEndian.PutUint16(udp[6:8], udpChecksum(pseudo, udp))
+
+		p.ipID++
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:4], uint16(20+len(udp)))
+		binary.BigEndian.PutUint16(ip[4:6], p.ipID)
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:16], src4)
+		copy(ip[16:20], dst4)
+		binary.BigEndian.PutUint16(ip[10:12], checksum(ip))
+		return append(ip, udp...)
+	}
+
+	src16, dst16 := src.IP.To16(), dst.IP.To16()
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, src16...)
+	pseudo = append(pseudo, dst16...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(udp)))
+	pseudo = append(pseudo, 0, 0, 0, 17)
+	binary.BigEndian.PutUint16(udp[6:8], udpChecksum(pseudo, udp))
+
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:6], uint16(len(udp)))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:24], src16)
+	copy(ip[24:40], dst16)
+	return append(ip, udp...)
+}
+
+func udpChecksum(pseudo, udp []byte) uint16 {
+	sum := checksum(append(append([]byte(nil), pseudo...), udp...))
+	if sum == 0 {
+		return 0xffff
+	}
+	return sum
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func pcapngOptions(comment string) []byte {
+	opt := make([]byte, 4)
+	binary.LittleEndian.PutUint16(opt[0:2], pcapngOptComment)
+	binary.LittleEndian.PutUint16(opt[2:4], uint16(len(comment)))
+	opt = append(opt, pad4([]byte(comment))...)
+	end := make([]byte, 4)
+	binary.LittleEndian.PutUint16(end[0:2], pcapngOptEnd)
+	return append(opt, end...)
+}
+
+func pad4(b []byte) []byte {
+	if rem := len(b) % 4; rem != 0 {
+		return append(append([]byte(nil), b...), make([]byte, 4-rem)...)
+	}
+	return b
+}
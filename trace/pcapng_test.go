@@ -0,0 +1,89 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPcapWriterBlocks(t *testing.T) {
+	buf := &bytes.Buffer{}
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	server := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1812}
+	w, err := NewPcapWriter(buf, client, server, "RADIUS shared secret: testing123")
+	if err != nil {
+		t.Fatalf("new writer failed: %v", err)
+	}
+	at := time.Unix(1700000000, 123456000)
+	payload := []byte{0x01, 0x02, 0x00, 0x05, 0xff}
+	if err := w.CapturePacket(true, payload, at); err != nil {
+		t.Fatalf("capture failed: %v", err)
+	}
+	if err := w.CapturePacket(false, payload, at.Add(time.Millisecond)); err != nil {
+		t.Fatalf("capture failed: %v", err)
+	}
+
+	blocks := splitBlocks(t, buf.Bytes())
+	if len(blocks) != 4 {
+		t.Fatalf("expected 4 blocks, got %d", len(blocks))
+	}
+	if blocks[0].typ != pcapngBlockSHB || !bytes.Contains(blocks[0].body, []byte("testing123")) {
+		t.Fatalf("expected section header with comment")
+	}
+	if blocks[1].typ != pcapngBlockIDB || binary.LittleEndian.Uint16(blocks[1].body[0:2]) != linkTypeRaw {
+		t.Fatalf("expected raw IP interface block")
+	}
+
+	epb := blocks[2].body
+	micros := uint64(binary.LittleEndian.Uint32(epb[4:8]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:12]))
+	if micros != uint64(at.UnixNano()/1000) {
+		t.Fatalf("unexpected timestamp %d", micros)
+	}
+	frame := epb[20 : 20+binary.LittleEndian.Uint32(epb[12:16])]
+	if checksum(frame[:20]) != 0 {
+		t.Fatalf("invalid IPv4 header checksum")
+	}
+	if !net.IP(frame[12:16]).Equal(client.IP) || binary.BigEndian.Uint16(frame[22:24]) != 1812 {
+		t.Fatalf("expected request from client to server port 1812")
+	}
+	if !bytes.Equal(frame[28:], payload) {
+		t.Fatalf("unexpected payload %x", frame[28:])
+	}
+
+	reply := blocks[3].body[20:]
+	if !net.IP(reply[12:16]).Equal(server.IP) || binary.BigEndian.Uint16(reply[20:22]) != 1812 {
+		t.Fatalf("expected reply from server")
+	}
+}
+
+func TestPcapWriterRejectsMixedFamilies(t *testing.T) {
+	client := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	server := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1812}
+	if _, err := NewPcapWriter(&bytes.Buffer{}, client, server, ""); err == nil {
+		t.Fatalf("expected error for mixed IP versions")
+	}
+}
+
+type pcapngBlock struct {
+	typ  uint32
+	body []byte
+}
+
+func splitBlocks(t *testing.T, data []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block")
+		}
+		total := binary.LittleEndian.Uint32(data[4:8])
+		if total%4 != 0 || int(total) > len(data) || binary.LittleEndian.Uint32(data[total-4:total]) != total {
+			t.Fatalf("invalid block length %d", total)
+		}
+		blocks = append(blocks, pcapngBlock{typ: binary.LittleEndian.Uint32(data[0:4]), body: data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
@@ -2,14 +2,15 @@ package trace
 
 import (
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"strings"
+	"time"
 
 	"github.com/oyaguma3/eapaka_test/eap"
 	"github.com/oyaguma3/eapaka_test/radiusc"
 
-	eapaka "github.com/oyaguma3/go-eapaka"
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
 	"layeh.com/radius/rfc2869"
@@ -23,14 +24,64 @@ const (
 	LevelVerbose Level = "verbose"
 )
 
+// Format selects the trace encoding.
+type Format string
+
+const (
+	FormatText Format = "text"
+	FormatJSON Format = "json"
+)
+
 // Logger emits trace messages to the output.
 type Logger struct {
 	Level  Level
 	Out    io.Writer
 	Unsafe bool
+	// Format is text (key=value lines, the default) or json (one object per
+	// event).
+	Format Format
+	// CaseName and Round are attached to every JSON event.
+	CaseName string
+	Round    int
 
 	DumpEAPHex      bool
 	DumpRadiusAttrs bool
+
+	now          func() time.Time
+	lastUserName string
+	// kEncr decrypts AT_ENCR_DATA; pendingAKA is a received request whose
+	// tree waits for the K_encr derived while handling it.
+	kEncr      []byte
+	pendingAKA []byte
+}
+
+// fields holds the event-specific members of a JSON trace object.
+type fields map[string]interface{}
+
+// emit writes one event: the text line in text mode, or a JSON object with
+// the common members (ts, case, round, event) merged with f.
+func (l *Logger) emit(event, text string, f fields) {
+	if l.Format != FormatJSON {
+		fmt.Fprintln(l.Out, text)
+		return
+	}
+	now := time.Now
+	if l.now != nil {
+		now = l.now
+	}
+	obj := make(map[string]interface{}, len(f)+4)
+	for k, v := range f {
+		obj[k] = v
+	}
+	obj["ts"] = now().UTC().Format(time.RFC3339Nano)
+	obj["case"] = l.CaseName
+	obj["round"] = l.Round
+	obj["event"] = event
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(l.Out, string(data))
 }
 
 // LogRadius writes a summary of the RADIUS message.
@@ -38,7 +89,37 @@ func (l *Logger) LogRadius(code radius.Code, packet *radius.Packet, eapPayload [
 	if l == nil || l.Out == nil {
 		return
 	}
+	l.logRadius("radius_receive", code, packet, eapPayload, sess, nil)
+}
+
+// LogRadiusRequest writes an outgoing Access-Request with the same detail as
+// LogRadius, noting when the User-Name differs from the previous request.
+func (l *Logger) LogRadiusRequest(packet *radius.Packet, eapPayload []byte, sess *eap.Session) {
+	if l == nil || l.Out == nil || packet == nil {
+		return
+	}
+	userName := rfc2865.UserName_GetString(packet)
+	f := fields{"user_name": l.identity(userName)}
+	if l.lastUserName != "" && userName != l.lastUserName {
+		f["identity_changed"] = true
+	}
+	l.lastUserName = userName
+	l.logRadius("radius_send", packet.Code, packet, eapPayload, sess, f)
+}
+
+func (l *Logger) logRadius(event string, code radius.Code, packet *radius.Packet, eapPayload []byte, sess *eap.Session, extra fields) {
+	l.Flush()
 	line := fmt.Sprintf("radius=%s", code.String())
+	f := fields{"code": code.String()}
+	if name, ok := extra["user_name"]; ok {
+		line += fmt.Sprintf(" user=%s", name)
+		if extra["identity_changed"] == true {
+			line += " identity_changed=true"
+		}
+	}
+	for k, v := range extra {
+		f[k] = v
+	}
 	if packet != nil {
 		state := rfc2865.State_Get(packet)
 		if len(state) > 0 {
@@ -46,12 +127,16 @@ func (l *Logger) LogRadius(code radius.Code, packet *radius.Packet, eapPayload [
 		} else {
 			line += " state=absent"
 		}
-		line += fmt.Sprintf(" attrs=%s", summarizeAttrs(packet))
+		f["state_present"] = len(state) > 0
+		attrs := summarizeAttrs(packet)
+		line += fmt.Sprintf(" attrs=%s", attrs)
+		f["attrs"] = attrs
 	}
 	if sess != nil {
-		line += fmt.Sprintf(" outer=%s inner=%s", maskIdentity(sess.OuterIdentity), maskIdentity(sess.InnerIdentity))
+		line += fmt.Sprintf(" outer=%s inner=%s", l.identity(sess.OuterIdentity), l.identity(sess.InnerIdentity))
+		l.identityFields(f, sess)
 	}
-	fmt.Fprintln(l.Out, line)
+	l.emit(event, line, f)
 	if l.Level == LevelVerbose {
 		if l.DumpEAPHex {
 			l.dumpEAP(eapPayload)
@@ -59,7 +144,7 @@ func (l *Logger) LogRadius(code radius.Code, packet *radius.Packet, eapPayload [
 		if l.DumpRadiusAttrs {
 			l.dumpRadiusAttrs(packet)
 		}
-		l.dumpAKAAttributes(eapPayload)
+		l.dumpAKA(eapPayload, event == "radius_receive")
 		l.warnCalledStationID(packet)
 	}
 }
@@ -69,13 +154,70 @@ func (l *Logger) LogChallengeResponse(req *eap.Packet, resp *eap.Packet, sess *e
 	if l == nil || l.Out == nil {
 		return
 	}
+	l.Flush()
 	reqType := eapTypeName(req)
 	respType := eapTypeName(resp)
 	line := fmt.Sprintf("eap request=%s response=%s", reqType, respType)
+	f := fields{"request": reqType, "response": respType}
+	if resp != nil && resp.Type == eap.TypeNak {
+		var offered []string
+		for _, t := range resp.TypeData {
+			if t != 0 {
+				offered = append(offered, eapTypeName(&eap.Packet{Type: t}))
+			}
+		}
+		line += " nak=" + strings.Join(offered, ",")
+		f["nak"] = offered
+	}
 	if sess != nil {
-		line += fmt.Sprintf(" outer=%s inner=%s", maskIdentity(sess.OuterIdentity), maskIdentity(sess.InnerIdentity))
+		line += fmt.Sprintf(" outer=%s inner=%s", l.identity(sess.OuterIdentity), l.identity(sess.InnerIdentity))
+		l.identityFields(f, sess)
+	}
+	l.emit("eap", line, f)
+}
+
+func (l *Logger) identityFields(f fields, sess *eap.Session) {
+	f["outer"], f["inner"] = l.identity(sess.OuterIdentity), l.identity(sess.InnerIdentity)
+}
+
+// identity masks an identity unless unsafe logging is on.
+func (l *Logger) identity(value string) string {
+	if l.Unsafe {
+		return value
+	}
+	return maskIdentity(value)
+}
+
+// SetKEncr sets the K_encr used to decrypt AT_ENCR_DATA in the AKA tree
+// (unsafe verbose only) and writes the tree of a received request that was
+// held back until its K_encr was derived.
+func (l *Logger) SetKEncr(kEncr []byte) {
+	if l == nil {
+		return
+	}
+	l.kEncr = kEncr
+	l.Flush()
+}
+
+// Flush writes a held-back AKA tree, decrypting what the current K_encr
+// allows. Call it when the request will not be handled, e.g. at the end of
+// a failed session.
+func (l *Logger) Flush() {
+	if l == nil || l.pendingAKA == nil {
+		return
+	}
+	payload := l.pendingAKA
+	l.pendingAKA = nil
+	l.dumpAKA(payload, false)
+}
+
+// LogSecret writes key material in hex only when unsafe logging is enabled.
+func (l *Logger) LogSecret(name string, value []byte) {
+	if l == nil || l.Out == nil || !l.Unsafe {
+		return
 	}
-	fmt.Fprintln(l.Out, line)
+	encoded := hex.EncodeToString(value)
+	l.emit("secret", name+"="+encoded, fields{"name": name, "value": encoded})
 }
 
 // LogMPPE logs MPPE presence and optionally value prefixes.
@@ -84,15 +226,18 @@ func (l *Logger) LogMPPE(keys radiusc.MPPEKeys) {
 		return
 	}
 	line := fmt.Sprintf("mppe send=%t recv=%t", keys.SendKeyPresent, keys.RecvKeyPresent)
+	f := fields{"send": keys.SendKeyPresent, "recv": keys.RecvKeyPresent}
 	if l.Level == LevelVerbose {
 		if keys.SendKeyPresent {
 			line += fmt.Sprintf(" send_prefix=%s", maskBytes(keys.SendKey))
+			f["send_prefix"] = maskBytes(keys.SendKey)
 		}
 		if keys.RecvKeyPresent {
 			line += fmt.Sprintf(" recv_prefix=%s", maskBytes(keys.RecvKey))
+			f["recv_prefix"] = maskBytes(keys.RecvKey)
 		}
 	}
-	fmt.Fprintln(l.Out, line)
+	l.emit("mppe", line, f)
 }
 
 func summarizeAttrs(packet *radius.Packet) string {
@@ -127,8 +272,16 @@ func (l *Logger) warnCalledStationID(packet *radius.Packet) {
 		return
 	}
 	if !calledStationIDOK(called) {
-		fmt.Fprintln(l.Out, "warn called_station_id format unexpected")
+		l.Warn("called_station_id format unexpected")
+	}
+}
+
+// Warn writes a warning event.
+func (l *Logger) Warn(message string) {
+	if l == nil || l.Out == nil {
+		return
 	}
+	l.emit("warning", "warn "+message, fields{"message": message})
 }
 
 func calledStationIDOK(value string) bool {
@@ -164,7 +317,8 @@ func (l *Logger) dumpEAP(payload []byte) {
 	if len(payload) == 0 {
 		return
 	}
-	fmt.Fprintf(l.Out, "eap_hex=%s\n", hex.EncodeToString(payload))
+	value := hex.EncodeToString(payload)
+	l.emit("eap_hex", "eap_hex="+value, fields{"hex": value})
 }
 
 func (l *Logger) dumpRadiusAttrs(packet *radius.Packet) {
@@ -172,53 +326,62 @@ func (l *Logger) dumpRadiusAttrs(packet *radius.Packet) {
 		return
 	}
 	var attrs []string
+	var list []fields
 	for _, avp := range packet.Attributes {
 		attrs = append(attrs, fmt.Sprintf("%d(len=%d)", avp.Type, len(avp.Attribute)))
+		list = append(list, fields{"type": int(avp.Type), "len": len(avp.Attribute)})
 	}
 	if len(attrs) > 0 {
-		fmt.Fprintf(l.Out, "radius_attrs=%s\n", strings.Join(attrs, ","))
+		l.emit("radius_attrs", "radius_attrs="+strings.Join(attrs, ","), fields{"attrs": list})
 	}
 }
 
-func (l *Logger) dumpAKAAttributes(payload []byte) {
-	if len(payload) == 0 {
+// dumpAKA writes the attribute tree of an AKA packet, as text lines or as
+// aka_attributes and kdf events. A received request carrying AT_ENCR_DATA
+// is held back (hold) until SetKEncr or Flush when it could be decrypted.
+func (l *Logger) dumpAKA(payload []byte, hold bool) {
+	if len(payload) == 0 || l.Out == nil {
 		return
 	}
-	pkt, err := eapaka.Parse(payload)
+	opts := DecodeOptions{Unsafe: l.Unsafe, KEncr: l.kEncr}
+	decoded, err := decodeAKA(payload, opts)
 	if err != nil {
 		return
 	}
-	if pkt.Type != eapaka.TypeAKA && pkt.Type != eapaka.TypeAKAPrime {
+	if hold && decoded.encrypted && l.Unsafe {
+		l.pendingAKA = payload
 		return
 	}
-	var names []string
-	for _, attr := range pkt.Attributes {
-		names = append(names, fmt.Sprintf("%T", attr))
-		if _, ok := attr.(*eapaka.AtPermanentIdReq); ok {
-			fmt.Fprintln(l.Out, "aka_perm_id_req=true")
-		}
-		if kdfInput, ok := attr.(*eapaka.AtKdfInput); ok {
-			fmt.Fprintf(l.Out, "aka_kdf_input=%s\n", kdfInput.NetworkName)
-		}
-		if kdf, ok := attr.(*eapaka.AtKdf); ok {
-			fmt.Fprintf(l.Out, "aka_kdf=%d\n", kdf.KDF)
-		}
-		if bidding, ok := attr.(*eapaka.AtBidding); ok {
-			fmt.Fprintf(l.Out, "aka_bidding_aka_prime=%t\n", bidding.SupportsAKAPrime())
-		}
-		if randAttr, ok := attr.(*eapaka.AtRand); ok {
-			fmt.Fprintf(l.Out, "aka_rand=%s\n", maskAKABytes(randAttr.Rand, l.Unsafe))
-		}
-		if autnAttr, ok := attr.(*eapaka.AtAutn); ok {
-			fmt.Fprintf(l.Out, "aka_autn=%s\n", maskAKABytes(autnAttr.Autn, l.Unsafe))
-		}
-		if resAttr, ok := attr.(*eapaka.AtRes); ok {
-			fmt.Fprintf(l.Out, "aka_res=%s\n", maskAKABytes(resAttr.Res, l.Unsafe))
+	if l.Format != FormatJSON {
+		for _, line := range decoded.lines {
+			fmt.Fprintln(l.Out, line)
 		}
+		return
+	}
+	attrFields := fields{}
+	for k, v := range decoded.values {
+		attrFields[k] = v
 	}
-	if len(names) > 0 {
-		fmt.Fprintf(l.Out, "aka_attrs=%s\n", strings.Join(names, ","))
+	attrFields["subtype"] = int(decoded.subtype)
+	attrFields["attrs"] = decoded.names
+	attrFields["tree"] = decoded.lines
+	l.emit("aka_attributes", "", attrFields)
+	kdfFields := fields{}
+	if decoded.kdfInput != nil {
+		kdfFields["kdf_input"] = *decoded.kdfInput
 	}
+	if len(decoded.kdfs) > 0 {
+		kdfFields["kdf"] = decoded.kdfs
+	}
+	if len(kdfFields) > 0 {
+		l.emit("kdf", "", kdfFields)
+	}
+}
+
+// MaskIdentity hides all but the first and last two characters of an
+// identity, as the trace does without unsafe logging.
+func MaskIdentity(identity string) string {
+	return maskIdentity(identity)
 }
 
 func maskIdentity(identity string) string {
@@ -258,6 +421,10 @@ func eapTypeName(pkt *eap.Packet) string {
 	switch pkt.Type {
 	case eap.TypeIdentity:
 		return "identity"
+	case eap.TypeNak:
+		return "nak"
+	case eap.TypeSIM:
+		return "sim"
 	case eap.TypeAKA:
 		return "aka"
 	case eap.TypeAKAPrime:
@@ -2,7 +2,10 @@ package trace
 
 import (
 	"bytes"
+	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/oyaguma3/eapaka_test/eap"
 	"github.com/oyaguma3/eapaka_test/radiusc"
@@ -46,10 +49,11 @@ func TestTraceVerboseAKA(t *testing.T) {
 	if err != nil {
 		t.Fatalf("marshal failed: %v", err)
 	}
-	logger.dumpAKAAttributes(raw)
+	logger.dumpAKA(raw, false)
 
-	if !bytes.Contains(buf.Bytes(), []byte("aka_perm_id_req=true")) {
-		t.Fatalf("expected perm id req trace")
+	out := buf.String()
+	if !strings.Contains(out, "AT_PERMANENT_ID_REQ (10)") || strings.Contains(out, "aka_") {
+		t.Fatalf("expected only the attribute tree, got %q", out)
 	}
 }
 
@@ -72,15 +76,15 @@ func TestTraceUnsafeAKAValues(t *testing.T) {
 	if err != nil {
 		t.Fatalf("marshal failed: %v", err)
 	}
-	logger.dumpAKAAttributes(raw)
+	logger.dumpAKA(raw, false)
 
-	if !bytes.Contains(buf.Bytes(), []byte("aka_rand=01010101010101010101010101010101")) {
+	if !bytes.Contains(buf.Bytes(), []byte("RAND: 01010101010101010101010101010101")) {
 		t.Fatalf("expected rand hex output")
 	}
-	if !bytes.Contains(buf.Bytes(), []byte("aka_autn=10101010101010101010101010101010")) {
+	if !bytes.Contains(buf.Bytes(), []byte("AUTN: 10101010101010101010101010101010")) {
 		t.Fatalf("expected autn hex output")
 	}
-	if !bytes.Contains(buf.Bytes(), []byte("aka_res=aabb")) {
+	if !bytes.Contains(buf.Bytes(), []byte("RES: aabb")) {
 		t.Fatalf("expected res hex output")
 	}
 }
@@ -107,3 +111,145 @@ func TestCalledStationIDWarning(t *testing.T) {
 		t.Fatalf("expected called_station_id warning")
 	}
 }
+
+func TestLogSecretRequiresUnsafe(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := &Logger{Level: LevelNormal, Out: buf}
+	logger.LogSecret("sim_opc_derived", []byte{0xaa, 0xbb})
+	if buf.Len() != 0 {
+		t.Fatalf("expected no output without unsafe, got %q", buf.String())
+	}
+	logger.Unsafe = true
+	logger.LogSecret("sim_opc_derived", []byte{0xaa, 0xbb})
+	if buf.String() != "sim_opc_derived=aabb\n" {
+		t.Fatalf("unexpected output: %q", buf.String())
+	}
+}
+
+func TestTraceJSONEvents(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := &Logger{
+		Level:    LevelVerbose,
+		Out:      buf,
+		Format:   FormatJSON,
+		CaseName: "json_case",
+		Round:    2,
+
+		DumpEAPHex:      true,
+		DumpRadiusAttrs: true,
+		now:             func() time.Time { return time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC) },
+	}
+	req := &eapaka.Packet{
+		Code:       eapaka.CodeRequest,
+		Identifier: 1,
+		Type:       eapaka.TypeAKAPrime,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtRand{Rand: bytes.Repeat([]byte{0x01}, 16)},
+			&eapaka.AtKdfInput{NetworkName: "WLAN"},
+			&eapaka.AtKdf{KDF: 1},
+		},
+	}
+	raw, err := req.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	packet := radius.New(radius.CodeAccessChallenge, []byte("secret"))
+	_ = rfc2865.CalledStationID_SetString(packet, "bad-format")
+	logger.LogRadius(radius.CodeAccessChallenge, packet, raw, &eap.Session{OuterIdentity: "0001010000000001@example"})
+	logger.LogMPPE(radiusc.MPPEKeys{SendKeyPresent: true, SendKey: []byte{0x01, 0x02, 0x03, 0x04, 0x05}})
+
+	events := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		if obj["case"] != "json_case" || obj["round"] != float64(2) || obj["ts"] != "2024-01-02T03:04:05Z" {
+			t.Fatalf("missing common fields: %v", obj)
+		}
+		events[obj["event"].(string)] = obj
+	}
+	for _, name := range []string{"radius_receive", "eap_hex", "radius_attrs", "aka_attributes", "kdf", "warning", "mppe"} {
+		if _, ok := events[name]; !ok {
+			t.Fatalf("expected %s event, got %v", name, events)
+		}
+	}
+	if events["radius_receive"]["outer"] != "00***le" {
+		t.Fatalf("expected masked identity, got %v", events["radius_receive"]["outer"])
+	}
+	if rand, _ := events["aka_attributes"]["rand"].(string); !strings.Contains(rand, "***") {
+		t.Fatalf("expected masked rand, got %q", rand)
+	}
+	if tree, _ := events["aka_attributes"]["tree"].([]interface{}); len(tree) != 7 {
+		t.Fatalf("expected attribute tree, got %v", events["aka_attributes"]["tree"])
+	}
+	if kdf, _ := events["kdf"]["kdf"].([]interface{}); events["kdf"]["kdf_input"] != "WLAN" || len(kdf) != 1 || kdf[0] != float64(1) {
+		t.Fatalf("unexpected kdf event: %v", events["kdf"])
+	}
+}
+
+func TestTraceJSONUnsafe(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := &Logger{Level: LevelNormal, Out: buf, Format: FormatJSON, Unsafe: true}
+	logger.LogChallengeResponse(&eap.Packet{Type: eap.TypeAKA}, &eap.Packet{Type: eap.TypeAKA}, &eap.Session{OuterIdentity: "0001010000000001@example"})
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &obj); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if obj["event"] != "eap" || obj["outer"] != "0001010000000001@example" {
+		t.Fatalf("unexpected event: %v", obj)
+	}
+}
+
+func TestTraceTextUnsafeIdentity(t *testing.T) {
+	sess := &eap.Session{OuterIdentity: "0001010000000001@example"}
+	buf := &bytes.Buffer{}
+	logger := &Logger{Level: LevelNormal, Out: buf, Unsafe: true}
+	logger.LogChallengeResponse(&eap.Packet{Type: eap.TypeAKA}, &eap.Packet{Type: eap.TypeAKA}, sess)
+	if !strings.Contains(buf.String(), "outer=0001010000000001@example") {
+		t.Fatalf("expected unmasked identity, got %q", buf.String())
+	}
+
+	buf.Reset()
+	logger.Unsafe = false
+	logger.LogChallengeResponse(&eap.Packet{Type: eap.TypeAKA}, &eap.Packet{Type: eap.TypeAKA}, sess)
+	if strings.Contains(buf.String(), "0001010000000001@example") {
+		t.Fatalf("expected masked identity, got %q", buf.String())
+	}
+}
+
+func TestTraceRadiusRequest(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := &Logger{Level: LevelVerbose, Out: buf}
+	resp := &eapaka.Packet{
+		Code:       eapaka.CodeResponse,
+		Identifier: 2,
+		Type:       eapaka.TypeAKA,
+		Subtype:    eapaka.SubtypeChallenge,
+		Attributes: []eapaka.Attribute{
+			&eapaka.AtRes{Res: bytes.Repeat([]byte{0xaa}, 8)},
+			&eapaka.AtMac{MAC: bytes.Repeat([]byte{0xbb}, 16)},
+		},
+	}
+	raw, err := resp.Marshal()
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	first := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	_ = rfc2865.UserName_SetString(first, "2pseudonym@example")
+	logger.LogRadiusRequest(first, nil, nil)
+	second := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	_ = rfc2865.UserName_SetString(second, "0001010000000001@example")
+	_ = rfc2865.State_Set(second, []byte{0x01})
+	logger.LogRadiusRequest(second, raw, nil)
+
+	out := buf.String()
+	if !strings.Contains(out, "radius=Access-Request user=00***le identity_changed=true state=present") {
+		t.Fatalf("expected request line with identity change, got %q", out)
+	}
+	if !strings.Contains(out, "RES: aaaa***(len=8)") || !strings.Contains(out, "MAC: bbbb***(len=16)") {
+		t.Fatalf("expected masked AT_RES and AT_MAC, got %q", out)
+	}
+}
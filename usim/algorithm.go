@@ -0,0 +1,50 @@
+package usim
+
+import "fmt"
+
+// Algorithm computes the USIM authentication functions (TS 33.102 6.3)
+// for a single subscriber key.
+type Algorithm interface {
+	// F1 computes MAC-A over SQN and AMF.
+	F1(rand, sqn, amf []byte) ([]byte, error)
+	// F1Star computes MAC-S over SQN_MS and AMF for re-synchronization.
+	F1Star(rand, sqn, amf []byte) ([]byte, error)
+	// F2345 computes RES, CK, IK and AK.
+	F2345(rand []byte) (res, ck, ik, ak []byte, err error)
+	// F5Star computes the anonymity key used to conceal SQN_MS in AUTS.
+	F5Star(rand []byte) ([]byte, error)
+}
+
+// GenerateAUTS builds AUTS = (SQN_MS xor AK*) || MAC-S with the resync AMF of zero.
+func GenerateAUTS(alg Algorithm, rand []byte, sqnMS uint64) ([]byte, error) {
+	if alg == nil {
+		return nil, fmt.Errorf("usim: algorithm is nil")
+	}
+	sqn := sqnBytes(sqnMS)
+	macS, err := alg.F1Star(rand, sqn, []byte{0x00, 0x00})
+	if err != nil {
+		return nil, err
+	}
+	aks, err := alg.F5Star(rand)
+	if err != nil {
+		return nil, err
+	}
+	if len(aks) != 6 || len(macS) < 8 {
+		return nil, fmt.Errorf("usim: invalid AK*/MAC-S length")
+	}
+	auts := make([]byte, 14)
+	for i := 0; i < 6; i++ {
+		auts[i] = sqn[i] ^ aks[i]
+	}
+	copy(auts[6:], macS[:8])
+	return auts, nil
+}
+
+func sqnBytes(sqn uint64) []byte {
+	out := make([]byte, 6)
+	for i := 5; i >= 0; i-- {
+		out[i] = byte(sqn)
+		sqn >>= 8
+	}
+	return out
+}
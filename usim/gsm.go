@@ -0,0 +1,67 @@
+package usim
+
+import "fmt"
+
+// GSMAlgorithm computes the GSM authentication functions A3 (SRES) and A8
+// (Kc) used by EAP-SIM.
+type GSMAlgorithm interface {
+	A3A8(rand []byte) (sres, kc []byte, err error)
+}
+
+// GSMContext derives GSM triplets from a USIM algorithm with the conversion
+// functions c2 and c3 of TS 33.102 Section 6.8.1.2, as a USIM does in a
+// GSM security context.
+type GSMContext struct {
+	alg Algorithm
+}
+
+// NewGSMContext wraps alg as a GSMAlgorithm.
+func NewGSMContext(alg Algorithm) (*GSMContext, error) {
+	if alg == nil {
+		return nil, fmt.Errorf("usim: algorithm is nil")
+	}
+	return &GSMContext{alg: alg}, nil
+}
+
+// A3A8 returns SRES = c2(RES) and Kc = c3(CK, IK).
+func (g *GSMContext) A3A8(rand []byte) ([]byte, []byte, error) {
+	res, ck, ik, _, err := g.alg.F2345(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	sres, err := C2(res)
+	if err != nil {
+		return nil, nil, err
+	}
+	kc, err := C3(ck, ik)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sres, kc, nil
+}
+
+// C2 folds RES (4 to 16 bytes, zero padded to 16) into a 32-bit SRES.
+func C2(res []byte) ([]byte, error) {
+	if len(res) < 4 || len(res) > 16 {
+		return nil, fmt.Errorf("usim: RES must be 4 to 16 bytes")
+	}
+	var padded [16]byte
+	copy(padded[:], res)
+	sres := make([]byte, 4)
+	for i := 0; i < 16; i += 4 {
+		xorInto(sres, padded[i:i+4])
+	}
+	return sres, nil
+}
+
+// C3 computes Kc = CK1 xor CK2 xor IK1 xor IK2 over the 64-bit halves.
+func C3(ck, ik []byte) ([]byte, error) {
+	if len(ck) != 16 || len(ik) != 16 {
+		return nil, fmt.Errorf("usim: CK/IK must be 16 bytes")
+	}
+	kc := append([]byte(nil), ck[:8]...)
+	xorInto(kc, ck[8:])
+	xorInto(kc, ik[:8])
+	xorInto(kc, ik[8:])
+	return kc, nil
+}
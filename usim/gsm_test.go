@@ -0,0 +1,109 @@
+package usim
+
+import "testing"
+
+func TestGSMContextXOR(t *testing.T) {
+	alg, err := NewXOR(mustHex(t, "000102030405060708090a0b0c0d0e0f"), 0)
+	if err != nil {
+		t.Fatalf("new xor failed: %v", err)
+	}
+	gsm, err := NewGSMContext(alg)
+	if err != nil {
+		t.Fatalf("new gsm context failed: %v", err)
+	}
+	sres, kc, err := gsm.A3A8(mustHex(t, "ffffffffffffffffffffffffffffffff"))
+	if err != nil {
+		t.Fatalf("a3a8 failed: %v", err)
+	}
+	// RES fffefdfcfbfaf9f8 folds to fffefdfc ^ fbfaf9f8.
+	expectHex(t, "SRES", sres, "04040404")
+	// CK and IK of the XOR algorithm cancel out under c3.
+	expectHex(t, "Kc", kc, "0000000000000000")
+}
+
+func TestC2C3(t *testing.T) {
+	sres, err := C2(mustHex(t, "0102030410203040"))
+	if err != nil {
+		t.Fatalf("c2 failed: %v", err)
+	}
+	expectHex(t, "SRES", sres, "11223344")
+	sres, _ = C2(mustHex(t, "01020304"))
+	expectHex(t, "SRES (32-bit RES)", sres, "01020304")
+	if _, err := C2(mustHex(t, "010203")); err == nil {
+		t.Fatalf("expected error for short RES")
+	}
+
+	kc, err := C3(
+		mustHex(t, "0100000000000000000000000000000f"),
+		mustHex(t, "00000000000000f00000000000000100"),
+	)
+	if err != nil {
+		t.Fatalf("c3 failed: %v", err)
+	}
+	expectHex(t, "Kc", kc, "01000000000001ff")
+	if _, err := C3(make([]byte, 8), make([]byte, 16)); err == nil {
+		t.Fatalf("expected error for short CK")
+	}
+}
+
+func TestCOMP128(t *testing.T) {
+	tests := []struct {
+		ki, rand, sres, kc string
+	}{
+		{"000102030405060708090a0b0c0d0e0f", "ffffffffffffffffffffffffffffffff", "3233f4b0", "af09eba3cd874000"},
+		{"465b5ce8b199b49faa5f0a2ee238a6bc", "23553cbe9637a89d218ae64dae47bf35", "27c443ca", "e8d311d150017400"},
+	}
+	for _, tt := range tests {
+		alg, err := NewCOMP128(mustHex(t, tt.ki))
+		if err != nil {
+			t.Fatalf("new comp128 failed: %v", err)
+		}
+		sres, kc, err := alg.A3A8(mustHex(t, tt.rand))
+		if err != nil {
+			t.Fatalf("a3a8 failed: %v", err)
+		}
+		expectHex(t, "SRES", sres, tt.sres)
+		expectHex(t, "Kc", kc, tt.kc)
+		if kc[6]&0x03 != 0 || kc[7] != 0 {
+			t.Fatalf("expected last 10 bits of Kc to be zero, got %x", kc)
+		}
+	}
+	if _, err := NewCOMP128(make([]byte, 8)); err == nil {
+		t.Fatalf("expected error for short Ki")
+	}
+}
+
+func TestCOMP128Tables(t *testing.T) {
+	var seen [256]int
+	for i := 0; i < 256; i++ {
+		seen[comp128T0[i]]++
+	}
+	for v, n := range seen {
+		if n != 1 {
+			t.Fatalf("T0 first half is not a permutation: %d appears %d times", v, n)
+		}
+	}
+	tables := []struct {
+		name  string
+		table []byte
+	}{
+		{"T1", comp128T1[:]},
+		{"T2", comp128T2[:]},
+		{"T3", comp128T3[:]},
+		{"T4", comp128T4[:]},
+	}
+	for _, tt := range tables {
+		counts := make([]int, len(tt.table)/2)
+		for _, v := range tt.table {
+			if int(v) >= len(counts) {
+				t.Fatalf("%s value %d out of range", tt.name, v)
+			}
+			counts[v]++
+		}
+		for v, n := range counts {
+			if n != 2 {
+				t.Fatalf("%s value %d appears %d times", tt.name, v, n)
+			}
+		}
+	}
+}
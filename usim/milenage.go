@@ -0,0 +1,200 @@
+package usim
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// MilenageConstants holds the operator-selectable rotations (in bits) and
+// additive constants c1..c5 of TS 35.206 section 4.1.
+type MilenageConstants struct {
+	R [5]int
+	C [5][16]byte
+}
+
+// DefaultMilenageConstants returns the constants specified in TS 35.206.
+func DefaultMilenageConstants() MilenageConstants {
+	var consts MilenageConstants
+	consts.R = [5]int{64, 0, 32, 64, 96}
+	consts.C[1][15] = 0x01
+	consts.C[2][15] = 0x02
+	consts.C[3][15] = 0x04
+	consts.C[4][15] = 0x08
+	return consts
+}
+
+// Validate checks that the rotations fit within the 128-bit block.
+func (c MilenageConstants) Validate() error {
+	for i, r := range c.R {
+		if r < 0 || r > 127 {
+			return fmt.Errorf("usim: milenage r%d must be between 0 and 127", i+1)
+		}
+	}
+	return nil
+}
+
+// Milenage implements Algorithm with the TS 35.206 Milenage functions.
+type Milenage struct {
+	block  cipher.Block
+	opc    []byte
+	consts MilenageConstants
+}
+
+// NewMilenage creates a Milenage instance from K and OPc with the default constants.
+func NewMilenage(k, opc []byte) (*Milenage, error) {
+	return NewMilenageWithConstants(k, opc, DefaultMilenageConstants())
+}
+
+// NewMilenageWithConstants creates a Milenage instance with custom r1..r5/c1..c5.
+func NewMilenageWithConstants(k, opc []byte, consts MilenageConstants) (*Milenage, error) {
+	if len(k) != 16 {
+		return nil, fmt.Errorf("usim: milenage K must be 16 bytes")
+	}
+	if len(opc) != 16 {
+		return nil, fmt.Errorf("usim: milenage OPc must be 16 bytes")
+	}
+	if err := consts.Validate(); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return &Milenage{
+		block:  block,
+		opc:    append([]byte(nil), opc...),
+		consts: consts,
+	}, nil
+}
+
+// ComputeOPc derives OPc = E_K(OP) xor OP.
+func ComputeOPc(k, op []byte) ([]byte, error) {
+	if len(k) != 16 {
+		return nil, fmt.Errorf("usim: milenage K must be 16 bytes")
+	}
+	if len(op) != 16 {
+		return nil, fmt.Errorf("usim: milenage OP must be 16 bytes")
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	opc := make([]byte, 16)
+	block.Encrypt(opc, op)
+	xorInto(opc, op)
+	return opc, nil
+}
+
+// OPc returns a copy of the OPc in use.
+func (m *Milenage) OPc() []byte {
+	return append([]byte(nil), m.opc...)
+}
+
+func (m *Milenage) F1(rand, sqn, amf []byte) ([]byte, error) {
+	out, err := m.out1(rand, sqn, amf)
+	if err != nil {
+		return nil, err
+	}
+	return out[:8], nil
+}
+
+func (m *Milenage) F1Star(rand, sqn, amf []byte) ([]byte, error) {
+	out, err := m.out1(rand, sqn, amf)
+	if err != nil {
+		return nil, err
+	}
+	return out[8:], nil
+}
+
+func (m *Milenage) F2345(rand []byte) ([]byte, []byte, []byte, []byte, error) {
+	temp, err := m.temp(rand)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	out2 := m.outN(temp, 1)
+	ck := m.outN(temp, 2)
+	ik := m.outN(temp, 3)
+	return out2[8:], ck, ik, out2[:6], nil
+}
+
+func (m *Milenage) F5Star(rand []byte) ([]byte, error) {
+	temp, err := m.temp(rand)
+	if err != nil {
+		return nil, err
+	}
+	return m.outN(temp, 4)[:6], nil
+}
+
+// temp computes TEMP = E_K(RAND xor OPc).
+func (m *Milenage) temp(rand []byte) ([]byte, error) {
+	if len(rand) != 16 {
+		return nil, fmt.Errorf("usim: RAND must be 16 bytes")
+	}
+	in := append([]byte(nil), rand...)
+	xorInto(in, m.opc)
+	out := make([]byte, 16)
+	m.block.Encrypt(out, in)
+	return out, nil
+}
+
+func (m *Milenage) out1(rand, sqn, amf []byte) ([]byte, error) {
+	if len(sqn) != 6 {
+		return nil, fmt.Errorf("usim: SQN must be 6 bytes")
+	}
+	if len(amf) != 2 {
+		return nil, fmt.Errorf("usim: AMF must be 2 bytes")
+	}
+	temp, err := m.temp(rand)
+	if err != nil {
+		return nil, err
+	}
+	in1 := make([]byte, 16)
+	copy(in1[0:6], sqn)
+	copy(in1[6:8], amf)
+	copy(in1[8:14], sqn)
+	copy(in1[14:16], amf)
+	xorInto(in1, m.opc)
+	in := rotateLeft(in1, m.consts.R[0])
+	xorInto(in, temp)
+	xorInto(in, m.consts.C[0][:])
+	out := make([]byte, 16)
+	m.block.Encrypt(out, in)
+	xorInto(out, m.opc)
+	return out, nil
+}
+
+// outN computes OUT2..OUT5 for index 1..4.
+func (m *Milenage) outN(temp []byte, idx int) []byte {
+	in := append([]byte(nil), temp...)
+	xorInto(in, m.opc)
+	in = rotateLeft(in, m.consts.R[idx])
+	xorInto(in, m.consts.C[idx][:])
+	out := make([]byte, 16)
+	m.block.Encrypt(out, in)
+	xorInto(out, m.opc)
+	return out
+}
+
+func rotateLeft(in []byte, bits int) []byte {
+	n := len(in)
+	out := make([]byte, n)
+	byteShift := bits / 8
+	bitShift := uint(bits % 8)
+	for i := 0; i < n; i++ {
+		hi := in[(i+byteShift)%n]
+		lo := in[(i+byteShift+1)%n]
+		if bitShift == 0 {
+			out[i] = hi
+		} else {
+			out[i] = hi<<bitShift | lo>>(8-bitShift)
+		}
+	}
+	return out
+}
+
+func xorInto(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,88 @@
+package usim
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// TestMilenageTestSet1 uses TS 35.207 test set 1.
+func TestMilenageTestSet1(t *testing.T) {
+	k := mustHex(t, "465b5ce8b199b49faa5f0a2ee238a6bc")
+	opc := mustHex(t, "cd63cb71954a9f4e48a5994e37a02baf")
+	rand := mustHex(t, "23553cbe9637a89d218ae64dae47bf35")
+	sqn := mustHex(t, "ff9bb4d0b607")
+	amf := mustHex(t, "b9b9")
+
+	alg, err := NewMilenage(k, opc)
+	if err != nil {
+		t.Fatalf("new milenage failed: %v", err)
+	}
+	macA, err := alg.F1(rand, sqn, amf)
+	if err != nil {
+		t.Fatalf("f1 failed: %v", err)
+	}
+	expectHex(t, "MAC-A", macA, "4a9ffac354dfafb3")
+	macS, err := alg.F1Star(rand, sqn, amf)
+	if err != nil {
+		t.Fatalf("f1* failed: %v", err)
+	}
+	expectHex(t, "MAC-S", macS, "01cfaf9ec4e871e9")
+	res, ck, ik, ak, err := alg.F2345(rand)
+	if err != nil {
+		t.Fatalf("f2345 failed: %v", err)
+	}
+	expectHex(t, "RES", res, "a54211d5e3ba50bf")
+	expectHex(t, "CK", ck, "b40ba9a3c58b2a05bbf0d987b21bf8cb")
+	expectHex(t, "IK", ik, "f769bcd751044604127672711c6d3441")
+	expectHex(t, "AK", ak, "aa689c648370")
+	aks, err := alg.F5Star(rand)
+	if err != nil {
+		t.Fatalf("f5* failed: %v", err)
+	}
+	expectHex(t, "AK*", aks, "451e8beca43b")
+}
+
+// TestComputeOPc uses the OP/OPc pair from TS 35.207 test set 1.
+func TestComputeOPc(t *testing.T) {
+	k := mustHex(t, "465b5ce8b199b49faa5f0a2ee238a6bc")
+	op := mustHex(t, "cdc202d5123e20f62b6d676ac72cb318")
+	opc, err := ComputeOPc(k, op)
+	if err != nil {
+		t.Fatalf("compute opc failed: %v", err)
+	}
+	expectHex(t, "OPc", opc, "cd63cb71954a9f4e48a5994e37a02baf")
+}
+
+func TestMilenageCustomConstants(t *testing.T) {
+	k := mustHex(t, "465b5ce8b199b49faa5f0a2ee238a6bc")
+	opc := mustHex(t, "cd63cb71954a9f4e48a5994e37a02baf")
+	rand := mustHex(t, "23553cbe9637a89d218ae64dae47bf35")
+
+	consts := DefaultMilenageConstants()
+	consts.R[2] = 40
+	consts.C[2][0] = 0x80
+	alg, err := NewMilenageWithConstants(k, opc, consts)
+	if err != nil {
+		t.Fatalf("new milenage failed: %v", err)
+	}
+	res, ck, _, ak, err := alg.F2345(rand)
+	if err != nil {
+		t.Fatalf("f2345 failed: %v", err)
+	}
+	expectHex(t, "RES", res, "a54211d5e3ba50bf")
+	expectHex(t, "AK", ak, "aa689c648370")
+	if hex.EncodeToString(ck) == "b40ba9a3c58b2a05bbf0d987b21bf8cb" {
+		t.Fatalf("expected CK to change with custom r3/c3")
+	}
+
+	consts.R[0] = 128
+	if _, err := NewMilenageWithConstants(k, opc, consts); err == nil {
+		t.Fatalf("expected error for out-of-range rotation")
+	}
+}
+
+func TestRotateLeft(t *testing.T) {
+	in := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	expectHex(t, "rot64", rotateLeft(in, 64), "08090a0b0c0d0e0f0001020304050607")
+	expectHex(t, "rot4", rotateLeft(in, 4), "00102030405060708090a0b0c0d0e0f0")
+}
@@ -0,0 +1,191 @@
+package usim
+
+import (
+	"fmt"
+	"slices"
+)
+
+var tuakAlgoName = []byte("TUAK1.0")
+
+// TUAKOptions configures the TUAK output lengths (in bits) and the number of
+// Keccak iterations (TS 35.231). Zero values select the defaults used for
+// EAP-AKA: MAC 64, RES 64, CK 128, IK 128 and one iteration.
+type TUAKOptions struct {
+	MACBits    int
+	RESBits    int
+	CKBits     int
+	IKBits     int
+	Iterations int
+}
+
+// TUAK implements Algorithm with the TS 35.231 TUAK functions.
+type TUAK struct {
+	k          []byte
+	topc       []byte
+	macBits    int
+	resBits    int
+	ckBits     int
+	ikBits     int
+	iterations int
+}
+
+// NewTUAK creates a TUAK instance from K (128 or 256 bits) and TOPc.
+func NewTUAK(k, topc []byte, opts TUAKOptions) (*TUAK, error) {
+	if len(k) != 16 && len(k) != 32 {
+		return nil, fmt.Errorf("usim: tuak K must be 16 or 32 bytes")
+	}
+	if len(topc) != 32 {
+		return nil, fmt.Errorf("usim: tuak TOPc must be 32 bytes")
+	}
+	t := &TUAK{
+		k:          append([]byte(nil), k...),
+		topc:       append([]byte(nil), topc...),
+		macBits:    defaultInt(opts.MACBits, 64),
+		resBits:    defaultInt(opts.RESBits, 64),
+		ckBits:     defaultInt(opts.CKBits, 128),
+		ikBits:     defaultInt(opts.IKBits, 128),
+		iterations: defaultInt(opts.Iterations, 1),
+	}
+	if !slices.Contains([]int{64, 128, 256}, t.macBits) {
+		return nil, fmt.Errorf("usim: tuak MAC length must be 64, 128 or 256 bits")
+	}
+	if !slices.Contains([]int{32, 64, 128, 256}, t.resBits) {
+		return nil, fmt.Errorf("usim: tuak RES length must be 32, 64, 128 or 256 bits")
+	}
+	if !slices.Contains([]int{128, 256}, t.ckBits) || !slices.Contains([]int{128, 256}, t.ikBits) {
+		return nil, fmt.Errorf("usim: tuak CK/IK length must be 128 or 256 bits")
+	}
+	if t.iterations < 1 {
+		return nil, fmt.Errorf("usim: tuak iterations must be at least 1")
+	}
+	return t, nil
+}
+
+// ComputeTOPc derives TOPc from TOP and K.
+func ComputeTOPc(k, top []byte, iterations int) ([]byte, error) {
+	if len(k) != 16 && len(k) != 32 {
+		return nil, fmt.Errorf("usim: tuak K must be 16 or 32 bytes")
+	}
+	if len(top) != 32 {
+		return nil, fmt.Errorf("usim: tuak TOP must be 32 bytes")
+	}
+	if iterations < 1 {
+		return nil, fmt.Errorf("usim: tuak iterations must be at least 1")
+	}
+	out := tuakCore(top, keyLengthBit(k), nil, nil, nil, k, iterations)
+	return reversed(out[0:32]), nil
+}
+
+func (t *TUAK) F1(rand, sqn, amf []byte) ([]byte, error) {
+	return t.f1(0x00, rand, sqn, amf)
+}
+
+func (t *TUAK) F1Star(rand, sqn, amf []byte) ([]byte, error) {
+	return t.f1(0x80, rand, sqn, amf)
+}
+
+func (t *TUAK) F2345(rand []byte) ([]byte, []byte, []byte, []byte, error) {
+	if len(rand) != 16 {
+		return nil, nil, nil, nil, fmt.Errorf("usim: RAND must be 16 bytes")
+	}
+	instance := byte(0x40) | keyLengthBit(t.k)
+	switch t.resBits {
+	case 64:
+		instance |= 0x08
+	case 128:
+		instance |= 0x10
+	case 256:
+		instance |= 0x20
+	}
+	if t.ckBits == 256 {
+		instance |= 0x04
+	}
+	if t.ikBits == 256 {
+		instance |= 0x02
+	}
+	out := tuakCore(t.topc, instance, rand, nil, nil, t.k, t.iterations)
+	res := reversed(out[0 : t.resBits/8])
+	ck := reversed(out[32 : 32+t.ckBits/8])
+	ik := reversed(out[64 : 64+t.ikBits/8])
+	ak := reversed(out[96:102])
+	return res, ck, ik, ak, nil
+}
+
+func (t *TUAK) F5Star(rand []byte) ([]byte, error) {
+	if len(rand) != 16 {
+		return nil, fmt.Errorf("usim: RAND must be 16 bytes")
+	}
+	out := tuakCore(t.topc, 0xc0|keyLengthBit(t.k), rand, nil, nil, t.k, t.iterations)
+	return reversed(out[96:102]), nil
+}
+
+func (t *TUAK) f1(instance byte, rand, sqn, amf []byte) ([]byte, error) {
+	if len(rand) != 16 {
+		return nil, fmt.Errorf("usim: RAND must be 16 bytes")
+	}
+	if len(sqn) != 6 {
+		return nil, fmt.Errorf("usim: SQN must be 6 bytes")
+	}
+	if len(amf) != 2 {
+		return nil, fmt.Errorf("usim: AMF must be 2 bytes")
+	}
+	instance |= keyLengthBit(t.k)
+	switch t.macBits {
+	case 64:
+		instance |= 0x08
+	case 128:
+		instance |= 0x10
+	case 256:
+		instance |= 0x20
+	}
+	out := tuakCore(t.topc, instance, rand, amf, sqn, t.k, t.iterations)
+	return reversed(out[0 : t.macBits/8]), nil
+}
+
+// tuakCore fills the INOUT buffer as laid out in TS 35.231 section 6 and
+// runs the Keccak permutation. Multi-byte fields are stored least significant
+// byte first, matching INOUT bit numbering.
+func tuakCore(topc []byte, instance byte, rand, amf, sqn, k []byte, iterations int) [200]byte {
+	var state [200]byte
+	copy(state[0:32], reversed(topc))
+	state[32] = instance
+	copy(state[33:40], reversed(tuakAlgoName))
+	if rand != nil {
+		copy(state[40:56], reversed(rand))
+	}
+	if amf != nil {
+		copy(state[56:58], reversed(amf))
+	}
+	if sqn != nil {
+		copy(state[58:64], reversed(sqn))
+	}
+	copy(state[64:64+len(k)], reversed(k))
+	state[96] = 0x1f
+	state[135] = 0x80
+	for i := 0; i < iterations; i++ {
+		keccakF1600(&state)
+	}
+	return state
+}
+
+func keyLengthBit(k []byte) byte {
+	if len(k) == 32 {
+		return 0x01
+	}
+	return 0x00
+}
+
+func reversed(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
+
+func defaultInt(value, fallback int) int {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
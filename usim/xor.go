@@ -0,0 +1,77 @@
+package usim
+
+import "fmt"
+
+// XOR implements Algorithm with the TS 34.108 section 8.1.2 test algorithm
+// used by conformance test equipment. It provides no security.
+type XOR struct {
+	k       []byte
+	resBits int
+}
+
+// NewXOR creates a test algorithm instance. resBits selects the RES length
+// (32 to 128 bits in steps of 8); zero selects 64.
+func NewXOR(k []byte, resBits int) (*XOR, error) {
+	if len(k) != 16 {
+		return nil, fmt.Errorf("usim: xor K must be 16 bytes")
+	}
+	resBits = defaultInt(resBits, 64)
+	if resBits < 32 || resBits > 128 || resBits%8 != 0 {
+		return nil, fmt.Errorf("usim: xor RES length must be 32 to 128 bits in steps of 8")
+	}
+	return &XOR{k: append([]byte(nil), k...), resBits: resBits}, nil
+}
+
+// F1 computes XMAC = XDOUT[0..63] xor (SQN || AMF).
+func (x *XOR) F1(rand, sqn, amf []byte) ([]byte, error) {
+	xdout, err := x.xdout(rand)
+	if err != nil {
+		return nil, err
+	}
+	if len(sqn) != 6 {
+		return nil, fmt.Errorf("usim: SQN must be 6 bytes")
+	}
+	if len(amf) != 2 {
+		return nil, fmt.Errorf("usim: AMF must be 2 bytes")
+	}
+	mac := make([]byte, 8)
+	copy(mac[0:6], sqn)
+	copy(mac[6:8], amf)
+	xorInto(mac, xdout[:8])
+	return mac, nil
+}
+
+// F1Star uses the same construction as F1.
+func (x *XOR) F1Star(rand, sqn, amf []byte) ([]byte, error) {
+	return x.F1(rand, sqn, amf)
+}
+
+func (x *XOR) F2345(rand []byte) ([]byte, []byte, []byte, []byte, error) {
+	xdout, err := x.xdout(rand)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	res := append([]byte(nil), xdout[:x.resBits/8]...)
+	ck := rotateLeft(xdout, 8)
+	ik := rotateLeft(xdout, 16)
+	ak := append([]byte(nil), xdout[3:9]...)
+	return res, ck, ik, ak, nil
+}
+
+// F5Star uses the same construction as f5.
+func (x *XOR) F5Star(rand []byte) ([]byte, error) {
+	xdout, err := x.xdout(rand)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), xdout[3:9]...), nil
+}
+
+func (x *XOR) xdout(rand []byte) ([]byte, error) {
+	if len(rand) != 16 {
+		return nil, fmt.Errorf("usim: RAND must be 16 bytes")
+	}
+	out := append([]byte(nil), x.k...)
+	xorInto(out, rand)
+	return out, nil
+}
@@ -0,0 +1,40 @@
+package usim
+
+import "testing"
+
+func TestXORAlgorithm(t *testing.T) {
+	k := mustHex(t, "000102030405060708090a0b0c0d0e0f")
+	rand := mustHex(t, "ffffffffffffffffffffffffffffffff")
+	sqn := mustHex(t, "000000000020")
+	amf := mustHex(t, "8000")
+
+	alg, err := NewXOR(k, 0)
+	if err != nil {
+		t.Fatalf("new xor failed: %v", err)
+	}
+	res, ck, ik, ak, err := alg.F2345(rand)
+	if err != nil {
+		t.Fatalf("f2345 failed: %v", err)
+	}
+	expectHex(t, "RES", res, "fffefdfcfbfaf9f8")
+	expectHex(t, "CK", ck, "fefdfcfbfaf9f8f7f6f5f4f3f2f1f0ff")
+	expectHex(t, "IK", ik, "fdfcfbfaf9f8f7f6f5f4f3f2f1f0fffe")
+	expectHex(t, "AK", ak, "fcfbfaf9f8f7")
+	mac, err := alg.F1(rand, sqn, amf)
+	if err != nil {
+		t.Fatalf("f1 failed: %v", err)
+	}
+	expectHex(t, "MAC-A", mac, "fffefdfcfbda79f8")
+
+	long, err := NewXOR(k, 128)
+	if err != nil {
+		t.Fatalf("new xor failed: %v", err)
+	}
+	res, _, _, _, _ = long.F2345(rand)
+	if len(res) != 16 {
+		t.Fatalf("expected 16-byte RES, got %d", len(res))
+	}
+	if _, err := NewXOR(k, 36); err == nil {
+		t.Fatalf("expected error for unaligned RES length")
+	}
+}